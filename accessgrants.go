@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/s3control"
+	s3controltypes "github.com/aws/aws-sdk-go-v2/service/s3control/types"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// issueAccessGrantsCredential calls s3:GetDataAccess for a target prefix and
+// returns the credentials vended by S3 Access Grants. Optional request
+// parameters:
+//
+//	permission  READ (default), WRITE or READWRITE
+//	privilege   Default (grant scope) or Minimal (exactly the target)
+func (p *AWSPlugin) issueAccessGrantsCredential(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	bucket, _, _ := strings.Cut(resource, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid s3 grants scope: %s (expected aws:s3:grants:<bucket>/<prefix>)", req.Scope)
+	}
+
+	permission := s3controltypes.PermissionRead
+	if v := req.Parameters["permission"]; v != "" {
+		permission = s3controltypes.Permission(strings.ToUpper(v))
+		switch permission {
+		case s3controltypes.PermissionRead, s3controltypes.PermissionWrite, s3controltypes.PermissionReadwrite:
+		default:
+			return nil, fmt.Errorf("invalid permission %q: must be READ, WRITE or READWRITE", v)
+		}
+	}
+
+	privilege := s3controltypes.PrivilegeDefault
+	if v := req.Parameters["privilege"]; v != "" {
+		switch {
+		case strings.EqualFold(v, string(s3controltypes.PrivilegeDefault)):
+		case strings.EqualFold(v, string(s3controltypes.PrivilegeMinimal)):
+			privilege = s3controltypes.PrivilegeMinimal
+		default:
+			return nil, fmt.Errorf("invalid privilege %q: must be Default or Minimal", v)
+		}
+	}
+
+	accountID := p.config.AccessGrantsAccountID
+	if accountID == "" {
+		roleARN, err := arn.Parse(p.config.RoleARN)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine access grants account from role_arn: %w", err)
+		}
+		accountID = roleARN.AccountID
+	}
+
+	// Access Grants vends its own credentials, so the role session only needs
+	// to live long enough to call GetDataAccess
+	creds, err := p.assumeRole(ctx, req.Scope, 900)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := p.sessionAWSConfig(ctx, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	cfg.Region = region
+
+	result, err := s3control.NewFromConfig(p.config.serviceAWSConfig(cfg, "s3control")).GetDataAccess(ctx, &s3control.GetDataAccessInput{
+		AccountId:       aws.String(accountID),
+		Target:          aws.String("s3://" + resource),
+		Permission:      permission,
+		Privilege:       privilege,
+		DurationSeconds: aws.Int32(sessionDurationSeconds(req.TTL)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data access: %w", err)
+	}
+
+	// Vended credentials have the same shape as role credentials
+	value, err := p.credentialValue(req, AWSCredentialValue{
+		AccessKeyID:     aws.ToString(result.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(result.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(result.Credentials.SessionToken),
+		Region:          region,
+	}, p.withExpiryMargin(aws.ToTime(result.Credentials.Expiration)), "")
+	if err != nil {
+		return nil, err
+	}
+	credJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["matched_grant_target"] = aws.ToString(result.MatchedGrantTarget)
+	metadata["permission"] = string(permission)
+
+	return &sdk.Credential{
+		Value:     string(credJSON),
+		ExpiresAt: aws.ToTime(result.Credentials.Expiration),
+		Metadata:  metadata,
+	}, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// Modes of anomaly_detection
+const (
+	anomalyWarn  = "warn"
+	anomalyBlock = "block"
+)
+
+// auditAnomaly is the action of anomalous request notifications
+const auditAnomaly = "anomaly"
+
+const (
+	// defaultAnomalyMinRequests is how many requests a requester makes
+	// before its baseline is used
+	defaultAnomalyMinRequests = 50
+
+	// maxAnomalyRequesters bounds the requesters tracked, and
+	// maxAnomalyScopes the scopes tracked per requester
+	maxAnomalyRequesters = 1024
+	maxAnomalyScopes     = 64
+
+	// A request is anomalous with a TTL over anomalyTTLFactor times the
+	// largest seen, or when it makes the hour's requests exceed
+	// anomalyRateFactor times the busiest hour seen and anomalyMinHourly
+	anomalyTTLFactor  = 2
+	anomalyRateFactor = 3
+	anomalyMinHourly  = 10
+
+	// anomalyAlertInterval is how often the same anomalies of a requester
+	// are notified
+	anomalyAlertInterval = time.Hour
+
+	// anomalySeedTimeout bounds reading the ledger for the baselines
+	anomalySeedTimeout = time.Minute
+)
+
+// Reasons a request is anomalous, as metric labels
+const (
+	anomalyScope     = "scope"
+	anomalyTTL       = "ttl"
+	anomalyHour      = "hour"
+	anomalyFrequency = "frequency"
+)
+
+// anomalyDetector keeps per-requester baselines of the scopes requested,
+// the TTLs, the hours of the day (UTC) and the requests per hour, across
+// reconfigurations
+type anomalyDetector struct {
+	mu         sync.Mutex
+	requesters map[string]*requesterBaseline
+	seeded     bool
+}
+
+type requesterBaseline struct {
+	requests int
+	scopes   map[string]int
+	hours    [24]int
+	maxTTL   time.Duration
+
+	// hourStart and hourRequests count the requests of the current hour;
+	// peakHourly is the busiest hour before it
+	hourStart    time.Time
+	hourRequests int
+	peakHourly   int
+
+	lastSeen time.Time
+	alerted  map[string]time.Time
+}
+
+// anomaly is a reason a request departs from its requester's baseline
+type anomaly struct {
+	reason string
+	detail string
+}
+
+// validateAnomalyDetection checks the anomaly detection settings
+func validateAnomalyDetection(c *AWSConfig) error {
+	switch c.AnomalyDetection {
+	case "":
+		if c.AnomalyMinRequests.Value != 0 {
+			return fmt.Errorf("anomaly_min_requests requires anomaly_detection")
+		}
+		return nil
+	case anomalyWarn, anomalyBlock:
+	default:
+		return fmt.Errorf("invalid anomaly_detection %q (expected warn or block)", c.AnomalyDetection)
+	}
+	if c.AnomalyMinRequests.Value < 0 {
+		return fmt.Errorf("anomaly_min_requests must not be negative")
+	}
+	if c.AnomalyMinRequests.Value == 0 {
+		c.AnomalyMinRequests.Value = defaultAnomalyMinRequests
+	}
+	return nil
+}
+
+// requesterKey identifies the requester of a request: its agent ID, or
+// name without one
+func requesterKey(req *sdk.CredentialRequest) string {
+	if req.Agent.ID != "" {
+		return req.Agent.ID
+	}
+	return req.Agent.Name
+}
+
+// observe checks a request against its requester's baseline and, unless
+// blocked, adds it to the baseline. It returns the anomalies found, and
+// whether to notify them: the same anomalies of a requester are notified
+// once per anomalyAlertInterval.
+func (d *anomalyDetector) observe(key, scope string, ttl time.Duration, at time.Time, minRequests int, block bool) ([]anomaly, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b := d.baseline(key, at)
+	b.roll(at)
+
+	var found []anomaly
+	if b.requests >= minRequests {
+		if b.scopes[scope] == 0 {
+			found = append(found, anomaly{anomalyScope, "first request for scope " + scope})
+		}
+		if b.maxTTL > 0 && ttl > anomalyTTLFactor*b.maxTTL {
+			found = append(found, anomaly{anomalyTTL, fmt.Sprintf("TTL %s is over %d times the largest seen (%s)", formatDuration(ttl), anomalyTTLFactor, formatDuration(b.maxTTL))})
+		}
+		if hour := at.UTC().Hour(); b.hours[hour] == 0 {
+			found = append(found, anomaly{anomalyHour, fmt.Sprintf("first request between %02d:00 and %02d:00 UTC", hour, (hour+1)%24)})
+		}
+		if n := b.hourRequests + 1; b.peakHourly > 0 && n > anomalyRateFactor*b.peakHourly && n > anomalyMinHourly {
+			found = append(found, anomaly{anomalyFrequency, fmt.Sprintf("%d requests this hour, over %d times the busiest hour seen (%d)", n, anomalyRateFactor, b.peakHourly)})
+		}
+	}
+	b.lastSeen = at
+	if len(found) == 0 || !block {
+		b.learn(scope, ttl, at)
+	}
+	if len(found) == 0 {
+		return nil, false
+	}
+
+	signature := anomalySignature(found)
+	if last, ok := b.alerted[signature]; ok && at.Sub(last) < anomalyAlertInterval {
+		return found, false
+	}
+	if b.alerted == nil {
+		b.alerted = make(map[string]time.Time)
+	}
+	for s, last := range b.alerted {
+		if at.Sub(last) >= anomalyAlertInterval {
+			delete(b.alerted, s)
+		}
+	}
+	b.alerted[signature] = at
+	return found, true
+}
+
+// baseline returns the baseline of a requester, creating it and, at the
+// bound, forgetting the requester seen least recently
+func (d *anomalyDetector) baseline(key string, at time.Time) *requesterBaseline {
+	if d.requesters == nil {
+		d.requesters = make(map[string]*requesterBaseline)
+	}
+	if b, ok := d.requesters[key]; ok {
+		return b
+	}
+	if len(d.requesters) >= maxAnomalyRequesters {
+		var oldest string
+		for k, b := range d.requesters {
+			if oldest == "" || b.lastSeen.Before(d.requesters[oldest].lastSeen) {
+				oldest = k
+			}
+		}
+		delete(d.requesters, oldest)
+	}
+	b := &requesterBaseline{scopes: make(map[string]int), hourStart: at.Truncate(time.Hour)}
+	d.requesters[key] = b
+	return b
+}
+
+// roll starts counting a new hour once at is past the current one
+func (b *requesterBaseline) roll(at time.Time) {
+	if start := at.Truncate(time.Hour); start.After(b.hourStart) {
+		b.peakHourly = max(b.peakHourly, b.hourRequests)
+		b.hourStart, b.hourRequests = start, 0
+	}
+}
+
+// learn adds a request to the baseline
+func (b *requesterBaseline) learn(scope string, ttl time.Duration, at time.Time) {
+	b.requests++
+	if _, ok := b.scopes[scope]; ok || len(b.scopes) < maxAnomalyScopes {
+		b.scopes[scope]++
+	}
+	b.hours[at.UTC().Hour()]++
+	b.maxTTL = max(b.maxTTL, ttl)
+	b.hourRequests++
+}
+
+// anomalySignature identifies a set of anomalies for alert deduplication
+func anomalySignature(found []anomaly) string {
+	reasons := make([]string, len(found))
+	for i, a := range found {
+		reasons[i] = a.reason
+	}
+	return strings.Join(reasons, ",")
+}
+
+// seed builds the baselines from the issuances in the ledger, once per
+// process, so they survive restarts for as long as the ledger keeps them.
+// Failing to read the ledger is logged; the baselines then start empty.
+func (d *anomalyDetector) seed(ledger ledgerStore) {
+	d.mu.Lock()
+	if d.seeded || ledger == nil {
+		d.mu.Unlock()
+		return
+	}
+	d.seeded = true
+	d.mu.Unlock()
+
+	go func() {
+		defer recoverLogged("anomaly baseline")
+		ctx, cancel := context.WithTimeout(context.Background(), anomalySeedTimeout)
+		defer cancel()
+		entries, err := ledger.List(ctx)
+		if err != nil {
+			sdk.Warn("failed to read ledger for anomaly baselines", "error", err)
+			return
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].IssuedAt.Before(entries[j].IssuedAt) })
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, entry := range entries {
+			key := entry.AgentID
+			if key == "" {
+				key = entry.AgentName
+			}
+			if key == "" || entry.IssuedAt.IsZero() || entry.Prefetch {
+				continue
+			}
+			b := d.baseline(key, entry.IssuedAt)
+			b.roll(entry.IssuedAt)
+			if entry.IssuedAt.After(b.lastSeen) {
+				b.lastSeen = entry.IssuedAt
+			}
+			if !entry.ExpiresAt.IsZero() {
+				b.learn(entry.Scope, entry.ExpiresAt.Sub(entry.IssuedAt).Round(time.Minute), entry.IssuedAt)
+			}
+		}
+		sdk.Debug("built anomaly baselines from ledger", "entries", len(entries), "requesters", len(d.requesters))
+	}()
+}
+
+// checkAnomalies checks a request against its requester's baseline.
+// Anomalies are logged, counted and notified; in block mode they also fail
+// the request.
+func (p *AWSPlugin) checkAnomalies(req *sdk.CredentialRequest) error {
+	mode := p.config.AnomalyDetection
+	key := requesterKey(req)
+	if mode == "" || key == "" {
+		return nil
+	}
+	now := time.Now().UTC()
+	found, alert := p.anomalies.observe(key, req.Scope, req.TTL, now, p.config.AnomalyMinRequests.Value, mode == anomalyBlock)
+	if len(found) == 0 {
+		return nil
+	}
+
+	details := make([]string, len(found))
+	for i, a := range found {
+		details[i] = a.detail
+		p.metrics.add(series("creddy_aws_anomalies_total", "reason", a.reason), 1)
+	}
+	outcome := "flagged"
+	if mode == anomalyBlock {
+		outcome = "blocked"
+	}
+	sdk.Warn("anomalous credential request", "scope", req.Scope, "agent", req.Agent.Name, "agent_id", req.Agent.ID, "outcome", outcome, "anomalies", details)
+	if alert {
+		event := auditEvent{
+			Time:      now,
+			Action:    auditAnomaly,
+			Outcome:   outcome,
+			Scope:     req.Scope,
+			AgentID:   req.Agent.ID,
+			AgentName: req.Agent.Name,
+			Anomalies: details,
+		}
+		if req.TTL > 0 {
+			event.TTL = formatDuration(req.TTL)
+		}
+		p.notifier.notify(event)
+		p.webhooks.notify(event)
+	}
+	if mode != anomalyBlock {
+		return nil
+	}
+	return &pluginError{
+		kind: errAccessDenied,
+		msg:  "request of " + req.Scope + " departs from the requester's baseline: " + strings.Join(details, "; "),
+		hint: "if the change is expected, set anomaly_detection to warn until the baseline includes it",
+	}
+}
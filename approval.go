@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// auditApproval is the action of approval requests and decisions
+const auditApproval = "approval"
+
+// Outcomes of approvals
+const (
+	approvalRequested = "requested"
+	approvalApproved  = "approved"
+	approvalDenied    = "denied"
+	approvalExpired   = "expired"
+	approvalCancelled = "cancelled"
+)
+
+const (
+	// approvalsPath is where the metrics listener lists pending approvals
+	// and takes decisions
+	approvalsPath = "/approvals"
+
+	// defaultApprovalTimeout is how long a request waits for a decision
+	// by default, and maxApprovalTimeout the longest it may wait
+	defaultApprovalTimeout = 15 * time.Minute
+	maxApprovalTimeout     = time.Hour
+
+	// maxPendingApprovals bounds the requests waiting for a decision
+	maxPendingApprovals = 100
+
+	// approvalCallbackWindow is how old a decision's timestamp may be, to
+	// stop replays
+	approvalCallbackWindow = 5 * time.Minute
+
+	// maxApprovalCallback bounds the body of a decision
+	maxApprovalCallback = 4 << 10
+)
+
+// errUnknownApproval is returned for decisions on approvals that are not
+// pending
+var errUnknownApproval = errors.New("no such pending approval")
+
+// approvalRequest is a credential request waiting for a decision
+type approvalRequest struct {
+	ID            string    `json:"id"`
+	Scope         string    `json:"scope"`
+	AgentID       string    `json:"agent_id,omitempty"`
+	AgentName     string    `json:"agent_name,omitempty"`
+	TTL           string    `json:"ttl,omitempty"`
+	Justification string    `json:"justification,omitempty"`
+	Reason        string    `json:"reason"`
+	RequestedAt   time.Time `json:"requested_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+
+	decided  chan struct{}
+	approved bool
+	approver string
+}
+
+// approvalDecision is the body of a decision callback
+type approvalDecision struct {
+	ID       string `json:"id"`
+	Decision string `json:"decision"`
+	Approver string `json:"approver"`
+}
+
+// approvals holds the requests waiting for a decision, across
+// reconfigurations
+type approvals struct {
+	mu      sync.Mutex
+	pending map[string]*approvalRequest
+}
+
+// validateApprovals checks the approval settings are complete when a scope
+// requires approval
+func validateApprovals(c *AWSConfig) error {
+	required := false
+	for _, sc := range c.Scopes.Value {
+		required = required || sc.RequireApproval || sc.OutsideWindow == windowApprove
+	}
+	if !required {
+		if c.ApprovalSecret != "" || c.ApprovalTimeout != 0 {
+			return fmt.Errorf("approval_secret and approval_timeout require a scope with require_approval or outside_window approve")
+		}
+		return nil
+	}
+	if c.ApprovalSecret == "" {
+		return fmt.Errorf("require_approval and outside_window approve require approval_secret")
+	}
+	if c.MetricsListen == "" {
+		return fmt.Errorf("require_approval and outside_window approve require metrics_listen, where approvers decide")
+	}
+	if c.ApprovalTimeout == 0 {
+		c.ApprovalTimeout = duration(defaultApprovalTimeout)
+	}
+	if d := time.Duration(c.ApprovalTimeout); d < time.Minute || d > maxApprovalTimeout {
+		return fmt.Errorf("approval_timeout must be between 1m and %s", formatDuration(maxApprovalTimeout))
+	}
+	return nil
+}
+
+// requiresApproval reports whether any scope of a request requires approval
+func (c *AWSConfig) requiresApproval(req *sdk.CredentialRequest) bool {
+	for _, scope := range requestedScopes(req.Scope) {
+		if c.scopeConfig(scope).RequireApproval {
+			return true
+		}
+	}
+	return false
+}
+
+// open adds a pending approval for a request
+func (a *approvals) open(req *sdk.CredentialRequest, reason string, timeout time.Duration) (*approvalRequest, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) >= maxPendingApprovals {
+		return nil, &pluginError{kind: errThrottled, msg: fmt.Sprintf("too many requests awaiting approval (%d)", maxPendingApprovals), hint: "retry once pending approvals are decided"}
+	}
+	if a.pending == nil {
+		a.pending = make(map[string]*approvalRequest)
+	}
+	now := time.Now().UTC()
+	r := &approvalRequest{
+		ID:            newIssuanceID(),
+		Scope:         req.Scope,
+		AgentID:       req.Agent.ID,
+		AgentName:     req.Agent.Name,
+		Justification: requestJustification(req),
+		Reason:        reason,
+		RequestedAt:   now,
+		ExpiresAt:     now.Add(timeout),
+		decided:       make(chan struct{}),
+	}
+	if req.TTL > 0 {
+		r.TTL = formatDuration(req.TTL)
+	}
+	a.pending[r.ID] = r
+	return r, nil
+}
+
+// decide records the decision on a pending approval and wakes its request
+func (a *approvals) decide(id string, approved bool, approver string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r, ok := a.pending[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownApproval, id)
+	}
+	delete(a.pending, id)
+	r.approved, r.approver = approved, approver
+	close(r.decided)
+	return nil
+}
+
+// close drops a pending approval its request stopped waiting for. It
+// reports false if a decision was made meanwhile.
+func (a *approvals) close(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.pending[id]; !ok {
+		return false
+	}
+	delete(a.pending, id)
+	return true
+}
+
+// list returns the pending approvals, oldest first
+func (a *approvals) list() []*approvalRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]*approvalRequest, 0, len(a.pending))
+	for _, r := range a.pending {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].RequestedAt.Before(list[j].RequestedAt) })
+	return list
+}
+
+// awaitApproval parks a request until an approver decides on it or
+// approval_timeout passes, releasing the caller's read lock meanwhile
+func (p *AWSPlugin) awaitApproval(ctx context.Context, req *sdk.CredentialRequest, reason string) error {
+	cfg := p.config
+	timeout := time.Duration(cfg.ApprovalTimeout)
+	r, err := p.approvals.open(req, reason, timeout)
+	if err != nil {
+		return err
+	}
+	sdk.Info("credential request awaiting approval", "approval_id", r.ID, "scope", req.Scope, "agent", req.Agent.Name, "reason", reason, "expires_at", r.ExpiresAt)
+	p.auditApproval(r, approvalRequested)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	p.mu.RUnlock()
+	outcome := approvalApproved
+	select {
+	case <-r.decided:
+		if !r.approved {
+			outcome = approvalDenied
+		}
+	case <-timer.C:
+		outcome = approvalExpired
+	case <-ctx.Done():
+		outcome = approvalCancelled
+	}
+	p.mu.RLock()
+
+	if outcome == approvalExpired || outcome == approvalCancelled {
+		if !p.approvals.close(r.ID) {
+			// Decided as the wait ended
+			outcome = approvalDenied
+			if r.approved {
+				outcome = approvalApproved
+			}
+		}
+	}
+	if p.config == nil {
+		return errNotConfigured
+	}
+	p.auditApproval(r, outcome)
+	switch outcome {
+	case approvalApproved:
+		sdk.Info("credential request approved", "approval_id", r.ID, "scope", req.Scope, "approver", r.approver)
+		if p.config != cfg {
+			return p.recheckApproved(ctx, req)
+		}
+		return nil
+	case approvalDenied:
+		return &pluginError{kind: errAccessDenied, msg: "approval " + r.ID + " of scope " + req.Scope + " was denied by " + r.approver}
+	case approvalExpired:
+		return &pluginError{
+			kind: errAccessDenied,
+			msg:  "approval " + r.ID + " of scope " + req.Scope + " was not decided within " + formatDuration(timeout),
+			hint: "ask an approver to decide sooner, or raise approval_timeout",
+		}
+	}
+	return requestDone(ctx)
+}
+
+// recheckApproved checks an approved request again against the
+// configuration applied while it waited, which the approver did not see.
+// The approval stands in for any approval the new one requires.
+func (p *AWSPlugin) recheckApproved(ctx context.Context, req *sdk.CredentialRequest) error {
+	if err := p.checkBreakGlass(req); err != nil {
+		return err
+	}
+	if err := p.checkTTL(ctx, req.TTL); err != nil {
+		return err
+	}
+	if err := p.checkJustification(req); err != nil {
+		return err
+	}
+	_, err := p.checkWindows(req)
+	return err
+}
+
+// auditApproval records an approval request or its outcome in the audit log
+// and publishes it to the notification sinks
+func (p *AWSPlugin) auditApproval(r *approvalRequest, outcome string) {
+	event := auditEvent{
+		Time:          time.Now().UTC(),
+		Action:        auditApproval,
+		Outcome:       outcome,
+		Scope:         r.Scope,
+		RoleARN:       p.config.RoleARN,
+		AgentID:       r.AgentID,
+		AgentName:     r.AgentName,
+		TTL:           r.TTL,
+		Justification: r.Justification,
+		Approval:      r.ID,
+	}
+	if outcome == approvalApproved || outcome == approvalDenied {
+		event.Approver = r.approver
+	}
+	if outcome == approvalRequested {
+		event.ExpiresAt = r.ExpiresAt.Format(time.RFC3339)
+	}
+	p.audit.record(event)
+	p.notifier.notify(event)
+	p.webhooks.notify(event)
+}
+
+// verifyApprovalCallback checks the HMAC signature of a decision, made as
+// webhook requests are signed, and that it is recent
+func verifyApprovalCallback(secret string, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get(webhookTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or invalid %s", webhookTimestampHeader)
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > approvalCallbackWindow || d < -approvalCallbackWindow {
+		return fmt.Errorf("%s is more than %s away", webhookTimestampHeader, formatDuration(approvalCallbackWindow))
+	}
+	signature, ok := strings.CutPrefix(header.Get(webhookSignatureHeader), "sha256=")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signWebhook(secret, timestamp, body))) {
+		return fmt.Errorf("invalid %s", webhookSignatureHeader)
+	}
+	return nil
+}
+
+// serveApprovals lists the pending approvals as JSON on a signed GET, and
+// takes a signed decision on POST
+func (p *AWSPlugin) serveApprovals(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.config == nil || p.config.ApprovalSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		// Listings are signed over an empty body
+		if err := verifyApprovalCallback(p.config.ApprovalSecret, r.Header, nil, time.Now()); err != nil {
+			sdk.Warn("rejected approvals listing", "error", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(p.approvals.list())
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxApprovalCallback+1))
+	if err != nil || len(body) > maxApprovalCallback {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := verifyApprovalCallback(p.config.ApprovalSecret, r.Header, body, time.Now()); err != nil {
+		sdk.Warn("rejected approval decision", "error", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var decision approvalDecision
+	if err := json.Unmarshal(body, &decision); err != nil {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if decision.ID == "" || decision.Approver == "" {
+		http.Error(w, "id and approver are required", http.StatusBadRequest)
+		return
+	}
+	var approved bool
+	switch decision.Decision {
+	case "approve":
+		approved = true
+	case "deny":
+	default:
+		http.Error(w, "decision must be approve or deny", http.StatusBadRequest)
+		return
+	}
+	if err := p.approvals.decide(decision.ID, approved, decision.Approver); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const approvalSettings = `,"metrics_listen":"127.0.0.1:0","approval_secret":"secret","scopes":{"aws:s3":{"require_approval":true}}`
+
+func TestServeApprovalsListingIsSigned(t *testing.T) {
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), f.config(approvalSettings)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		want      int
+	}{
+		{"unsigned", "", "", http.StatusUnauthorized},
+		{"wrong secret", now, "sha256=" + signWebhook("other", now, nil), http.StatusUnauthorized},
+		{"stale", stale, "sha256=" + signWebhook("secret", stale, nil), http.StatusUnauthorized},
+		{"signed", now, "sha256=" + signWebhook("secret", now, nil), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, approvalsPath, nil)
+			if tt.timestamp != "" {
+				req.Header.Set(webhookTimestampHeader, tt.timestamp)
+				req.Header.Set(webhookSignatureHeader, tt.signature)
+			}
+			w := httptest.NewRecorder()
+			p.serveApprovals(w, req)
+			if w.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", approvalsPath, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestApprovalRecheckedAfterReconfigure(t *testing.T) {
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), f.config(approvalSettings)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: "aws:s3", TTL: time.Hour, Agent: sdk.Agent{ID: "agent"}})
+		done <- err
+	}()
+	var pending []*approvalRequest
+	for deadline := time.Now().Add(5 * time.Second); len(pending) == 0; pending = p.approvals.list() {
+		if time.Now().After(deadline) {
+			t.Fatal("the request was not parked for approval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The scope requires a justification the approver was never shown
+	reconfigured := strings.Replace(approvalSettings, `"require_approval":true`, `"require_approval":true,"require_justification":true`, 1)
+	if err := p.Configure(context.Background(), f.config(reconfigured)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	if err := p.approvals.decide(pending[0].ID, true, "approver"); err != nil {
+		t.Fatalf("decide: %v", err)
+	}
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), "requires a justification") {
+		t.Errorf("GetCredential = %v, want the justification the new configuration requires", err)
+	}
+	if n := f.assumeRoles.Load(); n != 0 {
+		t.Errorf("%d AssumeRole calls, want none", n)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	auditFormatText = "text"
+	auditFormatJSON = "json"
+
+	defaultAuditLogMaxSize  = 100 // MB
+	defaultAuditLogMaxFiles = 10
+
+	// auditVerifyCommand is the subcommand that checks the hash chain of
+	// audit log files
+	auditVerifyCommand = "audit-verify"
+
+	// auditHashField is the field holding a record's hash, last in every
+	// record in both formats
+	auditHashField = "hash"
+)
+
+// Audit actions and the outcomes of revocations; issuances have the
+// outcomes of the request metrics (issued, cached, degraded or error)
+const (
+	auditIssue    = "issue"
+	auditPrefetch = "prefetch"
+	auditRevoke   = "revoke"
+
+	auditRevoked = "revoked"
+	auditError   = "error"
+)
+
+// auditEvent is one record of the audit log. Prev is the hash of the
+// record before it, so removing or altering a record breaks the chain.
+type auditEvent struct {
+	Time          time.Time `json:"time"`
+	Action        string    `json:"action"`
+	Outcome       string    `json:"outcome"`
+	Scope         string    `json:"scope,omitempty"`
+	RoleARN       string    `json:"role_arn,omitempty"`
+	SessionName   string    `json:"session_name,omitempty"`
+	AgentID       string    `json:"agent_id,omitempty"`
+	AgentName     string    `json:"agent_name,omitempty"`
+	TTL           string    `json:"ttl,omitempty"`
+	ExpiresAt     string    `json:"expires_at,omitempty"`
+	Credential    string    `json:"credential_id,omitempty"`
+	RequestID     string    `json:"request_id,omitempty"`
+	Justification string    `json:"justification,omitempty"`
+	Approval      string    `json:"approval_id,omitempty"`
+	Approver      string    `json:"approver,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	Changes       []string  `json:"changes,omitempty"`
+	Anomalies     []string  `json:"anomalies,omitempty"`
+	Prev          string    `json:"prev,omitempty"`
+}
+
+// auditLog appends hash-chained records of issuances and revocations to a
+// local file, rotating it by size, and hands them to the shippers. The
+// chain continues across rotations, reconfigurations and restarts.
+type auditLog struct {
+	path     string
+	format   string
+	maxSize  int64
+	maxFiles int
+
+	// shippers send the records to central stores, set by Configure
+	shippers []*auditShipper
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	prev   string
+	loaded bool
+}
+
+// openAuditLog returns the audit log of the config, or nil if neither a
+// file nor shipping is enabled. The file is opened on the first record,
+// after any audit log this one replaces is closed.
+func openAuditLog(cfg *AWSConfig) (*auditLog, error) {
+	if cfg.AuditLog == "" && !cfg.auditShipping() {
+		return nil, nil
+	}
+	switch cfg.AuditLogFormat {
+	case "":
+		cfg.AuditLogFormat = auditFormatText
+	case auditFormatText, auditFormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid audit_log_format %q (expected text or json)", cfg.AuditLogFormat)
+	}
+	if cfg.AuditLogMaxSize.Value <= 0 {
+		cfg.AuditLogMaxSize.Value = defaultAuditLogMaxSize
+	}
+	if cfg.AuditLogMaxFiles.Value <= 0 {
+		cfg.AuditLogMaxFiles.Value = defaultAuditLogMaxFiles
+	}
+	return &auditLog{
+		path:     cfg.AuditLog,
+		format:   cfg.AuditLogFormat,
+		maxSize:  int64(cfg.AuditLogMaxSize.Value) << 20,
+		maxFiles: cfg.AuditLogMaxFiles.Value,
+	}, nil
+}
+
+// record appends an event to the log. Failures are logged rather than
+// returned, like those of the ledger.
+func (a *auditLog) record(event auditEvent) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.append(event); err != nil {
+		sdk.Error("failed to write audit log", "path", a.path, "action", event.Action, "scope", event.Scope, "error", err)
+	}
+}
+
+func (a *auditLog) append(event auditEvent) error {
+	if !a.loaded && a.path != "" {
+		prev, err := lastAuditHash(a.path)
+		if err != nil {
+			// The verifier reports the break in the chain
+			sdk.Warn("failed to read the last audit log record; starting a new chain", "path", a.path, "error", err)
+		}
+		a.prev = prev
+	}
+	a.loaded = true
+
+	event.Prev = a.prev
+	line, hash, err := formatAuditRecord(a.format, event)
+	if err != nil {
+		return err
+	}
+	for _, s := range a.shippers {
+		s.send(auditRecord{line: line, at: event.Time, event: event})
+	}
+	a.prev = hash
+	if a.path == "" {
+		return nil
+	}
+
+	if a.file != nil && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	if a.file == nil {
+		file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		a.file, a.size = file, info.Size()
+	}
+
+	if _, err := a.file.Write(line); err != nil {
+		return fmt.Errorf("failed to append to audit log: %w", err)
+	}
+	a.size += int64(len(line))
+	return nil
+}
+
+// continueChain carries the chain of the audit log being replaced on, when
+// both write the same file or this one writes none
+func (a *auditLog) continueChain(old *auditLog) {
+	if a == nil || old == nil || (a.path != "" && a.path != old.path) {
+		return
+	}
+	old.mu.Lock()
+	prev, loaded := old.prev, old.loaded
+	old.mu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prev, a.loaded = prev, loaded
+}
+
+// rotate renames the log to <path>.1, shifting older files up to
+// <path>.<max_files> and dropping the oldest
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+	a.file = nil
+	os.Remove(a.path + "." + strconv.Itoa(a.maxFiles))
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(a.path+"."+strconv.Itoa(i), a.path+"."+strconv.Itoa(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	return nil
+}
+
+// close closes the file and ships the records still pending
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if a.file != nil {
+		if err := a.file.Close(); err != nil {
+			sdk.Warn("failed to close audit log", "path", a.path, "error", err)
+		}
+		a.file = nil
+	}
+	a.mu.Unlock()
+	for _, s := range a.shippers {
+		s.close()
+	}
+}
+
+// formatAuditRecord renders an event as a line of the log, returning the
+// line and its hash. The hash is the SHA-256 of the line up to the hash
+// field; as the line holds the previous hash, it covers the chain.
+func formatAuditRecord(format string, event auditEvent) ([]byte, string, error) {
+	var body string
+	if format == auditFormatJSON {
+		b, err := json.Marshal(event)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to encode audit record: %w", err)
+		}
+		body = string(b[:len(b)-1]) + `,"` + auditHashField + `":`
+	} else {
+		body = event.text() + " " + auditHashField + "="
+	}
+	sum := sha256.Sum256([]byte(body))
+	hash := hex.EncodeToString(sum[:])
+	if format == auditFormatJSON {
+		return []byte(body + `"` + hash + `"}` + "\n"), hash, nil
+	}
+	return []byte(body + hash + "\n"), hash, nil
+}
+
+// text renders an event as key=value pairs, quoting values as needed
+func (e auditEvent) text() string {
+	fields := []struct{ key, value string }{
+		{"time", e.Time.Format(time.RFC3339Nano)},
+		{"action", e.Action},
+		{"outcome", e.Outcome},
+		{"scope", e.Scope},
+		{"role_arn", e.RoleARN},
+		{"session_name", e.SessionName},
+		{"agent_id", e.AgentID},
+		{"agent_name", e.AgentName},
+		{"ttl", e.TTL},
+		{"expires_at", e.ExpiresAt},
+		{"credential_id", e.Credential},
+		{"request_id", e.RequestID},
+		{"justification", e.Justification},
+		{"approval_id", e.Approval},
+		{"approver", e.Approver},
+		{"error", e.Error},
+	}
+	var b strings.Builder
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		b.WriteString(f.key + "=")
+		if strings.ContainsAny(f.value, " \"=\\") || !strconv.CanBackquote(f.value) {
+			b.WriteString(strconv.Quote(f.value))
+		} else {
+			b.WriteString(f.value)
+		}
+		b.WriteByte(' ')
+	}
+	b.WriteString("prev=" + e.Prev)
+	return b.String()
+}
+
+// splitAuditRecord splits a line of the log into the part its hash covers
+// and the hash
+func splitAuditRecord(line string) (body, hash string, ok bool) {
+	if strings.HasPrefix(line, "{") {
+		i := strings.LastIndex(line, `,"`+auditHashField+`":"`)
+		if i < 0 || !strings.HasSuffix(line, `"}`) {
+			return "", "", false
+		}
+		body = line[:i+len(`,"`+auditHashField+`":`)]
+		hash = strings.TrimSuffix(line[len(body)+1:], `"}`)
+		return body, hash, true
+	}
+	i := strings.LastIndex(line, " "+auditHashField+"=")
+	if i < 0 {
+		return "", "", false
+	}
+	return line[:i+len(" "+auditHashField+"=")], line[i+len(" "+auditHashField+"="):], true
+}
+
+// auditRecordPrev returns the previous hash a record names
+func auditRecordPrev(body string) string {
+	if strings.HasPrefix(body, "{") {
+		var event auditEvent
+		json.Unmarshal([]byte(strings.TrimSuffix(body, `,"`+auditHashField+`":`)+"}"), &event)
+		return event.Prev
+	}
+	i := strings.LastIndex(body, "prev=")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(body[i+len("prev="):], " "+auditHashField+"=")
+}
+
+// lastAuditHash returns the hash of the last record of the log, looking in
+// the most recent rotated file if the log is empty or missing
+func lastAuditHash(path string) (string, error) {
+	for _, name := range []string{path, path + ".1"} {
+		line, err := lastLine(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if line == "" {
+			continue
+		}
+		_, hash, ok := splitAuditRecord(line)
+		if !ok {
+			return "", fmt.Errorf("last record of %s is malformed", name)
+		}
+		return hash, nil
+	}
+	return "", nil
+}
+
+// lastLine returns the last non-empty line of a file
+func lastLine(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	data = bytes.TrimRight(data, "\n")
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+	return string(data), nil
+}
+
+// verifyAuditLog checks the hash chain of audit log files, given oldest
+// first, and returns the number of records checked
+func verifyAuditLog(paths []string) (int, error) {
+	var prev string
+	records := 0
+	for i, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return records, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for n := 1; scanner.Scan(); n++ {
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+			body, hash, ok := splitAuditRecord(line)
+			if !ok {
+				file.Close()
+				return records, fmt.Errorf("%s:%d: malformed record", path, n)
+			}
+			sum := sha256.Sum256([]byte(body))
+			if hex.EncodeToString(sum[:]) != hash {
+				file.Close()
+				return records, fmt.Errorf("%s:%d: record does not match its hash (altered)", path, n)
+			}
+			// The first record checked may continue a chain from files
+			// not given
+			if got := auditRecordPrev(body); got != prev && (i > 0 || records > 0) {
+				file.Close()
+				return records, fmt.Errorf("%s:%d: record does not follow the one before it (removed, reordered or inserted records)", path, n)
+			}
+			prev = hash
+			records++
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return records, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+	return records, nil
+}
+
+// runAuditVerify checks audit log files, oldest first, reporting the first
+// break in their chain
+func runAuditVerify(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s %s <file>... (oldest first, e.g. audit.log.2 audit.log.1 audit.log)", os.Args[0], auditVerifyCommand)
+	}
+	records, err := verifyAuditLog(args)
+	if err != nil {
+		return fmt.Errorf("audit log verification failed after %d records: %w", records, err)
+	}
+	fmt.Fprintf(stdout, "ok: %d records\n", records)
+	return nil
+}
+
+// auditIssuance records the outcome of a credential request, or of a
+// prefetch
+func (p *AWSPlugin) auditIssuance(action string, req *sdk.CredentialRequest, cred *sdk.Credential, outcome string, err error) {
+	if p.audit == nil && p.notifier == nil && p.webhooks == nil {
+		return
+	}
+	event := auditEvent{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Outcome:   outcome,
+		Scope:     req.Scope,
+		RoleARN:   p.config.RoleARN,
+		AgentID:   req.Agent.ID,
+		AgentName: req.Agent.Name,
+	}
+	if req.TTL > 0 {
+		event.TTL = formatDuration(req.TTL)
+	}
+	event.Justification = requestJustification(req)
+	if cred != nil {
+		event.Credential = cred.Credential
+		if !cred.ExpiresAt.IsZero() {
+			event.ExpiresAt = cred.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		event.SessionName = cred.Metadata["session_name"]
+		event.RequestID = cred.Metadata["request_id"]
+	}
+	if err != nil {
+		event.Error = redactError(err).Error()
+	}
+	p.audit.record(event)
+	p.notifier.notify(event)
+	p.webhooks.notify(event)
+}
+
+// auditRevocation records the outcome of a revocation, with the details of
+// the credential from the ledger where it is recorded
+func (p *AWSPlugin) auditRevocation(ctx context.Context, externalID string, err error) {
+	if p.audit == nil && p.notifier == nil {
+		return
+	}
+	event := auditEvent{
+		Time:       time.Now().UTC(),
+		Action:     auditRevoke,
+		Outcome:    auditRevoked,
+		Credential: externalID,
+	}
+	if err != nil {
+		event.Outcome = auditError
+		event.Error = redactError(err).Error()
+	}
+	if p.ledger != nil {
+		if entry, _ := p.ledger.Get(ctx, externalID); entry != nil {
+			event.Scope = entry.Scope
+			event.RoleARN = entry.RoleARN
+			event.SessionName = entry.SessionName
+			event.AgentID = entry.AgentID
+			event.AgentName = entry.AgentName
+			if !entry.ExpiresAt.IsZero() {
+				event.ExpiresAt = entry.ExpiresAt.Format(time.RFC3339)
+			}
+		}
+	}
+	p.audit.record(event)
+	p.notifier.notify(event)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	defaultAuditShipInterval = 10 * time.Second
+	defaultAuditS3Prefix     = "creddy-aws/audit/"
+
+	// auditRoleSessionName names the sessions of audit_role_arn
+	auditRoleSessionName = "creddy-aws-audit"
+
+	// maxAuditPending bounds the records kept while a destination is
+	// failing; the oldest are dropped beyond it
+	maxAuditPending = 10000
+
+	// maxAuditShipBackoff bounds the wait between attempts at a failing
+	// destination
+	maxAuditShipBackoff = 5 * time.Minute
+
+	// auditShipTimeout bounds one delivery, and the last one on close
+	auditShipTimeout = 30 * time.Second
+
+	// PutLogEvents limits: events per call, and bytes per call counting
+	// 26 bytes of overhead per event
+	maxCloudWatchBatchEvents = 10000
+	maxCloudWatchBatchBytes  = 1048576
+	cloudWatchEventOverhead  = 26
+)
+
+// auditRecord is a line of the audit log as it is shipped, or the detail
+// of a notification
+type auditRecord struct {
+	line  []byte
+	at    time.Time
+	event auditEvent
+}
+
+// auditDestination is a central store audit records are shipped to
+type auditDestination interface {
+	name() string
+	put(ctx context.Context, records []auditRecord) error
+}
+
+// auditShipping reports whether audit records are shipped anywhere
+func (c *AWSConfig) auditShipping() bool {
+	return c.AuditCloudWatchLogGroup != "" || c.AuditS3Bucket != ""
+}
+
+// validateAuditShipping checks the shipping settings, defaulting the
+// stream, prefix and interval
+func validateAuditShipping(c *AWSConfig) error {
+	if !c.auditShipping() {
+		if c.AuditRoleARN != "" {
+			return fmt.Errorf("audit_role_arn requires audit_cloudwatch_log_group or audit_s3_bucket")
+		}
+		return nil
+	}
+	if c.AuditRoleARN != "" {
+		if _, err := parseRoleARN(c.AuditRoleARN); err != nil {
+			return fmt.Errorf("invalid audit_role_arn: %w", err)
+		}
+	}
+	if c.AuditCloudWatchLogGroup != "" && c.AuditCloudWatchLogStream == "" {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = "unknown-host"
+		}
+		c.AuditCloudWatchLogStream = "creddy-aws-" + host
+	}
+	if strings.ContainsAny(c.AuditCloudWatchLogStream, ":*") {
+		return fmt.Errorf("invalid audit_cloudwatch_log_stream %q: must not contain ':' or '*'", c.AuditCloudWatchLogStream)
+	}
+	if c.AuditS3Bucket != "" && c.AuditS3Prefix == "" {
+		c.AuditS3Prefix = defaultAuditS3Prefix
+	}
+	if c.AuditShipInterval <= 0 {
+		c.AuditShipInterval = duration(defaultAuditShipInterval)
+	}
+	return nil
+}
+
+// startShippers starts shipping the log's records to the configured
+// destinations, as audit_role_arn if set
+func (a *auditLog) startShippers(c *AWSConfig, clients *awsClients) {
+	if a == nil || !c.auditShipping() {
+		return
+	}
+	awsCfg := clients.roleAWSConfig(c.AuditRoleARN, auditRoleSessionName)
+	interval := time.Duration(c.AuditShipInterval)
+	if c.AuditCloudWatchLogGroup != "" {
+		a.shippers = append(a.shippers, startAuditShipper(&cloudWatchAuditDestination{
+			client: cloudwatchlogs.NewFromConfig(c.serviceAWSConfig(awsCfg, "logs")),
+			group:  c.AuditCloudWatchLogGroup,
+			stream: c.AuditCloudWatchLogStream,
+		}, interval))
+	}
+	if c.AuditS3Bucket != "" {
+		ext := ".log"
+		if c.AuditLogFormat == auditFormatJSON {
+			ext = ".jsonl"
+		}
+		a.shippers = append(a.shippers, startAuditShipper(&s3AuditDestination{
+			client: c.newS3Client(awsCfg),
+			bucket: c.AuditS3Bucket,
+			prefix: c.AuditS3Prefix,
+			ext:    ext,
+		}, interval))
+	}
+}
+
+// roleAWSConfig returns the base AWS config with the credentials of a
+// dedicated role, if one is given
+func (c *awsClients) roleAWSConfig(roleARN, sessionName string) aws.Config {
+	cfg := c.base.Copy()
+	if roleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(c.sts, roleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = sessionName
+		}))
+	}
+	return cfg
+}
+
+// auditShipper batches records for a destination, delivering them every
+// interval and retrying failed batches with backoff
+type auditShipper struct {
+	dest     auditDestination
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []auditRecord
+	dropped int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startAuditShipper(dest auditDestination, interval time.Duration) *auditShipper {
+	s := &auditShipper{dest: dest, interval: interval, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.run()
+	return s
+}
+
+// send queues a record for the next delivery
+func (s *auditShipper) send(record auditRecord) {
+	record.line = bytes.TrimSuffix(record.line, []byte("\n"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= maxAuditPending {
+		s.pending = s.pending[1:]
+		s.dropped++
+	}
+	s.pending = append(s.pending, record)
+}
+
+func (s *auditShipper) run() {
+	defer close(s.done)
+	backoff := s.interval
+	timer := time.NewTimer(s.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stop:
+			if err := s.flush(); err != nil {
+				sdk.Error("failed to ship audit records on close", "destination", s.dest.name(), "error", err)
+			}
+			return
+		case <-timer.C:
+		}
+		if err := s.flush(); err != nil {
+			backoff = min(2*backoff, maxAuditShipBackoff)
+			sdk.Warn("failed to ship audit records", "destination", s.dest.name(), "retry_in", backoff, "error", err)
+		} else {
+			backoff = s.interval
+		}
+		timer.Reset(backoff)
+	}
+}
+
+// flush delivers the pending records, keeping them for the next attempt
+// if delivery fails
+func (s *auditShipper) flush() (err error) {
+	defer recoverPanic("audit shipping", &err)
+
+	s.mu.Lock()
+	batch, dropped := s.pending, s.dropped
+	s.pending, s.dropped = nil, 0
+	s.mu.Unlock()
+	if dropped > 0 {
+		sdk.Error("dropped audit records while their destination was failing", "destination", s.dest.name(), "dropped", dropped)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditShipTimeout)
+	defer cancel()
+	if err := s.dest.put(ctx, batch); err != nil {
+		s.mu.Lock()
+		s.pending = append(batch, s.pending...)
+		if excess := len(s.pending) - maxAuditPending; excess > 0 {
+			s.pending = s.pending[excess:]
+			s.dropped += excess
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// close delivers the records still pending and stops the shipper
+func (s *auditShipper) close() {
+	close(s.stop)
+	<-s.done
+}
+
+// cloudWatchAuditDestination ships records as events of a CloudWatch Logs
+// stream, creating the stream if needed
+type cloudWatchAuditDestination struct {
+	client        *cloudwatchlogs.Client
+	group, stream string
+	created       bool
+}
+
+func (d *cloudWatchAuditDestination) name() string {
+	return "cloudwatch-logs:" + d.group + "/" + d.stream
+}
+
+func (d *cloudWatchAuditDestination) put(ctx context.Context, records []auditRecord) error {
+	if !d.created {
+		_, err := d.client.CreateLogStream(ctx, &cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  aws.String(d.group),
+			LogStreamName: aws.String(d.stream),
+		})
+		var exists *cwltypes.ResourceAlreadyExistsException
+		if err != nil && !errors.As(err, &exists) {
+			return fmt.Errorf("failed to create log stream: %w", err)
+		}
+		d.created = true
+	}
+
+	for len(records) > 0 {
+		n, size := 0, 0
+		for n < len(records) && n < maxCloudWatchBatchEvents && size+len(records[n].line)+cloudWatchEventOverhead <= maxCloudWatchBatchBytes {
+			size += len(records[n].line) + cloudWatchEventOverhead
+			n++
+		}
+		if n == 0 {
+			// Oversized; CloudWatch Logs reports it rejected
+			n = 1
+		}
+		events := make([]cwltypes.InputLogEvent, n)
+		for i, r := range records[:n] {
+			events[i] = cwltypes.InputLogEvent{Message: aws.String(string(r.line)), Timestamp: aws.Int64(r.at.UnixMilli())}
+		}
+		out, err := d.client.PutLogEvents(ctx, &cloudwatchlogs.PutLogEventsInput{
+			LogGroupName:  aws.String(d.group),
+			LogStreamName: aws.String(d.stream),
+			LogEvents:     events,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to put log events: %w", err)
+		}
+		if rejected := out.RejectedLogEventsInfo; rejected != nil {
+			// Retrying would be rejected again
+			sdk.Error("CloudWatch Logs rejected audit records", "destination", d.name(),
+				"too_old_end_index", aws.ToInt32(rejected.TooOldLogEventEndIndex),
+				"too_new_start_index", aws.ToInt32(rejected.TooNewLogEventStartIndex),
+				"expired_end_index", aws.ToInt32(rejected.ExpiredLogEventEndIndex))
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// s3AuditDestination ships each batch of records as an object of
+// <prefix><yyyy>/<mm>/<dd>/<time>-<random><ext>
+type s3AuditDestination struct {
+	client         *s3.Client
+	bucket, prefix string
+	ext            string
+}
+
+func (d *s3AuditDestination) name() string {
+	return "s3://" + d.bucket + "/" + d.prefix
+}
+
+func (d *s3AuditDestination) put(ctx context.Context, records []auditRecord) error {
+	var body bytes.Buffer
+	for _, r := range records {
+		body.Write(r.line)
+		body.WriteByte('\n')
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	first := records[0].at.UTC()
+	key := d.prefix + first.Format("2006/01/02/20060102T150405.000Z") + "-" + hex.EncodeToString(b) + d.ext
+
+	_, err := d.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(d.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body.Bytes()),
+		ContentType: aws.String("text/plain; charset=utf-8"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put object %s: %w", key, err)
+	}
+	return nil
+}
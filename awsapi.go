@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/smithy-go"
+)
+
+// maxAPIResponse bounds the response bodies read by callAWS
+const maxAPIResponse = 4 << 20
+
+// serviceEndpoint returns the base URL of a service the plugin calls
+// without an SDK client: its endpoint_urls or endpoint_url override, or its
+// regional (FIPS, if configured) endpoint
+func (c *AWSConfig) serviceEndpoint(service, region string) string {
+	if endpoint := c.EndpointURLs.Value[service]; endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	if c.EndpointURL != "" {
+		return strings.TrimSuffix(c.EndpointURL, "/")
+	}
+	prefix := service
+	if c.UseFIPSEndpoint.Value {
+		prefix += "-fips"
+	}
+	return "https://" + prefix + "." + region + "." + regionDNSSuffix(region)
+}
+
+// callAWS makes a JSON API call signed with the base credentials, for
+// services without an SDK client in the plugin. input, if not nil, is sent
+// as the JSON body and the JSON response is decoded into out.
+func (p *AWSPlugin) callAWS(ctx context.Context, service, region, method, rawURL string, header http.Header, input, out any) error {
+	var body []byte
+	payloadHash := emptyPayloadHash
+	if input != nil {
+		var err error
+		if body, err = json.Marshal(input); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
+	req.Header.Set("User-Agent", userAgentProduct+"/"+PluginVersion)
+	creds, err := p.clients.base.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve base credentials: %w", err)
+	}
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, payloadHash, service, region, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	resp, err := p.config.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAPIResponse))
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return apiErrorResponse(resp, data)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
+
+// apiErrorResponse turns an error response of a REST or JSON protocol
+// service into an API error, so its code classifies like those of the SDK
+// clients
+func apiErrorResponse(resp *http.Response, data []byte) error {
+	var body struct {
+		Type         string `json:"__type"`
+		Message      string `json:"message"`
+		MessageUpper string `json:"Message"`
+	}
+	json.Unmarshal(data, &body)
+
+	code := resp.Header.Get("X-Amzn-Errortype")
+	if code == "" {
+		code = body.Type
+	}
+	// Codes may be qualified with a namespace or suffixed with a URL
+	code, _, _ = strings.Cut(code, ":")
+	if i := strings.LastIndex(code, "#"); i >= 0 {
+		code = code[i+1:]
+	}
+	if code == "" {
+		code = resp.Status
+	}
+	message := body.Message
+	if message == "" {
+		message = body.MessageUpper
+	}
+	return &smithy.GenericAPIError{Code: code, Message: message}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// bedrockAPIKeyLifetime is the maximum lifetime of a short-term Bedrock
+	// API key
+	bedrockAPIKeyLifetime = 12 * time.Hour
+	bedrockAPIKeyPrefix   = "bedrock-api-key-"
+)
+
+// BedrockAPIKeyValue is the credential value returned for aws:bedrock:apikey.
+// APIKey is suitable for AWS_BEARER_TOKEN_BEDROCK.
+type BedrockAPIKeyValue struct {
+	APIKey string `json:"api_key"`
+	Region string `json:"region"`
+}
+
+// issueBedrockAPIKey generates a short-term Bedrock API key: a presigned
+// CallWithBearerToken request encoded the same way as the AWS Bedrock token
+// generator libraries
+func (p *AWSPlugin) issueBedrockAPIKey(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	if resource != "" {
+		return nil, fmt.Errorf("invalid bedrock scope: %s (expected aws:bedrock:apikey)", req.Scope)
+	}
+
+	creds, err := p.assumeRole(ctx, req.Scope, sessionDurationSeconds(req.TTL))
+	if err != nil {
+		return nil, err
+	}
+
+	// The key stops working when the signing session expires
+	lifetime := tokenLifetime(time.Until(*creds.Expiration), bedrockAPIKeyLifetime)
+
+	signedURL, _, err := presignURL(ctx, signingCredentials(creds), "POST",
+		"https://bedrock.amazonaws.com/?Action=CallWithBearerToken", "bedrock", region, lifetime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign bedrock api key: %w", err)
+	}
+
+	token := strings.TrimPrefix(signedURL, "https://") + "&Version=1"
+
+	value, err := json.Marshal(BedrockAPIKeyValue{
+		APIKey: bedrockAPIKeyPrefix + base64.StdEncoding.EncodeToString([]byte(token)),
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	return &sdk.Credential{
+		Value:     string(value),
+		ExpiresAt: time.Now().Add(lifetime),
+		Metadata:  p.baseMetadata(req.Scope),
+	}, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// breakGlassScope is the emergency access scope
+	breakGlassScope = "aws:breakglass"
+
+	// mfaCodeParam is the request parameter carrying the one-time code of
+	// breakglass_mfa_serial
+	mfaCodeParam = "mfa_code"
+
+	// auditBreakGlass is the action of break-glass requests, recorded and
+	// notified apart from other issuances
+	auditBreakGlass = "breakglass"
+
+	// breakGlassTTL is the lifetime of every break-glass session, the STS
+	// minimum
+	breakGlassTTL = minSessionDuration
+)
+
+var (
+	// mfaSerialPattern is what STS accepts as an MFA device serial number
+	mfaSerialPattern = regexp.MustCompile(`^[\w+=/:,.@-]{9,256}$`)
+
+	// mfaCodePattern is what STS accepts as an MFA code
+	mfaCodePattern = regexp.MustCompile(`^\d{6}$`)
+)
+
+// validateBreakGlass checks the break-glass settings, and that break-glass
+// requests have somewhere to alert
+func validateBreakGlass(c *AWSConfig) error {
+	if c.BreakGlassMFASerial == "" {
+		return nil
+	}
+	if !mfaSerialPattern.MatchString(c.BreakGlassMFASerial) {
+		return fmt.Errorf("invalid breakglass_mfa_serial %q", c.BreakGlassMFASerial)
+	}
+	if c.NotifyEventBus == "" && c.NotifySNSTopicARN == "" && len(c.Webhooks.Value) == 0 {
+		return fmt.Errorf("breakglass_mfa_serial requires notify_event_bus, notify_sns_topic_arn or webhooks to alert on break-glass requests")
+	}
+	return nil
+}
+
+// checkBreakGlass rejects break-glass requests without an MFA code and a
+// justification, renewals of break-glass credentials, and aws:multi bundles
+// including the scope
+func (p *AWSPlugin) checkBreakGlass(req *sdk.CredentialRequest) error {
+	if req.Scope != breakGlassScope {
+		for _, scope := range requestedScopes(req.Scope) {
+			if scope == breakGlassScope {
+				return &pluginError{kind: errInvalidScope, msg: breakGlassScope + " cannot be bundled in " + req.Scope, hint: "request " + breakGlassScope + " on its own"}
+			}
+		}
+		return nil
+	}
+	if p.config.BreakGlassMFASerial == "" {
+		return &pluginError{kind: errInvalidScope, msg: breakGlassScope + " is not enabled", hint: "set breakglass_mfa_serial to an MFA device of the plugin's IAM user"}
+	}
+	if requestJustification(req) == "" {
+		return &pluginError{kind: errAccessDenied, msg: breakGlassScope + " requires a justification", hint: "set the justification parameter to why emergency access is needed"}
+	}
+	if !mfaCodePattern.MatchString(req.Parameters[mfaCodeParam]) {
+		return &pluginError{kind: errAccessDenied, msg: breakGlassScope + " requires an MFA code", hint: "set the mfa_code parameter to the current 6-digit code of " + p.config.BreakGlassMFASerial}
+	}
+	if req.Parameters[renewParam] != "" {
+		return &pluginError{kind: errInvalidScope, msg: breakGlassScope + " credentials cannot be renewed", hint: "request new break-glass credentials"}
+	}
+	return nil
+}
+
+// breakGlassRequest returns a break-glass request with the break-glass TTL,
+// whatever TTL was requested
+func breakGlassRequest(req *sdk.CredentialRequest) *sdk.CredentialRequest {
+	shortened := *req
+	shortened.TTL = breakGlassTTL
+	return &shortened
+}
+
+// addBreakGlassMFA makes a break-glass AssumeRole present the MFA code,
+// so the session carries aws:MultiFactorAuthPresent
+func addBreakGlassMFA(input *sts.AssumeRoleInput, serial, code string) {
+	input.SerialNumber = aws.String(serial)
+	input.TokenCode = aws.String(code)
+}
+
+// auditAction returns the audit action of an issuance of a scope
+func auditAction(scope string) string {
+	if scope == breakGlassScope {
+		return auditBreakGlass
+	}
+	return auditIssue
+}
+
+// warnBreakGlass logs a break-glass request at warning level, whatever its
+// outcome
+func warnBreakGlass(req *sdk.CredentialRequest, cred *sdk.Credential, outcome string) {
+	args := []any{"outcome", outcome, "agent", req.Agent.Name, "agent_id", req.Agent.ID, "justification", requestJustification(req)}
+	if cred != nil {
+		args = append(args, "credential_id", cred.Credential, "expires_at", cred.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	sdk.Warn("break-glass credential request", args...)
+}
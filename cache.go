@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	defaultCacheMargin = 5 * time.Minute
+
+	// cacheTTLBucket is the granularity at which requested TTLs share
+	// cache entries
+	cacheTTLBucket = 15 * time.Minute
+
+	// cacheTTLSlack is how much longer than a request's TTL a cached
+	// credential served to it may last, for clock skew to AWS
+	cacheTTLSlack = time.Minute
+)
+
+// credentialCache holds issued credentials for reuse by identical requests
+// until margin before they expire. Entries are kept until they actually
+// expire, to fall back on during STS outages.
+type credentialCache struct {
+	mu      sync.Mutex
+	margin  time.Duration
+	entries map[string]*sdk.Credential
+
+	// file persists the cache across restarts, if configured
+	file *cacheFile
+}
+
+func newCredentialCache(margin time.Duration) *credentialCache {
+	return &credentialCache{margin: margin, entries: make(map[string]*sdk.Credential)}
+}
+
+// get returns a copy of a cached credential that is still outside the
+// expiry margin and does not outlive ttl
+func (c *credentialCache) get(key string, ttl time.Duration) *sdk.Credential {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cred, ok := c.entries[key]
+	if !ok || time.Until(cred.ExpiresAt) <= c.margin || outlivesTTL(cred, ttl) {
+		return nil
+	}
+	return copyCredential(cred)
+}
+
+// getValid returns a copy of a cached credential that has not expired yet,
+// even if it is within the expiry margin, and does not outlive ttl
+func (c *credentialCache) getValid(key string, ttl time.Duration) *sdk.Credential {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cred, ok := c.entries[key]
+	if !ok || !time.Now().Before(cred.ExpiresAt) || outlivesTTL(cred, ttl) {
+		return nil
+	}
+	return copyCredential(cred)
+}
+
+// outlivesTTL reports whether a cached credential lasts longer than a request
+// for ttl allows. Requests share entries of TTLs rounded up to the bucket, so
+// an entry may have been issued for a longer TTL.
+func outlivesTTL(cred *sdk.Credential, ttl time.Duration) bool {
+	return ttl > 0 && cred.ExpiresAt.After(time.Now().Add(ttl+cacheTTLSlack))
+}
+
+// put caches a credential, dropping expired entries
+func (c *credentialCache) put(key string, cred *sdk.Credential) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sweep()
+	if time.Until(cred.ExpiresAt) > c.margin {
+		c.entries[key] = copyCredential(cred)
+	}
+	c.persist()
+}
+
+// evict drops the cached credential with the given external ID
+func (c *credentialCache) evict(externalID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	evicted := false
+	for k, cached := range c.entries {
+		if cached.Credential == externalID {
+			delete(c.entries, k)
+			evicted = true
+		}
+	}
+	if evicted {
+		c.persist()
+	}
+}
+
+// expiresAt returns the expiry of the cached credential for key, if any
+func (c *credentialCache) expiresAt(key string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cred, ok := c.entries[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return cred.ExpiresAt, true
+}
+
+// restore adds entries loaded from the cache file
+func (c *credentialCache) restore(entries map[string]*sdk.Credential) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, cred := range entries {
+		c.entries[k] = cred
+	}
+	c.sweep()
+}
+
+// sweep drops expired entries. Called with mu held.
+func (c *credentialCache) sweep() {
+	for k, cached := range c.entries {
+		if !time.Now().Before(cached.ExpiresAt) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// persist writes the cache to its file, if any. Called with mu held.
+func (c *credentialCache) persist() {
+	if c.file == nil {
+		return
+	}
+	if err := c.file.save(c.entries); err != nil {
+		sdk.Warn("failed to persist credential cache", "path", c.file.path, "error", err)
+	}
+}
+
+// cacheKey identifies requests that can share a credential: the same agent,
+// scope, role, session policy, parameters, and TTL bucket
+func (p *AWSPlugin) cacheKey(req *sdk.CredentialRequest) (string, error) {
+	policy, err := p.sessionPolicy(req.Scope)
+	if err != nil {
+		return "", err
+	}
+
+	params := make([]string, 0, len(req.Parameters))
+	for k, v := range req.Parameters {
+		params = append(params, k+"="+v)
+	}
+	sort.Strings(params)
+
+	bucket := (req.TTL + cacheTTLBucket - 1) / cacheTTLBucket
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%d", req.Agent.ID, req.Scope, p.config.RoleARN, policy, strings.Join(params, "\x00"), bucket)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func copyCredential(cred *sdk.Credential) *sdk.Credential {
+	c := *cred
+	c.Metadata = maps.Clone(cred.Metadata)
+	return &c
+}
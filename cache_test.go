@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestCacheGetBoundsTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		remaining time.Duration
+		ttl       time.Duration
+		want      bool
+	}{
+		{"issued for a longer TTL of the bucket", 25 * time.Minute, 20 * time.Minute, false},
+		{"within the TTL", 18 * time.Minute, 20 * time.Minute, true},
+		{"within the slack", 20*time.Minute + 30*time.Second, 20 * time.Minute, true},
+		{"no TTL requested", 25 * time.Minute, 0, true},
+		{"within the expiry margin", 4 * time.Minute, 20 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCredentialCache(defaultCacheMargin)
+			c.put("key", &sdk.Credential{Value: "value", ExpiresAt: time.Now().Add(tt.remaining)})
+			if got := c.get("key", tt.ttl) != nil; got != tt.want {
+				t.Errorf("get served = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheGetValidBoundsTTL(t *testing.T) {
+	c := newCredentialCache(defaultCacheMargin)
+	c.put("key", &sdk.Credential{Value: "value", ExpiresAt: time.Now().Add(25 * time.Minute)})
+	if c.getValid("key", 20*time.Minute) != nil {
+		t.Error("getValid served a credential outliving the requested TTL")
+	}
+	if c.getValid("key", 30*time.Minute) == nil {
+		t.Error("getValid did not serve a credential within the requested TTL")
+	}
+}
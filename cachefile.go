@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	cacheSealPassphrase = "passphrase"
+	cacheSealAge        = "age"
+	cacheSealKMS        = "kms"
+
+	// cachePBKDF2Iterations follows the OWASP recommendation for
+	// PBKDF2-HMAC-SHA256
+	cachePBKDF2Iterations = 600000
+)
+
+// cacheEnvelope is the on-disk format of the persistent cache. Key holds the
+// passphrase salt or the KMS-encrypted data key; Data holds the sealed
+// entries.
+type cacheEnvelope struct {
+	Mode string `json:"mode"`
+	Key  []byte `json:"key,omitempty"`
+	Data []byte `json:"data"`
+}
+
+// cacheFile persists the credential cache, encrypted, to a local file
+type cacheFile struct {
+	path string
+	mode string
+
+	// age recipients; unused for AES-GCM modes
+	identity  age.Identity
+	recipient age.Recipient
+
+	// AES-GCM data key and the header stored alongside it
+	key    []byte
+	header []byte
+}
+
+// openCacheFile prepares the persistent cache configured by cfg and returns
+// the entries it holds. Unreadable cache files are discarded with a warning,
+// since they only ever hold reissuable credentials.
+func openCacheFile(ctx context.Context, cfg *AWSConfig) (*cacheFile, map[string]*sdk.Credential, error) {
+	f := &cacheFile{path: cfg.CacheFile}
+
+	var modes []string
+	if cfg.CachePassphrase != "" {
+		modes = append(modes, cacheSealPassphrase)
+	}
+	if cfg.CacheAgeIdentity != "" {
+		modes = append(modes, cacheSealAge)
+	}
+	if cfg.CacheKMSKeyID != "" {
+		modes = append(modes, cacheSealKMS)
+	}
+	if len(modes) != 1 {
+		return nil, nil, fmt.Errorf("cache_file requires exactly one of cache_passphrase, cache_age_identity or cache_kms_key_id")
+	}
+	f.mode = modes[0]
+
+	var kmsClient *kms.Client
+	switch f.mode {
+	case cacheSealAge:
+		identities, err := age.ParseIdentities(strings.NewReader(cfg.CacheAgeIdentity))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid cache_age_identity: %w", err)
+		}
+		x25519, ok := identities[0].(*age.X25519Identity)
+		if !ok {
+			return nil, nil, fmt.Errorf("cache_age_identity must be an X25519 identity")
+		}
+		f.identity = x25519
+		f.recipient = x25519.Recipient()
+	case cacheSealKMS:
+		awsCfg, err := newAWSConfig(ctx, cfg, baseCredentialsProvider(cfg))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load AWS config for cache: %w", err)
+		}
+		kmsClient = kms.NewFromConfig(cfg.serviceAWSConfig(awsCfg, "kms"))
+	}
+
+	entries, err := f.load(ctx, cfg, kmsClient)
+	if err != nil {
+		sdk.Warn("discarding unreadable credential cache", "path", f.path, "error", err)
+		entries = nil
+		f.key, f.header = nil, nil
+	}
+
+	// Fresh AES-GCM key when nothing was loaded
+	if f.mode != cacheSealAge && f.key == nil {
+		if err := f.newKey(ctx, cfg, kmsClient); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return f, entries, nil
+}
+
+// load reads and decrypts the cache file, recovering the data key from it
+func (f *cacheFile) load(ctx context.Context, cfg *AWSConfig, kmsClient *kms.Client) (map[string]*sdk.Credential, error) {
+	raw, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var env cacheEnvelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, fmt.Errorf("invalid cache file: %w", err)
+	}
+	if env.Mode != f.mode {
+		return nil, fmt.Errorf("cache file was sealed with %s, not %s", env.Mode, f.mode)
+	}
+
+	switch f.mode {
+	case cacheSealPassphrase:
+		f.key = passphraseKey(cfg.CachePassphrase, env.Key)
+		f.header = env.Key
+	case cacheSealKMS:
+		out, err := kmsClient.Decrypt(ctx, &kms.DecryptInput{
+			CiphertextBlob:    env.Key,
+			KeyId:             aws.String(cfg.CacheKMSKeyID),
+			EncryptionContext: cacheEncryptionContext,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt cache data key: %w", err)
+		}
+		f.key = out.Plaintext
+		f.header = env.Key
+	}
+
+	plaintext, err := f.open(env.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries map[string]*sdk.Credential
+	if err := json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, fmt.Errorf("invalid cache contents: %w", err)
+	}
+	return entries, nil
+}
+
+// cacheEncryptionContext binds KMS data keys to their use
+var cacheEncryptionContext = map[string]string{"creddy:purpose": "credential-cache"}
+
+// newKey creates the AES-GCM data key for a new cache file
+func (f *cacheFile) newKey(ctx context.Context, cfg *AWSConfig, kmsClient *kms.Client) error {
+	switch f.mode {
+	case cacheSealPassphrase:
+		salt := make([]byte, 16)
+		rand.Read(salt)
+		f.key = passphraseKey(cfg.CachePassphrase, salt)
+		f.header = salt
+	case cacheSealKMS:
+		out, err := kmsClient.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+			KeyId:             aws.String(cfg.CacheKMSKeyID),
+			KeySpec:           "AES_256",
+			EncryptionContext: cacheEncryptionContext,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to generate cache data key: %w", err)
+		}
+		f.key = out.Plaintext
+		f.header = out.CiphertextBlob
+	}
+	return nil
+}
+
+// close wipes the data key of a cache file that will not be written again
+func (f *cacheFile) close() {
+	if f == nil {
+		return
+	}
+	clear(f.key)
+	f.key, f.header = nil, nil
+}
+
+func passphraseKey(passphrase string, salt []byte) []byte {
+	key, _ := pbkdf2.Key(sha256.New, passphrase, salt, cachePBKDF2Iterations, 32)
+	return key
+}
+
+// save seals the entries and atomically replaces the cache file
+func (f *cacheFile) save(entries map[string]*sdk.Credential) error {
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache: %w", err)
+	}
+	data, err := f.seal(plaintext)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(cacheEnvelope{Mode: f.mode, Key: f.header, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".creddy-cache-*")
+	if err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	return nil
+}
+
+func (f *cacheFile) seal(plaintext []byte) ([]byte, error) {
+	if f.mode == cacheSealAge {
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, f.recipient)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt cache: %w", err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return nil, fmt.Errorf("failed to encrypt cache: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("failed to encrypt cache: %w", err)
+		}
+		return buf.Bytes(), nil
+	}
+
+	gcm, err := newGCM(f.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return gcm.Seal(nonce, nonce, plaintext, []byte(f.mode)), nil
+}
+
+func (f *cacheFile) open(data []byte) ([]byte, error) {
+	if f.mode == cacheSealAge {
+		r, err := age.Decrypt(bytes.NewReader(data), f.identity)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt cache: %w", err)
+		}
+		return io.ReadAll(r)
+	}
+
+	gcm, err := newGCM(f.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("cache file is truncated")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(f.mode))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt cache: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// canary periodically assumes the role for each of its scopes with the
+// shortest session, so broken trust policies and deleted roles show up
+// before a credential request needs them
+type canary struct {
+	interval time.Duration
+	scopes   []string
+	stop     chan struct{}
+
+	// failing holds the scopes whose last check failed, to log changes
+	mu      sync.Mutex
+	failing map[string]bool
+}
+
+// validateCanary checks canary_scopes, defaulting them to the full aws
+// scope
+func validateCanary(c *AWSConfig) error {
+	if c.CanaryInterval < 0 {
+		return fmt.Errorf("canary_interval must not be negative")
+	}
+	if c.CanaryInterval == 0 {
+		if len(c.CanaryScopes.Value) > 0 {
+			return fmt.Errorf("canary_scopes requires canary_interval")
+		}
+		return nil
+	}
+	if len(c.CanaryScopes.Value) == 0 {
+		c.CanaryScopes.Value = []string{"aws"}
+	}
+	for _, scope := range c.CanaryScopes.Value {
+		if !isValidAWSScope(scope) {
+			return fmt.Errorf("invalid canary_scopes scope: %s", scope)
+		}
+	}
+	return nil
+}
+
+// startCanary starts the background checks
+func (p *AWSPlugin) startCanary(interval time.Duration, scopes []string) *canary {
+	c := &canary{interval: interval, scopes: scopes, stop: make(chan struct{}), failing: make(map[string]bool)}
+	go p.runCanary(c)
+	return c
+}
+
+func (c *canary) close() {
+	close(c.stop)
+}
+
+func (p *AWSPlugin) runCanary(c *canary) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	// First check as soon as the configuration is in place
+	p.runCanaryChecks(c)
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			p.runCanaryChecks(c)
+		}
+	}
+}
+
+// runCanaryChecks checks every scope of a canary that is still the current
+// one. Each probe holds the read lock on its own, so a pending Configure only
+// waits for one of them.
+func (p *AWSPlugin) runCanaryChecks(c *canary) {
+	defer recoverLogged("canary")
+	for _, scope := range c.scopes {
+		if !p.runCanaryCheck(c, scope) {
+			// Replaced by a reconfiguration
+			return
+		}
+	}
+}
+
+// runCanaryCheck probes one scope, unless the canary was replaced
+func (p *AWSPlugin) runCanaryCheck(c *canary, scope string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.canary != c {
+		return false
+	}
+
+	ctx, cancel := p.requestContext(context.Background())
+	err := p.probeScope(ctx, "canary", scope)
+	cancel()
+	c.record(scope, err)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	p.metrics.add(series("creddy_aws_canary_checks_total", "scope", p.metrics.scopeLabel(scope), "result", result), 1)
+	return true
+}
+
+// probeScope assumes the role for a scope with the shortest session and
+// discards the credentials. The outcome reaches the health report through
+// assumeRoleSession.
+func (p *AWSPlugin) probeScope(ctx context.Context, probe, scope string) error {
+	ctx, iss := withIssuance(ctx)
+	iss.Scope = scope
+	iss.Probe = probe
+	_, err := p.assumeRoleSession(ctx, scope, int32(minSessionDuration.Seconds()))
+	return err
+}
+
+// record logs a scope's check when its outcome changes
+func (c *canary) record(scope string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err != nil && !c.failing[scope]:
+		c.failing[scope] = true
+		sdk.Warn("canary failed to assume the role for scope", "scope", scope, "error", err)
+	case err != nil:
+		sdk.Debug("canary still failing for scope", "scope", scope, "error", err)
+	case c.failing[scope]:
+		delete(c.failing, scope)
+		sdk.Info("canary assumed the role for scope again", "scope", scope)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// pluginCapabilities describes what the configured plugin supports, for the
+// Creddy host to present accurate options
+type pluginCapabilities struct {
+	SupportsRevocation         bool
+	SupportsBulkRevocation     bool
+	SupportsRenewal            bool
+	SupportedCredentialFormats []string
+}
+
+// capabilities derives the capabilities of the current configuration. Before
+// the plugin is configured, nothing can be revoked or renewed.
+func (p *AWSPlugin) capabilities() pluginCapabilities {
+	cfg := p.config
+	if cfg == nil {
+		return pluginCapabilities{SupportedCredentialFormats: supportedFormats()}
+	}
+	ledger := cfg.Ledger != ledgerNone
+	// Role sessions, and the credentials derived from them, are denied by
+	// the revocation policy, with IDs that need no ledger to map them back;
+	// KMS grants are retired
+	revocation := cfg.RevocationPolicyName != ""
+
+	return pluginCapabilities{
+		SupportsRevocation: revocation,
+		// revoke-all: selectors are matched against the ledger
+		SupportsBulkRevocation:     revocation && ledger,
+		SupportsRenewal:            ledger,
+		SupportedCredentialFormats: supportedFormats(),
+	}
+}
+
+// supportedFormats returns the value formats of the scopes that can be
+// requested, in the order of credentialFormats
+func supportedFormats() []string {
+	scopes := []string{"aws", "aws:ecr", multiScopePrefix}
+	for _, ct := range credentialTypes {
+		scopes = append(scopes, ct.Prefix)
+	}
+	var formats []string
+	for _, format := range credentialFormats {
+		if slices.ContainsFunc(scopes, func(scope string) bool { return slices.Contains(scopeFormats(scope), format) }) {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// String formats the capabilities as space-separated key=value flags, the
+// form appended to the plugin description
+func (c pluginCapabilities) String() string {
+	return fmt.Sprintf("supports_revocation=%t supports_bulk_revocation=%t supports_renewal=%t supported_credential_formats=%s",
+		c.SupportsRevocation, c.SupportsBulkRevocation, c.SupportsRenewal, strings.Join(c.SupportedCredentialFormats, ","))
+}
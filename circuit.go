@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	defaultCircuitBreakerThreshold = 5
+	defaultCircuitBreakerCooldown  = 30 * time.Second
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitOpenError is returned without calling AWS while a breaker is open
+type circuitOpenError struct {
+	service string
+	retryIn time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	if e.retryIn <= 0 {
+		return fmt.Sprintf("%s is unavailable: circuit breaker open after repeated failures, probe in progress", e.service)
+	}
+	return fmt.Sprintf("%s is unavailable: circuit breaker open after repeated failures, next attempt in %s", e.service, e.retryIn.Round(time.Second))
+}
+
+// circuitBreaker stops calling an AWS service after repeated outage errors,
+// so requests fail fast (or are served from the cache) instead of each
+// waiting out timeouts during an incident. After the cooldown one call is
+// let through as a probe: success closes the breaker, failure reopens it.
+type circuitBreaker struct {
+	service   string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// newCircuitBreaker returns a breaker for a service, or nil if breakers
+// are disabled (a negative threshold)
+func newCircuitBreaker(service string, threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold < 0 {
+		return nil
+	}
+	return &circuitBreaker{service: service, threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may go to the service
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+			return &circuitOpenError{service: b.service, retryIn: wait}
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		sdk.Info("circuit breaker half-open, probing", "service", b.service)
+		return nil
+	case circuitHalfOpen:
+		if b.probing {
+			return &circuitOpenError{service: b.service, retryIn: 0}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// currentState returns the breaker's state, counting an open breaker whose
+// cooldown has passed as half-open
+func (b *circuitBreaker) currentState() circuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen && time.Since(b.openedAt) >= b.cooldown {
+		return circuitHalfOpen
+	}
+	return b.state
+}
+
+// record counts the outcome of a call. Only outages count as failures; a
+// request AWS rejected shows the service is up.
+func (b *circuitBreaker) record(ctx context.Context, err error) {
+	failed := err != nil && isServiceOutage(err) && !isThrottling(err) && ctx.Err() == nil && !errors.Is(err, context.Canceled)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		if b.state != circuitClosed {
+			sdk.Info("circuit breaker closed", "service", b.service)
+		}
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		if b.state != circuitOpen {
+			sdk.Warn("circuit breaker open", "service", b.service, "failures", b.failures, "cooldown", b.cooldown, "error", err)
+		}
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// addMiddleware adds the breaker to an SDK client's middleware stack. It
+// sits in front of the retries, so one call is one outcome.
+func (b *circuitBreaker) addMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CircuitBreaker",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if err := b.allow(); err != nil {
+				return middleware.InitializeOutput{}, middleware.Metadata{}, err
+			}
+			out, md, err := next.HandleInitialize(ctx, in)
+			b.record(ctx, err)
+			return out, md, err
+		}), middleware.Before)
+}
+
+// withCircuitBreaker returns the API options adding a breaker, if any
+func withCircuitBreaker(b *circuitBreaker) []func(*middleware.Stack) error {
+	if b == nil {
+		return nil
+	}
+	return []func(*middleware.Stack) error{b.addMiddleware}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// formatCLICache returns session credentials as an AWS CLI assume-role
+	// cache entry
+	formatCLICache = "cli_cache"
+
+	// cliCacheCommand is the subcommand that writes an AWS CLI cache entry
+	cliCacheCommand = "cli-cache"
+
+	// cliCacheTimeLayout is how botocore serializes cached expirations
+	cliCacheTimeLayout = "2006-01-02T15:04:05-07:00"
+)
+
+// cliCacheEntry is an AWS CLI cache entry: the AssumeRole response the CLI
+// would otherwise have fetched for the profile
+type cliCacheEntry struct {
+	Credentials     cliCacheCredentials `json:"Credentials"`
+	AssumedRoleUser *cliCacheRoleUser   `json:"AssumedRoleUser,omitempty"`
+}
+
+type cliCacheCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+type cliCacheRoleUser struct {
+	AssumedRoleID string `json:"AssumedRoleId"`
+	ARN           string `json:"Arn"`
+}
+
+// cliCacheValue renders a role session as a CLI cache entry
+func cliCacheValue(session *sts.AssumeRoleOutput, expiresAt time.Time) cliCacheEntry {
+	creds := session.Credentials
+	entry := cliCacheEntry{
+		Credentials: cliCacheCredentials{
+			AccessKeyID:     aws.ToString(creds.AccessKeyId),
+			SecretAccessKey: aws.ToString(creds.SecretAccessKey),
+			SessionToken:    aws.ToString(creds.SessionToken),
+			Expiration:      expiresAt.UTC().Format(cliCacheTimeLayout),
+		},
+	}
+	if user := session.AssumedRoleUser; user != nil {
+		entry.AssumedRoleUser = &cliCacheRoleUser{
+			AssumedRoleID: aws.ToString(user.AssumedRoleId),
+			ARN:           aws.ToString(user.Arn),
+		}
+	}
+	return entry
+}
+
+// cliCacheKey returns the cache key the AWS CLI (botocore) uses for an
+// assume-role profile: the SHA-1 of its AssumeRole arguments, less the
+// session name, as sorted-key JSON in Python's default formatting
+func cliCacheKey(roleARN string, durationSeconds int, externalID string) string {
+	quote := func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+
+	var args []string
+	if durationSeconds > 0 {
+		args = append(args, `"DurationSeconds": `+strconv.Itoa(durationSeconds))
+	}
+	if externalID != "" {
+		args = append(args, `"ExternalId": `+quote(externalID))
+	}
+	args = append(args, `"RoleArn": `+quote(roleARN))
+
+	sum := sha1.Sum([]byte("{" + strings.Join(args, ", ") + "}"))
+	return hex.EncodeToString(sum[:])
+}
+
+// defaultCLICacheDir returns the AWS CLI's cache directory
+func defaultCLICacheDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", "cli", "cache")
+}
+
+// runCLICache writes credentials for a scope into the AWS CLI cache under
+// the key of an assume-role profile, so the CLI uses them instead of
+// assuming the role itself
+func runCLICache(ctx context.Context, p *AWSPlugin, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet(cliCacheCommand, flag.ContinueOnError)
+	buildRequest := addHelperFlags(fs, cliCacheCommand)
+	profileRole := fs.String("role-arn", "", "role_arn of the CLI profile (default: --role, or the config's role_arn)")
+	durationSeconds := fs.Int("duration-seconds", 0, "duration_seconds of the CLI profile, if set")
+	externalID := fs.String("external-id", "", "external_id of the CLI profile, if set")
+	cacheDir := fs.String("cache-dir", defaultCLICacheDir(), "AWS CLI cache directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	hr, err := buildRequest()
+	if err != nil {
+		return err
+	}
+	if *cacheDir == "" {
+		return fmt.Errorf("--cache-dir is required")
+	}
+	hr.Params[formatParam] = formatCLICache
+
+	value, err := requestHelperCredential(ctx, p, hr)
+	if err != nil {
+		return err
+	}
+
+	roleARN := *profileRole
+	if roleARN == "" {
+		roleARN = hr.RoleARN
+	}
+	if roleARN == "" {
+		p.mu.RLock()
+		if p.config != nil {
+			roleARN = p.config.RoleARN
+		}
+		p.mu.RUnlock()
+	}
+	if roleARN == "" {
+		return fmt.Errorf("--role-arn is required with --creddy")
+	}
+
+	var entry cliCacheEntry
+	if err := json.Unmarshal([]byte(value), &entry); err != nil || entry.Credentials.AccessKeyID == "" {
+		return fmt.Errorf("credentials are not in the cli_cache format")
+	}
+
+	if err := os.MkdirAll(*cacheDir, 0700); err != nil {
+		return fmt.Errorf("failed to create CLI cache directory: %w", err)
+	}
+	path := filepath.Join(*cacheDir, cliCacheKey(roleARN, *durationSeconds, *externalID)+".json")
+	if err := writeFileAtomic(path, []byte(value), 0600); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, path)
+	return err
+}
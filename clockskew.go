@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// clockSkewWarning is the skew beyond which the local clock is reported as
+// wrong. SigV4 tolerates 5 minutes.
+const clockSkewWarning = time.Minute
+
+// clockSkew tracks how far AWS's clock is ahead of the local one, measured
+// from the Date header of AWS responses
+type clockSkew struct {
+	nanos atomic.Int64
+}
+
+// get returns the last measured skew (AWS time minus local time)
+func (c *clockSkew) get() time.Duration {
+	return time.Duration(c.nanos.Load())
+}
+
+func (c *clockSkew) set(skew time.Duration) {
+	prev := time.Duration(c.nanos.Swap(int64(skew)))
+	if (skew.Abs() > clockSkewWarning) != (prev.Abs() > clockSkewWarning) {
+		if skew.Abs() > clockSkewWarning {
+			sdk.Warn("local clock is skewed from AWS; expiry times are corrected for it", "skew", skew.Round(time.Second).String())
+		} else {
+			sdk.Info("local clock is back in sync with AWS", "skew", skew.Round(time.Second).String())
+		}
+	}
+}
+
+// observe records the skew measured for a successful AWS response
+func (c *clockSkew) observe(metadata middleware.Metadata) {
+	if skew, ok := awsmiddleware.GetAttemptSkew(metadata); ok {
+		c.set(skew)
+	}
+}
+
+// observeError records the skew measured for a failed AWS response and
+// reports whether the failure was caused by it
+func (c *clockSkew) observeError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "RequestTimeTooSkewed", "RequestExpired", "RequestInTheFuture", "SignatureDoesNotMatch", "InvalidSignatureException":
+	default:
+		return false
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if !errors.As(err, &respErr) || respErr.Response == nil {
+		return false
+	}
+	serverTime, parseErr := smithyhttp.ParseTime(respErr.Response.Header.Get("Date"))
+	if parseErr != nil {
+		return false
+	}
+	skew := time.Until(serverTime)
+	c.set(skew)
+	return skew.Abs() > clockSkewWarning
+}
+
+// local converts a time reported by AWS to the local clock
+func (c *clockSkew) local(t time.Time) time.Time {
+	return t.Add(-c.get())
+}
+
+// withExpiryMargin moves a credential expiry expiry_margin earlier, so
+// consumers whose clocks run slow stop using it before AWS rejects it. The
+// margin is capped at half the remaining lifetime.
+func (p *AWSPlugin) withExpiryMargin(expiresAt time.Time) time.Time {
+	margin := time.Duration(p.config.ExpiryMargin)
+	if remaining := time.Until(expiresAt); margin > remaining/2 {
+		margin = remaining / 2
+	}
+	if margin <= 0 {
+		return expiresAt
+	}
+	return expiresAt.Add(-margin)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// cloudfrontEncoding is base64 with the URL-safe substitutions CloudFront
+// expects ('+' -> '-', '=' -> '_', '/' -> '~')
+var cloudfrontEncoding = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+// CloudFrontCookiesValue is the credential value returned for
+// aws:cloudfront:cookie scopes
+type CloudFrontCookiesValue struct {
+	Cookies map[string]string `json:"cookies"`
+	Domain  string            `json:"domain"`
+	Path    string            `json:"path"`
+}
+
+// cloudfrontPolicy is a CloudFront signed URL / cookie policy document. Field
+// order matters for canned policies, which must match CloudFront's own
+// serialization byte for byte.
+type cloudfrontPolicy struct {
+	Statement []cloudfrontStatement `json:"Statement"`
+}
+
+type cloudfrontStatement struct {
+	Resource  string              `json:"Resource"`
+	Condition cloudfrontCondition `json:"Condition"`
+}
+
+type cloudfrontCondition struct {
+	DateLessThan map[string]int64 `json:"DateLessThan"`
+}
+
+// issueCloudFrontSignedURL signs a single URL. Exact URLs use a canned policy;
+// URLs containing wildcards use a custom policy.
+func (p *AWSPlugin) issueCloudFrontSignedURL(ctx context.Context, req *sdk.CredentialRequest, resource, _ string) (*sdk.Credential, error) {
+	if p.cloudfrontKey == nil {
+		return nil, fmt.Errorf("cloudfront_key_pair_id and cloudfront_private_key must be configured for cloudfront scopes")
+	}
+
+	u, err := url.Parse(resource)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid cloudfront scope: %s (expected aws:cloudfront:url:<url>)", req.Scope)
+	}
+
+	expiresAt := cloudfrontExpiry(req.TTL)
+	policy, signature, err := p.signCloudFrontPolicy(resource, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Append rather than re-encode: canned policies are verified against the
+	// URL exactly as given
+	params := url.Values{}
+	if strings.Contains(resource, "*") {
+		params.Set("Policy", policy)
+	} else {
+		params.Set("Expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	}
+	params.Set("Signature", signature)
+	params.Set("Key-Pair-Id", p.config.CloudFrontKeyPairID)
+
+	separator := "?"
+	if u.RawQuery != "" {
+		separator = "&"
+	}
+
+	return &sdk.Credential{
+		Value:     resource + separator + params.Encode(),
+		ExpiresAt: expiresAt,
+		Metadata:  p.cloudfrontMetadata(req.Scope),
+	}, nil
+}
+
+// issueCloudFrontSignedCookies returns the three CloudFront signed cookies
+// granting access to every URL matching the resource pattern
+func (p *AWSPlugin) issueCloudFrontSignedCookies(ctx context.Context, req *sdk.CredentialRequest, resource, _ string) (*sdk.Credential, error) {
+	if p.cloudfrontKey == nil {
+		return nil, fmt.Errorf("cloudfront_key_pair_id and cloudfront_private_key must be configured for cloudfront scopes")
+	}
+
+	u, err := url.Parse(resource)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid cloudfront scope: %s (expected aws:cloudfront:cookie:<url-pattern>)", req.Scope)
+	}
+
+	expiresAt := cloudfrontExpiry(req.TTL)
+	policy, signature, err := p.signCloudFrontPolicy(resource, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cookies apply to the path up to the first wildcard
+	path := u.Path
+	if i := strings.Index(path, "*"); i >= 0 {
+		path = path[:strings.LastIndex(path[:i], "/")+1]
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	value, err := json.Marshal(CloudFrontCookiesValue{
+		Cookies: map[string]string{
+			"CloudFront-Policy":      policy,
+			"CloudFront-Signature":   signature,
+			"CloudFront-Key-Pair-Id": p.config.CloudFrontKeyPairID,
+		},
+		Domain: u.Hostname(),
+		Path:   path,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	return &sdk.Credential{
+		Value:     string(value),
+		ExpiresAt: expiresAt,
+		Metadata:  p.cloudfrontMetadata(req.Scope),
+	}, nil
+}
+
+// signCloudFrontPolicy builds and signs the policy for a resource, returning
+// the encoded policy and signature
+func (p *AWSPlugin) signCloudFrontPolicy(resource string, expiresAt time.Time) (string, string, error) {
+	// Resources must appear verbatim, so '&' in query strings must not be
+	// HTML-escaped
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(cloudfrontPolicy{
+		Statement: []cloudfrontStatement{{
+			Resource: resource,
+			Condition: cloudfrontCondition{
+				DateLessThan: map[string]int64{"AWS:EpochTime": expiresAt.Unix()},
+			},
+		}},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal cloudfront policy: %w", err)
+	}
+	policyJSON := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+	// CloudFront only supports SHA-1 signatures for key pairs
+	digest := sha1.Sum(policyJSON)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.cloudfrontKey, crypto.SHA1, digest[:])
+	if err != nil {
+		return "", "", fmt.Errorf("failed to sign cloudfront policy: %w", err)
+	}
+
+	return cloudfrontEncoding.Replace(base64.StdEncoding.EncodeToString(policyJSON)),
+		cloudfrontEncoding.Replace(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// cloudfrontMetadata returns metadata for CloudFront credentials, which are
+// signed by the configured key pair rather than an assumed role
+func (p *AWSPlugin) cloudfrontMetadata(scope string) map[string]string {
+	return map[string]string{
+		"key_pair_id": p.config.CloudFrontKeyPairID,
+		"scope":       scope,
+	}
+}
+
+// cloudfrontExpiry returns the expiry for a requested TTL
+func cloudfrontExpiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		ttl = defaultPresignTTL
+	}
+	return time.Now().Add(ttl).Truncate(time.Second)
+}
+
+// parseRSAPrivateKey parses a PEM-encoded PKCS#1 or PKCS#8 RSA private key
+func parseRSAPrivateKey(pemData string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
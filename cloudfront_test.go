@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// cloudfrontDecode reverses cloudfrontEncoding
+func cloudfrontDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s))
+	if err != nil {
+		t.Fatalf("invalid CloudFront base64 %q: %v", s, err)
+	}
+	return data
+}
+
+func TestSignCloudFrontPolicy(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	p := &AWSPlugin{cloudfrontKey: key}
+
+	// The canned and custom policy examples of the CloudFront developer
+	// guide, which CloudFront verifies byte for byte
+	tests := []struct {
+		resource string
+		want     string
+	}{
+		{
+			"http://d111111abcdef8.cloudfront.net/horizon.jpg?size=large&license=yes",
+			`{"Statement":[{"Resource":"http://d111111abcdef8.cloudfront.net/horizon.jpg?size=large&license=yes","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400}}}]}`,
+		},
+		{
+			"http://d111111abcdef8.cloudfront.net/training/*",
+			`{"Statement":[{"Resource":"http://d111111abcdef8.cloudfront.net/training/*","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400}}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		policy, signature, err := p.signCloudFrontPolicy(tt.resource, time.Unix(1357034400, 0))
+		if err != nil {
+			t.Fatalf("signCloudFrontPolicy: %v", err)
+		}
+		if strings.ContainsAny(policy+signature, "+=/") {
+			t.Errorf("policy %s and signature %s are not CloudFront-encoded", policy, signature)
+		}
+		policyJSON := cloudfrontDecode(t, policy)
+		if string(policyJSON) != tt.want {
+			t.Errorf("policy = %s, want %s", policyJSON, tt.want)
+		}
+		digest := sha1.Sum([]byte(tt.want))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], cloudfrontDecode(t, signature)); err != nil {
+			t.Errorf("signature of %s does not verify: %v", tt.resource, err)
+		}
+	}
+}
+
+func TestCloudFrontCredentials(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	cfg := f.config(`,"cloudfront_key_pair_id":"K2JCJMDEHXQW5F","cloudfront_private_key":` + strconv.Quote(string(keyPEM)))
+	if err := p.Configure(context.Background(), cfg); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	request := func(scope string) *sdk.Credential {
+		t.Helper()
+		cred, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: scope, TTL: 10 * time.Minute, Agent: sdk.Agent{ID: "agent"}})
+		if err != nil {
+			t.Fatalf("GetCredential(%s): %v", scope, err)
+		}
+		return cred
+	}
+	verify := func(policyJSON []byte, signature string) {
+		t.Helper()
+		digest := sha1.Sum(policyJSON)
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], cloudfrontDecode(t, signature)); err != nil {
+			t.Errorf("signature does not verify: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		resource string
+		canned   bool
+	}{
+		{"canned", "https://d111111abcdef8.cloudfront.net/videos/intro.mp4?size=large", true},
+		{"custom", "https://d111111abcdef8.cloudfront.net/videos/*", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred := request("aws:cloudfront:url:" + tt.resource)
+			separator := "?"
+			if strings.Contains(tt.resource, "?") {
+				separator = "&"
+			}
+			rawQuery, ok := strings.CutPrefix(cred.Value, tt.resource+separator)
+			if !ok {
+				t.Fatalf("signed URL %s does not keep %s verbatim", cred.Value, tt.resource)
+			}
+			query, err := url.ParseQuery(rawQuery)
+			if err != nil {
+				t.Fatalf("invalid signed URL %s: %v", cred.Value, err)
+			}
+			if got := query.Get("Key-Pair-Id"); got != "K2JCJMDEHXQW5F" {
+				t.Errorf("Key-Pair-Id = %q, want K2JCJMDEHXQW5F", got)
+			}
+			expires := strconv.FormatInt(cred.ExpiresAt.Unix(), 10)
+			policyJSON := []byte(`{"Statement":[{"Resource":"` + tt.resource + `","Condition":{"DateLessThan":{"AWS:EpochTime":` + expires + `}}}]}`)
+			if tt.canned {
+				if query.Get("Expires") != expires || query.Has("Policy") {
+					t.Errorf("canned policy URL params = %v, want Expires %s and no Policy", query, expires)
+				}
+			} else if got := cloudfrontDecode(t, query.Get("Policy")); string(got) != string(policyJSON) {
+				t.Errorf("Policy = %s, want %s", got, policyJSON)
+			}
+			verify(policyJSON, query.Get("Signature"))
+		})
+	}
+
+	t.Run("cookies", func(t *testing.T) {
+		cred := request("aws:cloudfront:cookie:https://d111111abcdef8.cloudfront.net/private/reports/*")
+		var value CloudFrontCookiesValue
+		if err := json.Unmarshal([]byte(cred.Value), &value); err != nil {
+			t.Fatalf("invalid value %q: %v", cred.Value, err)
+		}
+		if value.Domain != "d111111abcdef8.cloudfront.net" || value.Path != "/private/reports/" {
+			t.Errorf("cookies apply to %s%s, want d111111abcdef8.cloudfront.net/private/reports/", value.Domain, value.Path)
+		}
+		if got := value.Cookies["CloudFront-Key-Pair-Id"]; got != "K2JCJMDEHXQW5F" {
+			t.Errorf("CloudFront-Key-Pair-Id = %q, want K2JCJMDEHXQW5F", got)
+		}
+		verify(cloudfrontDecode(t, value.Cookies["CloudFront-Policy"]), value.Cookies["CloudFront-Signature"])
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// Modes of compliance_mode
+const (
+	complianceFedRAMP = "fedramp"
+	compliancePCI     = "pci"
+)
+
+const (
+	// complianceMaxTTL is the longest session compliance_mode allows
+	complianceMaxTTL = time.Hour
+
+	// Session tags compliance_mode puts on every session, naming its
+	// requester and scope
+	agentTagKey = "creddy:agent"
+	scopeTagKey = "creddy:scope"
+)
+
+// applyComplianceMode turns on the settings of compliance_mode, and rejects
+// the settings it does not allow. It runs before the settings it turns on
+// are checked.
+func applyComplianceMode(c *AWSConfig) error {
+	switch c.ComplianceMode {
+	case "":
+		return nil
+	case complianceFedRAMP:
+		// FIPS 140 validated endpoints; PCI DSS does not require them, and
+		// most regions outside the US have none
+		c.UseFIPSEndpoint.Value = true
+	case compliancePCI:
+	default:
+		return fmt.Errorf("invalid compliance_mode %q (expected fedramp or pci)", c.ComplianceMode)
+	}
+	if c.TLSMinVersion == "" {
+		c.TLSMinVersion = "1.2"
+	}
+	if c.STSRegionalEndpoints == stsLegacyEndpoints {
+		return fmt.Errorf("compliance_mode %s requires regional STS endpoints", c.ComplianceMode)
+	}
+	if c.AuditLog == "" && !c.auditShipping() {
+		return fmt.Errorf("compliance_mode %s requires audit_log or an audit shipping destination", c.ComplianceMode)
+	}
+	if d := time.Duration(c.DefaultDuration); d > complianceMaxTTL {
+		return fmt.Errorf("compliance_mode %s allows sessions of at most %s, not a default_duration of %s", c.ComplianceMode, formatDuration(complianceMaxTTL), formatDuration(d))
+	}
+	return nil
+}
+
+// addComplianceTags tags a session with its requester and scope, as
+// transitive tags that sessions chained from it keep
+func addComplianceTags(input *sts.AssumeRoleInput, requester, scope string) {
+	for _, tag := range [][2]string{{agentTagKey, requester}, {scopeTagKey, scope}} {
+		value := truncateTagValue(disallowedTagChars.ReplaceAllString(tag[1], "_"))
+		input.Tags = append(input.Tags, ststypes.Tag{Key: aws.String(tag[0]), Value: aws.String(value)})
+		input.TransitiveTagKeys = append(input.TransitiveTagKeys, tag[0])
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jsonValue holds a structured config option. It accepts either the JSON
+// value itself or a string containing it, since options set through
+// schema-generated CLI flags arrive as strings.
+type jsonValue[T any] struct {
+	Value T
+}
+
+func (v *jsonValue[T]) UnmarshalJSON(data []byte) error {
+	if strings.HasPrefix(strings.TrimSpace(string(data)), `"`) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if s == "" {
+			return nil
+		}
+		data = []byte(s)
+	}
+	return json.Unmarshal(data, &v.Value)
+}
+
+func (v jsonValue[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.Value)
+}
+
+// duration is a config option holding a Go duration string ("90s", "5m").
+// Plain numbers are taken as seconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = duration(time.Duration(v * float64(time.Second)))
+	case string:
+		if v == "" {
+			*d = 0
+			return nil
+		}
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			*d = duration(time.Duration(secs * float64(time.Second)))
+			return nil
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %v", v)
+	}
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// formatDuration formats a duration without zero trailing units ("12h"
+// rather than "12h0m0s")
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// ScopeConfig holds settings that apply to matching scopes
+type ScopeConfig struct {
+	// Verify probes newly issued session credentials before returning them
+	Verify bool `json:"verify,omitempty"`
+
+	// Format is the default credential value format
+	Format string `json:"format,omitempty"`
+
+	// Regions lists the regions the credentials are used in, returned
+	// with them along with endpoint hints
+	Regions []string `json:"regions,omitempty"`
+
+	// Simulate lists the representative actions of policy simulations
+	Simulate []SimulatedAction `json:"simulate,omitempty"`
+
+	// SessionPolicy is a policy document narrowing the role's permissions
+	// for matching scopes that do not generate their own
+	SessionPolicy json.RawMessage `json:"session_policy,omitempty"`
+
+	// RequireJustification rejects requests without a justification
+	// parameter, and records it on the session
+	RequireJustification bool `json:"require_justification,omitempty"`
+
+	// RequireApproval parks requests until an approver approves them
+	RequireApproval bool `json:"require_approval,omitempty"`
+
+	// SourceIPs and SourceVpces restrict sessions to calls from these CIDRs
+	// or VPC endpoints
+	SourceIPs   []string `json:"source_ips,omitempty"`
+	SourceVpces []string `json:"source_vpces,omitempty"`
+
+	// AllowedWindows are cron expressions of the minutes matching scopes are
+	// issued in, in WindowTimezone (UTC by default). Requests outside them
+	// are denied, or need approval with OutsideWindow approve.
+	AllowedWindows []string `json:"allowed_windows,omitempty"`
+	WindowTimezone string   `json:"window_timezone,omitempty"`
+	OutsideWindow  string   `json:"outside_window,omitempty"`
+
+	// GranteePrincipals are the ARNs aws:kms:grant scopes may grant to
+	GranteePrincipals []string `json:"grantee_principals,omitempty"`
+}
+
+// scopeConfig returns the settings for a scope. Patterns match exactly, or
+// as a prefix when they end in '*'; the exact match or longest prefix wins.
+func (c *AWSConfig) scopeConfig(scope string) ScopeConfig {
+	if sc, ok := c.Scopes.Value[scope]; ok {
+		return sc
+	}
+
+	var best ScopeConfig
+	bestLen := -1
+	for pattern, sc := range c.Scopes.Value {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && strings.HasPrefix(scope, prefix) && len(prefix) > bestLen {
+			best, bestLen = sc, len(prefix)
+		}
+	}
+	return best
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	consoleIssuer = "creddy"
+	// consoleSigninTokenLifetime is how long a sign-in URL can be used before
+	// the console session begins
+	consoleSigninTokenLifetime = 15 * time.Minute
+)
+
+// consoleEndpoints holds the federation and console hosts of a partition
+type consoleEndpoints struct {
+	Federation string
+	Console    string
+}
+
+var partitionConsoleEndpoints = map[string]consoleEndpoints{
+	"aws":        {Federation: "https://signin.aws.amazon.com/federation", Console: "https://console.aws.amazon.com/"},
+	"aws-us-gov": {Federation: "https://signin.amazonaws-us-gov.com/federation", Console: "https://console.amazonaws-us-gov.com/"},
+	"aws-cn":     {Federation: "https://signin.amazonaws.cn/federation", Console: "https://console.amazonaws.cn/"},
+}
+
+// issueConsoleURL exchanges assumed-role credentials at the federation
+// endpoint for a console sign-in URL. The console session lasts as long as
+// the role session. The optional "destination" request parameter selects the
+// console page to open (e.g. "https://console.aws.amazon.com/s3/").
+func (p *AWSPlugin) issueConsoleURL(ctx context.Context, req *sdk.CredentialRequest, resource, _ string) (*sdk.Credential, error) {
+	if resource != "" {
+		return nil, fmt.Errorf("invalid console scope: %s (expected aws:console)", req.Scope)
+	}
+
+	roleARN, err := arn.Parse(p.config.RoleARN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse role_arn: %w", err)
+	}
+	endpoints, ok := partitionConsoleEndpoints[roleARN.Partition]
+	if !ok {
+		return nil, fmt.Errorf("console sign-in is not supported in partition %s", roleARN.Partition)
+	}
+
+	destination := endpoints.Console
+	if d := req.Parameters["destination"]; d != "" {
+		destination = d
+	}
+
+	creds, err := p.assumeRole(ctx, req.Scope, sessionDurationSeconds(req.TTL))
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := p.getSigninToken(ctx, endpoints.Federation, signingCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("Action", "login")
+	query.Set("Issuer", consoleIssuer)
+	query.Set("Destination", destination)
+	query.Set("SigninToken", token)
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["session_expires_at"] = creds.Expiration.Format(time.RFC3339)
+
+	// The URL itself must be used within 15 minutes; after sign-in the console
+	// session runs until the role session expires
+	expiresAt := time.Now().Add(consoleSigninTokenLifetime)
+	if creds.Expiration.Before(expiresAt) {
+		expiresAt = *creds.Expiration
+	}
+
+	return &sdk.Credential{
+		Value:     endpoints.Federation + "?" + query.Encode(),
+		ExpiresAt: expiresAt,
+		Metadata:  metadata,
+	}, nil
+}
+
+// getSigninToken calls the federation endpoint's getSigninToken action
+func (p *AWSPlugin) getSigninToken(ctx context.Context, federationURL string, creds aws.Credentials) (string, error) {
+	session, err := json.Marshal(map[string]string{
+		"sessionId":    creds.AccessKeyID,
+		"sessionKey":   creds.SecretAccessKey,
+		"sessionToken": creds.SessionToken,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal federation session: %w", err)
+	}
+
+	form := url.Values{}
+	form.Set("Action", "getSigninToken")
+	form.Set("Session", string(session))
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, federationURL+"?"+form.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to build federation request: %w", err)
+	}
+
+	resp, err := p.doHTTP(ctx, "signin", "GetSigninToken", httpReq)
+	if err != nil {
+		return "", fmt.Errorf("failed to call federation endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to read federation response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("federation endpoint returned %s", resp.Status)
+	}
+
+	var result struct {
+		SigninToken string `json:"SigninToken"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || result.SigninToken == "" {
+		return "", fmt.Errorf("invalid federation response")
+	}
+
+	return result.SigninToken, nil
+}
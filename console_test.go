@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestConsoleSigninUsesProxy(t *testing.T) {
+	f := newFakeAWS(t, false)
+	tunnels := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			select {
+			case tunnels <- r.Host:
+			default:
+			}
+		}
+		http.Error(w, "refused by test proxy", http.StatusForbidden)
+	}))
+	defer proxy.Close()
+
+	// Loopback calls to the fake skip the proxy; the federation endpoint's
+	// must go through it
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), f.config(`,"https_proxy":"`+proxy.URL+`"`)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	if _, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: "aws:console", TTL: time.Hour, Agent: sdk.Agent{ID: "agent"}}); err == nil {
+		t.Fatal("GetCredential succeeded through a refusing proxy")
+	}
+	select {
+	case host := <-tunnels:
+		if host != "signin.aws.amazon.com:443" {
+			t.Errorf("proxy tunnelled to %s, want signin.aws.amazon.com:443", host)
+		}
+	default:
+		t.Error("the federation call did not go through https_proxy")
+	}
+}
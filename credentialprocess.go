@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// credentialProcessCommand is the subcommand that runs the binary as an AWS
+// SDK credential_process
+const credentialProcessCommand = "credential-process"
+
+// helperRequest describes the credential a helper mode needs and where to
+// get it from: the Creddy CLI, or the plugin itself configured from a file
+type helperRequest struct {
+	Scope      string
+	TTL        time.Duration
+	Params     map[string]string
+	Creddy     string
+	Backend    string
+	ConfigFile string
+	RoleARN    string
+	AgentID    string
+
+	configured bool
+}
+
+// addHelperFlags registers the flags selecting a helper's credential and its
+// source, and returns a function building the request from them once parsed
+func addHelperFlags(fs *flag.FlagSet, defaultAgentID string) func() (*helperRequest, error) {
+	scope := fs.String("scope", "", "Scope to request (required)")
+	ttl := fs.Duration("ttl", time.Hour, "TTL of the credentials")
+	paramsJSON := fs.String("params", "", "JSON parameters of the request")
+	creddy := fs.String("creddy", "", "Path of the creddy CLI to request credentials through the Creddy daemon")
+	backend := fs.String("backend", PluginName, "Creddy backend name, with --creddy")
+	configFile := fs.String("config", os.Getenv("CREDDY_AWS_CONFIG"), "Plugin config file, to issue credentials without Creddy")
+	roleARN := fs.String("role", "", "Role to assume instead of the config's role_arn")
+	agentID := fs.String("agent-id", defaultAgentID, "Agent ID recorded for credentials issued without Creddy")
+
+	return func() (*helperRequest, error) {
+		if *scope == "" {
+			return nil, fmt.Errorf("--scope is required")
+		}
+		if *creddy == "" && *configFile == "" {
+			return nil, fmt.Errorf("one of --creddy or --config is required")
+		}
+
+		params := map[string]string{}
+		if *paramsJSON != "" {
+			if err := json.Unmarshal([]byte(*paramsJSON), &params); err != nil {
+				return nil, fmt.Errorf("invalid --params: %w", err)
+			}
+		}
+
+		return &helperRequest{
+			Scope:      *scope,
+			TTL:        *ttl,
+			Params:     params,
+			Creddy:     *creddy,
+			Backend:    *backend,
+			ConfigFile: *configFile,
+			RoleARN:    *roleARN,
+			AgentID:    *agentID,
+		}, nil
+	}
+}
+
+// runCredentialProcess prints credentials for a scope in the
+// credential_process format, either by asking the Creddy CLI for them or by
+// issuing them itself from a plugin config file
+func runCredentialProcess(ctx context.Context, p *AWSPlugin, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet(credentialProcessCommand, flag.ContinueOnError)
+	buildRequest := addHelperFlags(fs, credentialProcessCommand)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	hr, err := buildRequest()
+	if err != nil {
+		return err
+	}
+	hr.Params[formatParam] = formatCredentialProcess
+
+	value, err := requestHelperCredential(ctx, p, hr)
+	if err != nil {
+		return err
+	}
+
+	// Only hand the SDK a well-formed document
+	var doc credentialProcessValue
+	if err := json.Unmarshal([]byte(value), &doc); err != nil || doc.Version != credentialProcessVersion || doc.AccessKeyID == "" {
+		return fmt.Errorf("credentials are not in the credential_process format")
+	}
+	_, err = fmt.Fprintln(stdout, value)
+	return err
+}
+
+// requestHelperCredential returns the value of the credential a helper mode
+// asked for
+func requestHelperCredential(ctx context.Context, p *AWSPlugin, hr *helperRequest) (string, error) {
+	switch {
+	case hr.Creddy != "":
+		if hr.RoleARN != "" {
+			return "", fmt.Errorf("a role cannot be chosen when requesting through creddy; the backend's role is used")
+		}
+		paramsArg, _ := json.Marshal(hr.Params)
+		cmd := exec.CommandContext(ctx, hr.Creddy, "get", hr.Backend,
+			"--scope", hr.Scope, "--ttl", hr.TTL.String(), "--params", string(paramsArg))
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to get credentials from creddy: %w", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	case hr.ConfigFile != "":
+		if err := configureHelper(ctx, p, hr); err != nil {
+			return "", err
+		}
+		cred, err := p.GetCredential(ctx, &sdk.CredentialRequest{
+			Agent:      sdk.Agent{ID: hr.AgentID, Name: hr.AgentID, Scopes: []string{hr.Scope}},
+			Scope:      hr.Scope,
+			TTL:        hr.TTL,
+			Parameters: hr.Params,
+		})
+		if err != nil {
+			return "", err
+		}
+		return cred.Value, nil
+	default:
+		return "", fmt.Errorf("no credential source: set the creddy CLI or a plugin config file")
+	}
+}
+
+// configureHelper configures the plugin from a helper's config file.
+// Long-running helpers configure it once.
+func configureHelper(ctx context.Context, p *AWSPlugin, hr *helperRequest) error {
+	if hr.configured {
+		return nil
+	}
+	configJSON, err := os.ReadFile(hr.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if hr.RoleARN != "" {
+		configJSON, err = withRoleARN(configJSON, hr.RoleARN)
+		if err != nil {
+			return err
+		}
+	}
+	if err := p.Configure(ctx, string(configJSON)); err != nil {
+		return fmt.Errorf("configuration error: %w", err)
+	}
+	hr.configured = true
+	return nil
+}
+
+// withRoleARN replaces role_arn in a plugin config
+func withRoleARN(configJSON []byte, roleARN string) ([]byte, error) {
+	var cfg map[string]interface{}
+	if err := json.Unmarshal(configJSON, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	cfg["role_arn"] = roleARN
+	return json.Marshal(cfg)
+}
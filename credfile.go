@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// credentialsFileAgent is the agent credentials written to the shared
+	// credentials file are issued to
+	credentialsFileAgent = "credentials-file"
+
+	defaultCredentialsFileTTL = time.Hour
+
+	// credentialsFileLockStale is how old a lock file must be to be
+	// considered left behind by a crashed writer
+	credentialsFileLockStale = 30 * time.Second
+	credentialsFileLockWait  = 10 * time.Second
+)
+
+// credentialsFileWriter keeps profiles of the shared credentials file
+// (~/.aws/credentials) filled with fresh credentials for configured scopes
+type credentialsFileWriter struct {
+	path     string
+	profiles map[string]string
+	ttl      time.Duration
+	stop     chan struct{}
+}
+
+// defaultCredentialsFilePath returns the shared credentials file the AWS
+// SDKs read: AWS_SHARED_CREDENTIALS_FILE, else ~/.aws/credentials
+func defaultCredentialsFilePath() (string, error) {
+	if path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".aws", "credentials"), nil
+}
+
+// startCredentialsFileWriter starts refreshing the configured profiles
+func (p *AWSPlugin) startCredentialsFileWriter(path string, profiles map[string]string, ttl time.Duration) *credentialsFileWriter {
+	w := &credentialsFileWriter{path: path, profiles: profiles, ttl: ttl, stop: make(chan struct{})}
+	go p.runCredentialsFileWriter(w)
+	return w
+}
+
+func (w *credentialsFileWriter) close() {
+	close(w.stop)
+}
+
+func (p *AWSPlugin) runCredentialsFileWriter(w *credentialsFileWriter) {
+	names := make([]string, 0, len(w.profiles))
+	for name := range w.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	refreshAt := make(map[string]time.Time, len(names))
+	ticker := time.NewTicker(serverRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, name := range names {
+			if time.Now().Before(refreshAt[name]) {
+				continue
+			}
+			expiresAt, err := p.writeCredentialsProfile(w, name)
+			if err != nil {
+				sdk.Warn("failed to write credentials profile", "profile", name, "path", w.path, "error", err)
+				continue
+			}
+			margin := serverRefreshMargin
+			if lifetime := time.Until(expiresAt); margin > lifetime/4 {
+				margin = lifetime / 4
+			}
+			refreshAt[name] = expiresAt.Add(-margin)
+			sdk.Debug("wrote credentials profile", "profile", name, "expires_at", expiresAt.Format(time.RFC3339))
+		}
+
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeCredentialsProfile issues credentials for a profile's scope and
+// writes them to the file, returning their expiry
+func (p *AWSPlugin) writeCredentialsProfile(w *credentialsFileWriter, name string) (_ time.Time, err error) {
+	defer recoverPanic("credentials file", &err)
+
+	scope := w.profiles[name]
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cred, err := p.GetCredential(ctx, &sdk.CredentialRequest{
+		Agent:      sdk.Agent{ID: credentialsFileAgent, Name: credentialsFileAgent, Scopes: []string{scope}},
+		Scope:      scope,
+		TTL:        w.ttl,
+		Parameters: map[string]string{formatParam: formatINI, profileParam: name},
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The ini value is the whole section, header included
+	header, body, _ := strings.Cut(cred.Value, "\n")
+	section := fmt.Sprintf("%s\n# Managed by creddy-aws for %s; expires %s\n%s",
+		header, scope, cred.ExpiresAt.UTC().Format(time.RFC3339), body)
+
+	if err := updateCredentialsFile(w.path, name, section); err != nil {
+		return time.Time{}, err
+	}
+	return cred.ExpiresAt, nil
+}
+
+// updateCredentialsFile replaces a profile's section of a credentials file,
+// or appends it, leaving the rest of the file as it is. The file is locked
+// against other creddy writers, written with mode 0600 and replaced
+// atomically, so readers never see a partial file.
+func updateCredentialsFile(path, profile, section string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create credentials directory: %w", err)
+	}
+
+	unlock, err := lockCredentialsFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	updated := replaceINISection(string(existing), profile, section)
+
+	return writeFileAtomic(path, []byte(updated), 0600)
+}
+
+// writeFileAtomic writes a file through a temporary file renamed into
+// place, so readers see either the old or the new contents
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions of %s: %w", path, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+// lockCredentialsFile takes the lock file next to a credentials file,
+// breaking locks left behind by crashed writers
+func lockCredentialsFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(credentialsFileLockWait)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to lock credentials file: %w", err)
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > credentialsFileLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("credentials file is locked by %s", lockPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// replaceINISection replaces the [name] section of an ini document with
+// section, or appends it if there is none
+func replaceINISection(doc, name, section string) string {
+	section = strings.TrimRight(section, "\n") + "\n"
+	lines := strings.SplitAfter(doc, "\n")
+
+	var out strings.Builder
+	found, skipping := false, false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			skipping = strings.TrimSpace(trimmed[1:len(trimmed)-1]) == name
+			if skipping {
+				if found {
+					continue
+				}
+				found = true
+				out.WriteString(section)
+				out.WriteString("\n")
+				continue
+			}
+		}
+		if !skipping {
+			out.WriteString(line)
+		}
+	}
+
+	if !found {
+		result := out.String()
+		if result != "" && !strings.HasSuffix(result, "\n\n") {
+			if !strings.HasSuffix(result, "\n") {
+				result += "\n"
+			}
+			result += "\n"
+		}
+		return result + section
+	}
+	return out.String()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// serverRefreshMargin is how long before expiry a credential server
+	// fetches new credentials; at most a quarter of their lifetime
+	serverRefreshMargin = 5 * time.Minute
+	// serverRefreshInterval is how often a credential server checks whether
+	// its credentials need refreshing
+	serverRefreshInterval = 30 * time.Second
+)
+
+// servedCredentials are the session credentials a local credential server
+// hands out
+type servedCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+	Expiration      time.Time
+	LastUpdated     time.Time
+}
+
+// credentialRefresher keeps the credentials of a helper request fresh for a
+// local credential server, refreshing them ahead of expiry in the background
+// so requests are served without waiting on Creddy or STS
+type credentialRefresher struct {
+	p  *AWSPlugin
+	hr *helperRequest
+
+	mu        sync.Mutex
+	creds     *servedCredentials
+	refreshAt time.Time
+}
+
+// newCredentialRefresher returns a refresher for a helper request. The
+// credentials are requested in the kv format, which carries the region and
+// expiration.
+func newCredentialRefresher(p *AWSPlugin, hr *helperRequest) *credentialRefresher {
+	hr.Params[formatParam] = formatKV
+	return &credentialRefresher{p: p, hr: hr}
+}
+
+// get returns the current credentials, fetching new ones once they are due
+// for a refresh. If that fails, credentials that have not expired yet are
+// still served.
+func (r *credentialRefresher) get(ctx context.Context) (*servedCredentials, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.creds != nil && time.Now().Before(r.refreshAt) {
+		return r.creds, nil
+	}
+
+	creds, err := r.fetch(ctx)
+	if err != nil {
+		if r.creds != nil && time.Now().Before(r.creds.Expiration) {
+			sdk.Warn("failed to refresh credentials; serving the current ones", "scope", r.hr.Scope, "error", err)
+			return r.creds, nil
+		}
+		return nil, err
+	}
+
+	margin := serverRefreshMargin
+	if lifetime := time.Until(creds.Expiration); margin > lifetime/4 {
+		margin = lifetime / 4
+	}
+	r.creds = creds
+	r.refreshAt = creds.Expiration.Add(-margin)
+	sdk.Debug("refreshed served credentials", "scope", r.hr.Scope, "expires_at", creds.Expiration.Format(time.RFC3339))
+	return creds, nil
+}
+
+func (r *credentialRefresher) fetch(ctx context.Context) (*servedCredentials, error) {
+	value, err := requestHelperCredential(ctx, r.p, r.hr)
+	if err != nil {
+		return nil, err
+	}
+
+	var kv map[string]string
+	if err := json.Unmarshal([]byte(value), &kv); err != nil || kv["access_key_id"] == "" {
+		return nil, fmt.Errorf("credentials are not in the kv format")
+	}
+	expiration, err := time.Parse(time.RFC3339, kv["expiration"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential expiration: %w", err)
+	}
+
+	return &servedCredentials{
+		AccessKeyID:     kv["access_key_id"],
+		SecretAccessKey: kv["secret_access_key"],
+		SessionToken:    kv["session_token"],
+		Region:          kv["region"],
+		Expiration:      expiration,
+		LastUpdated:     time.Now().UTC(),
+	}, nil
+}
+
+// run refreshes the credentials ahead of expiry until ctx is done
+func (r *credentialRefresher) run(ctx context.Context) {
+	ticker := time.NewTicker(serverRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.get(ctx); err != nil {
+				sdk.Warn("failed to refresh credentials", "scope", r.hr.Scope, "error", err)
+			}
+		}
+	}
+}
+
+// serveCredentials runs a local credential server on addr until interrupted.
+// Credentials are fetched once up front, so misconfiguration fails fast;
+// ready, if set, is called with the listening address once the server is up.
+func serveCredentials(ctx context.Context, name, addr string, refresher *credentialRefresher, handler http.Handler, ready func(addr string)) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	if _, err := refresher.get(ctx); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	go refresher.run(ctx)
+
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	sdk.Info("serving credentials", "server", name, "address", listener.Addr().String(), "scope", refresher.hr.Scope)
+	if ready != nil {
+		ready(listener.Addr().String())
+	}
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%s server failed: %w", name, err)
+	}
+	return nil
+}
+
+// checkLoopbackListen rejects listen addresses other processes on the network
+// could reach
+func checkLoopbackListen(listen string) error {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid --listen: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("--listen must be a loopback address")
+	}
+	return nil
+}
+
+// newServerToken returns a random bearer token for a credential server
+func newServerToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
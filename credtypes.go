@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// credentialType is a scope family that issues something other than plain
+// STS session credentials (auth tokens, presigned URLs, ...)
+type credentialType struct {
+	// Prefix is matched against the requested scope; the remainder of the
+	// scope is passed to Issue as the resource, along with the region of the
+	// request. A prefix not ending in ':' only matches the scope itself or
+	// the scope followed by ':'.
+	Prefix string
+	Spec   sdk.ScopeSpec
+	Issue  func(p *AWSPlugin, ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error)
+	// Formats lists the value formats the type emits besides json
+	Formats []string
+}
+
+// credentialTypes lists the specialised credential types, checked in order
+var credentialTypes = []credentialType{
+	{
+		Prefix: "aws:msk:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:msk:cluster/<name>",
+			Description: "MSK IAM SASL/OAUTHBEARER auth token for Kafka clients",
+			Examples:    []string{"aws:msk:cluster/orders"},
+		},
+		Issue: (*AWSPlugin).issueMSKToken,
+	},
+	{
+		Prefix: "aws:elasticache:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:elasticache:<cache>/<user>",
+			Description: "ElastiCache (Redis OSS / Valkey) IAM auth token for a cache user",
+			Examples:    []string{"aws:elasticache:sessions/app-user"},
+		},
+		Issue: (*AWSPlugin).issueElastiCacheToken,
+	},
+	{
+		Prefix: "aws:memorydb:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:memorydb:<cluster>/<user>",
+			Description: "MemoryDB IAM auth token for a cluster user",
+			Examples:    []string{"aws:memorydb:ledger/app-user"},
+		},
+		Issue: (*AWSPlugin).issueMemoryDBToken,
+	},
+	{
+		Prefix: "aws:keyspaces:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:keyspaces:<keyspace>",
+			Description: "Amazon Keyspaces connection credentials for the Cassandra SigV4 auth plugin",
+			Examples:    []string{"aws:keyspaces:catalog"},
+		},
+		Issue: (*AWSPlugin).issueKeyspacesCredential,
+	},
+	{
+		Prefix: "aws:s3:presign:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:s3:presign:[get:|put:]<bucket>/<key>",
+			Description: "S3 presigned URL for downloading (default) or uploading a single object",
+			Examples:    []string{"aws:s3:presign:reports/2024/q1.csv", "aws:s3:presign:put:uploads/incoming/data.json"},
+		},
+		Issue: (*AWSPlugin).issueS3PresignedURL,
+	},
+	{
+		Prefix: "aws:s3:grants:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:s3:grants:<bucket>/<prefix>",
+			Description: "Just-in-time credentials vended by S3 Access Grants for a prefix",
+			Examples:    []string{"aws:s3:grants:datalake/finance/*"},
+		},
+		Issue: (*AWSPlugin).issueAccessGrantsCredential,
+	},
+	{
+		Prefix: "aws:s3:post:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:s3:post:<bucket>/<prefix>",
+			Description: "S3 presigned POST form policy for browser uploads under a key prefix",
+			Examples:    []string{"aws:s3:post:uploads/avatars/"},
+		},
+		Issue: (*AWSPlugin).issueS3PresignedPost,
+	},
+	{
+		Prefix: "aws:cloudfront:url:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:cloudfront:url:<url>",
+			Description: "CloudFront signed URL for private distribution content (may contain * wildcards)",
+			Examples:    []string{"aws:cloudfront:url:https://d111111abcdef8.cloudfront.net/videos/intro.mp4"},
+		},
+		Issue: (*AWSPlugin).issueCloudFrontSignedURL,
+	},
+	{
+		Prefix: "aws:cloudfront:cookie:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:cloudfront:cookie:<url-pattern>",
+			Description: "CloudFront signed cookies for private distribution content",
+			Examples:    []string{"aws:cloudfront:cookie:https://d111111abcdef8.cloudfront.net/private/*"},
+		},
+		Issue: (*AWSPlugin).issueCloudFrontSignedCookies,
+	},
+	{
+		Prefix: "aws:ses:smtp",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:ses:smtp",
+			Description: "SES SMTP host, port, username and password for mail agents",
+			Examples:    []string{"aws:ses:smtp"},
+		},
+		Issue: (*AWSPlugin).issueSESSMTPCredential,
+	},
+	{
+		Prefix: "aws:s3express:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:s3express:<bucket>",
+			Description: "S3 Express One Zone session credentials for a directory bucket",
+			Examples:    []string{"aws:s3express:scratch--use1-az4--x-s3"},
+		},
+		Issue: (*AWSPlugin).issueS3ExpressSession,
+	},
+	{
+		Prefix: "aws:console",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:console",
+			Description: "Time-limited AWS console sign-in URL for the configured role",
+			Examples:    []string{"aws:console"},
+		},
+		Issue: (*AWSPlugin).issueConsoleURL,
+	},
+	{
+		Prefix: "aws:bedrock:apikey",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:bedrock:apikey",
+			Description: "Short-term Bedrock API key (bearer token) for API-key based clients",
+			Examples:    []string{"aws:bedrock:apikey"},
+		},
+		Issue: (*AWSPlugin).issueBedrockAPIKey,
+	},
+	{
+		Prefix: "aws:sagemaker:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:sagemaker:<domain-id>/<user-profile>",
+			Description: "SageMaker Studio presigned domain URL for a user profile",
+			Examples:    []string{"aws:sagemaker:d-xxxxxxxxxxxx/alice"},
+		},
+		Issue: (*AWSPlugin).issueSageMakerDomainURL,
+	},
+	{
+		Prefix: "aws:neptune:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:neptune:<endpoint>[:port]",
+			Description: "SigV4-signed connection headers for a Neptune IAM-auth endpoint",
+			Examples:    []string{"aws:neptune:graph.cluster-abc123.us-east-1.neptune.amazonaws.com"},
+		},
+		Issue: (*AWSPlugin).issueNeptuneToken,
+	},
+	{
+		Prefix: "aws:docdb:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:docdb:<endpoint>[:port]",
+			Description: "MONGODB-AWS connection credentials for a DocumentDB elastic cluster",
+			Examples:    []string{"aws:docdb:orders-123456789012.us-east-1.docdb-elastic.amazonaws.com"},
+		},
+		Issue: (*AWSPlugin).issueDocumentDBCredential,
+	},
+	{
+		Prefix: "aws:kms:grant:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:kms:grant:<key-id>",
+			Description: "Revocable KMS grant token for a principal on a key",
+			Examples:    []string{"aws:kms:grant:arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"},
+		},
+		Issue: (*AWSPlugin).issueKMSGrant,
+	},
+	{
+		Prefix: "aws:iot:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:iot:<role-alias>",
+			Description: "AWS credentials from the IoT Core credentials provider for a role alias",
+			Examples:    []string{"aws:iot:fleet-telemetry"},
+		},
+		Issue: (*AWSPlugin).issueIoTCredential,
+	},
+	{
+		Prefix: "aws:eks:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:eks:<cluster>",
+			Description: "EKS authentication token, optionally as a client-go ExecCredential",
+			Examples:    []string{"aws:eks:prod"},
+		},
+		Issue:   (*AWSPlugin).issueEKSToken,
+		Formats: []string{formatExecCredential},
+	},
+	{
+		Prefix: "aws:sigv4:",
+		Spec: sdk.ScopeSpec{
+			Pattern:     "aws:sigv4:<target>",
+			Description: "Presigned SigV4 request (URL + headers) for a configured service endpoint",
+			Examples:    []string{"aws:sigv4:search-logs"},
+		},
+		Issue: (*AWSPlugin).issueSigV4Request,
+	},
+}
+
+// lookupCredentialType finds the credential type handling a scope
+func lookupCredentialType(scope string) (*credentialType, string, bool) {
+	for i := range credentialTypes {
+		prefix := credentialTypes[i].Prefix
+		resource, ok := strings.CutPrefix(scope, prefix)
+		if !ok || (resource != "" && !strings.HasSuffix(prefix, ":") && !strings.HasPrefix(resource, ":")) {
+			continue
+		}
+		return &credentialTypes[i], resource, true
+	}
+	return nil, "", false
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestLookupCredentialType(t *testing.T) {
+	tests := []struct {
+		scope        string
+		wantPrefix   string
+		wantResource string
+	}{
+		{"aws:console", "aws:console", ""},
+		{"aws:console:extra", "aws:console", ":extra"},
+		{"aws:consolex", "", ""},
+		{"aws:ses:smtp", "aws:ses:smtp", ""},
+		{"aws:ses:smtps", "", ""},
+		{"aws:bedrock:apikey", "aws:bedrock:apikey", ""},
+		{"aws:bedrock:apikeys", "", ""},
+		{"aws:msk:cluster/orders", "aws:msk:", "cluster/orders"},
+		{"aws:s3:presign:put:uploads/data.json", "aws:s3:presign:", "put:uploads/data.json"},
+		{"aws:s3", "", ""},
+	}
+	for _, tt := range tests {
+		ct, resource, ok := lookupCredentialType(tt.scope)
+		var prefix string
+		if ok {
+			prefix = ct.Prefix
+		}
+		if prefix != tt.wantPrefix || resource != tt.wantResource {
+			t.Errorf("lookupCredentialType(%s) = %q, %q, want %q, %q", tt.scope, prefix, resource, tt.wantPrefix, tt.wantResource)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// dataLakePolicy builds the session policy for aws:datalake:<database>: run
+// Athena queries in the configured workgroup, read the database from the Glue
+// catalog, and read/write query results
+func (p *AWSPlugin) dataLakePolicy(database string) (*policyDocument, error) {
+	if database == "" || strings.ContainsAny(database, "/*") {
+		return nil, fmt.Errorf("invalid datalake database: %q", database)
+	}
+	if p.config.DataLakeResultsLocation == "" {
+		return nil, fmt.Errorf("datalake_results_location must be configured for datalake scopes")
+	}
+
+	roleARN, err := arn.Parse(p.config.RoleARN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse role_arn: %w", err)
+	}
+	partition, account, region := roleARN.Partition, roleARN.AccountID, p.config.Region
+
+	workgroup := p.config.DataLakeWorkgroup
+	if workgroup == "" {
+		workgroup = "primary"
+	}
+
+	resultsBucket, resultsPrefix, err := parseS3Location(p.config.DataLakeResultsLocation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid datalake_results_location: %w", err)
+	}
+
+	glueARN := func(resource string) string {
+		return fmt.Sprintf("arn:%s:glue:%s:%s:%s", partition, region, account, resource)
+	}
+
+	statements := []policyStatement{
+		{
+			Sid:    "AthenaQuery",
+			Effect: "Allow",
+			Action: []string{
+				"athena:StartQueryExecution",
+				"athena:StopQueryExecution",
+				"athena:GetQueryExecution",
+				"athena:GetQueryResults",
+				"athena:GetWorkGroup",
+			},
+			Resource: []string{fmt.Sprintf("arn:%s:athena:%s:%s:workgroup/%s", partition, region, account, workgroup)},
+		},
+		{
+			Sid:    "GlueCatalogRead",
+			Effect: "Allow",
+			Action: []string{
+				"glue:GetDatabase",
+				"glue:GetTable",
+				"glue:GetTables",
+				"glue:GetPartition",
+				"glue:GetPartitions",
+				"glue:BatchGetPartition",
+			},
+			Resource: []string{
+				glueARN("catalog"),
+				glueARN("database/" + database),
+				glueARN("table/" + database + "/*"),
+			},
+		},
+		{
+			Sid:      "QueryResultsBucket",
+			Effect:   "Allow",
+			Action:   []string{"s3:GetBucketLocation", "s3:ListBucket"},
+			Resource: []string{fmt.Sprintf("arn:%s:s3:::%s", partition, resultsBucket)},
+		},
+		{
+			Sid:    "QueryResultsObjects",
+			Effect: "Allow",
+			Action: []string{
+				"s3:GetObject",
+				"s3:PutObject",
+				"s3:AbortMultipartUpload",
+				"s3:ListMultipartUploadParts",
+			},
+			Resource: []string{fmt.Sprintf("arn:%s:s3:::%s/%s*", partition, resultsBucket, resultsPrefix)},
+		},
+		{
+			// Tables governed by Lake Formation get their data access vended
+			Sid:      "LakeFormationDataAccess",
+			Effect:   "Allow",
+			Action:   []string{"lakeformation:GetDataAccess"},
+			Resource: []string{"*"},
+		},
+	}
+
+	// Tables not governed by Lake Formation are read directly from S3
+	if locations := p.config.DataLakeDataLocations; locations != "" {
+		var buckets, objects []string
+		for _, location := range strings.Split(locations, ",") {
+			bucket, prefix, err := parseS3Location(strings.TrimSpace(location))
+			if err != nil {
+				return nil, fmt.Errorf("invalid datalake_data_locations: %w", err)
+			}
+			buckets = append(buckets, fmt.Sprintf("arn:%s:s3:::%s", partition, bucket))
+			objects = append(objects, fmt.Sprintf("arn:%s:s3:::%s/%s*", partition, bucket, prefix))
+		}
+		statements = append(statements,
+			policyStatement{
+				Sid:      "TableDataBuckets",
+				Effect:   "Allow",
+				Action:   []string{"s3:GetBucketLocation", "s3:ListBucket"},
+				Resource: buckets,
+			},
+			policyStatement{
+				Sid:      "TableDataObjects",
+				Effect:   "Allow",
+				Action:   []string{"s3:GetObject"},
+				Resource: objects,
+			},
+		)
+	}
+
+	return newPolicy(statements...), nil
+}
+
+// parseS3Location splits an "s3://bucket/prefix" location
+func parseS3Location(location string) (bucket, prefix string, err error) {
+	rest, ok := strings.CutPrefix(location, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not an s3:// location", location)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("%q has no bucket", location)
+	}
+	return bucket, prefix, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// defaultRequestTimeout is the budget of a credential request, across all
+// the AWS calls and retries it makes
+const defaultRequestTimeout = 30 * time.Second
+
+// requestContext applies the configured budget to a request's context; a
+// deadline of the caller's own that is sooner still applies
+func (p *AWSPlugin) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(p.config.RequestTimeout))
+}
+
+// requestDone returns the error of a request whose context is done
+func requestDone(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("request deadline exceeded: %w", ctx.Err())
+	}
+	return fmt.Errorf("request cancelled: %w", ctx.Err())
+}
+
+// issuanceFlights collapses concurrent identical requests into one
+// issuance. Unlike a plain singleflight, each caller stops waiting when its
+// own context is done, and the issuance is only cancelled once every
+// caller has gone, so one impatient caller does not fail the others.
+type issuanceFlights struct {
+	mu      sync.Mutex
+	flights map[string]*issuanceFlight
+}
+
+type issuanceFlight struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+	done    chan struct{}
+	cred    *sdk.Credential
+	err     error
+}
+
+// do runs fn for key unless an identical issuance is in flight, in which
+// case it waits for that one. fn runs on the first caller's goroutine, with
+// a context that keeps the first caller's deadline but is cancelled only
+// when no caller is waiting any more.
+func (g *issuanceFlights) do(ctx context.Context, key string, fn func(context.Context) (*sdk.Credential, error)) (*sdk.Credential, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*issuanceFlight)
+	}
+	f, running := g.flights[key]
+	if !running {
+		fctx := context.WithoutCancel(ctx)
+		var cancel context.CancelFunc
+		if deadline, ok := ctx.Deadline(); ok {
+			fctx, cancel = context.WithDeadline(fctx, deadline)
+		} else {
+			fctx, cancel = context.WithCancel(fctx)
+		}
+		f = &issuanceFlight{ctx: fctx, cancel: cancel, done: make(chan struct{})}
+		g.flights[key] = f
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() { g.leave(key, f) })
+	defer func() {
+		if stop() {
+			g.leave(key, f)
+		}
+	}()
+
+	if running {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, requestDone(ctx)
+		}
+	} else {
+		func() {
+			// Release the waiters even if fn panics; the panic goes on to
+			// the entry point
+			defer func() {
+				g.mu.Lock()
+				if g.flights[key] == f {
+					delete(g.flights, key)
+				}
+				g.mu.Unlock()
+				f.cancel()
+				close(f.done)
+			}()
+			f.err = fmt.Errorf("identical request failed with an internal error")
+			f.cred, f.err = fn(f.ctx)
+		}()
+	}
+
+	if ctx.Err() != nil {
+		return nil, requestDone(ctx)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return copyCredential(f.cred), nil
+}
+
+// leave drops a caller of a flight, cancelling it once none is left. A
+// later identical request then starts a new issuance rather than joining
+// the cancelled one.
+func (g *issuanceFlights) leave(key string, f *issuanceFlight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f.waiters--
+	if f.waiters == 0 {
+		f.cancel()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// deepValidate assumes every configured role with the shortest session, as
+// the plugin would, so trust policies and external IDs that do not allow it
+// fail validation instead of the first request that needs them
+func (p *AWSPlugin) deepValidate(ctx context.Context) error {
+	var errs []error
+	if err := p.probeScope(ctx, "validate", "aws"); err != nil {
+		errs = append(errs, fmt.Errorf("role_arn: %w", err))
+	}
+
+	for _, role := range []struct{ setting, arn, sessionName string }{
+		{"audit_role_arn", p.config.AuditRoleARN, auditRoleSessionName},
+		{"notify_role_arn", p.config.NotifyRoleARN, notifyRoleSessionName},
+	} {
+		if role.arn == "" {
+			continue
+		}
+		_, err := p.clients.sts.AssumeRole(ctx, &sts.AssumeRoleInput{
+			RoleArn:         aws.String(role.arn),
+			RoleSessionName: aws.String(role.sessionName),
+			DurationSeconds: aws.Int32(int32(minSessionDuration.Seconds())),
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: failed to assume role %s: %w", role.setting, role.arn, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const docdbDefaultPort = "27017"
+
+// DocumentDBCredentialValue is the credential value returned for aws:docdb
+// scopes. DocumentDB's IAM auth uses the MONGODB-AWS mechanism, which
+// authenticates with the session credentials themselves.
+type DocumentDBCredentialValue struct {
+	Username         string `json:"username"`
+	Password         string `json:"password"`
+	SessionToken     string `json:"session_token"`
+	AuthMechanism    string `json:"auth_mechanism"`
+	Endpoint         string `json:"endpoint"`
+	ConnectionString string `json:"connection_string"`
+}
+
+// issueDocumentDBCredential packages assumed-role credentials for
+// MONGODB-AWS authentication against a DocumentDB elastic cluster
+func (p *AWSPlugin) issueDocumentDBCredential(ctx context.Context, req *sdk.CredentialRequest, resource, _ string) (*sdk.Credential, error) {
+	host, err := endpointHostPort(resource, docdbDefaultPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docdb scope: %s (expected aws:docdb:<endpoint>[:port])", req.Scope)
+	}
+
+	creds, err := p.assumeRole(ctx, req.Scope, sessionDurationSeconds(req.TTL))
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("tls", "true")
+	query.Set("authMechanism", "MONGODB-AWS")
+	query.Set("authMechanismProperties", "AWS_SESSION_TOKEN:"+*creds.SessionToken)
+	query.Set("retryWrites", "false")
+
+	connection := url.URL{
+		Scheme:   "mongodb",
+		User:     url.UserPassword(*creds.AccessKeyId, *creds.SecretAccessKey),
+		Host:     host,
+		Path:     "/",
+		RawQuery: query.Encode(),
+	}
+
+	value, err := json.Marshal(DocumentDBCredentialValue{
+		Username:         *creds.AccessKeyId,
+		Password:         *creds.SecretAccessKey,
+		SessionToken:     *creds.SessionToken,
+		AuthMechanism:    "MONGODB-AWS",
+		Endpoint:         host,
+		ConnectionString: connection.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["endpoint"] = host
+
+	return &sdk.Credential{
+		Value:     string(value),
+		ExpiresAt: *creds.Expiration,
+		Metadata:  metadata,
+	}, nil
+}
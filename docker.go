@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// formatDocker returns ECR registry credentials in the shape of a
+	// Docker credential helper's get response
+	formatDocker = "docker"
+
+	// registryParam names the ECR registry host of the docker format
+	registryParam = "registry"
+
+	// dockerHelperCommand is the subcommand implementing the Docker
+	// credential helper protocol. Docker runs helpers as
+	// docker-credential-<name>, so the binary also answers to that name.
+	dockerHelperCommand = "docker-credential-helper"
+	dockerHelperPrefix  = "docker-credential-"
+)
+
+// ecrRegistryHost matches private ECR registry hosts, capturing the account
+// and region
+var ecrRegistryHost = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// DockerCredentialValue is the credential value of the docker format, and
+// the response of the credential helper's get action
+type DockerCredentialValue struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// isECRScope reports whether a scope is an ECR scope
+func isECRScope(scope string) bool {
+	return scope == "aws:ecr" || strings.HasPrefix(scope, "aws:ecr:")
+}
+
+// dockerCredentials exchanges role session credentials for an ECR
+// authorization token. The registry parameter selects the registry (and
+// the region of the token); it defaults to the role's account in the
+// request's region.
+func (p *AWSPlugin) dockerCredentials(ctx context.Context, req *sdk.CredentialRequest, creds *types.Credentials, region string, expiresAt time.Time) (string, time.Time, error) {
+	if !isECRScope(req.Scope) {
+		return "", time.Time{}, fmt.Errorf("the docker format is only supported for aws:ecr scopes")
+	}
+
+	cfg, err := p.sessionAWSConfig(ctx, creds)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	cfg.Region = region
+
+	var input ecr.GetAuthorizationTokenInput
+	if registry := req.Parameters[registryParam]; registry != "" {
+		account, region, ok := parseECRRegistry(registry)
+		if !ok {
+			return "", time.Time{}, fmt.Errorf("invalid registry %q: expected <account>.dkr.ecr.<region>.amazonaws.com", registry)
+		}
+		cfg.Region = region
+		input.RegistryIds = []string{account}
+	}
+
+	out, err := ecr.NewFromConfig(p.config.serviceAWSConfig(cfg, "ecr")).GetAuthorizationToken(ctx, &input)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to get ECR authorization token: %w", err)
+	}
+	if len(out.AuthorizationData) == 0 {
+		return "", time.Time{}, fmt.Errorf("ECR returned no authorization data")
+	}
+	data := out.AuthorizationData[0]
+
+	decoded, err := base64.StdEncoding.DecodeString(aws.ToString(data.AuthorizationToken))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid ECR authorization token: %w", err)
+	}
+	username, secret, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("invalid ECR authorization token")
+	}
+
+	// The token cannot outlive the session it was issued to
+	if tokenExpiry := aws.ToTime(data.ExpiresAt); !tokenExpiry.IsZero() && tokenExpiry.Before(expiresAt) {
+		expiresAt = p.withExpiryMargin(p.clock.local(tokenExpiry))
+	}
+
+	value, err := json.Marshal(DockerCredentialValue{
+		ServerURL: aws.ToString(data.ProxyEndpoint),
+		Username:  username,
+		Secret:    secret,
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+	return string(value), expiresAt, nil
+}
+
+// parseECRRegistry extracts the account and region of an ECR registry host
+// or URL
+func parseECRRegistry(registry string) (account, region string, ok bool) {
+	host := registry
+	if u, err := url.Parse(registry); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	m := ecrRegistryHost.FindStringSubmatch(strings.ToLower(host))
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// isDockerHelperInvocation reports whether the binary was invoked as a
+// Docker credential helper, either by name or with the helper subcommand,
+// and returns the helper arguments
+func isDockerHelperInvocation(args []string) ([]string, bool) {
+	if strings.HasPrefix(filepath.Base(args[0]), dockerHelperPrefix) {
+		return args[1:], true
+	}
+	if len(args) > 1 && args[1] == dockerHelperCommand {
+		return args[2:], true
+	}
+	return nil, false
+}
+
+// runDockerHelper implements the Docker credential helper protocol. Only
+// get is meaningful: ECR tokens are issued on demand, so store and erase
+// are accepted and ignored, and list reports no stored credentials. The
+// credential source comes from the environment, since Docker passes no
+// flags to helpers.
+func runDockerHelper(ctx context.Context, p *AWSPlugin, args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s <get|store|erase|list>", dockerHelperPrefix+"creddy")
+	}
+
+	switch args[0] {
+	case "get":
+	case "store", "erase":
+		_, err := io.Copy(io.Discard, stdin)
+		return err
+	case "list":
+		_, err := fmt.Fprintln(stdout, "{}")
+		return err
+	default:
+		return fmt.Errorf("unknown credential helper action %q", args[0])
+	}
+
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read server URL: %w", err)
+	}
+	serverURL := strings.TrimSpace(line)
+	if _, _, ok := parseECRRegistry(serverURL); !ok {
+		// Docker prints this message and continues without credentials
+		return fmt.Errorf("credentials not found in native keychain")
+	}
+
+	scope := os.Getenv("CREDDY_AWS_SCOPE")
+	if scope == "" {
+		scope = "aws:ecr"
+	}
+	ttl := time.Hour
+	if v := os.Getenv("CREDDY_AWS_TTL"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid CREDDY_AWS_TTL: %w", err)
+		}
+	}
+	backend := os.Getenv("CREDDY_AWS_BACKEND")
+	if backend == "" {
+		backend = PluginName
+	}
+
+	value, err := requestHelperCredential(ctx, p, &helperRequest{
+		Scope:      scope,
+		TTL:        ttl,
+		Params:     map[string]string{formatParam: formatDocker, registryParam: serverURL},
+		Creddy:     os.Getenv("CREDDY_CLI"),
+		Backend:    backend,
+		ConfigFile: os.Getenv("CREDDY_AWS_CONFIG"),
+		AgentID:    dockerHelperPrefix + "creddy",
+	})
+	if err != nil {
+		return err
+	}
+
+	var creds DockerCredentialValue
+	if err := json.Unmarshal([]byte(value), &creds); err != nil || creds.Secret == "" {
+		return fmt.Errorf("credentials are not in the docker format")
+	}
+	// Answer for the registry Docker asked about
+	creds.ServerURL = serverURL
+	return json.NewEncoder(stdout).Encode(creds)
+}
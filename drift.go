@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// auditDrift is the action of role drift notifications
+const auditDrift = "drift"
+
+// roleSnapshot is what the role grants and who may assume it, as compared
+// between validations
+type roleSnapshot struct {
+	RoleARN            string    `json:"role_arn"`
+	TakenAt            time.Time `json:"taken_at"`
+	TrustPolicy        string    `json:"trust_policy"`
+	MaxSessionDuration int32     `json:"max_session_duration"`
+
+	// PermissionsBoundary is the boundary's ARN, if the role has one
+	PermissionsBoundary string `json:"permissions_boundary,omitempty"`
+
+	// PolicyVersions are the default versions of the attached managed
+	// policies and the boundary, by ARN
+	PolicyVersions map[string]string `json:"policy_versions"`
+
+	// AttachedPolicies are the ARNs of the attached managed policies
+	AttachedPolicies []string `json:"attached_policies"`
+
+	// InlinePolicies are the SHA-256 of the inline policy documents, by
+	// name, except the plugin's own revocation policy
+	InlinePolicies map[string]string `json:"inline_policies"`
+}
+
+// driftState is the last snapshot of the role, kept across
+// reconfigurations and, with drift_snapshot_file, restarts
+type driftState struct {
+	mu       sync.Mutex
+	snapshot *roleSnapshot
+	loaded   string
+}
+
+// checkDrift snapshots the role and reports how it changed since the last
+// snapshot. Failing to take a snapshot is logged and does not fail
+// validation.
+func (p *AWSPlugin) checkDrift(ctx context.Context) {
+	snapshot, err := p.snapshotRole(ctx)
+	if err != nil {
+		sdk.Warn("failed to snapshot role for drift detection", "role", p.config.RoleARN, "error", err)
+		return
+	}
+
+	state := &p.drift
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if path := p.config.DriftSnapshotFile; path != "" && state.loaded != path {
+		state.loaded = path
+		previous, err := readRoleSnapshot(path)
+		if err != nil {
+			sdk.Warn("failed to read drift snapshot, starting a new one", "path", path, "error", err)
+		} else if previous != nil {
+			state.snapshot = previous
+		}
+	}
+
+	previous := state.snapshot
+	state.snapshot = snapshot
+	if path := p.config.DriftSnapshotFile; path != "" {
+		if err := writeRoleSnapshot(path, snapshot); err != nil {
+			sdk.Warn("failed to write drift snapshot", "path", path, "error", err)
+		}
+	}
+	if previous == nil || previous.RoleARN != snapshot.RoleARN {
+		sdk.Debug("took first snapshot of role for drift detection", "role", snapshot.RoleARN)
+		return
+	}
+
+	changes := previous.diff(snapshot)
+	if len(changes) == 0 {
+		return
+	}
+	sdk.Warn("role changed since it was last validated", "role", snapshot.RoleARN, "since", previous.TakenAt, "changes", changes)
+	p.metrics.add(series("creddy_aws_role_drift_total"), float64(len(changes)))
+	event := auditEvent{
+		Time:    snapshot.TakenAt,
+		Action:  auditDrift,
+		Outcome: "changed",
+		RoleARN: snapshot.RoleARN,
+		Changes: changes,
+	}
+	p.notifier.notify(event)
+	p.webhooks.notify(event)
+}
+
+// snapshotRole reads the role's trust policy, boundary and policies
+func (p *AWSPlugin) snapshotRole(ctx context.Context) (*roleSnapshot, error) {
+	name, err := roleNameFromARN(p.config.RoleARN)
+	if err != nil {
+		return nil, err
+	}
+	client, err := p.createIAMClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IAM client: %w", err)
+	}
+
+	role, err := client.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(name)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role: %w", err)
+	}
+	trust, err := normalizePolicyDocument(aws.ToString(role.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust policy: %w", err)
+	}
+	s := &roleSnapshot{
+		RoleARN:            p.config.RoleARN,
+		TakenAt:            time.Now().UTC(),
+		TrustPolicy:        trust,
+		MaxSessionDuration: aws.ToInt32(role.Role.MaxSessionDuration),
+		PolicyVersions:     make(map[string]string),
+		InlinePolicies:     make(map[string]string),
+	}
+	var managed []string
+	if b := role.Role.PermissionsBoundary; b != nil {
+		s.PermissionsBoundary = aws.ToString(b.PermissionsBoundaryArn)
+		managed = append(managed, s.PermissionsBoundary)
+	}
+
+	attached := iam.NewListAttachedRolePoliciesPaginator(client, &iam.ListAttachedRolePoliciesInput{RoleName: aws.String(name)})
+	for attached.HasMorePages() {
+		page, err := attached.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list attached policies: %w", err)
+		}
+		for _, policy := range page.AttachedPolicies {
+			s.AttachedPolicies = append(s.AttachedPolicies, aws.ToString(policy.PolicyArn))
+		}
+	}
+	sort.Strings(s.AttachedPolicies)
+	managed = append(managed, s.AttachedPolicies...)
+
+	for _, policyARN := range managed {
+		if _, ok := s.PolicyVersions[policyARN]; ok {
+			continue
+		}
+		out, err := client.GetPolicy(ctx, &iam.GetPolicyInput{PolicyArn: aws.String(policyARN)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get policy %s: %w", policyARN, err)
+		}
+		s.PolicyVersions[policyARN] = aws.ToString(out.Policy.DefaultVersionId)
+	}
+
+	inline := iam.NewListRolePoliciesPaginator(client, &iam.ListRolePoliciesInput{RoleName: aws.String(name)})
+	for inline.HasMorePages() {
+		page, err := inline.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list inline policies: %w", err)
+		}
+		for _, policyName := range page.PolicyNames {
+			if policyName == p.config.RevocationPolicyName {
+				// Changed by the plugin itself on every revocation
+				continue
+			}
+			out, err := client.GetRolePolicy(ctx, &iam.GetRolePolicyInput{RoleName: aws.String(name), PolicyName: aws.String(policyName)})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get inline policy %s: %w", policyName, err)
+			}
+			doc, err := normalizePolicyDocument(aws.ToString(out.PolicyDocument))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read inline policy %s: %w", policyName, err)
+			}
+			sum := sha256.Sum256([]byte(doc))
+			s.InlinePolicies[policyName] = hex.EncodeToString(sum[:])
+		}
+	}
+	return s, nil
+}
+
+// normalizePolicyDocument decodes a URL-encoded policy document and
+// re-encodes it canonically, so formatting changes are not drift
+func normalizePolicyDocument(encoded string) (string, error) {
+	decoded, err := url.QueryUnescape(encoded)
+	if err != nil {
+		return "", err
+	}
+	var doc any
+	if err := json.Unmarshal([]byte(decoded), &doc); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// diff describes the changes from s to next, in a stable order
+func (s *roleSnapshot) diff(next *roleSnapshot) []string {
+	var changes []string
+	if s.TrustPolicy != next.TrustPolicy {
+		changes = append(changes, "trust policy changed")
+	}
+	if s.MaxSessionDuration != next.MaxSessionDuration {
+		changes = append(changes, fmt.Sprintf("MaxSessionDuration changed from %ds to %ds", s.MaxSessionDuration, next.MaxSessionDuration))
+	}
+	switch {
+	case s.PermissionsBoundary == next.PermissionsBoundary:
+	case next.PermissionsBoundary == "":
+		changes = append(changes, "permissions boundary removed: "+s.PermissionsBoundary)
+	case s.PermissionsBoundary == "":
+		changes = append(changes, "permissions boundary set: "+next.PermissionsBoundary)
+	default:
+		changes = append(changes, "permissions boundary changed from "+s.PermissionsBoundary+" to "+next.PermissionsBoundary)
+	}
+
+	before := make(map[string]bool)
+	for _, policyARN := range s.AttachedPolicies {
+		before[policyARN] = true
+	}
+	for _, policyARN := range next.AttachedPolicies {
+		if !before[policyARN] {
+			changes = append(changes, "managed policy attached: "+policyARN)
+		}
+		delete(before, policyARN)
+	}
+	for _, policyARN := range sortedKeys(before) {
+		changes = append(changes, "managed policy detached: "+policyARN)
+	}
+	for _, policyARN := range sortedKeys(next.PolicyVersions) {
+		if old, ok := s.PolicyVersions[policyARN]; ok && old != next.PolicyVersions[policyARN] {
+			changes = append(changes, fmt.Sprintf("managed policy %s default version changed from %s to %s", policyARN, old, next.PolicyVersions[policyARN]))
+		}
+	}
+
+	for _, name := range sortedKeys(next.InlinePolicies) {
+		old, ok := s.InlinePolicies[name]
+		switch {
+		case !ok:
+			changes = append(changes, "inline policy added: "+name)
+		case old != next.InlinePolicies[name]:
+			changes = append(changes, "inline policy changed: "+name)
+		}
+	}
+	for _, name := range sortedKeys(s.InlinePolicies) {
+		if _, ok := next.InlinePolicies[name]; !ok {
+			changes = append(changes, "inline policy removed: "+name)
+		}
+	}
+	return changes
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readRoleSnapshot reads a snapshot file, or returns nil if there is none
+func readRoleSnapshot(path string) (*roleSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s roleSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// writeRoleSnapshot replaces a snapshot file
+func writeRoleSnapshot(path string, s *roleSnapshot) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0o600)
+}
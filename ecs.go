@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// containerCredentialsCommand is the subcommand that runs a local ECS
+	// container credentials endpoint serving creddy credentials
+	containerCredentialsCommand = "container-credentials"
+
+	defaultContainerListen = "127.0.0.1:8170"
+	defaultContainerPath   = "/credentials"
+)
+
+// containerCredentials is the document of the container credentials
+// endpoint read by the AWS SDKs' container provider
+type containerCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+}
+
+// containerError is the error document of the container credentials
+// endpoint
+type containerError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// containerServer serves credentials on the AWS_CONTAINER_CREDENTIALS_FULL_URI
+// contract, to clients presenting the authorization token
+type containerServer struct {
+	path      string
+	token     string
+	refresher *credentialRefresher
+}
+
+// runContainerCredentialsServer runs a local container credentials endpoint
+// serving credentials for a scope, and prints the environment pointing SDKs
+// at it
+func runContainerCredentialsServer(ctx context.Context, p *AWSPlugin, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet(containerCredentialsCommand, flag.ContinueOnError)
+	buildRequest := addHelperFlags(fs, containerCredentialsCommand)
+	listen := fs.String("listen", defaultContainerListen, "Loopback address to serve the endpoint on")
+	path := fs.String("path", defaultContainerPath, "URL path of the endpoint")
+	tokenFile := fs.String("token-file", "", "File holding the authorization token; created with a random token if missing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	hr, err := buildRequest()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(*path, "/") {
+		return fmt.Errorf("--path must start with /")
+	}
+
+	// SDKs only send credentials requests over plain HTTP to loopback hosts
+	if err := checkLoopbackListen(*listen); err != nil {
+		return err
+	}
+
+	token, err := containerToken(*tokenFile)
+	if err != nil {
+		return err
+	}
+
+	s := &containerServer{
+		path:      *path,
+		token:     token,
+		refresher: newCredentialRefresher(p, hr),
+	}
+
+	return serveCredentials(ctx, containerCredentialsCommand, *listen, s.refresher, s, func(addr string) {
+		fmt.Fprintf(stdout, "AWS_CONTAINER_CREDENTIALS_FULL_URI=http://%s%s\n", addr, *path)
+		if *tokenFile != "" {
+			fmt.Fprintf(stdout, "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE=%s\n", *tokenFile)
+		} else {
+			fmt.Fprintf(stdout, "AWS_CONTAINER_AUTHORIZATION_TOKEN=%s\n", token)
+		}
+	})
+}
+
+// containerToken reads the authorization token from a file, creating the
+// file with a random token if it does not exist. Without a file, a random
+// token is used.
+func containerToken(path string) (string, error) {
+	if path == "" {
+		return newServerToken(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("token file %s is empty", path)
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	token := newServerToken()
+	if err := os.WriteFile(path, []byte(token), 0600); err != nil {
+		return "", fmt.Errorf("failed to write token file: %w", err)
+	}
+	return token, nil
+}
+
+func (s *containerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != s.path {
+		s.writeError(w, http.StatusNotFound, "NotFound", "not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.token)) != 1 {
+		s.writeError(w, http.StatusUnauthorized, "Unauthorized", "invalid authorization token")
+		return
+	}
+
+	creds, err := s.refresher.get(r.Context())
+	if err != nil {
+		sdk.Error("failed to get credentials", "server", containerCredentialsCommand, "error", err)
+		s.writeError(w, http.StatusInternalServerError, "CredentialsUnavailable", "credentials unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(containerCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		Token:           creds.SessionToken,
+		Expiration:      creds.Expiration.UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *containerServer) writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(containerError{Code: code, Message: message})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestCacheToken(t *testing.T) {
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), f.config(`,"region":"eu-west-1"`)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	tests := []struct {
+		name             string
+		scope            string
+		params           map[string]string
+		ttl              time.Duration
+		wantService      string
+		wantResourceType string
+		wantExpires      string
+	}{
+		{name: "elasticache", scope: "aws:elasticache:sessions/app-user", wantService: "elasticache", wantExpires: "900"},
+		{name: "serverless", scope: "aws:elasticache:sessions/app-user", params: map[string]string{"serverless": "true"}, wantService: "elasticache", wantResourceType: "ServerlessCache", wantExpires: "900"},
+		{name: "memorydb", scope: "aws:memorydb:sessions/app-user", ttl: 10 * time.Minute, wantService: "memorydb", wantExpires: "600"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: tt.scope, TTL: tt.ttl, Parameters: tt.params, Agent: sdk.Agent{ID: "agent"}})
+			if err != nil {
+				t.Fatalf("GetCredential: %v", err)
+			}
+			var value CacheTokenValue
+			if err := json.Unmarshal([]byte(cred.Value), &value); err != nil {
+				t.Fatalf("invalid value %q: %v", cred.Value, err)
+			}
+			if value.User != "app-user" || value.Cache != "sessions" || value.Region != "eu-west-1" {
+				t.Errorf("value = %+v, want a token of app-user on sessions in eu-west-1", value)
+			}
+			// The token is the presigned URL without its scheme
+			query := verifyPresignedURL(t, "GET", "http://"+value.Token, "secret", tt.wantService, "eu-west-1", emptyPayloadHash)
+			for name, want := range map[string]string{
+				"Action":               "connect",
+				"User":                 "app-user",
+				"ResourceType":         tt.wantResourceType,
+				"X-Amz-Expires":        tt.wantExpires,
+				"X-Amz-Security-Token": "token",
+			} {
+				if got := query.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
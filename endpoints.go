@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	smithyendpoints "github.com/aws/smithy-go/endpoints"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// STS endpoint selection: the regional endpoint of the configured region,
+// or the legacy global endpoint (sts.amazonaws.com) for the regions that
+// used it by default
+const (
+	stsRegionalEndpoints = "regional"
+	stsLegacyEndpoints   = "legacy"
+)
+
+// endpointServices are the services the plugin calls, as keys of
+// endpoint_urls
+var endpointServices = []string{"access-analyzer", "cloudtrail", "dynamodb", "ecr", "events", "iam", "kms", "lambda", "logs", "s3", "s3control", "sagemaker", "sns", "sts"}
+
+// newAWSConfig loads the AWS config for the configured region, endpoints,
+// HTTP client and retry policy with the given credentials
+func newAWSConfig(ctx context.Context, c *AWSConfig, provider aws.CredentialsProvider) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(c.Region),
+		config.WithCredentialsProvider(provider),
+		config.WithAPIOptions(append(userAgentOptions(), addRequestIDMiddleware)),
+	}
+	if c.httpClient != nil {
+		opts = append(opts, config.WithHTTPClient(c.httpClient))
+	}
+	if c.metrics != nil {
+		opts = append(opts, config.WithAPIOptions([]func(*middleware.Stack) error{c.metrics.addMiddleware}))
+	}
+	if c.tracing != nil {
+		opts = append(opts, config.WithAPIOptions([]func(*middleware.Stack) error{c.tracing.addMiddleware}))
+	}
+	if c.MaxAttempts.Value > 0 {
+		opts = append(opts, config.WithRetryMaxAttempts(c.MaxAttempts.Value))
+	}
+	if c.RetryMode != "" {
+		mode, _ := aws.ParseRetryMode(c.RetryMode)
+		opts = append(opts, config.WithRetryMode(mode))
+	}
+	if c.EndpointURL != "" {
+		opts = append(opts, config.WithBaseEndpoint(c.EndpointURL))
+	}
+	if c.UseFIPSEndpoint.Value {
+		opts = append(opts, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if c.UseDualStackEndpoint.Value {
+		opts = append(opts, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+	return config.LoadDefaultConfig(ctx, opts...)
+}
+
+// serviceAWSConfig returns cfg with a service's endpoint_urls override, if
+// it has one
+func (c *AWSConfig) serviceAWSConfig(cfg aws.Config, service string) aws.Config {
+	if endpoint := c.EndpointURLs.Value[service]; endpoint != "" {
+		cfg.BaseEndpoint = aws.String(endpoint)
+	}
+	return cfg
+}
+
+// newS3Client returns an S3 client honouring the endpoint settings
+func (c *AWSConfig) newS3Client(cfg aws.Config) *s3.Client {
+	return s3.NewFromConfig(c.serviceAWSConfig(cfg, "s3"), func(o *s3.Options) {
+		o.UsePathStyle = c.S3UsePathStyle.Value
+	})
+}
+
+// newSTSClient returns an STS client honouring the endpoint settings
+func (c *AWSConfig) newSTSClient(cfg aws.Config) *sts.Client {
+	return sts.NewFromConfig(c.serviceAWSConfig(cfg, "sts"), func(o *sts.Options) {
+		o.APIOptions = append(o.APIOptions, withCircuitBreaker(c.stsBreaker)...)
+		if c.STSRegionalEndpoints == stsLegacyEndpoints {
+			o.EndpointResolverV2 = globalSTSResolver{sts.NewDefaultEndpointResolverV2()}
+		}
+	})
+}
+
+// globalSTSResolver resolves STS endpoints with the global endpoint enabled,
+// as sts_regional_endpoints = legacy does in the AWS CLI
+type globalSTSResolver struct {
+	sts.EndpointResolverV2
+}
+
+func (r globalSTSResolver) ResolveEndpoint(ctx context.Context, params sts.EndpointParameters) (smithyendpoints.Endpoint, error) {
+	params.UseGlobalEndpoint = aws.Bool(true)
+	return r.EndpointResolverV2.ResolveEndpoint(ctx, params)
+}
+
+// validateEndpoints checks endpoint_url, endpoint_urls and
+// sts_regional_endpoints
+func validateEndpoints(c *AWSConfig) error {
+	switch c.STSRegionalEndpoints {
+	case "", stsRegionalEndpoints, stsLegacyEndpoints:
+	default:
+		return fmt.Errorf("invalid sts_regional_endpoints %q (expected regional or legacy)", c.STSRegionalEndpoints)
+	}
+	if c.EndpointURL != "" {
+		if err := validateEndpointURL(c.EndpointURL); err != nil {
+			return fmt.Errorf("invalid endpoint_url: %w", err)
+		}
+	}
+	for service, endpoint := range c.EndpointURLs.Value {
+		if !slices.Contains(endpointServices, service) {
+			return fmt.Errorf("invalid endpoint_urls: unknown service %q (expected one of %s)", service, strings.Join(endpointServices, ", "))
+		}
+		if err := validateEndpointURL(endpoint); err != nil {
+			return fmt.Errorf("invalid endpoint_urls %q: %w", service, err)
+		}
+	}
+	return nil
+}
+
+// validateEndpointURL checks an endpoint is an absolute http(s) URL
+func validateEndpointURL(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", endpoint)
+	}
+	return nil
+}
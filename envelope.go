@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+)
+
+// encryptToParam carries the public key a credential value is encrypted to
+const encryptToParam = "encrypt_to"
+
+// Envelope schemes, as reported in the encryption metadata. The RSA and
+// ECDH schemes are the JWE algorithms of the compact serialization.
+const (
+	envelopeAge     = "age"
+	envelopeRSAOAEP = "RSA-OAEP-256"
+	envelopeECDHES  = "ECDH-ES"
+
+	// envelopeContentEncryption is the JWE content encryption algorithm
+	envelopeContentEncryption = "A256GCM"
+
+	// minEnvelopeRSABits is the smallest RSA key values are encrypted to
+	minEnvelopeRSABits = 2048
+)
+
+// envelopeRecipient is a requester's public key that credential values are
+// encrypted to, so they are opaque to every hop before the consumer holding
+// the private key
+type envelopeRecipient struct {
+	scheme string
+	age    age.Recipient
+	rsa    *rsa.PublicKey
+	ecdh   *ecdh.PublicKey
+}
+
+// jweHeader is the protected header of a JWE
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	EPK *jwk   `json:"epk,omitempty"`
+}
+
+// jwk is the ephemeral public key of an ECDH-ES JWE
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+}
+
+// parseEnvelopeRecipient parses an encrypt_to parameter: an age recipient
+// (age1...), an SSH public key, or a PEM public key (RSA, EC or X25519).
+// An empty key means no encryption.
+func parseEnvelopeRecipient(key string) (*envelopeRecipient, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, nil
+	}
+
+	switch {
+	case strings.HasPrefix(key, "age1"):
+		r, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", encryptToParam, err)
+		}
+		return &envelopeRecipient{scheme: envelopeAge, age: r}, nil
+	case strings.HasPrefix(key, "ssh-"):
+		r, err := agessh.ParseRecipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", encryptToParam, err)
+		}
+		return &envelopeRecipient{scheme: envelopeAge, age: r}, nil
+	}
+
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, fmt.Errorf("invalid %s: expected an age recipient, an SSH public key or a PEM public key", encryptToParam)
+	}
+	var pub any
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("invalid %s: unexpected PEM block %q", encryptToParam, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", encryptToParam, err)
+	}
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minEnvelopeRSABits {
+			return nil, fmt.Errorf("invalid %s: RSA keys must be at least %d bits", encryptToParam, minEnvelopeRSABits)
+		}
+		return &envelopeRecipient{scheme: envelopeRSAOAEP, rsa: k}, nil
+	case *ecdsa.PublicKey:
+		ek, err := k.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", encryptToParam, err)
+		}
+		return &envelopeRecipient{scheme: envelopeECDHES, ecdh: ek}, nil
+	case *ecdh.PublicKey:
+		return &envelopeRecipient{scheme: envelopeECDHES, ecdh: k}, nil
+	default:
+		return nil, fmt.Errorf("invalid %s: unsupported %T key", encryptToParam, pub)
+	}
+}
+
+// seal encrypts a credential value: age recipients get an armored age file,
+// the other keys a JWE in compact serialization
+func (r *envelopeRecipient) seal(plaintext string) (string, error) {
+	if r.scheme == envelopeAge {
+		var buf bytes.Buffer
+		aw := armor.NewWriter(&buf)
+		w, err := age.Encrypt(aw, r.age)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt credential: %w", err)
+		}
+		if _, err := w.Write([]byte(plaintext)); err != nil {
+			return "", fmt.Errorf("failed to encrypt credential: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return "", fmt.Errorf("failed to encrypt credential: %w", err)
+		}
+		if err := aw.Close(); err != nil {
+			return "", fmt.Errorf("failed to encrypt credential: %w", err)
+		}
+		return buf.String(), nil
+	}
+	return r.sealJWE([]byte(plaintext))
+}
+
+// sealJWE encrypts to an RSA key with a random content key wrapped by
+// RSA-OAEP-256, or to an ECDH key with a content key agreed with an
+// ephemeral key (ECDH-ES direct key agreement, RFC 7518 section 4.6)
+func (r *envelopeRecipient) sealJWE(plaintext []byte) (string, error) {
+	header := jweHeader{Alg: r.scheme, Enc: envelopeContentEncryption}
+	var cek, encryptedKey []byte
+	if r.rsa != nil {
+		cek = make([]byte, 32)
+		if _, err := rand.Read(cek); err != nil {
+			return "", fmt.Errorf("failed to generate content key: %w", err)
+		}
+		var err error
+		encryptedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, r.rsa, cek, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt content key: %w", err)
+		}
+	} else {
+		ephemeral, err := r.ecdh.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate ephemeral key: %w", err)
+		}
+		z, err := ephemeral.ECDH(r.ecdh)
+		if err != nil {
+			return "", fmt.Errorf("failed to agree content key: %w", err)
+		}
+		header.EPK = ephemeralJWK(ephemeral.PublicKey())
+		cek = concatKDF(z, envelopeContentEncryption)
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode JWE header: %w", err)
+	}
+	protected := base64.RawURLEncoding.EncodeToString(headerJSON)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt credential: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt credential: %w", err)
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", fmt.Errorf("failed to generate IV: %w", err)
+	}
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// ephemeralJWK encodes an ephemeral ECDH public key as a JWK
+func ephemeralJWK(pub *ecdh.PublicKey) *jwk {
+	b := pub.Bytes()
+	if pub.Curve() == ecdh.X25519() {
+		return &jwk{Kty: "OKP", Crv: "X25519", X: base64.RawURLEncoding.EncodeToString(b)}
+	}
+
+	crv := "P-256"
+	switch pub.Curve() {
+	case ecdh.P384():
+		crv = "P-384"
+	case ecdh.P521():
+		crv = "P-521"
+	}
+	// Uncompressed point: 0x04 || x || y
+	size := (len(b) - 1) / 2
+	return &jwk{
+		Kty: "EC",
+		Crv: crv,
+		X:   base64.RawURLEncoding.EncodeToString(b[1 : 1+size]),
+		Y:   base64.RawURLEncoding.EncodeToString(b[1+size:]),
+	}
+}
+
+// concatKDF derives a 256-bit content key from an ECDH shared secret with
+// the Concat KDF of NIST SP 800-56A, as parameterized by JWE ECDH-ES (no
+// party info, the enc algorithm as AlgorithmID). One SHA-256 round gives
+// the whole key.
+func concatKDF(z []byte, algorithm string) []byte {
+	h := sha256.New()
+	h.Write(binary.BigEndian.AppendUint32(nil, 1))
+	h.Write(z)
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(algorithm))))
+	h.Write([]byte(algorithm))
+	h.Write(binary.BigEndian.AppendUint32(nil, 0)) // PartyUInfo
+	h.Write(binary.BigEndian.AppendUint32(nil, 0)) // PartyVInfo
+	h.Write(binary.BigEndian.AppendUint32(nil, 256))
+	return h.Sum(nil)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// errorLookupTimeout bounds looking up the caller for an error's hint
+const errorLookupTimeout = 5 * time.Second
+
+// errorKind is the stable category of a plugin error, leading its message
+type errorKind string
+
+const (
+	errConfiguration      errorKind = "configuration_error"
+	errAccessDenied       errorKind = "access_denied"
+	errThrottled          errorKind = "throttled"
+	errInvalidScope       errorKind = "invalid_scope"
+	errExpiredCredentials errorKind = "expired_credentials"
+	errUnavailable        errorKind = "unavailable"
+	errQuotaExceeded      errorKind = "quota_exceeded"
+)
+
+// AWS error codes by the kind of error they are
+var errorCodeKinds = map[string]errorKind{
+	"AccessDenied":                errAccessDenied,
+	"AccessDeniedException":       errAccessDenied,
+	"AuthorizationError":          errAccessDenied,
+	"UnauthorizedOperation":       errAccessDenied,
+	"UnauthorizedAccess":          errAccessDenied,
+	"ExpiredToken":                errExpiredCredentials,
+	"ExpiredTokenException":       errExpiredCredentials,
+	"InvalidClientTokenId":        errConfiguration,
+	"InvalidAccessKeyId":          errConfiguration,
+	"UnrecognizedClientException": errConfiguration,
+	"SignatureDoesNotMatch":       errConfiguration,
+	"IncompleteSignature":         errConfiguration,
+	"RegionDisabledException":     errConfiguration,
+	"NoSuchEntity":                errConfiguration,
+}
+
+// errNotConfigured is returned by calls made before Configure
+var errNotConfigured = &pluginError{kind: errConfiguration, msg: "plugin not configured", hint: "the plugin must be configured before it is used"}
+
+// pluginError is an error of a known kind, with a readable cause and a hint
+// on fixing it. It reads "<kind>: <what failed>: <cause>; <hint>".
+type pluginError struct {
+	kind errorKind
+	msg  string
+	err  error
+	hint string
+}
+
+func (e *pluginError) Error() string {
+	s := string(e.kind) + ": " + e.msg
+	if e.err != nil {
+		s += ": " + readableError(e.err)
+	}
+	if e.hint != "" {
+		s += "; " + e.hint
+	}
+	return s
+}
+
+func (e *pluginError) Unwrap() error {
+	return e.err
+}
+
+// readableError describes an error by its AWS error code and message where
+// it has one, rather than the SDK's chain of operation and response
+// details. What the plugin wrapped around the SDK error is kept.
+func readableError(err error) string {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err.Error()
+	}
+	s := apiErr.ErrorCode()
+	if msg := apiErr.ErrorMessage(); msg != "" {
+		s += ": " + msg
+	}
+	if id := requestIDOf(err); id != "" {
+		s += " (request ID " + id + ")"
+	}
+	var opErr *smithy.OperationError
+	if errors.As(err, &opErr) {
+		if prefix, _, ok := strings.Cut(err.Error(), opErr.Error()); ok {
+			s = prefix + s
+		}
+	}
+	return s
+}
+
+// errorKindOf returns the kind of an error, or "" if it is not one the
+// plugin knows
+func errorKindOf(err error) errorKind {
+	var perr *pluginError
+	if errors.As(err, &perr) {
+		return perr.kind
+	}
+	if isThrottling(err) {
+		return errThrottled
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if kind, ok := errorCodeKinds[apiErr.ErrorCode()]; ok {
+			return kind
+		}
+	}
+	if isServiceOutage(err) {
+		return errUnavailable
+	}
+	return ""
+}
+
+// errorCode returns the AWS error code of an error, if any
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// assumeRoleError describes a failed AssumeRole call, with a hint naming the
+// caller and settings involved
+func (p *AWSPlugin) assumeRoleError(ctx context.Context, err error) error {
+	kind := errorKindOf(err)
+	if kind == "" {
+		return fmt.Errorf("failed to assume role: %w", err)
+	}
+	perr := &pluginError{kind: kind, msg: "failed to assume role " + p.config.RoleARN, err: err}
+
+	switch kind {
+	case errAccessDenied:
+		caller := "the base credentials"
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), errorLookupTimeout)
+		defer cancel()
+		if callerARN, _ := p.callerIdentity(ctx); callerARN != "" {
+			caller = callerARN
+		}
+		externalID := "not configured"
+		if p.config.ExternalID != "" {
+			externalID = "configured"
+		}
+		perr.hint = fmt.Sprintf("check the role trust policy allows %s to call sts:AssumeRole (external_id is %s), and that the caller's own policies allow sts:AssumeRole on the role", caller, externalID)
+	case errConfiguration:
+		perr.hint = configurationHint(errorCode(err), p.config)
+	default:
+		perr.hint = kindHint(kind)
+	}
+	return perr
+}
+
+// describeError turns an error returned by an entry point into a
+// pluginError where its kind is known. op names the call for hints.
+func (p *AWSPlugin) describeError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var perr *pluginError
+	if errors.As(err, &perr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	kind := errorKindOf(err)
+	if kind == "" {
+		return err
+	}
+
+	perr = &pluginError{kind: kind, msg: op + " failed", err: err, hint: kindHint(kind)}
+	switch {
+	case kind == errConfiguration && p.config != nil:
+		perr.hint = configurationHint(errorCode(err), p.config)
+	case kind == errAccessDenied && op == "revocation":
+		perr.hint = "revoking sessions needs iam:GetRolePolicy, iam:PutRolePolicy and iam:DeleteRolePolicy on the role for the base credentials"
+	case kind == errAccessDenied:
+		perr.hint = "the role's policies, or the scope's session policy, do not allow this call"
+	}
+	return perr
+}
+
+// configurationHint returns the remediation of a configuration error code
+func configurationHint(code string, cfg *AWSConfig) string {
+	switch code {
+	case "InvalidClientTokenId", "InvalidAccessKeyId", "UnrecognizedClientException":
+		return "the base access key is not valid; check access_key_id (or the credentials in the environment)"
+	case "SignatureDoesNotMatch", "IncompleteSignature":
+		return "the base credentials do not sign correctly; check secret_access_key and session_token"
+	case "RegionDisabledException":
+		return fmt.Sprintf("STS is not activated in %s; activate it in the account settings of IAM, or set sts_regional_endpoints to legacy", cfg.Region)
+	case "NoSuchEntity":
+		return "check role_arn names an existing role"
+	}
+	return "check the plugin configuration"
+}
+
+// kindHint returns the general remediation of an error kind
+func kindHint(kind errorKind) string {
+	switch kind {
+	case errThrottled:
+		return "AWS is throttling requests; retry later, or allow for it with sts_throttle_wait, sts_rate_limit or the cache"
+	case errExpiredCredentials:
+		return "the base credentials have expired; refresh session_token or configure long-lived credentials"
+	case errUnavailable:
+		return "AWS could not be reached; check network access, proxy settings and endpoint_url"
+	}
+	return ""
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// formatParam selects the credential value format of a request
+	formatParam = "format"
+	// profileParam names the profile of the ini format
+	profileParam = "profile"
+
+	formatJSON              = "json"
+	formatCredentialProcess = "credential_process"
+	formatEnv               = "env"
+	formatINI               = "ini"
+	formatKV                = "kv"
+
+	defaultProfileName = "creddy"
+)
+
+// credentialFormats lists the credential value formats the plugin can emit
+var credentialFormats = []string{formatJSON, formatCredentialProcess, formatEnv, formatINI, formatKV, formatDocker, formatExecCredential, formatK8sSecret, formatCLICache}
+
+// credentialProcessValue is the output of an AWS SDK credential_process,
+// version 1 of the contract. SDKs refresh the credentials shortly before
+// Expiration; AccountId is read by SDKs that support account-based
+// endpoints.
+type credentialProcessValue struct {
+	Version         int    `json:"Version"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+	AccountID       string `json:"AccountId,omitempty"`
+}
+
+// credentialProcessVersion is the credential_process contract version
+const credentialProcessVersion = 1
+
+// Credential value schema versions. v2 adds the account, assumed role and
+// expiration to JSON values.
+const (
+	credentialSchemaV1 = 1
+	credentialSchemaV2 = 2
+
+	// schemaVersionParam selects the schema version of a request
+	schemaVersionParam = "schema_version"
+)
+
+// sessionFormats lists the formats of role session credentials; docker is
+// added for ECR scopes
+var sessionFormats = []string{formatJSON, formatCredentialProcess, formatEnv, formatINI, formatKV, formatK8sSecret, formatCLICache}
+
+// scopeFormats returns the value formats a scope can be issued in
+func scopeFormats(scope string) []string {
+	if strings.HasPrefix(scope, multiScopePrefix) {
+		return []string{formatJSON}
+	}
+	if ct, _, ok := lookupCredentialType(scope); ok {
+		return append([]string{formatJSON}, ct.Formats...)
+	}
+	if isECRScope(scope) {
+		return append(slices.Clone(sessionFormats), formatDocker)
+	}
+	return sessionFormats
+}
+
+// credentialFormat negotiates the value format of a request. The format
+// parameter is a comma-separated list in order of preference, and the first
+// one the scope supports is chosen; without it, the scope's configured
+// format is used if the scope supports it, else JSON.
+func (p *AWSPlugin) credentialFormat(req *sdk.CredentialRequest) (string, error) {
+	supported := scopeFormats(req.Scope)
+
+	if accept := req.Parameters[formatParam]; accept != "" {
+		for _, format := range strings.Split(accept, ",") {
+			format = strings.TrimSpace(format)
+			if !slices.Contains(credentialFormats, format) {
+				return "", fmt.Errorf("unsupported credential format %q: must be one of %s", format, strings.Join(credentialFormats, ", "))
+			}
+			if slices.Contains(supported, format) {
+				return format, nil
+			}
+		}
+		return "", fmt.Errorf("no requested format is supported for %s: supported formats are %s", req.Scope, strings.Join(supported, ", "))
+	}
+
+	if format := p.config.scopeConfig(req.Scope).Format; slices.Contains(supported, format) {
+		return format, nil
+	}
+	return formatJSON, nil
+}
+
+// credentialSchemaVersion returns the schema version of a request's JSON
+// value: the schema_version parameter, else credential_schema_version
+func (p *AWSPlugin) credentialSchemaVersion(req *sdk.CredentialRequest) (int, error) {
+	if v := req.Parameters[schemaVersionParam]; v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil || version < credentialSchemaV1 || version > credentialSchemaV2 {
+			return 0, fmt.Errorf("invalid schema_version %q: must be 1 or 2", v)
+		}
+		return version, nil
+	}
+	if v := p.config.CredentialSchemaVersion.Value; v != 0 {
+		return v, nil
+	}
+	return credentialSchemaV1, nil
+}
+
+// credentialValue builds the JSON credential value in the request's schema
+// version. expiresAt is the expiry reported to Creddy; assumedRoleARN is
+// empty for credentials not vended by AssumeRole.
+func (p *AWSPlugin) credentialValue(req *sdk.CredentialRequest, creds AWSCredentialValue, expiresAt time.Time, assumedRoleARN string) (AWSCredentialValue, error) {
+	if regions := p.config.scopeConfig(req.Scope).Regions; len(regions) > 0 {
+		creds.Regions = regions
+		creds.Endpoints = regionEndpoints(req.Scope, regions)
+	}
+
+	version, err := p.credentialSchemaVersion(req)
+	if err != nil {
+		return AWSCredentialValue{}, err
+	}
+	if version == credentialSchemaV1 {
+		return creds, nil
+	}
+
+	creds.SchemaVersion = version
+	creds.AccountID = p.roleARN.AccountID
+	creds.AssumedRoleARN = assumedRoleARN
+	creds.Expiration = expiresAt.UTC().Format(time.RFC3339)
+	creds.ExpirationEpoch = expiresAt.Unix()
+	return creds, nil
+}
+
+// formatSessionCredentials renders role session credentials for a region
+// in a format
+func (p *AWSPlugin) formatSessionCredentials(format string, req *sdk.CredentialRequest, session *sts.AssumeRoleOutput, region string, expiresAt time.Time) (string, error) {
+	creds := session.Credentials
+	accessKeyID := aws.ToString(creds.AccessKeyId)
+	secretAccessKey := aws.ToString(creds.SecretAccessKey)
+	sessionToken := aws.ToString(creds.SessionToken)
+	expiration := expiresAt.UTC().Format(time.RFC3339)
+
+	var value interface{}
+	switch format {
+	case formatJSON:
+		var assumedRoleARN string
+		if session.AssumedRoleUser != nil {
+			assumedRoleARN = aws.ToString(session.AssumedRoleUser.Arn)
+		}
+		creds, err := p.credentialValue(req, AWSCredentialValue{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
+			SessionToken:    sessionToken,
+			Region:          region,
+		}, expiresAt, assumedRoleARN)
+		if err != nil {
+			return "", err
+		}
+		value = creds
+	case formatCredentialProcess:
+		value = credentialProcessValue{
+			Version:         credentialProcessVersion,
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
+			SessionToken:    sessionToken,
+			Expiration:      expiration,
+			AccountID:       p.roleARN.AccountID,
+		}
+	case formatKV:
+		kv := map[string]string{
+			"access_key_id":     accessKeyID,
+			"secret_access_key": secretAccessKey,
+			"session_token":     sessionToken,
+			"region":            region,
+			"expiration":        expiration,
+		}
+		if regions := p.config.scopeConfig(req.Scope).Regions; len(regions) > 0 {
+			kv["regions"] = strings.Join(regions, ",")
+		}
+		value = kv
+	case formatEnv:
+		return fmt.Sprintf("AWS_ACCESS_KEY_ID=%s\nAWS_SECRET_ACCESS_KEY=%s\nAWS_SESSION_TOKEN=%s\nAWS_REGION=%s\nAWS_CREDENTIAL_EXPIRATION=%s\n",
+			accessKeyID, secretAccessKey, sessionToken, region, expiration), nil
+	case formatINI:
+		profile := req.Parameters[profileParam]
+		if profile == "" {
+			profile = defaultProfileName
+		}
+		if strings.ContainsAny(profile, "[]\n") {
+			return "", fmt.Errorf("invalid profile name %q", profile)
+		}
+		return fmt.Sprintf("[%s]\naws_access_key_id = %s\naws_secret_access_key = %s\naws_session_token = %s\n",
+			profile, accessKeyID, secretAccessKey, sessionToken), nil
+	case formatCLICache:
+		value = cliCacheValue(session, expiresAt)
+	case formatK8sSecret:
+		secret, err := k8sSecret(req, map[string]string{
+			"AWS_ACCESS_KEY_ID":         accessKeyID,
+			"AWS_SECRET_ACCESS_KEY":     secretAccessKey,
+			"AWS_SESSION_TOKEN":         sessionToken,
+			"AWS_REGION":                region,
+			"AWS_CREDENTIAL_EXPIRATION": expiration,
+		}, expiration)
+		if err != nil {
+			return "", err
+		}
+		value = secret
+	default:
+		return "", fmt.Errorf("unsupported credential format %q", format)
+	}
+
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal credential: %w", err)
+	}
+	return string(valueJSON), nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// healthPath is where the metrics listener serves the health report
+	healthPath = "/health"
+
+	// healthCheckInterval is how long a check of the base credentials is
+	// reused by health reports, bounding the STS calls they make
+	healthCheckInterval = 30 * time.Second
+
+	// healthCheckTimeout bounds a check of the base credentials
+	healthCheckTimeout = 10 * time.Second
+)
+
+// Health statuses: degraded still serves requests, unhealthy cannot
+const (
+	healthOK        = "ok"
+	healthDegraded  = "degraded"
+	healthUnhealthy = "unhealthy"
+)
+
+// healthStats tracks the outcomes behind the health report for the current
+// configuration
+type healthStats struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	baseErr   error
+	scopes    map[string]*scopeHealth
+
+	// checkMu lets one report at a time refresh the check
+	checkMu sync.Mutex
+}
+
+// scopeHealth is the outcome of the AssumeRole calls of a scope
+type scopeHealth struct {
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// healthReport is the body of the health endpoint
+type healthReport struct {
+	Status           string                 `json:"status"`
+	Reasons          []string               `json:"reasons,omitempty"`
+	BaseCredentials  baseCredentialsHealth  `json:"base_credentials"`
+	Scopes           map[string]scopeHealth `json:"scopes,omitempty"`
+	Cache            cacheHealth            `json:"cache"`
+	ClockSkewSeconds float64                `json:"clock_skew_seconds"`
+	CircuitBreakers  map[string]string      `json:"circuit_breakers,omitempty"`
+}
+
+type baseCredentialsHealth struct {
+	Valid     bool       `json:"valid"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type cacheHealth struct {
+	Enabled bool  `json:"enabled"`
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// reset forgets the outcomes of the previous configuration
+func (h *healthStats) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checkedAt, h.baseErr, h.scopes = time.Time{}, nil, nil
+}
+
+// recordBaseCheck records a check of the base credentials
+func (h *healthStats) recordBaseCheck(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checkedAt, h.baseErr = time.Now(), err
+}
+
+// recordAssumeRole records the outcome of an AssumeRole call for a scope,
+// bounding how many scopes are tracked
+func (h *healthStats) recordAssumeRole(scope string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.scopes == nil {
+		h.scopes = make(map[string]*scopeHealth)
+	}
+	s, ok := h.scopes[scope]
+	if !ok {
+		if len(h.scopes) >= maxMetricScopes {
+			return
+		}
+		s = &scopeHealth{}
+		h.scopes[scope] = s
+	}
+	now := time.Now()
+	if err != nil {
+		s.LastFailure, s.LastError = &now, redactError(err).Error()
+	} else {
+		s.LastSuccess = &now
+	}
+}
+
+// checkBaseCredentials checks the base credentials with GetCallerIdentity
+// and records the outcome
+func (p *AWSPlugin) checkBaseCredentials(ctx context.Context) error {
+	err := p.verifyCallerIdentity(ctx)
+	if ctx.Err() == nil {
+		p.health.recordBaseCheck(err)
+	}
+	return err
+}
+
+// healthReport reports the plugin's health, checking the base credentials
+// again if the last check is older than healthCheckInterval
+func (p *AWSPlugin) healthReport(ctx context.Context) healthReport {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.config == nil {
+		return healthReport{Status: healthUnhealthy, Reasons: []string{"plugin is not configured"}}
+	}
+
+	p.health.mu.Lock()
+	stale := time.Since(p.health.checkedAt) > healthCheckInterval
+	p.health.mu.Unlock()
+	if stale && p.health.checkMu.TryLock() {
+		ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		p.checkBaseCredentials(ctx)
+		cancel()
+		p.health.checkMu.Unlock()
+	}
+
+	report := healthReport{Status: healthOK, ClockSkewSeconds: p.clock.get().Seconds()}
+	p.health.mu.Lock()
+	if !p.health.checkedAt.IsZero() {
+		checkedAt := p.health.checkedAt
+		report.BaseCredentials = baseCredentialsHealth{Valid: p.health.baseErr == nil, CheckedAt: &checkedAt}
+		if p.health.baseErr != nil {
+			report.BaseCredentials.Error = redactError(p.health.baseErr).Error()
+		}
+	}
+	if len(p.health.scopes) > 0 {
+		report.Scopes = make(map[string]scopeHealth, len(p.health.scopes))
+	}
+	var failing []string
+	for scope, s := range p.health.scopes {
+		report.Scopes[scope] = *s
+		if s.LastFailure != nil && (s.LastSuccess == nil || s.LastFailure.After(*s.LastSuccess)) {
+			failing = append(failing, scope)
+		}
+	}
+	p.health.mu.Unlock()
+
+	switch {
+	case report.BaseCredentials.CheckedAt == nil:
+		report.Reasons = append(report.Reasons, "base credentials have not been checked yet")
+	case !report.BaseCredentials.Valid:
+		report.Status = healthUnhealthy
+		report.Reasons = append(report.Reasons, "base credentials are not valid")
+	}
+	sort.Strings(failing)
+	for _, scope := range failing {
+		report.Reasons = append(report.Reasons, "AssumeRole is failing for scope "+scope)
+	}
+	if skew := p.clock.get(); skew.Abs() > clockSkewWarning {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("local clock is skewed from AWS by %s", skew.Round(time.Second)))
+	}
+	for _, b := range []*circuitBreaker{p.config.stsBreaker, p.config.iamBreaker} {
+		if b == nil {
+			continue
+		}
+		if report.CircuitBreakers == nil {
+			report.CircuitBreakers = make(map[string]string)
+		}
+		state := b.currentState()
+		report.CircuitBreakers[strings.ToLower(b.service)] = state.String()
+		if state != circuitClosed {
+			report.Reasons = append(report.Reasons, b.service+" circuit breaker is "+state.String())
+		}
+	}
+	if report.Status == healthOK && len(report.Reasons) > 0 {
+		report.Status = healthDegraded
+	}
+
+	if p.cache != nil {
+		report.Cache.Enabled = true
+		for _, n := range p.cache.scopeCounts() {
+			report.Cache.Entries += n
+		}
+	}
+	report.Cache.Hits = int64(p.metrics.counter(series("creddy_aws_cache_requests_total", "result", "hit")))
+	report.Cache.Misses = int64(p.metrics.counter(series("creddy_aws_cache_requests_total", "result", "miss")))
+	return report
+}
+
+// serveHealth writes the health report as JSON, with status 503 when the
+// plugin is unhealthy
+func (p *AWSPlugin) serveHealth(w http.ResponseWriter, r *http.Request) {
+	report := p.healthReport(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status == healthUnhealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// newHTTPClient builds the HTTP client of the plugin's AWS API calls from
+// the proxy, TLS and timeout settings
+func newHTTPClient(c *AWSConfig) (aws.HTTPClient, error) {
+	if err := validateProxies(c); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := awsTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	proxy := proxyFunc(c)
+	client := awshttp.NewBuildableClient()
+	if c.RequirePrivateLink.Value {
+		// Proxies from the environment would hide where calls go
+		proxy = nil
+		client = client.WithDialerOptions(withPrivateLink)
+	}
+	client = client.WithTransportOptions(func(tr *http.Transport) {
+		tr.Proxy = proxy
+		if tlsConfig != nil {
+			tr.TLSClientConfig = tlsConfig
+		}
+	})
+	if timeout := time.Duration(c.APITimeout); timeout > 0 {
+		client = client.WithTimeout(timeout)
+	}
+	return client, nil
+}
+
+// httpTransport returns the transport of the configured HTTP client: its
+// proxy, TLS and PrivateLink settings without its api_timeout, for requests
+// streamed by the signing proxy
+func (p *AWSPlugin) httpTransport() http.RoundTripper {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.config != nil {
+		if client, ok := p.config.httpClient.(*awshttp.BuildableClient); ok {
+			return client.GetTransport()
+		}
+	}
+	return http.DefaultTransport
+}
+
+// doHTTP sends a request the SDK clients do not make, such as to the console
+// federation endpoint, through the configured HTTP client, traced and timed
+// like their calls. Responses with an error status count as failed calls.
+func (p *AWSPlugin) doHTTP(ctx context.Context, service, operation string, req *http.Request) (*http.Response, error) {
+	var span trace.Span
+	if p.config.tracing != nil {
+		ctx, span = p.config.tracing.startCall(ctx, service, operation, "")
+		req = req.WithContext(ctx)
+	}
+	start := time.Now()
+	resp, err := p.config.httpClient.Do(req)
+	callErr := err
+	if err == nil && resp.StatusCode >= 400 {
+		callErr = fmt.Errorf("%s %s returned %s", service, operation, resp.Status)
+	}
+	if p.config.metrics != nil {
+		p.config.metrics.observeCall(service, operation, start, callErr)
+	}
+	if span != nil {
+		endSpan(span, callErr)
+	}
+	return resp, err
+}
+
+// validateRetryPolicy checks api_timeout, max_attempts and retry_mode
+func validateRetryPolicy(c *AWSConfig) error {
+	if c.APITimeout < 0 {
+		return fmt.Errorf("api_timeout must not be negative")
+	}
+	if c.MaxAttempts.Value < 0 {
+		return fmt.Errorf("max_attempts must not be negative")
+	}
+	if c.RetryMode != "" {
+		if _, err := aws.ParseRetryMode(c.RetryMode); err != nil {
+			return fmt.Errorf("invalid retry_mode %q (expected standard or adaptive)", c.RetryMode)
+		}
+	}
+	return nil
+}
+
+// tlsVersions maps tls_min_version values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// awsTLSConfig returns the TLS settings of AWS calls, or nil for the
+// defaults: the system roots, TLS 1.2 and later
+func awsTLSConfig(c *AWSConfig) (*tls.Config, error) {
+	if c.CABundle == "" && c.TLSMinVersion == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSMinVersion != "" {
+		version, ok := tlsVersions[c.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls_min_version %q (expected 1.2 or 1.3)", c.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if c.CABundle != "" {
+		pool, err := caBundlePool(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ca_bundle: %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// caBundlePool returns the system roots plus the certificates of a CA
+// bundle, given as PEM or as the path of a PEM file
+func caBundlePool(bundle string) (*x509.CertPool, error) {
+	data := []byte(bundle)
+	if !strings.Contains(bundle, "-----BEGIN") {
+		var err error
+		if data, err = os.ReadFile(bundle); err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return pool, nil
+}
+
+// proxyFunc returns the proxy selection of AWS calls. When any proxy
+// setting is configured, only the settings are used, not the process
+// environment; otherwise HTTP_PROXY, HTTPS_PROXY and NO_PROXY apply.
+func proxyFunc(c *AWSConfig) func(*http.Request) (*url.URL, error) {
+	if c.HTTPProxy == "" && c.HTTPSProxy == "" && c.NoProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	proxy := (&httpproxy.Config{
+		HTTPProxy:  c.HTTPProxy,
+		HTTPSProxy: c.HTTPSProxy,
+		NoProxy:    c.NoProxy,
+	}).ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxy(r.URL)
+	}
+}
+
+// validateProxies checks http_proxy and https_proxy
+func validateProxies(c *AWSConfig) error {
+	for name, proxy := range map[string]string{"http_proxy": c.HTTPProxy, "https_proxy": c.HTTPSProxy} {
+		if proxy == "" {
+			continue
+		}
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("invalid %s %q: expected an http, https or socks5 URL", name, proxy)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("invalid %s %q: no host", name, proxy)
+		}
+	}
+	return nil
+}
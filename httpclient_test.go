@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	f := newFakeAWS(t, false)
+	tests := []struct {
+		name      string
+		extra     string
+		wantProxy string
+		wantDial  string
+	}{
+		{name: "proxy", extra: `,"https_proxy":"http://proxy.example.com:3128"`, wantProxy: "http://proxy.example.com:3128"},
+		{name: "private link", extra: `,"require_private_link":true`, wantDial: "public address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &AWSPlugin{}
+			if err := p.Configure(context.Background(), f.config(tt.extra)); err != nil {
+				t.Fatalf("Configure: %v", err)
+			}
+			defer p.Shutdown(context.Background())
+
+			tr, ok := p.httpTransport().(*http.Transport)
+			if !ok || tr == http.DefaultTransport {
+				t.Fatalf("httpTransport = %T, want a transport built from the settings", p.httpTransport())
+			}
+			req, _ := http.NewRequest(http.MethodGet, "https://s3.us-east-1.amazonaws.com/", nil)
+			var proxy string
+			if tr.Proxy != nil {
+				if u, err := tr.Proxy(req); err == nil && u != nil {
+					proxy = u.String()
+				}
+			}
+			if proxy != tt.wantProxy {
+				t.Errorf("proxy = %q, want %q", proxy, tt.wantProxy)
+			}
+			if tt.wantDial != "" {
+				_, err := tr.DialContext(context.Background(), "tcp", "203.0.113.1:443")
+				if err == nil || !strings.Contains(err.Error(), tt.wantDial) {
+					t.Errorf("dialing a public address = %v, want an error naming a %s", err, tt.wantDial)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// issuanceWindow returns the same credential for identical requests from the
+// same agent made within a short window, instead of minting a new session
+// for each
+type issuanceWindow struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]windowEntry
+}
+
+type windowEntry struct {
+	cred     *sdk.Credential
+	issuedAt time.Time
+}
+
+func newIssuanceWindow(window time.Duration) *issuanceWindow {
+	return &issuanceWindow{window: window, entries: make(map[string]windowEntry)}
+}
+
+// requestKey identifies identical requests from the same agent
+func requestKey(cacheKey string, req *sdk.CredentialRequest) string {
+	return fmt.Sprintf("%s\x00%s\x00%d", cacheKey, req.Agent.ID, req.TTL)
+}
+
+// get returns a copy of the credential issued for key within the window
+func (w *issuanceWindow) get(key string) *sdk.Credential {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry, ok := w.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Since(entry.issuedAt) >= w.window || !time.Now().Before(entry.cred.ExpiresAt) {
+		delete(w.entries, key)
+		return nil
+	}
+	return copyCredential(entry.cred)
+}
+
+// put records a credential issued for key, dropping entries outside the
+// window
+func (w *issuanceWindow) put(key string, cred *sdk.Credential) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for k, entry := range w.entries {
+		if time.Since(entry.issuedAt) >= w.window {
+			delete(w.entries, k)
+		}
+	}
+	w.entries[key] = windowEntry{cred: copyCredential(cred), issuedAt: time.Now()}
+}
+
+// evict drops the credential with the given external ID
+func (w *issuanceWindow) evict(externalID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for k, entry := range w.entries {
+		if entry.cred.Credential == externalID {
+			delete(w.entries, k)
+		}
+	}
+}
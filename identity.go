@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// chainedSessionLimit is the STS cap on sessions assumed with role session
+// credentials
+const chainedSessionLimit = time.Hour
+
+// baseIdentity caches the identity of the plugin's base credentials
+type baseIdentity struct {
+	mu        sync.Mutex
+	fetchedAt time.Time
+	arn       string
+	account   string
+}
+
+// callerIdentity returns the ARN and account of the base credentials, from
+// sts:GetCallerIdentity. Empty values mean the identity could not be read.
+func (p *AWSPlugin) callerIdentity(ctx context.Context) (string, string) {
+	id := p.identity
+	id.mu.Lock()
+	defer id.mu.Unlock()
+
+	if !id.fetchedAt.IsZero() && time.Since(id.fetchedAt) < roleInfoTTL {
+		return id.arn, id.account
+	}
+	id.fetchedAt = time.Now()
+
+	client, err := p.createSTSClient(ctx)
+	if err != nil {
+		return id.arn, id.account
+	}
+	out, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		sdk.Warn("failed to read identity of base credentials", "error", err)
+		return id.arn, id.account
+	}
+	p.clock.observe(out.ResultMetadata)
+	id.arn = aws.ToString(out.Arn)
+	id.account = aws.ToString(out.Account)
+
+	if err := p.checkCallerPartition(id.arn); err != nil {
+		sdk.Warn("MISCONFIGURATION: "+err.Error(), "caller", id.arn, "role", p.config.RoleARN)
+	} else if id.account != p.roleARN.AccountID {
+		sdk.Debug("assuming role in another account", "caller_account", id.account, "role_account", p.roleARN.AccountID)
+	}
+	return id.arn, id.account
+}
+
+// checkCallerPartition checks the base credentials are in the role's
+// partition; roles cannot be assumed across partitions
+func (p *AWSPlugin) checkCallerPartition(callerARN string) error {
+	parsed, err := arn.Parse(callerARN)
+	if err != nil {
+		return nil
+	}
+	if parsed.Partition != p.roleARN.Partition {
+		return fmt.Errorf("base credentials are in partition %s but role_arn is in partition %s", parsed.Partition, p.roleARN.Partition)
+	}
+	return nil
+}
+
+// verifyCallerIdentity checks the base credentials with GetCallerIdentity,
+// and that they can assume roles of the role's partition
+func (p *AWSPlugin) verifyCallerIdentity(ctx context.Context) error {
+	client, err := p.createSTSClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create STS client: %w", err)
+	}
+
+	identity, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil && p.clock.observeError(err) {
+		identity, err = client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to validate AWS credentials: %w", err)
+	}
+	p.clock.observe(identity.ResultMetadata)
+	return p.checkCallerPartition(aws.ToString(identity.Arn))
+}
+
+// parseRoleARN parses and checks the configured role ARN
+func parseRoleARN(roleARN string) (arn.ARN, error) {
+	parsed, err := arn.Parse(roleARN)
+	if err != nil {
+		return arn.ARN{}, fmt.Errorf("invalid role_arn: %w", err)
+	}
+	if parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+		return arn.ARN{}, fmt.Errorf("role_arn is not an IAM role ARN: %s", roleARN)
+	}
+	return parsed, nil
+}
+
+// regionPartition returns the partition a region belongs to
+func regionPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "us-isob-"):
+		return "aws-iso-b"
+	case strings.HasPrefix(region, "us-iso-"):
+		return "aws-iso"
+	case strings.HasPrefix(region, "eu-isoe-"):
+		return "aws-iso-e"
+	case strings.HasPrefix(region, "us-isof-"):
+		return "aws-iso-f"
+	default:
+		return "aws"
+	}
+}
+
+// chainedRole reports whether the base credentials are themselves a role
+// session, making every AssumeRole a role chain
+func (p *AWSPlugin) chainedRole(ctx context.Context) bool {
+	callerARN, _ := p.callerIdentity(ctx)
+	parsed, err := arn.Parse(callerARN)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(parsed.Resource, "assumed-role/")
+}
+
+// sessionLimit returns the longest session the role can be assumed for and
+// a description of the limit
+func (p *AWSPlugin) sessionLimit(ctx context.Context) (time.Duration, string) {
+	max := p.roleMaxSessionDuration(ctx)
+	if max > complianceMaxTTL && p.config.ComplianceMode != "" {
+		return complianceMaxTTL, "the 1h limit of compliance_mode " + p.config.ComplianceMode
+	}
+	if max > chainedSessionLimit && p.chainedRole(ctx) {
+		return chainedSessionLimit, "the 1h limit on role chaining (the base credentials are a role session)"
+	}
+	return max, "the MaxSessionDuration of " + formatDuration(max) + " on role " + p.config.RoleARN
+}
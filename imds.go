@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// imdsCommand is the subcommand that runs a local EC2 instance metadata
+	// service (IMDS) serving creddy credentials
+	imdsCommand = "imds"
+
+	defaultIMDSListen   = "127.0.0.1:8169"
+	defaultIMDSRoleName = "creddy"
+
+	// imdsMaxTokenTTL is the longest IMDSv2 session token EC2 issues
+	imdsMaxTokenTTL = 6 * time.Hour
+
+	// imdsMaxTokens bounds the live session tokens kept; past it, the token
+	// expiring soonest is dropped
+	imdsMaxTokens = 1024
+
+	imdsTokenHeader    = "X-aws-ec2-metadata-token"
+	imdsTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+
+	imdsCredentialsPath = "/latest/meta-data/iam/security-credentials/"
+	imdsRegionPath      = "/latest/meta-data/placement/region"
+	imdsTokenPath       = "/latest/api/token"
+)
+
+// imdsCredentials is the IMDS security-credentials document read by the AWS
+// SDKs' instance profile providers
+type imdsCredentials struct {
+	Code            string `json:"Code"`
+	LastUpdated     string `json:"LastUpdated"`
+	Type            string `json:"Type"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+}
+
+// imdsServer serves the credential paths of the instance metadata service,
+// with IMDSv2 session tokens and, if allowed, IMDSv1
+type imdsServer struct {
+	roleName      string
+	tokenRequired bool
+	refresher     *credentialRefresher
+
+	mu     sync.Mutex
+	tokens map[string]time.Time
+}
+
+// runIMDSServer runs a local IMDS endpoint serving credentials for a scope.
+// Point SDKs at it with AWS_EC2_METADATA_SERVICE_ENDPOINT.
+func runIMDSServer(ctx context.Context, p *AWSPlugin, args []string) error {
+	fs := flag.NewFlagSet(imdsCommand, flag.ContinueOnError)
+	buildRequest := addHelperFlags(fs, imdsCommand)
+	listen := fs.String("listen", defaultIMDSListen, "Loopback address to serve the metadata endpoint on")
+	roleName := fs.String("role-name", defaultIMDSRoleName, "Instance profile role name reported under iam/security-credentials/")
+	tokenRequired := fs.Bool("imdsv2-only", true, "Require IMDSv2 session tokens; false also serves IMDSv1")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	hr, err := buildRequest()
+	if err != nil {
+		return err
+	}
+	if err := checkIMDSListen(*listen); err != nil {
+		return err
+	}
+
+	s := &imdsServer{
+		roleName:      *roleName,
+		tokenRequired: *tokenRequired,
+		refresher:     newCredentialRefresher(p, hr),
+		tokens:        make(map[string]time.Time),
+	}
+	return serveCredentials(ctx, imdsCommand, *listen, s.refresher, s, nil)
+}
+
+// checkIMDSListen allows loopback addresses, and addresses such as
+// 169.254.169.254 added to a loopback interface
+func checkIMDSListen(listen string) error {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid --listen: %w", err)
+	}
+	if checkLoopbackListen(listen) == nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && onLoopbackInterface(ip) {
+		return nil
+	}
+	return fmt.Errorf("--listen must be a loopback address, or an address of a loopback interface")
+}
+
+// onLoopbackInterface reports whether an address is assigned to a loopback
+// interface
+func onLoopbackInterface(ip net.IP) bool {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *imdsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == imdsTokenPath {
+		s.serveToken(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch path := r.URL.Path; {
+	case path == imdsCredentialsPath || path == strings.TrimSuffix(imdsCredentialsPath, "/"):
+		w.Write([]byte(s.roleName))
+	case path == imdsCredentialsPath+s.roleName:
+		creds, err := s.refresher.get(r.Context())
+		if err != nil {
+			sdk.Error("failed to get credentials", "server", imdsCommand, "error", err)
+			http.Error(w, "credentials unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(imdsCredentials{
+			Code:            "Success",
+			LastUpdated:     creds.LastUpdated.Format(time.RFC3339),
+			Type:            "AWS-HMAC",
+			AccessKeyID:     creds.AccessKeyID,
+			SecretAccessKey: creds.SecretAccessKey,
+			Token:           creds.SessionToken,
+			Expiration:      creds.Expiration.UTC().Format(time.RFC3339),
+		})
+	case path == imdsRegionPath:
+		creds, err := s.refresher.get(r.Context())
+		if err != nil || creds.Region == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(creds.Region))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveToken issues an IMDSv2 session token. Like EC2, it refuses requests
+// that went through a proxy, so tokens cannot be obtained from off the host.
+func (s *imdsServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("X-Forwarded-For") != "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	seconds, err := strconv.Atoi(r.Header.Get(imdsTokenTTLHeader))
+	if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > imdsMaxTokenTTL {
+		http.Error(w, "invalid token TTL", http.StatusBadRequest)
+		return
+	}
+
+	token := newServerToken()
+	now := time.Now()
+	s.mu.Lock()
+	for t, expiresAt := range s.tokens {
+		if now.After(expiresAt) {
+			delete(s.tokens, t)
+		}
+	}
+	if len(s.tokens) >= imdsMaxTokens {
+		var soonest string
+		for t, expiresAt := range s.tokens {
+			if soonest == "" || expiresAt.Before(s.tokens[soonest]) {
+				soonest = t
+			}
+		}
+		delete(s.tokens, soonest)
+	}
+	s.tokens[token] = now.Add(time.Duration(seconds) * time.Second)
+	s.mu.Unlock()
+
+	w.Header().Set(imdsTokenTTLHeader, strconv.Itoa(seconds))
+	w.Write([]byte(token))
+}
+
+// authorized checks a request's IMDSv2 session token. Requests without one
+// are IMDSv1 requests, allowed unless tokens are required.
+func (s *imdsServer) authorized(r *http.Request) bool {
+	token := r.Header.Get(imdsTokenHeader)
+	if token == "" {
+		return !s.tokenRequired
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt, ok := s.tokens[token]
+	return ok && time.Now().Before(expiresAt)
+}
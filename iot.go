@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// iotCredentialsResponse is the credentials provider response body
+type iotCredentialsResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `json:"accessKeyId"`
+		SecretAccessKey string    `json:"secretAccessKey"`
+		SessionToken    string    `json:"sessionToken"`
+		Expiration      time.Time `json:"expiration"`
+	} `json:"credentials"`
+}
+
+// newIoTClient builds the mutual-TLS client used to call the IoT credentials
+// provider with the configured device certificate
+func newIoTClient(cfg *AWSConfig) (*http.Client, error) {
+	if cfg.IoTCertificate == "" || cfg.IoTPrivateKey == "" {
+		return nil, fmt.Errorf("iot_certificate and iot_private_key are required with iot_credentials_endpoint")
+	}
+
+	cert, err := tls.X509KeyPair([]byte(cfg.IoTCertificate), []byte(cfg.IoTPrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid iot_certificate/iot_private_key: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if version, ok := tlsVersions[cfg.TLSMinVersion]; ok {
+		tlsConfig.MinVersion = version
+	}
+	if cfg.IoTCACertificate != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.IoTCACertificate)) {
+			return nil, fmt.Errorf("invalid iot_ca_certificate: no certificates found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: proxyFunc(cfg)},
+	}, nil
+}
+
+// issueIoTCredential exchanges the device certificate for AWS credentials
+// through an IoT role alias. The "thing_name" request parameter overrides the
+// configured iot_thing_name. Session duration is set on the role alias.
+func (p *AWSPlugin) issueIoTCredential(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	if p.iotClient == nil {
+		return nil, fmt.Errorf("iot_credentials_endpoint must be configured for iot scopes")
+	}
+	if resource == "" {
+		return nil, fmt.Errorf("invalid iot scope: %s (expected aws:iot:<role-alias>)", req.Scope)
+	}
+
+	endpoint := fmt.Sprintf("https://%s/role-aliases/%s/credentials", p.config.IoTCredentialsEndpoint, url.PathEscape(resource))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build iot credentials request: %w", err)
+	}
+
+	thingName := p.config.IoTThingName
+	if name := req.Parameters["thing_name"]; name != "" {
+		thingName = name
+	}
+	if thingName != "" {
+		httpReq.Header.Set("x-amzn-iot-thingname", thingName)
+	}
+
+	resp, err := p.iotClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call iot credentials provider: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read iot credentials response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errBody struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &errBody)
+		return nil, fmt.Errorf("iot credentials provider returned %s: %s", resp.Status, errBody.Message)
+	}
+
+	var result iotCredentialsResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("invalid iot credentials response: %w", err)
+	}
+
+	value, err := p.credentialValue(req, AWSCredentialValue{
+		AccessKeyID:     result.Credentials.AccessKeyID,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		Region:          region,
+	}, p.withExpiryMargin(result.Credentials.Expiration), "")
+	if err != nil {
+		return nil, err
+	}
+	credJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := map[string]string{
+		"role_alias": resource,
+		"region":     region,
+		"scope":      req.Scope,
+	}
+	if thingName != "" {
+		metadata["thing_name"] = thingName
+	}
+
+	return &sdk.Credential{
+		Value:     string(credJSON),
+		ExpiresAt: result.Credentials.Expiration,
+		Metadata:  metadata,
+	}, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const defaultLedgerRetention = 7 * 24 * time.Hour
+
+// janitorStats counts cleanup activity over the life of the process
+type janitorStats struct {
+	Runs                 atomic.Int64
+	RevocationsRemoved   atomic.Int64
+	GrantsRetired        atomic.Int64
+	LedgerEntriesPruned  atomic.Int64
+	Errors               atomic.Int64
+	LastRunUnix          atomic.Int64
+	LastRunDurationNanos atomic.Int64
+}
+
+// janitor periodically removes state left behind by revocation and
+// expiry: expired revocation statements, grants Creddy never revoked, and
+// old ledger entries
+type janitor struct {
+	interval  time.Duration
+	retention time.Duration
+	stop      chan struct{}
+}
+
+// startJanitor starts the background cleanup
+func (p *AWSPlugin) startJanitor(interval, retention time.Duration) *janitor {
+	j := &janitor{interval: interval, retention: retention, stop: make(chan struct{})}
+	go p.runJanitor(j)
+	return j
+}
+
+func (j *janitor) close() {
+	close(j.stop)
+}
+
+func (p *AWSPlugin) runJanitor(j *janitor) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			p.runCleanup(j)
+		}
+	}
+}
+
+// runCleanup runs one pass of a janitor that is still the current one
+func (p *AWSPlugin) runCleanup(j *janitor) {
+	defer recoverLogged("janitor")
+	p.mu.RLock()
+	ledger := p.ledger
+	current := p.janitor == j
+	p.mu.RUnlock()
+	if !current {
+		// Replaced by a reconfiguration
+		return
+	}
+	p.cleanup(j, ledger)
+}
+
+// janitorStep runs one AWS call of a janitor pass under the read lock, with
+// the budget of a request, unless the janitor was replaced. The lock is not
+// held across the pass, so a pending Configure, and the requests queued
+// behind it, only wait for one call.
+func (p *AWSPlugin) janitorStep(j *janitor, fn func(ctx context.Context)) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.janitor != j {
+		return false
+	}
+	ctx, cancel := p.requestContext(context.Background())
+	defer cancel()
+	fn(ctx)
+	return true
+}
+
+// cleanup runs one pass of the janitor
+func (p *AWSPlugin) cleanup(j *janitor, ledger ledgerStore) {
+	start := time.Now()
+	stats := &p.janitorStats
+	stats.Runs.Add(1)
+
+	var removed int
+	p.janitorStep(j, func(ctx context.Context) {
+		var err error
+		if removed, err = p.cleanupRevocations(ctx); err != nil {
+			stats.Errors.Add(1)
+			sdk.Warn("janitor failed to clean up revocation policy", "error", err)
+		}
+	})
+	stats.RevocationsRemoved.Add(int64(removed))
+
+	var retired, pruned int
+	if ledger != nil {
+		retired, pruned = p.cleanupLedger(j, ledger)
+	}
+
+	stats.LastRunUnix.Store(start.Unix())
+	stats.LastRunDurationNanos.Store(int64(time.Since(start)))
+	if removed+retired+pruned > 0 {
+		sdk.Info("janitor cleaned up",
+			"revocations_removed", removed, "grants_retired", retired, "ledger_entries_pruned", pruned,
+			"total_revocations_removed", stats.RevocationsRemoved.Load(),
+			"total_grants_retired", stats.GrantsRetired.Load(),
+			"total_ledger_entries_pruned", stats.LedgerEntriesPruned.Load(),
+			"total_errors", stats.Errors.Load())
+	}
+}
+
+// cleanupLedger retires KMS grants that outlived their credential and
+// deletes entries that expired longer than retention ago. The ledger is
+// listed and pruned without the lock, as it needs nothing else of the
+// configuration.
+func (p *AWSPlugin) cleanupLedger(j *janitor, ledger ledgerStore) (retired, pruned int) {
+	stats := &p.janitorStats
+
+	ctx, cancel := context.WithTimeout(context.Background(), j.interval)
+	defer cancel()
+	entries, err := ledger.List(ctx)
+	if err != nil {
+		stats.Errors.Add(1)
+		sdk.Warn("janitor failed to list ledger", "error", err)
+		return 0, 0
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.ExpiresAt.After(now) {
+			continue
+		}
+
+		// Grants do not expire on their own
+		if entry.RevokedAt == nil && strings.HasPrefix(entry.ID, kmsGrantExternalIDPrefix) {
+			var err error
+			current := p.janitorStep(j, func(ctx context.Context) {
+				grantID, keyID, region, _ := parseKMSGrantExternalID(entry.ID)
+				if err = p.retireKMSGrant(ctx, keyID, grantID, region); err == nil {
+					p.markRevoked(ctx, entry)
+				}
+			})
+			if !current {
+				return retired, pruned
+			}
+			if err != nil {
+				stats.Errors.Add(1)
+				sdk.Warn("janitor failed to retire expired kms grant", "id", entry.ID, "error", err)
+				continue
+			}
+			retired++
+			stats.GrantsRetired.Add(1)
+		}
+
+		if now.Sub(entry.retainedFrom()) > j.retention {
+			if err := ledger.Delete(ctx, entry.ID); err != nil {
+				stats.Errors.Add(1)
+				sdk.Warn("janitor failed to prune ledger entry", "id", entry.ID, "error", err)
+				continue
+			}
+			pruned++
+			stats.LedgerEntriesPruned.Add(1)
+		}
+	}
+	return retired, pruned
+}
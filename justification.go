@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// justificationParam is the request parameter saying why credentials
+	// are needed
+	justificationParam = "justification"
+
+	// maxJustificationLength is the STS limit on session tag values, so a
+	// justification fits its tag whole
+	maxJustificationLength = 256
+
+	// justificationTagKey is the session tag carrying the justification
+	justificationTagKey = "creddy:justification"
+)
+
+// disallowedTagChars are the characters STS does not allow in tag values
+var disallowedTagChars = regexp.MustCompile(`[^\p{L}\p{Z}\p{N}_.:/=+\-@]`)
+
+// truncateTagValue cuts a tag value to the STS limit, which counts
+// characters rather than bytes
+func truncateTagValue(value string) string {
+	if utf8.RuneCountInString(value) <= maxJustificationLength {
+		return value
+	}
+	return string([]rune(value)[:maxJustificationLength])
+}
+
+// requestJustification returns the justification of a request, if any
+func requestJustification(req *sdk.CredentialRequest) string {
+	return strings.TrimSpace(req.Parameters[justificationParam])
+}
+
+// checkJustification rejects requests without a justification for scopes
+// requiring one, including the parts of aws:multi bundles
+func (p *AWSPlugin) checkJustification(req *sdk.CredentialRequest) error {
+	justification := requestJustification(req)
+	if utf8.RuneCountInString(justification) > maxJustificationLength {
+		return fmt.Errorf("justification is longer than %d characters", maxJustificationLength)
+	}
+	if justification != "" {
+		return nil
+	}
+	for _, scope := range requestedScopes(req.Scope) {
+		if p.config.scopeConfig(scope).RequireJustification {
+			return &pluginError{
+				kind: errAccessDenied,
+				msg:  "scope " + scope + " requires a justification",
+				hint: "set the justification parameter to why the credentials are needed",
+			}
+		}
+	}
+	return nil
+}
+
+// addJustification tags the session of a scope requiring a justification
+// with it, and sets its source identity to the requester and the
+// justification, which CloudTrail records on every call of the session and
+// of the sessions chained from it
+func addJustification(input *sts.AssumeRoleInput, requester, justification string) {
+	input.Tags = append(input.Tags, ststypes.Tag{
+		Key:   aws.String(justificationTagKey),
+		Value: aws.String(disallowedTagChars.ReplaceAllString(justification, "_")),
+	})
+	if requester == "" {
+		requester = userAgentProduct
+	}
+	input.SourceIdentity = aws.String(normalizeSessionName(requester + "@" + justification))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// keyspacesPort is the TLS port of the Amazon Keyspaces service endpoint
+const keyspacesPort = 9142
+
+// KeyspacesCredentialValue is the credential value returned for
+// aws:keyspaces scopes. It carries the signing material expected by the
+// Cassandra SigV4 authentication plugins along with the contact point.
+type KeyspacesCredentialValue struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+	Region          string `json:"region"`
+	ContactPoint    string `json:"contact_point"`
+	Port            int    `json:"port"`
+	Keyspace        string `json:"keyspace"`
+}
+
+// issueKeyspacesCredential packages assumed-role credentials for the
+// Cassandra SigV4 auth plugin
+func (p *AWSPlugin) issueKeyspacesCredential(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	if resource == "" {
+		return nil, fmt.Errorf("invalid keyspaces scope: %s (expected aws:keyspaces:<keyspace>)", req.Scope)
+	}
+
+	creds, err := p.assumeRole(ctx, req.Scope, sessionDurationSeconds(req.TTL))
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := json.Marshal(KeyspacesCredentialValue{
+		AccessKeyID:     *creds.AccessKeyId,
+		SecretAccessKey: *creds.SecretAccessKey,
+		SessionToken:    *creds.SessionToken,
+		Region:          region,
+		ContactPoint:    fmt.Sprintf("cassandra.%s.amazonaws.com", region),
+		Port:            keyspacesPort,
+		Keyspace:        resource,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["keyspace"] = resource
+
+	return &sdk.Credential{
+		Value:     string(value),
+		ExpiresAt: *creds.Expiration,
+		Metadata:  metadata,
+	}, nil
+}
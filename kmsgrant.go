@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// kmsGrantExternalIDPrefix marks revocation IDs of KMS grants; the full
+	// form is "kms-grant:<grant-id>@<region>:<key-id>"
+	kmsGrantExternalIDPrefix = "kms-grant:"
+
+	// kmsGrantSessionSeconds is the duration of the role session creating or
+	// retiring a grant, which only lasts for the call
+	kmsGrantSessionSeconds = int32(minSessionDuration / time.Second)
+)
+
+// kmsGrantDeniedOperations are the grant operations grants are never given:
+// a grantee able to create grants could mint child grants that outlive
+// retirement of its own, and one able to retire grants could retire others'
+var kmsGrantDeniedOperations = []kmstypes.GrantOperation{
+	kmstypes.GrantOperationCreateGrant,
+	kmstypes.GrantOperationRetireGrant,
+}
+
+// KMSGrantValue is the credential value returned for aws:kms:grant scopes.
+// GrantToken lets the grantee use the grant before it has propagated.
+type KMSGrantValue struct {
+	GrantID    string   `json:"grant_id"`
+	GrantToken string   `json:"grant_token"`
+	KeyID      string   `json:"key_id"`
+	Operations []string `json:"operations"`
+	Region     string   `json:"region"`
+}
+
+// issueKMSGrant creates a KMS grant for the requester's principal, one of the
+// grantee_principals of the scope. The configured role is the retiring
+// principal so RevokeCredential can retire the grant. Request parameters:
+//
+//	grantee_principal        ARN of the principal receiving the grant
+//	                         (default: the scope's only grantee_principals)
+//	operations               comma-separated grant operations (default "Decrypt")
+//	encryption_context       JSON object the grant is constrained to
+//	encryption_context_mode  "equals" (default) or "subset"
+func (p *AWSPlugin) issueKMSGrant(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	if resource == "" {
+		return nil, fmt.Errorf("invalid kms scope: %s (expected aws:kms:grant:<key-id>)", req.Scope)
+	}
+
+	grantee, err := p.kmsGrantee(req)
+	if err != nil {
+		return nil, err
+	}
+
+	operations, err := parseGrantOperations(req.Parameters["operations"])
+	if err != nil {
+		return nil, err
+	}
+
+	constraints, err := parseGrantConstraints(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := p.assumeRole(ctx, req.Scope, kmsGrantSessionSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := p.sessionAWSConfig(ctx, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	cfg.Region = region
+
+	result, err := kms.NewFromConfig(p.config.serviceAWSConfig(cfg, "kms")).CreateGrant(ctx, &kms.CreateGrantInput{
+		KeyId:             aws.String(resource),
+		GranteePrincipal:  aws.String(grantee),
+		RetiringPrincipal: aws.String(p.config.RoleARN),
+		Operations:        operations,
+		Constraints:       constraints,
+		Name:              aws.String(fmt.Sprintf("creddy-%d", time.Now().Unix())),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kms grant: %w", err)
+	}
+
+	ops := make([]string, len(operations))
+	for i, op := range operations {
+		ops[i] = string(op)
+	}
+
+	value, err := json.Marshal(KMSGrantValue{
+		GrantID:    aws.ToString(result.GrantId),
+		GrantToken: aws.ToString(result.GrantToken),
+		KeyID:      resource,
+		Operations: ops,
+		Region:     region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["grant_id"] = aws.ToString(result.GrantId)
+	metadata["grantee_principal"] = grantee
+
+	// Grants do not expire on their own; Creddy revokes them at expiry
+	return &sdk.Credential{
+		Value:      string(value),
+		ExpiresAt:  time.Now().Add(ttl),
+		Credential: kmsGrantExternalIDPrefix + aws.ToString(result.GrantId) + "@" + region + ":" + resource,
+		Metadata:   metadata,
+	}, nil
+}
+
+// kmsGrantee returns the principal a grant is for: the grantee_principal
+// parameter, which must be one of the scope's grantee_principals, or the only
+// one of them
+func (p *AWSPlugin) kmsGrantee(req *sdk.CredentialRequest) (string, error) {
+	allowed := p.config.scopeConfig(req.Scope).GranteePrincipals
+	if len(allowed) == 0 {
+		return "", &pluginError{kind: errInvalidScope, msg: "no grantee_principals for scope " + req.Scope, hint: "list the principals that may receive grants on the key in the scope's grantee_principals"}
+	}
+	grantee := req.Parameters["grantee_principal"]
+	if grantee == "" {
+		if len(allowed) > 1 {
+			return "", &pluginError{kind: errInvalidScope, msg: "grantee_principal parameter is required for kms grants", hint: "set grantee_principal to one of " + strings.Join(allowed, ", ")}
+		}
+		return allowed[0], nil
+	}
+	if !slices.Contains(allowed, grantee) {
+		return "", &pluginError{kind: errAccessDenied, msg: "grantee_principal " + grantee + " is not in the grantee_principals of scope " + req.Scope}
+	}
+	return grantee, nil
+}
+
+// retireKMSGrant retires a grant created by issueKMSGrant, in the region it
+// was created in; the configured region if none is given
+func (p *AWSPlugin) retireKMSGrant(ctx context.Context, keyID, grantID, region string) error {
+	creds, err := p.assumeRole(ctx, "aws:kms:grant:"+keyID, kmsGrantSessionSeconds)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := p.sessionAWSConfig(ctx, creds)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if region != "" {
+		cfg.Region = region
+	}
+
+	_, err = kms.NewFromConfig(p.config.serviceAWSConfig(cfg, "kms")).RetireGrant(ctx, &kms.RetireGrantInput{
+		KeyId:   aws.String(keyID),
+		GrantId: aws.String(grantID),
+	})
+	if err != nil {
+		var notFound *kmstypes.NotFoundException
+		if errors.As(err, &notFound) {
+			// Already retired or revoked
+			return nil
+		}
+		return fmt.Errorf("failed to retire kms grant: %w", err)
+	}
+
+	return nil
+}
+
+// parseKMSGrantExternalID splits a KMS grant revocation ID. IDs issued
+// before grants recorded their region have none.
+func parseKMSGrantExternalID(externalID string) (grantID, keyID, region string, ok bool) {
+	rest, ok := strings.CutPrefix(externalID, kmsGrantExternalIDPrefix)
+	if !ok {
+		return "", "", "", false
+	}
+	// Grant IDs and regions never contain ':' but key ARNs do
+	grant, keyID, ok := strings.Cut(rest, ":")
+	grantID, region, _ = strings.Cut(grant, "@")
+	return grantID, keyID, region, ok && grantID != "" && keyID != ""
+}
+
+// parseGrantOperations parses a comma-separated list of grant operations
+func parseGrantOperations(value string) ([]kmstypes.GrantOperation, error) {
+	if value == "" {
+		return []kmstypes.GrantOperation{kmstypes.GrantOperationDecrypt}, nil
+	}
+
+	valid := map[kmstypes.GrantOperation]bool{}
+	for _, op := range kmstypes.GrantOperation("").Values() {
+		valid[op] = true
+	}
+
+	var operations []kmstypes.GrantOperation
+	for _, name := range strings.Split(value, ",") {
+		op := kmstypes.GrantOperation(strings.TrimSpace(name))
+		if !valid[op] {
+			return nil, fmt.Errorf("invalid kms grant operation: %q", name)
+		}
+		if slices.Contains(kmsGrantDeniedOperations, op) {
+			return nil, fmt.Errorf("kms grant operation %s is not allowed", op)
+		}
+		operations = append(operations, op)
+	}
+	return operations, nil
+}
+
+// parseGrantConstraints builds encryption context constraints from request
+// parameters
+func parseGrantConstraints(params map[string]string) (*kmstypes.GrantConstraints, error) {
+	raw := params["encryption_context"]
+	if raw == "" {
+		return nil, nil
+	}
+
+	var encryptionContext map[string]string
+	if err := json.Unmarshal([]byte(raw), &encryptionContext); err != nil {
+		return nil, fmt.Errorf("invalid encryption_context: must be a JSON object of strings")
+	}
+
+	switch mode := params["encryption_context_mode"]; mode {
+	case "", "equals":
+		return &kmstypes.GrantConstraints{EncryptionContextEquals: encryptionContext}, nil
+	case "subset":
+		return &kmstypes.GrantConstraints{EncryptionContextSubset: encryptionContext}, nil
+	default:
+		return nil, fmt.Errorf("invalid encryption_context_mode %q: must be equals or subset", mode)
+	}
+}
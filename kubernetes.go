@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// formatExecCredential returns an EKS token as a client-go
+	// ExecCredential, the output of a kubeconfig exec plugin
+	formatExecCredential = "exec_credential"
+	// formatK8sSecret returns session credentials as a Secret manifest
+	formatK8sSecret = "k8s_secret"
+
+	// apiVersionParam selects the ExecCredential API version
+	apiVersionParam = "api_version"
+	// secretNameParam and namespaceParam name the Secret of the k8s_secret
+	// format
+	secretNameParam = "secret_name"
+	namespaceParam  = "namespace"
+
+	defaultSecretName = "creddy-aws"
+
+	execCredentialV1      = "client.authentication.k8s.io/v1"
+	execCredentialV1beta1 = "client.authentication.k8s.io/v1beta1"
+
+	// eksTokenPrefix and eksClusterHeader are those of aws-iam-authenticator
+	// tokens, which the EKS API server accepts
+	eksTokenPrefix   = "k8s-aws-v1."
+	eksClusterHeader = "x-k8s-aws-id"
+
+	// eksTokenLifetime is how long EKS accepts a token, less a minute so
+	// kubectl refreshes it in time; EKS rejects tokens signed more than 15
+	// minutes ago whatever their X-Amz-Expires
+	eksTokenLifetime = 14 * time.Minute
+	eksPresignExpiry = 60 * time.Second
+)
+
+// dns1123Subdomain and dns1123Label validate Kubernetes object names and
+// namespaces
+var (
+	dns1123Subdomain = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	dns1123Label     = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+// EKSTokenValue is the credential value returned for aws:eks scopes
+type EKSTokenValue struct {
+	Token      string `json:"token"`
+	Cluster    string `json:"cluster"`
+	Region     string `json:"region"`
+	Expiration string `json:"expiration"`
+}
+
+// execCredential is the client.authentication.k8s.io ExecCredential a
+// kubeconfig exec plugin prints
+type execCredential struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Spec       struct{}             `json:"spec"`
+	Status     execCredentialStatus `json:"status"`
+}
+
+type execCredentialStatus struct {
+	ExpirationTimestamp string `json:"expirationTimestamp"`
+	Token               string `json:"token"`
+}
+
+// secretManifest is a Kubernetes Secret holding credentials as string data
+type secretManifest struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   secretMetadata    `json:"metadata"`
+	Type       string            `json:"type"`
+	StringData map[string]string `json:"stringData"`
+}
+
+type secretMetadata struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// issueEKSToken generates an EKS authentication token: a presigned STS
+// GetCallerIdentity URL bound to the cluster name, as produced by
+// aws-iam-authenticator and `aws eks get-token`
+func (p *AWSPlugin) issueEKSToken(ctx context.Context, req *sdk.CredentialRequest, cluster, region string) (*sdk.Credential, error) {
+	if cluster == "" {
+		return nil, fmt.Errorf("invalid eks scope: %s (expected aws:eks:<cluster>)", req.Scope)
+	}
+
+	apiVersion, err := execCredentialAPIVersion(req.Parameters[apiVersionParam])
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime := tokenLifetime(req.TTL, eksTokenLifetime)
+
+	creds, err := p.assumeRole(ctx, req.Scope, sessionDurationSeconds(lifetime))
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("https://sts.%s.amazonaws.com/?Action=GetCallerIdentity&Version=2011-06-15&X-Amz-Expires=%d",
+		region, int(eksPresignExpiry.Seconds()))
+	signReq, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	// The cluster header is signed, so the token is only valid for it
+	signReq.Header.Set(eksClusterHeader, cluster)
+	signedURL, _, err := v4.NewSigner().PresignHTTP(ctx, signingCredentials(creds), signReq, emptyPayloadHash, "sts", region, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign EKS token: %w", err)
+	}
+
+	token := eksTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(signedURL))
+	// issueCredential applies the expiry margin to ExpiresAt; the embedded
+	// expiry carries it too so kubectl refreshes in step with Creddy
+	expiresAt := time.Now().Add(lifetime)
+	expiration := p.withExpiryMargin(expiresAt).UTC().Format(time.RFC3339)
+
+	var value interface{} = EKSTokenValue{
+		Token:      token,
+		Cluster:    cluster,
+		Region:     region,
+		Expiration: expiration,
+	}
+	if iss := issuanceFrom(ctx); iss != nil && iss.Format == formatExecCredential {
+		value = execCredential{
+			APIVersion: apiVersion,
+			Kind:       "ExecCredential",
+			Status:     execCredentialStatus{ExpirationTimestamp: expiration, Token: token},
+		}
+	}
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["cluster"] = cluster
+
+	return &sdk.Credential{
+		Value:     string(valueJSON),
+		ExpiresAt: expiresAt,
+		Metadata:  metadata,
+	}, nil
+}
+
+// execCredentialAPIVersion resolves the api_version parameter, which may be
+// given in full or as just the version
+func execCredentialAPIVersion(version string) (string, error) {
+	switch version {
+	case "", "v1beta1", execCredentialV1beta1:
+		return execCredentialV1beta1, nil
+	case "v1", execCredentialV1:
+		return execCredentialV1, nil
+	default:
+		return "", fmt.Errorf("unsupported ExecCredential api_version %q: must be v1 or v1beta1", version)
+	}
+}
+
+// k8sSecret renders credentials as an Opaque Secret manifest that can be
+// piped to kubectl apply
+func k8sSecret(req *sdk.CredentialRequest, data map[string]string, expiration string) (secretManifest, error) {
+	name := req.Parameters[secretNameParam]
+	if name == "" {
+		name = defaultSecretName
+	}
+	if len(name) > 253 || !dns1123Subdomain.MatchString(name) {
+		return secretManifest{}, fmt.Errorf("invalid secret_name %q: must be a lowercase DNS subdomain", name)
+	}
+	namespace := req.Parameters[namespaceParam]
+	if namespace != "" && (len(namespace) > 63 || !dns1123Label.MatchString(namespace)) {
+		return secretManifest{}, fmt.Errorf("invalid namespace %q: must be a lowercase DNS label", namespace)
+	}
+
+	return secretManifest{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: secretMetadata{
+			Name:        name,
+			Namespace:   namespace,
+			Annotations: map[string]string{"creddy/scope": req.Scope, "creddy/expiration": expiration},
+		},
+		Type:       "Opaque",
+		StringData: data,
+	}, nil
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	ledgerMemory   = "memory"
+	ledgerBolt     = "bolt"
+	ledgerDynamoDB = "dynamodb"
+	ledgerNone     = "none"
+
+	// credentialIDPrefix marks generated external IDs of credentials that
+	// have no self-describing revocation ID
+	credentialIDPrefix = "cred-"
+)
+
+var ledgerBucket = []byte("credentials")
+
+// LedgerEntry records one issued credential
+type LedgerEntry struct {
+	ID               string     `json:"id"`
+	Scope            string     `json:"scope"`
+	RoleARN          string     `json:"role_arn,omitempty"`
+	SessionName      string     `json:"session_name,omitempty"`
+	AccessKeyID      string     `json:"access_key_id,omitempty"`
+	AgentID          string     `json:"agent_id,omitempty"`
+	AgentName        string     `json:"agent_name,omitempty"`
+	IssuedAt         time.Time  `json:"issued_at"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	SessionExpiresAt time.Time  `json:"session_expires_at,omitempty"`
+	RenewedFrom      string     `json:"renewed_from,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+
+	// RequestID is the request ID of the issuance
+	RequestID     string `json:"request_id,omitempty"`
+	Justification string `json:"justification,omitempty"`
+
+	// Prefetch marks credentials issued ahead of requests by the
+	// prefetcher, which quotas and anomaly baselines do not count
+	Prefetch bool `json:"prefetch,omitempty"`
+}
+
+// retainedFrom returns when the retention of an entry starts: the expiry of
+// its credential, or its issue time for credentials that do not expire
+func (e *LedgerEntry) retainedFrom() time.Time {
+	if e.ExpiresAt.IsZero() {
+		return e.IssuedAt
+	}
+	return e.ExpiresAt
+}
+
+// ledgerStore persists ledger entries keyed by external ID
+type ledgerStore interface {
+	Put(ctx context.Context, entry *LedgerEntry) error
+	// Get returns nil if the entry does not exist
+	Get(ctx context.Context, id string) (*LedgerEntry, error)
+	List(ctx context.Context) ([]*LedgerEntry, error)
+	Delete(ctx context.Context, id string) error
+	Close() error
+}
+
+// openLedger opens the ledger store selected by the config. A nil store
+// means the ledger is disabled.
+func openLedger(ctx context.Context, cfg *AWSConfig) (ledgerStore, error) {
+	switch cfg.Ledger {
+	case "", ledgerMemory:
+		return newMemoryLedger(time.Duration(cfg.LedgerRetention)), nil
+	case ledgerBolt:
+		if cfg.LedgerPath == "" {
+			return nil, fmt.Errorf("ledger_path is required for the bolt ledger")
+		}
+		return openBoltLedger(cfg.LedgerPath)
+	case ledgerDynamoDB:
+		if cfg.LedgerTable == "" {
+			return nil, fmt.Errorf("ledger_table is required for the dynamodb ledger")
+		}
+		awsCfg, err := newAWSConfig(ctx, cfg, baseCredentialsProvider(cfg))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config for ledger: %w", err)
+		}
+		return &dynamoLedger{client: dynamodb.NewFromConfig(cfg.serviceAWSConfig(awsCfg, "dynamodb")), table: cfg.LedgerTable}, nil
+	case ledgerNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown ledger %q (expected memory, bolt, dynamodb or none)", cfg.Ledger)
+	}
+}
+
+// reusableLedger returns the open ledger store if cfg selects it again: the
+// memory ledger, whose entries would otherwise be lost, or the same bolt
+// file, which stays locked until its handle is closed
+func (p *AWSPlugin) reusableLedger(cfg *AWSConfig) ledgerStore {
+	if p.config == nil {
+		return nil
+	}
+	switch l := p.ledger.(type) {
+	case *memoryLedger:
+		if cfg.Ledger == "" || cfg.Ledger == ledgerMemory {
+			return l
+		}
+	case *boltLedger:
+		if cfg.Ledger == ledgerBolt && cfg.LedgerPath == p.config.LedgerPath {
+			return l
+		}
+	}
+	return nil
+}
+
+// newCredentialID generates an external ID for credentials without a
+// self-describing revocation ID
+func newCredentialID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return credentialIDPrefix + hex.EncodeToString(b)
+}
+
+// credentialID returns the external ID of a credential that has none of its
+// own: the one its role session was tagged with, if any, or a generated one
+func (iss *issuance) credentialID() string {
+	if iss.CredentialID != "" {
+		return iss.CredentialID
+	}
+	return newCredentialID()
+}
+
+// recordIssuance adds an issued credential to the ledger. Failures are logged
+// rather than returned since the credential has already been issued.
+func (p *AWSPlugin) recordIssuance(ctx context.Context, req *sdk.CredentialRequest, iss *issuance, cred *sdk.Credential) {
+	if p.ledger == nil {
+		return
+	}
+
+	entry := &LedgerEntry{
+		ID:               cred.Credential,
+		Scope:            req.Scope,
+		RoleARN:          iss.RoleARN,
+		SessionName:      iss.SessionName,
+		AccessKeyID:      iss.AccessKeyID,
+		AgentID:          req.Agent.ID,
+		AgentName:        req.Agent.Name,
+		IssuedAt:         time.Now().UTC(),
+		ExpiresAt:        cred.ExpiresAt.UTC(),
+		SessionExpiresAt: iss.ExpiresAt.UTC(),
+		RequestID:        iss.ID,
+		Justification:    iss.Justification,
+		Prefetch:         iss.Prefetch,
+	}
+	if iss.Renews != nil {
+		entry.RenewedFrom = iss.Renews.ID
+	}
+	if err := p.ledger.Put(ctx, entry); err != nil {
+		sdk.Warn("failed to record credential in ledger", "id", entry.ID, "scope", entry.Scope, "error", err)
+	}
+	p.quotas.record(entry)
+}
+
+// markRevoked records the revocation time of a ledger entry
+func (p *AWSPlugin) markRevoked(ctx context.Context, entry *LedgerEntry) {
+	now := time.Now().UTC()
+	entry.RevokedAt = &now
+	if err := p.ledger.Put(ctx, entry); err != nil {
+		sdk.Warn("failed to mark credential revoked in ledger", "id", entry.ID, "error", err)
+	}
+	p.quotas.revoke(entry)
+}
+
+// --- issuance tracking ---
+
+// issuance collects the details of the role session behind one credential
+// as it is issued, whichever credential type issues it
+type issuance struct {
+	// ID identifies the issuance in the user agent of its AWS calls
+	ID    string
+	Scope string
+
+	// CredentialID is the external ID of the credential, which its role
+	// session is tagged with
+	CredentialID string
+
+	RoleARN     string
+	SessionName string
+	AccessKeyID string
+	ExpiresAt   time.Time
+
+	// Details of the AssumeRole response
+	AssumedRoleARN   string
+	RequestID        string
+	PackedPolicySize *int32
+
+	// RequestIDs are the request IDs of the AWS calls made for the
+	// credential, by service:operation
+	mu         sync.Mutex
+	RequestIDs map[string]string
+
+	// DurationNote explains why the session is shorter than requested
+	DurationNote string
+
+	// Format is the negotiated credential value format
+	Format string
+
+	// Justification is the request's justification parameter
+	Justification string
+
+	// MFACode is the one-time code of a break-glass request
+	MFACode string
+
+	// Network is the networks the session is restricted to, if any
+	Network *networkRestriction
+
+	// Agent is the agent the credential is issued to
+	Agent sdk.Agent
+
+	// Renews is the ledger entry of the credential being renewed, if any
+	Renews *LedgerEntry
+
+	// Probe names the check a session is assumed for, such as the canary,
+	// whose sessions are named apart in CloudTrail
+	Probe string
+
+	// Prefetch is set for credentials issued by the prefetcher
+	Prefetch bool
+}
+
+type issuanceKey struct{}
+
+// withIssuance returns a context that records issuance details
+func withIssuance(ctx context.Context) (context.Context, *issuance) {
+	iss := &issuance{ID: newIssuanceID()}
+	return context.WithValue(ctx, issuanceKey{}, iss), iss
+}
+
+// issuanceFrom returns the issuance being recorded by the context, if any
+func issuanceFrom(ctx context.Context) *issuance {
+	iss, _ := ctx.Value(issuanceKey{}).(*issuance)
+	return iss
+}
+
+// recordSession notes the assumed-role session on the context's issuance
+func recordSession(ctx context.Context, roleARN string, session *sts.AssumeRoleOutput) {
+	iss := issuanceFrom(ctx)
+	if iss == nil {
+		return
+	}
+	iss.RoleARN = roleARN
+	iss.SessionName = sessionName(session)
+	iss.PackedPolicySize = session.PackedPolicySize
+	if user := session.AssumedRoleUser; user != nil {
+		iss.AssumedRoleARN = aws.ToString(user.Arn)
+	}
+	if id, ok := awsmiddleware.GetRequestIDMetadata(session.ResultMetadata); ok {
+		iss.RequestID = id
+	}
+	if creds := session.Credentials; creds != nil {
+		iss.AccessKeyID = aws.ToString(creds.AccessKeyId)
+		iss.ExpiresAt = aws.ToTime(creds.Expiration)
+	}
+}
+
+// --- memory store ---
+
+// memoryLedgerMinPrune is the size of the memory ledger below which it is
+// not pruned
+const memoryLedgerMinPrune = 1024
+
+type memoryLedger struct {
+	mu      sync.Mutex
+	entries map[string]LedgerEntry
+
+	// Entries are pruned retention after they expire, whenever the ledger
+	// reaches pruneAt entries, so it stays bounded without the janitor
+	retention time.Duration
+	pruneAt   int
+}
+
+func newMemoryLedger(retention time.Duration) *memoryLedger {
+	if retention <= 0 {
+		retention = defaultLedgerRetention
+	}
+	return &memoryLedger{entries: make(map[string]LedgerEntry), retention: retention, pruneAt: memoryLedgerMinPrune}
+}
+
+// setRetention changes the retention of a ledger kept across
+// reconfigurations
+func (l *memoryLedger) setRetention(retention time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.retention = retention
+}
+
+func (l *memoryLedger) Put(ctx context.Context, entry *LedgerEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[entry.ID] = *entry
+	if len(l.entries) >= l.pruneAt {
+		l.prune(time.Now())
+	}
+	return nil
+}
+
+// prune drops the entries the janitor would: those that expired more than
+// the retention ago, except KMS grants still to be retired. The next pruning
+// waits for the ledger to double, so pruning stays cheap per write.
+func (l *memoryLedger) prune(now time.Time) {
+	for id, entry := range l.entries {
+		if now.Sub(entry.retainedFrom()) <= l.retention {
+			continue
+		}
+		if entry.RevokedAt == nil && strings.HasPrefix(id, kmsGrantExternalIDPrefix) {
+			continue
+		}
+		delete(l.entries, id)
+	}
+	l.pruneAt = max(2*len(l.entries), memoryLedgerMinPrune)
+}
+
+func (l *memoryLedger) Get(ctx context.Context, id string) (*LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[id]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (l *memoryLedger) List(ctx context.Context) ([]*LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]*LedgerEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+func (l *memoryLedger) Delete(ctx context.Context, id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, id)
+	return nil
+}
+
+func (l *memoryLedger) Close() error {
+	return nil
+}
+
+// --- bolt store ---
+
+type boltLedger struct {
+	db *bolt.DB
+}
+
+func openBoltLedger(path string) (*boltLedger, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ledger file: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ledgerBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize ledger file: %w", err)
+	}
+	return &boltLedger{db: db}, nil
+}
+
+func (l *boltLedger) Put(ctx context.Context, entry *LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ledger entry: %w", err)
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ledgerBucket).Put([]byte(entry.ID), data)
+	})
+}
+
+func (l *boltLedger) Get(ctx context.Context, id string) (*LedgerEntry, error) {
+	var entry *LedgerEntry
+	err := l.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(ledgerBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		entry = &LedgerEntry{}
+		return json.Unmarshal(data, entry)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger entry: %w", err)
+	}
+	return entry, nil
+}
+
+func (l *boltLedger) List(ctx context.Context) ([]*LedgerEntry, error) {
+	var entries []*LedgerEntry
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ledgerBucket).ForEach(func(k, v []byte) error {
+			var entry LedgerEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, &entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ledger entries: %w", err)
+	}
+	return entries, nil
+}
+
+func (l *boltLedger) Delete(ctx context.Context, id string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ledgerBucket).Delete([]byte(id))
+	})
+}
+
+func (l *boltLedger) Close() error {
+	return l.db.Close()
+}
+
+// --- DynamoDB store ---
+
+// dynamoLedger stores entries in a table with a string partition key "id".
+// The "expires_at" attribute holds the session expiry as epoch seconds so it
+// can be used as the table's TTL attribute; credentials that do not expire
+// have none.
+type dynamoLedger struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func (l *dynamoLedger) Put(ctx context.Context, entry *LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ledger entry: %w", err)
+	}
+	expiresAt := entry.ExpiresAt
+	if entry.SessionExpiresAt.After(expiresAt) {
+		expiresAt = entry.SessionExpiresAt
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(l.table),
+		Item: map[string]dynamotypes.AttributeValue{
+			"id":       &dynamotypes.AttributeValueMemberS{Value: entry.ID},
+			"scope":    &dynamotypes.AttributeValueMemberS{Value: entry.Scope},
+			"agent_id": &dynamotypes.AttributeValueMemberS{Value: entry.AgentID},
+			"entry":    &dynamotypes.AttributeValueMemberS{Value: string(data)},
+		},
+	}
+	if !expiresAt.IsZero() {
+		input.Item["expires_at"] = &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)}
+	}
+	if entry.RequestID != "" {
+		// For an index finding entries by request ID
+		input.Item["request_id"] = &dynamotypes.AttributeValueMemberS{Value: entry.RequestID}
+	}
+	_, err = l.client.PutItem(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to write ledger entry: %w", err)
+	}
+	return nil
+}
+
+func (l *dynamoLedger) Get(ctx context.Context, id string) (*LedgerEntry, error) {
+	out, err := l.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(l.table),
+		Key:            map[string]dynamotypes.AttributeValue{"id": &dynamotypes.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger entry: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	return decodeDynamoEntry(out.Item)
+}
+
+func (l *dynamoLedger) List(ctx context.Context) ([]*LedgerEntry, error) {
+	var entries []*LedgerEntry
+	paginator := dynamodb.NewScanPaginator(l.client, &dynamodb.ScanInput{TableName: aws.String(l.table)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ledger entries: %w", err)
+		}
+		for _, item := range page.Items {
+			entry, err := decodeDynamoEntry(item)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (l *dynamoLedger) Delete(ctx context.Context, id string) error {
+	_, err := l.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(l.table),
+		Key:       map[string]dynamotypes.AttributeValue{"id": &dynamotypes.AttributeValueMemberS{Value: id}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete ledger entry: %w", err)
+	}
+	return nil
+}
+
+func (l *dynamoLedger) Close() error {
+	return nil
+}
+
+// decodeDynamoEntry decodes the JSON entry attribute of a ledger item
+func decodeDynamoEntry(item map[string]dynamotypes.AttributeValue) (*LedgerEntry, error) {
+	attr, ok := item["entry"].(*dynamotypes.AttributeValueMemberS)
+	if !ok {
+		return nil, errors.New("ledger item has no entry attribute")
+	}
+	var entry LedgerEntry
+	if err := json.Unmarshal([]byte(attr.Value), &entry); err != nil {
+		return nil, fmt.Errorf("invalid ledger entry: %w", err)
+	}
+	return &entry, nil
+}
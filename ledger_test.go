@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestReconfigureKeepsLedger(t *testing.T) {
+	f := newFakeAWS(t, false)
+	tests := []struct {
+		name   string
+		ledger string
+	}{
+		{"memory", `,"ledger":"memory"`},
+		{"bolt", `,"ledger":"bolt","ledger_path":` + strconv.Quote(filepath.Join(t.TempDir(), "ledger.db"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &AWSPlugin{}
+			if err := p.Configure(context.Background(), f.config(tt.ledger)); err != nil {
+				t.Fatalf("Configure: %v", err)
+			}
+			defer p.Shutdown(context.Background())
+			cred, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: "aws", TTL: time.Hour, Agent: sdk.Agent{ID: "agent"}})
+			if err != nil {
+				t.Fatalf("GetCredential: %v", err)
+			}
+
+			start := time.Now()
+			if err := p.Configure(context.Background(), f.config(tt.ledger+`,"request_timeout":"10s"`)); err != nil {
+				t.Fatalf("reconfigure: %v", err)
+			}
+			if waited := time.Since(start); waited > time.Second {
+				t.Errorf("reconfigure took %s", waited)
+			}
+			entry, err := p.ledger.Get(context.Background(), cred.Credential)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if entry == nil {
+				t.Errorf("ledger entry %s was lost on reconfigure", cred.Credential)
+			}
+		})
+	}
+}
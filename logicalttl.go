@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// minSessionDuration is the STS floor on session duration
+	minSessionDuration = 15 * time.Minute
+
+	// maxSessionDuration is the STS ceiling on session duration
+	maxSessionDuration = 12 * time.Hour
+
+	// minLogicalTTL is the shortest TTL accepted in logical TTL mode
+	minLogicalTTL = time.Minute
+)
+
+// logicalTTL reports whether a requested TTL is below the STS floor and
+// should be enforced by revoking the session once it has passed
+func (p *AWSPlugin) logicalTTL(ttl time.Duration) bool {
+	return p.config.LogicalTTL.Value && ttl > 0 && ttl < minSessionDuration
+}
+
+// logicalExpiries are the sessions waiting for their logical expiry, by
+// session name, with the STS expiry of each
+type logicalExpiries struct {
+	mu      sync.Mutex
+	pending map[string]logicalExpiry
+}
+
+type logicalExpiry struct {
+	timer         *time.Timer
+	sessionExpiry time.Time
+}
+
+// schedule runs fn at the logical expiry of a session
+func (e *logicalExpiries) schedule(name string, at, sessionExpiry time.Time, fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == nil {
+		e.pending = make(map[string]logicalExpiry)
+	}
+	e.pending[name] = logicalExpiry{timer: time.AfterFunc(time.Until(at), fn), sessionExpiry: sessionExpiry}
+}
+
+// take removes a session, reporting whether it was still waiting
+func (e *logicalExpiries) take(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.pending[name]
+	delete(e.pending, name)
+	return ok
+}
+
+// drain stops the timers and returns the waiting sessions with their STS
+// expiry
+func (e *logicalExpiries) drain() map[string]time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sessions := make(map[string]time.Time, len(e.pending))
+	for name, expiry := range e.pending {
+		expiry.timer.Stop()
+		sessions[name] = expiry.sessionExpiry
+	}
+	clear(e.pending)
+	return sessions
+}
+
+// scheduleLogicalExpiry denies a session through the revocation policy at its
+// logical expiry, ahead of the STS expiry
+func (p *AWSPlugin) scheduleLogicalExpiry(name string, logicalExpiry, sessionExpiry time.Time) {
+	p.logicalExpiries.schedule(name, logicalExpiry, sessionExpiry, func() {
+		defer recoverLogged("logical expiry")
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		// Taken under the lock, so a session is either expired here with
+		// the configuration it was issued under, or by expireLogicalTTLs
+		if !p.logicalExpiries.take(name) || p.config == nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		if err := p.revokeSessions(ctx, []string{name}, sessionExpiry); err != nil {
+			sdk.Warn("failed to expire session at its logical TTL", "session", name, "error", err)
+		}
+	})
+}
+
+// expireLogicalTTLs denies every session waiting for its logical expiry at
+// once, before the plugin stops serving their role. Called with p.mu held.
+func (p *AWSPlugin) expireLogicalTTLs(ctx context.Context) {
+	sessions := p.logicalExpiries.drain()
+	if len(sessions) == 0 {
+		return
+	}
+	names := make([]string, 0, len(sessions))
+	var sessionExpiry time.Time
+	for name, expiry := range sessions {
+		names = append(names, name)
+		if expiry.After(sessionExpiry) {
+			sessionExpiry = expiry
+		}
+	}
+	sort.Strings(names)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	for start := 0; start < len(names); start += revokeAllBatchSize {
+		batch := names[start:min(start+revokeAllBatchSize, len(names))]
+		if err := p.revokeSessions(ctx, batch, sessionExpiry); err != nil {
+			sdk.Warn("failed to expire sessions ahead of their logical TTL", "sessions", strings.Join(batch, ","), "error", err)
+		}
+	}
+}
+
+// uniqueSessionNames reports whether a session name template gives every
+// session its own name, which logical TTLs rely on to deny one session
+// without affecting others. Timestamps are not enough, as sessions issued in
+// the same second share them.
+func uniqueSessionNames(cfg *AWSConfig) bool {
+	if cfg.SessionNameTemplate == "" {
+		return !cfg.StickySessionNames.Value
+	}
+	return strings.Contains(cfg.SessionNameTemplate, ".RequestID")
+}
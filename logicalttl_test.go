@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// logicalTTLSettings enable logical TTLs against the fake
+const logicalTTLSettings = `,"logical_ttl":true,"revocation_policy_name":"creddy-revocations","session_name_template":"creddy-{{.RequestID}}"`
+
+func TestPendingLogicalTTLsExpireEarly(t *testing.T) {
+	tests := []struct {
+		name string
+		// stop ends the plugin's tracking of the session
+		stop func(p *AWSPlugin, f *fakeAWS) error
+	}{
+		{"shutdown", func(p *AWSPlugin, f *fakeAWS) error {
+			p.Shutdown(context.Background())
+			return nil
+		}},
+		{"role change", func(p *AWSPlugin, f *fakeAWS) error {
+			cfg := strings.Replace(f.config(logicalTTLSettings), "role/test", "role/other", 1)
+			return p.Configure(context.Background(), cfg)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeAWS(t, false)
+			p := &AWSPlugin{}
+			if err := p.Configure(context.Background(), f.config(logicalTTLSettings)); err != nil {
+				t.Fatalf("Configure: %v", err)
+			}
+			defer p.Shutdown(context.Background())
+			cred, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: "aws", TTL: 5 * time.Minute, Agent: sdk.Agent{ID: "agent"}})
+			if err != nil {
+				t.Fatalf("GetCredential: %v", err)
+			}
+			session := cred.Metadata["session_name"]
+
+			if err := tt.stop(p, f); err != nil {
+				t.Fatalf("stopping: %v", err)
+			}
+			policies := f.putRolePolicies()
+			if len(policies) != 1 {
+				t.Fatalf("%d PutRolePolicy calls, want 1 denying the pending session", len(policies))
+			}
+			if role := policies[0].Get("RoleName"); role != "test" {
+				t.Errorf("denied on role %s, want the session's role test", role)
+			}
+			if doc := policies[0].Get("PolicyDocument"); !strings.Contains(doc, "*:"+session) {
+				t.Errorf("revocation policy %s does not deny session %s", doc, session)
+			}
+		})
+	}
+}
+
+func TestLogicalTTLKeptAcrossReconfigure(t *testing.T) {
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), f.config(logicalTTLSettings)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+	if _, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: "aws", TTL: 5 * time.Minute, Agent: sdk.Agent{ID: "agent"}}); err != nil {
+		t.Fatalf("GetCredential: %v", err)
+	}
+
+	// The same role can still deny the session at its logical expiry
+	if err := p.Configure(context.Background(), f.config(logicalTTLSettings+`,"request_timeout":"10s"`)); err != nil {
+		t.Fatalf("reconfigure: %v", err)
+	}
+	if n := len(f.putRolePolicies()); n != 0 {
+		t.Errorf("%d PutRolePolicy calls on reconfigure, want the session left to its logical expiry", n)
+	}
+	if n := len(p.logicalExpiries.drain()); n != 1 {
+		t.Errorf("%d sessions pending, want 1", n)
+	}
+}
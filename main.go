@@ -1,9 +1,55 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	sdk "github.com/getcreddy/creddy-plugin-sdk"
 )
 
 func main() {
-	sdk.ServeWithStandalone(&AWSPlugin{}, nil)
+	p := &AWSPlugin{}
+
+	signals := make(chan os.Signal, 1)
+	// Interrupts are left to the plugin host, which stops plugins gracefully
+	signal.Notify(signals, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		sdk.Info("shutting down", "signal", sig.String())
+		p.Shutdown(context.Background())
+		os.Exit(1)
+	}()
+
+	// Helper modes of our own; everything else is the SDK's
+	var helper func() error
+	if args, ok := isDockerHelperInvocation(os.Args); ok {
+		helper = func() error { return runDockerHelper(context.Background(), p, args, os.Stdin, os.Stdout) }
+	} else if len(os.Args) > 1 && os.Args[1] == credentialProcessCommand {
+		helper = func() error { return runCredentialProcess(context.Background(), p, os.Args[2:], os.Stdout) }
+	} else if len(os.Args) > 1 && os.Args[1] == imdsCommand {
+		helper = func() error { return runIMDSServer(context.Background(), p, os.Args[2:]) }
+	} else if len(os.Args) > 1 && os.Args[1] == containerCredentialsCommand {
+		helper = func() error { return runContainerCredentialsServer(context.Background(), p, os.Args[2:], os.Stdout) }
+	} else if len(os.Args) > 1 && os.Args[1] == sigv4ProxyCommand {
+		helper = func() error { return runSigV4Proxy(context.Background(), p, os.Args[2:], os.Stdout) }
+	} else if len(os.Args) > 1 && os.Args[1] == cliCacheCommand {
+		helper = func() error { return runCLICache(context.Background(), p, os.Args[2:], os.Stdout) }
+	} else if len(os.Args) > 1 && os.Args[1] == auditVerifyCommand {
+		helper = func() error { return runAuditVerify(os.Args[2:], os.Stdout) }
+	}
+	if helper != nil {
+		err := helper()
+		p.Shutdown(context.Background())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, redactError(err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	sdk.ServeWithStandalone(p, nil)
+	p.Shutdown(context.Background())
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// enrichMetadata adds details of the issuance to a credential's metadata:
+// the role's account and partition, the assumed-role session behind it, if
+// any, and its lifetime
+func (p *AWSPlugin) enrichMetadata(cred *sdk.Credential, iss *issuance) {
+	if cred.Metadata == nil {
+		cred.Metadata = make(map[string]string)
+	}
+	md := cred.Metadata
+
+	md["account_id"] = p.roleARN.AccountID
+	md["partition"] = p.roleARN.Partition
+
+	now := time.Now().UTC()
+	md["issued_at"] = now.Format(time.RFC3339)
+	if !cred.ExpiresAt.IsZero() {
+		md["expires_in"] = strconv.FormatInt(int64(cred.ExpiresAt.Sub(now).Seconds()), 10)
+	}
+
+	if iss.AssumedRoleARN != "" {
+		md["assumed_role_arn"] = iss.AssumedRoleARN
+	}
+	if iss.SessionName != "" {
+		md["session_name"] = iss.SessionName
+	}
+	if iss.RequestID != "" {
+		md["sts_request_id"] = iss.RequestID
+	}
+	md["request_id"] = iss.ID
+	if cred.Credential != "" {
+		md["credential_id"] = cred.Credential
+	}
+	if ids := iss.requestIDList(); ids != "" {
+		md["aws_request_ids"] = ids
+	}
+	if iss.PackedPolicySize != nil {
+		md["packed_policy_size"] = strconv.Itoa(int(*iss.PackedPolicySize))
+	}
+	if iss.DurationNote != "" {
+		md["duration_note"] = iss.DurationNote
+	}
+	if iss.Format != "" {
+		md["format"] = iss.Format
+	}
+	if n := iss.Network; n != nil && iss.SessionName != "" {
+		if len(n.SourceIPs) > 0 {
+			md["source_ips"] = strings.Join(n.SourceIPs, ",")
+		}
+		if len(n.SourceVpces) > 0 {
+			md["source_vpces"] = strings.Join(n.SourceVpces, ",")
+		}
+	}
+}
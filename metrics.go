@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// metricsPath is where the metrics listener serves the metrics
+	metricsPath = "/metrics"
+
+	// maxMetricScopes bounds the scope label values kept; further scopes
+	// are counted as "other"
+	maxMetricScopes = 500
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency
+// histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metricFamilies describes the exported metrics, in exposition order
+var metricFamilies = []struct {
+	name, typ, help string
+}{
+	{"creddy_aws_credential_requests_total", "counter", "Credential requests by scope and result (issued, cached, degraded or error)."},
+	{"creddy_aws_credential_request_duration_seconds", "histogram", "Time to serve a credential request, by scope."},
+	{"creddy_aws_cache_requests_total", "counter", "Cache lookups of cacheable requests, by result (hit or miss)."},
+	{"creddy_aws_errors_total", "counter", "Failed credential requests, by error kind."},
+	{"creddy_aws_api_call_duration_seconds", "histogram", "Latency of AWS calls, including SDK retries, by service, operation and result."},
+	{"creddy_aws_cached_credentials", "gauge", "Credentials in the cache that have not expired, by scope."},
+	{"creddy_aws_canary_checks_total", "counter", "Background AssumeRole checks of canary_scopes, by scope and result (success or error)."},
+	{"creddy_aws_role_drift_total", "counter", "Changes to the role's trust policy, boundary or policies found by drift detection."},
+}
+
+// metrics collects the plugin's metrics over the life of the process, for
+// the Prometheus text exposition format
+type metrics struct {
+	mu         sync.Mutex
+	counters   map[metricSeries]float64
+	histograms map[metricSeries]*histogram
+	scopes     map[string]bool
+}
+
+// metricSeries is a metric name with its rendered labels
+type metricSeries struct {
+	name   string
+	labels string
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// series renders labels, given as name and value pairs
+func series(name string, labels ...string) metricSeries {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	return metricSeries{name: name, labels: b.String()}
+}
+
+func (m *metrics) add(s metricSeries, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters == nil {
+		m.counters = make(map[metricSeries]float64)
+	}
+	m.counters[s] += v
+}
+
+func (m *metrics) observe(s metricSeries, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.histograms == nil {
+		m.histograms = make(map[metricSeries]*histogram)
+	}
+	h, ok := m.histograms[s]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.histograms[s] = h
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// counter returns the value of a counter series
+func (m *metrics) counter(s metricSeries) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[s]
+}
+
+// scopeLabel returns the label value of a scope, bounding how many are
+// tracked
+func (m *metrics) scopeLabel(scope string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.scopes == nil {
+		m.scopes = make(map[string]bool)
+	}
+	if !m.scopes[scope] {
+		if len(m.scopes) >= maxMetricScopes {
+			return "other"
+		}
+		m.scopes[scope] = true
+	}
+	return scope
+}
+
+// recordRequest counts a served credential request
+func (m *metrics) recordRequest(scope, result string, elapsed time.Duration, err error) {
+	scope = m.scopeLabel(scope)
+	m.add(series("creddy_aws_credential_requests_total", "scope", scope, "result", result), 1)
+	m.observe(series("creddy_aws_credential_request_duration_seconds", "scope", scope), elapsed.Seconds())
+	if err != nil {
+		kind := string(errorKindOf(err))
+		if kind == "" {
+			kind = "other"
+		}
+		m.add(series("creddy_aws_errors_total", "kind", kind), 1)
+	}
+}
+
+// recordCacheLookup counts a cache hit or miss
+func (m *metrics) recordCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.add(series("creddy_aws_cache_requests_total", "result", result), 1)
+}
+
+// addMiddleware times every AWS call of an SDK client
+func (m *metrics) addMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CreddyMetrics",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			start := time.Now()
+			out, md, err := next.HandleInitialize(ctx, in)
+			m.observeCall(awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx), start, err)
+			return out, md, err
+		}), middleware.After)
+}
+
+// observeCall records the duration of an AWS call started at start
+func (m *metrics) observeCall(service, operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.observe(series("creddy_aws_api_call_duration_seconds", "service", service, "operation", operation, "result", result), time.Since(start).Seconds())
+}
+
+// write writes the metrics in the Prometheus text format, with gauges
+// computed at the time of writing
+func (m *metrics) write(w io.Writer, gauges map[metricSeries]float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, family := range metricFamilies {
+		var out strings.Builder
+		for _, s := range sortedSeries(m.counters, family.name) {
+			out.WriteString(sample(s.name, s.labels, m.counters[s]))
+		}
+		for _, s := range sortedSeries(gauges, family.name) {
+			out.WriteString(sample(s.name, s.labels, gauges[s]))
+		}
+		for _, s := range sortedSeries(m.histograms, family.name) {
+			h := m.histograms[s]
+			for i, bound := range latencyBuckets {
+				out.WriteString(sample(s.name+"_bucket", joinLabels(s.labels, `le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`), float64(h.buckets[i])))
+			}
+			out.WriteString(sample(s.name+"_bucket", joinLabels(s.labels, `le="+Inf"`), float64(h.count)))
+			out.WriteString(sample(s.name+"_sum", s.labels, h.sum))
+			out.WriteString(sample(s.name+"_count", s.labels, float64(h.count)))
+		}
+		if out.Len() == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.typ)
+		io.WriteString(w, out.String())
+	}
+}
+
+// sortedSeries returns the series of a metric, sorted by their labels
+func sortedSeries[V any](values map[metricSeries]V, name string) []metricSeries {
+	var list []metricSeries
+	for s := range values {
+		if s.name == name {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].labels < list[j].labels })
+	return list
+}
+
+func sample(name, labels string, v float64) string {
+	value := strconv.FormatFloat(v, 'g', -1, 64)
+	if labels == "" {
+		return name + " " + value + "\n"
+	}
+	return name + "{" + labels + "} " + value + "\n"
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+// scopeCounts counts the cached credentials that have not expired by the
+// scope they were issued for
+func (c *credentialCache) scopeCounts() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	counts := make(map[string]int)
+	for _, cred := range c.entries {
+		if now.Before(cred.ExpiresAt) {
+			counts[cred.Metadata["scope"]]++
+		}
+	}
+	return counts
+}
+
+// metricsServer serves the metrics on a local listener
+type metricsServer struct {
+	addr   string
+	server *http.Server
+}
+
+// startMetricsServer listens on addr and serves the metrics there
+func (p *AWSPlugin) startMetricsServer(addr string) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on metrics_listen %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, p.serveMetrics)
+	mux.HandleFunc(healthPath, p.serveHealth)
+	mux.HandleFunc(simulatePath, p.serveSimulation)
+	mux.HandleFunc(policyGenerationPath, p.servePolicyGeneration)
+	mux.HandleFunc(usagePath, p.serveUsage)
+	mux.HandleFunc(unusedPath, p.serveUnused)
+	mux.HandleFunc(approvalsPath, p.serveApprovals)
+	s := &metricsServer{addr: addr, server: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			sdk.Warn("metrics server failed", "address", addr, "error", err)
+		}
+	}()
+	sdk.Info("serving metrics", "address", listener.Addr().String(), "path", metricsPath)
+	return s, nil
+}
+
+func (s *metricsServer) close() {
+	s.server.Close()
+}
+
+// serveMetrics writes the metrics in the Prometheus text format
+func (p *AWSPlugin) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	gauges := make(map[metricSeries]float64)
+	if p.cache != nil {
+		for scope, n := range p.cache.scopeCounts() {
+			gauges[series("creddy_aws_cached_credentials", "scope", p.metrics.scopeLabel(scope))] += float64(n)
+		}
+	}
+	p.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.metrics.write(w, gauges)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// mskTokenLifetime is the maximum lifetime of an MSK IAM auth token
+	mskTokenLifetime = 15 * time.Minute
+	mskUserAgent     = "creddy-aws/" + PluginVersion
+)
+
+// MSKTokenValue is the credential value returned for aws:msk scopes
+type MSKTokenValue struct {
+	Token     string `json:"token"`
+	Mechanism string `json:"mechanism"`
+	Cluster   string `json:"cluster"`
+	Region    string `json:"region"`
+}
+
+// issueMSKToken generates an MSK IAM SASL/OAUTHBEARER token, using the same
+// presigned kafka-cluster:Connect URL as the official MSK IAM signer libraries
+func (p *AWSPlugin) issueMSKToken(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	cluster, ok := strings.CutPrefix(resource, "cluster/")
+	if !ok || cluster == "" {
+		return nil, fmt.Errorf("invalid msk scope: %s (expected aws:msk:cluster/<name>)", req.Scope)
+	}
+
+	lifetime := tokenLifetime(req.TTL, mskTokenLifetime)
+
+	// The token can never outlive the session that signed it, so the
+	// shortest session is enough
+	creds, err := p.assumeRole(ctx, req.Scope, sessionDurationSeconds(lifetime))
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("https://kafka.%s.amazonaws.com/?Action=%s", region, url.QueryEscape("kafka-cluster:Connect"))
+	signedURL, _, err := presignURL(ctx, signingCredentials(creds), "GET", endpoint, "kafka-cluster", region, lifetime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign MSK auth token: %w", err)
+	}
+
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signed MSK URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("User-Agent", mskUserAgent)
+	u.RawQuery = query.Encode()
+
+	value, err := json.Marshal(MSKTokenValue{
+		Token:     base64.RawURLEncoding.EncodeToString([]byte(u.String())),
+		Mechanism: "OAUTHBEARER",
+		Cluster:   cluster,
+		Region:    region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["cluster"] = cluster
+
+	return &sdk.Credential{
+		Value:     string(value),
+		ExpiresAt: time.Now().Add(lifetime),
+		Metadata:  metadata,
+	}, nil
+}
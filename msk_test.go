@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestMSKToken(t *testing.T) {
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), f.config(`,"region":"eu-west-1"`)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	tests := []struct {
+		ttl         time.Duration
+		wantExpires string
+	}{
+		{0, "900"},
+		{5 * time.Minute, "300"},
+		{time.Hour, "900"},
+	}
+	for _, tt := range tests {
+		cred, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: "aws:msk:cluster/orders", TTL: tt.ttl, Agent: sdk.Agent{ID: "agent"}})
+		if err != nil {
+			t.Fatalf("GetCredential: %v", err)
+		}
+		var value MSKTokenValue
+		if err := json.Unmarshal([]byte(cred.Value), &value); err != nil {
+			t.Fatalf("invalid value %q: %v", cred.Value, err)
+		}
+		if value.Mechanism != "OAUTHBEARER" || value.Cluster != "orders" || value.Region != "eu-west-1" {
+			t.Errorf("value = %+v, want an OAUTHBEARER token of orders in eu-west-1", value)
+		}
+		signed, err := base64.RawURLEncoding.DecodeString(value.Token)
+		if err != nil {
+			t.Fatalf("token is not unpadded base64url: %v", err)
+		}
+		if !strings.HasPrefix(string(signed), "https://kafka.eu-west-1.amazonaws.com/?") {
+			t.Errorf("token URL = %s, want the regional kafka endpoint", signed)
+		}
+		query := verifyPresignedURL(t, "GET", string(signed), "secret", "kafka-cluster", "eu-west-1", emptyPayloadHash, "User-Agent")
+		for name, want := range map[string]string{
+			"Action":               "kafka-cluster:Connect",
+			"X-Amz-Expires":        tt.wantExpires,
+			"X-Amz-Security-Token": "token",
+			"User-Agent":           mskUserAgent,
+		} {
+			if got := query.Get(name); got != want {
+				t.Errorf("TTL %s: %s = %q, want %q", tt.ttl, name, got, want)
+			}
+		}
+	}
+}
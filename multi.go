@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	multiScopePrefix = "aws:multi:"
+
+	// multiExternalIDPrefix marks bundle external IDs, which list the
+	// external IDs of their parts separated by '|'
+	multiExternalIDPrefix = "multi:"
+
+	maxMultiScopes = 10
+)
+
+// MultiCredentialValue is the JSON structure returned for aws:multi scopes,
+// keyed by scope
+type MultiCredentialValue map[string]MultiCredentialPart
+
+// MultiCredentialPart is one credential of a bundle
+type MultiCredentialPart struct {
+	Value     json.RawMessage   `json:"value"`
+	ExpiresAt time.Time         `json:"expires_at,omitzero"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// requestedScopes returns the scopes a request is for: its scope, or the
+// parts of an aws:multi bundle. Invalid bundles fail when they are issued.
+func requestedScopes(scope string) []string {
+	if resource, ok := strings.CutPrefix(scope, multiScopePrefix); ok {
+		scopes, _ := parseMultiScopes(resource)
+		return scopes
+	}
+	return []string{scope}
+}
+
+// parseMultiScopes parses "[s3,lambda]" (or "s3,lambda") into full scopes.
+// Parts may omit the "aws:" prefix.
+func parseMultiScopes(resource string) ([]string, error) {
+	list := strings.TrimSuffix(strings.TrimPrefix(resource, "["), "]")
+
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		scope := part
+		if scope != "aws" && !strings.HasPrefix(scope, "aws:") {
+			scope = "aws:" + scope
+		}
+		if strings.HasPrefix(scope, multiScopePrefix) {
+			return nil, fmt.Errorf("aws:multi scopes cannot be nested")
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("aws:multi requires at least one scope")
+	}
+	if len(scopes) > maxMultiScopes {
+		return nil, fmt.Errorf("aws:multi supports at most %d scopes", maxMultiScopes)
+	}
+	return scopes, nil
+}
+
+// issueMulti issues credentials for several scopes concurrently and returns
+// them as one bundle. Each part is recorded in the ledger on its own; the
+// bundle's external ID revokes all of them.
+func (p *AWSPlugin) issueMulti(ctx context.Context, req *sdk.CredentialRequest, resource string) (*sdk.Credential, error) {
+	scopes, err := parseMultiScopes(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]*sdk.Credential, len(scopes))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, scope := range scopes {
+		g.Go(func() (err error) {
+			// A panic here would not reach the entry point's recovery
+			defer recoverPanic("aws:multi", &err)
+
+			subReq := *req
+			subReq.Scope = scope
+
+			subCtx, iss := withIssuance(gctx)
+			iss.Agent = req.Agent
+			iss.Scope = scope
+
+			cred, err := p.issueCredential(subCtx, &subReq)
+			if err != nil {
+				return fmt.Errorf("%s: %w", scope, err)
+			}
+			if cred.Credential == "" {
+				cred.Credential = iss.credentialID()
+			}
+			p.enrichMetadata(cred, iss)
+			p.recordIssuance(subCtx, &subReq, iss, cred)
+			parts[i] = cred
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		// Don't leave the parts that were issued usable
+		for _, cred := range parts {
+			if cred != nil {
+				if rerr := p.revokeCredential(context.WithoutCancel(ctx), cred.Credential); rerr != nil {
+					sdk.Warn("failed to revoke part of failed aws:multi request", "id", cred.Credential, "error", rerr)
+				}
+			}
+		}
+		return nil, err
+	}
+
+	bundle := make(MultiCredentialValue, len(parts))
+	ids := make([]string, len(parts))
+	var expiresAt time.Time
+	for i, cred := range parts {
+		value := json.RawMessage(cred.Value)
+		if !json.Valid(value) {
+			value, _ = json.Marshal(cred.Value)
+		}
+		bundle[scopes[i]] = MultiCredentialPart{
+			Value:     value,
+			ExpiresAt: cred.ExpiresAt,
+			Metadata:  cred.Metadata,
+		}
+		ids[i] = cred.Credential
+		// Parts that do not expire, such as SES SMTP credentials, do not
+		// bound the bundle
+		if !cred.ExpiresAt.IsZero() && (expiresAt.IsZero() || cred.ExpiresAt.Before(expiresAt)) {
+			expiresAt = cred.ExpiresAt
+		}
+	}
+
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["scopes"] = strings.Join(scopes, ",")
+
+	return &sdk.Credential{
+		Value:      string(bundleJSON),
+		ExpiresAt:  expiresAt,
+		Credential: multiExternalIDPrefix + strings.Join(ids, "|"),
+		Metadata:   metadata,
+	}, nil
+}
+
+// revokeMulti revokes every part of a bundle
+func (p *AWSPlugin) revokeMulti(ctx context.Context, ids string) error {
+	var errs []error
+	for _, id := range strings.Split(ids, "|") {
+		if err := p.revokeCredential(ctx, id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	neptuneDefaultPort = "8182"
+	// neptuneSignatureLifetime is how long Neptune accepts a signed request
+	// after its X-Amz-Date; established connections stay open afterwards
+	neptuneSignatureLifetime = 5 * time.Minute
+)
+
+// NeptuneTokenValue is the credential value returned for aws:neptune scopes:
+// the connection URL and the headers to send when opening it
+type NeptuneTokenValue struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Region  string            `json:"region"`
+}
+
+// issueNeptuneToken signs a connection request to a Neptune endpoint. The
+// "path" request parameter selects the query API (default "/gremlin"; also
+// "/sparql", "/openCypher").
+func (p *AWSPlugin) issueNeptuneToken(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	host, err := endpointHostPort(resource, neptuneDefaultPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid neptune scope: %s (expected aws:neptune:<endpoint>[:port])", req.Scope)
+	}
+
+	path := req.Parameters["path"]
+	if path == "" {
+		path = "/gremlin"
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	creds, err := p.assumeRole(ctx, req.Scope, 900)
+	if err != nil {
+		return nil, err
+	}
+
+	connectURL := "https://" + host + path
+	headers, err := signHeaders(ctx, signingCredentials(creds), "GET", connectURL, "neptune-db", region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign neptune connection: %w", err)
+	}
+
+	value, err := json.Marshal(NeptuneTokenValue{
+		URL:     connectURL,
+		Headers: headers,
+		Region:  region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["endpoint"] = host
+
+	return &sdk.Credential{
+		Value:     string(value),
+		ExpiresAt: time.Now().Add(neptuneSignatureLifetime),
+		Metadata:  metadata,
+	}, nil
+}
+
+// endpointHostPort validates a "<host>[:port]" resource and applies the
+// default port
+func endpointHostPort(resource, defaultPort string) (string, error) {
+	if resource == "" || strings.ContainsAny(resource, "/?#@") {
+		return "", fmt.Errorf("invalid endpoint %q", resource)
+	}
+	host, port, err := net.SplitHostPort(resource)
+	if err != nil {
+		host, port = resource, defaultPort
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid endpoint %q", resource)
+	}
+	return net.JoinHostPort(host, port), nil
+}
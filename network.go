@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// sourceIPParam and sourceVpceParam are the request parameters pinning
+	// the credentials to the requester's networks, as comma-separated
+	// lists
+	sourceIPParam   = "source_ip"
+	sourceVpceParam = "source_vpce"
+
+	// networkStatementSid names the statement added to session policies to
+	// deny calls from other networks
+	networkStatementSid = "CreddyNetworkRestriction"
+)
+
+// vpceIDPattern is what a VPC endpoint ID looks like
+var vpceIDPattern = regexp.MustCompile(`^vpce-[0-9a-f]{8,17}$`)
+
+// networkRestriction is the networks a session's credentials work from:
+// the CIDRs of aws:SourceIp, or the VPC endpoints of aws:SourceVpce
+type networkRestriction struct {
+	SourceIPs   []string
+	SourceVpces []string
+}
+
+// parseSourceIPs parses IP addresses and CIDRs; addresses are taken as
+// single-address CIDRs
+func parseSourceIPs(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source IP %q: expected an address or CIDR", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseSourceVpces checks VPC endpoint IDs
+func parseSourceVpces(values []string) ([]string, error) {
+	vpces := make([]string, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !vpceIDPattern.MatchString(value) {
+			return nil, fmt.Errorf("invalid source VPC endpoint %q: expected vpce-<id>", value)
+		}
+		vpces = append(vpces, value)
+	}
+	return vpces, nil
+}
+
+// validateNetwork checks the network settings of a scope
+func validateNetwork(sc ScopeConfig) error {
+	if _, err := parseSourceIPs(sc.SourceIPs); err != nil {
+		return err
+	}
+	_, err := parseSourceVpces(sc.SourceVpces)
+	return err
+}
+
+// networkRestriction returns the networks a request's credentials are
+// restricted to, or nil when they work from anywhere. Scopes without network
+// settings are restricted to the top-level source_vpces. A request setting
+// source_ip or source_vpce is restricted to those instead of its scope's,
+// which must then include them.
+func (p *AWSPlugin) networkRestriction(req *sdk.CredentialRequest) (*networkRestriction, error) {
+	sc := p.config.scopeConfig(req.Scope)
+	if len(sc.SourceIPs) == 0 && len(sc.SourceVpces) == 0 {
+		sc.SourceVpces = p.config.SourceVpces.Value
+	}
+	allowedIPs, _ := parseSourceIPs(sc.SourceIPs)
+	allowedVpces, _ := parseSourceVpces(sc.SourceVpces)
+
+	restricted := len(allowedIPs) > 0 || len(allowedVpces) > 0
+	ipParam, vpceParam := req.Parameters[sourceIPParam], req.Parameters[sourceVpceParam]
+	if ipParam == "" && vpceParam == "" {
+		if !restricted {
+			return nil, nil
+		}
+		return newNetworkRestriction(allowedIPs, allowedVpces), nil
+	}
+
+	var ips []netip.Prefix
+	if ipParam != "" {
+		var err error
+		if ips, err = parseSourceIPs(strings.Split(ipParam, ",")); err != nil {
+			return nil, &pluginError{kind: errInvalidScope, msg: err.Error(), hint: "set source_ip to comma-separated addresses or CIDRs"}
+		}
+		for _, ip := range ips {
+			if restricted && !slices.ContainsFunc(allowedIPs, func(allowed netip.Prefix) bool {
+				return allowed.Bits() <= ip.Bits() && allowed.Contains(ip.Addr())
+			}) {
+				return nil, &pluginError{kind: errAccessDenied, msg: "source IP " + ip.String() + " is outside the source_ips of scope " + req.Scope}
+			}
+		}
+	}
+	var vpces []string
+	if vpceParam != "" {
+		var err error
+		if vpces, err = parseSourceVpces(strings.Split(vpceParam, ",")); err != nil {
+			return nil, &pluginError{kind: errInvalidScope, msg: err.Error(), hint: "set source_vpce to comma-separated VPC endpoint IDs"}
+		}
+		for _, vpce := range vpces {
+			if restricted && !slices.Contains(allowedVpces, vpce) {
+				return nil, &pluginError{kind: errAccessDenied, msg: "source VPC endpoint " + vpce + " is not in the source_vpces of scope " + req.Scope}
+			}
+		}
+	}
+	return newNetworkRestriction(ips, vpces), nil
+}
+
+func newNetworkRestriction(ips []netip.Prefix, vpces []string) *networkRestriction {
+	n := &networkRestriction{SourceVpces: vpces}
+	for _, ip := range ips {
+		n.SourceIPs = append(n.SourceIPs, ip.String())
+	}
+	return n
+}
+
+// statement returns the statement denying calls from outside the networks.
+// Calls AWS services make on the session's behalf carry their own source,
+// so they are not denied.
+func (n *networkRestriction) statement() policyStatement {
+	condition := map[string]map[string]interface{}{
+		"Bool": {"aws:ViaAWSService": "false"},
+	}
+	if len(n.SourceIPs) > 0 {
+		condition["NotIpAddress"] = map[string]interface{}{"aws:SourceIp": n.SourceIPs}
+	}
+	if len(n.SourceVpces) > 0 {
+		condition["StringNotEquals"] = map[string]interface{}{"aws:SourceVpce": n.SourceVpces}
+	}
+	return policyStatement{
+		Sid:       networkStatementSid,
+		Effect:    "Deny",
+		Action:    stringList{"*"},
+		Resource:  stringList{"*"},
+		Condition: condition,
+	}
+}
+
+// apply adds the network restriction to a session policy. Without one, the
+// role's permissions are allowed as they are.
+func (n *networkRestriction) apply(policy string) (string, error) {
+	if policy == "" {
+		return newPolicy(
+			policyStatement{Effect: "Allow", Action: stringList{"*"}, Resource: stringList{"*"}},
+			n.statement(),
+		).String()
+	}
+
+	// Keep the statements as they are, whatever elements they use
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		return "", fmt.Errorf("invalid session policy: %w", err)
+	}
+	var statements []json.RawMessage
+	if err := json.Unmarshal(doc["Statement"], &statements); err != nil {
+		statements = []json.RawMessage{doc["Statement"]}
+	}
+	statement, err := json.Marshal(n.statement())
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal policy: %w", err)
+	}
+	if doc["Statement"], err = json.Marshal(append(statements, statement)); err != nil {
+		return "", fmt.Errorf("failed to marshal policy: %w", err)
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal policy: %w", err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+const (
+	// notifyEventSource is the source of the EventBridge events, to match
+	// in rules
+	notifyEventSource = "creddy.aws"
+
+	// notifyInterval is how often events are delivered; short, as they
+	// feed detection
+	notifyInterval = time.Second
+
+	// notifyRoleSessionName names the sessions of notify_role_arn
+	notifyRoleSessionName = "creddy-aws-notify"
+
+	// Entries per PutEvents and per PublishBatch call
+	maxEventBridgeBatch = 10
+	maxSNSBatch         = 10
+)
+
+// auditValidate is the action of validation failures, which are notified but
+// not written to the audit log
+const auditValidate = "validate"
+
+// notifyDetailTypes are the EventBridge detail types of the actions
+var notifyDetailTypes = map[string]string{
+	auditIssue:      "Credential Issuance",
+	auditRevoke:     "Credential Revocation",
+	auditValidate:   "Validation Failure",
+	auditDrift:      "Role Drift",
+	auditAnomaly:    "Issuance Anomaly",
+	auditApproval:   "Credential Approval",
+	auditBreakGlass: "Break-Glass Access",
+}
+
+// notifier publishes issuances, revocations, validation failures and role
+// drift to an EventBridge bus and an SNS topic
+type notifier struct {
+	shippers []*auditShipper
+}
+
+// validateNotify checks the notification settings
+func validateNotify(c *AWSConfig) error {
+	if c.NotifyEventBus == "" && c.NotifySNSTopicARN == "" {
+		if c.NotifyRoleARN != "" {
+			return fmt.Errorf("notify_role_arn requires notify_event_bus or notify_sns_topic_arn")
+		}
+		return nil
+	}
+	if strings.HasPrefix(c.NotifyEventBus, "arn:") {
+		if _, err := arn.Parse(c.NotifyEventBus); err != nil {
+			return fmt.Errorf("invalid notify_event_bus: %w", err)
+		}
+	}
+	if c.NotifySNSTopicARN != "" {
+		if parsed, err := arn.Parse(c.NotifySNSTopicARN); err != nil {
+			return fmt.Errorf("invalid notify_sns_topic_arn: %w", err)
+		} else if parsed.Service != "sns" {
+			return fmt.Errorf("notify_sns_topic_arn is not an SNS topic ARN: %s", c.NotifySNSTopicARN)
+		}
+	}
+	if c.NotifyRoleARN != "" {
+		if _, err := parseRoleARN(c.NotifyRoleARN); err != nil {
+			return fmt.Errorf("invalid notify_role_arn: %w", err)
+		}
+	}
+	return nil
+}
+
+// startNotifier starts publishing to the configured bus and topic, as
+// notify_role_arn if set, or returns nil if neither is configured
+func startNotifier(c *AWSConfig, clients *awsClients) *notifier {
+	if c.NotifyEventBus == "" && c.NotifySNSTopicARN == "" {
+		return nil
+	}
+	awsCfg := clients.roleAWSConfig(c.NotifyRoleARN, notifyRoleSessionName)
+	n := &notifier{}
+	if c.NotifyEventBus != "" {
+		n.shippers = append(n.shippers, startAuditShipper(&eventBridgeDestination{
+			client: eventbridge.NewFromConfig(c.serviceAWSConfig(awsCfg, "events")),
+			bus:    c.NotifyEventBus,
+		}, notifyInterval))
+	}
+	if c.NotifySNSTopicARN != "" {
+		n.shippers = append(n.shippers, startAuditShipper(&snsDestination{
+			client: sns.NewFromConfig(c.serviceAWSConfig(awsCfg, "sns")),
+			topic:  c.NotifySNSTopicARN,
+			fifo:   strings.HasSuffix(c.NotifySNSTopicARN, ".fifo"),
+		}, notifyInterval))
+	}
+	return n
+}
+
+// notify queues an event for publishing
+func (n *notifier) notify(event auditEvent) {
+	if n == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, s := range n.shippers {
+		s.send(auditRecord{line: line, at: event.Time, event: event})
+	}
+}
+
+// close publishes the events still pending and stops the notifier
+func (n *notifier) close() {
+	if n == nil {
+		return
+	}
+	for _, s := range n.shippers {
+		s.close()
+	}
+}
+
+// notifyValidation publishes a failed validation
+func (p *AWSPlugin) notifyValidation(err error) {
+	p.notifier.notify(auditEvent{
+		Time:    time.Now().UTC(),
+		Action:  auditValidate,
+		Outcome: auditError,
+		RoleARN: p.config.RoleARN,
+		Error:   redactError(err).Error(),
+	})
+}
+
+// eventBridgeDestination puts events on an EventBridge bus
+type eventBridgeDestination struct {
+	client *eventbridge.Client
+	bus    string
+}
+
+func (d *eventBridgeDestination) name() string {
+	return "eventbridge:" + d.bus
+}
+
+func (d *eventBridgeDestination) put(ctx context.Context, records []auditRecord) error {
+	for len(records) > 0 {
+		n := min(len(records), maxEventBridgeBatch)
+		entries := make([]ebtypes.PutEventsRequestEntry, n)
+		for i, r := range records[:n] {
+			entries[i] = ebtypes.PutEventsRequestEntry{
+				EventBusName: aws.String(d.bus),
+				Source:       aws.String(notifyEventSource),
+				DetailType:   aws.String(notifyDetailTypes[r.event.Action]),
+				Detail:       aws.String(string(r.line)),
+				Time:         aws.Time(r.at),
+			}
+		}
+		out, err := d.client.PutEvents(ctx, &eventbridge.PutEventsInput{Entries: entries})
+		if err != nil {
+			return fmt.Errorf("failed to put events: %w", err)
+		}
+		if out.FailedEntryCount > 0 {
+			// The batch is retried whole, so consumers may see an event
+			// twice
+			for _, entry := range out.Entries {
+				if entry.ErrorCode != nil {
+					return fmt.Errorf("failed to put %d of %d events: %s: %s", out.FailedEntryCount, n, aws.ToString(entry.ErrorCode), aws.ToString(entry.ErrorMessage))
+				}
+			}
+			return fmt.Errorf("failed to put %d of %d events", out.FailedEntryCount, n)
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// snsDestination publishes events to an SNS topic, with the action,
+// outcome and scope as message attributes for subscription filters
+type snsDestination struct {
+	client *sns.Client
+	topic  string
+	fifo   bool
+}
+
+func (d *snsDestination) name() string {
+	return "sns:" + d.topic
+}
+
+func (d *snsDestination) put(ctx context.Context, records []auditRecord) error {
+	for len(records) > 0 {
+		n := min(len(records), maxSNSBatch)
+		entries := make([]snstypes.PublishBatchRequestEntry, n)
+		for i, r := range records[:n] {
+			attributes := map[string]snstypes.MessageAttributeValue{
+				"action":  {DataType: aws.String("String"), StringValue: aws.String(r.event.Action)},
+				"outcome": {DataType: aws.String("String"), StringValue: aws.String(r.event.Outcome)},
+			}
+			if r.event.Scope != "" {
+				attributes["scope"] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(r.event.Scope)}
+			}
+			entries[i] = snstypes.PublishBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i)),
+				Message:           aws.String(string(r.line)),
+				Subject:           aws.String("creddy-aws " + notifyDetailTypes[r.event.Action]),
+				MessageAttributes: attributes,
+			}
+			if d.fifo {
+				entries[i].MessageGroupId = aws.String(notifyEventSource)
+				sum := sha256.Sum256(r.line)
+				entries[i].MessageDeduplicationId = aws.String(hex.EncodeToString(sum[:]))
+			}
+		}
+		out, err := d.client.PublishBatch(ctx, &sns.PublishBatchInput{TopicArn: aws.String(d.topic), PublishBatchRequestEntries: entries})
+		if err != nil {
+			return fmt.Errorf("failed to publish events: %w", err)
+		}
+		if len(out.Failed) > 0 {
+			f := out.Failed[0]
+			return fmt.Errorf("failed to publish %d of %d events: %s: %s", len(out.Failed), n, aws.ToString(f.Code), aws.ToString(f.Message))
+		}
+		records = records[n:]
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// isServiceOutage reports whether an error means an AWS service could not
+// be reached or failed on its side (network errors, 5xx responses,
+// throttling), as opposed to rejecting the request
+func isServiceOutage(err error) bool {
+	var openErr *circuitOpenError
+	if errors.As(err, &openErr) {
+		return true
+	}
+
+	var sendErr *smithyhttp.RequestSendError
+	if errors.As(err, &sendErr) {
+		return true
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		if status := respErr.HTTPStatusCode(); status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			return true
+		}
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "Throttling", "ThrottlingException", "RequestLimitExceeded", "ServiceUnavailable", "InternalFailure":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// panicError is returned by an entry point in place of a panic. The
+// incident ID ties the error the host sees to the logged stack.
+type panicError struct {
+	op       string
+	incident string
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("internal error in %s (incident %s); the plugin logs have details", e.op, e.incident)
+}
+
+// recoverPanic turns a panic into an error of the entry point it is
+// deferred in, logging it with its stack. One malformed request must not
+// take the plugin process, and every consumer of it, down.
+func recoverPanic(op string, err *error) {
+	if r := recover(); r != nil {
+		*err = logPanic(op, r)
+	}
+}
+
+// recoverLogged recovers a panic where there is no error to return it as,
+// in background tasks and Shutdown, and logs it
+func recoverLogged(op string) {
+	if r := recover(); r != nil {
+		logPanic(op, r)
+	}
+}
+
+// logPanic logs a recovered panic with its stack
+func logPanic(op string, r any) *panicError {
+	b := make([]byte, 8)
+	rand.Read(b)
+	perr := &panicError{op: op, incident: hex.EncodeToString(b)}
+	sdk.Error("recovered from panic", "op", op, "incident", perr.incident, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+	return perr
+}
@@ -2,16 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
 	sdk "github.com/getcreddy/creddy-plugin-sdk"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -21,16 +31,337 @@ const (
 
 // AWSPlugin implements the Creddy Plugin interface for AWS
 type AWSPlugin struct {
-	config *AWSConfig
+	// mu guards the configuration and everything built from it. Configure
+	// and Shutdown replace them under the write lock; entry points and
+	// background tasks hold the read lock while they use them.
+	mu sync.RWMutex
+
+	// configureMu serializes Configure and Shutdown, which keep the
+	// metrics listener across reconfigurations
+	configureMu   sync.Mutex
+	metricsServer *metricsServer
+
+	// tracing exports the spans of the current configuration, if any
+	tracing *tracing
+
+	// audit appends issuances and revocations to the audit log, if any
+	audit *auditLog
+
+	// notifier publishes issuances, revocations and validation failures,
+	// if a bus or topic is configured
+	notifier *notifier
+
+	// webhooks are notified of issuances of their scopes, if any
+	webhooks *webhooks
+
+	config              *AWSConfig
+	cloudfrontKey       *rsa.PrivateKey
+	iotClient           *http.Client
+	sessionNameTemplate *template.Template
+	ledger              ledgerStore
+	quotas              *quotaCounters
+	cache               *credentialCache
+	prefetch            *prefetcher
+	janitor             *janitor
+	canary              *canary
+	credentialsFile     *credentialsFileWriter
+	window              *issuanceWindow
+	policyChecks        *policyChecks
+	throttle            *stsThrottle
+	clients             *awsClients
+	rateLimiter         *stsRateLimiter
+	role                *roleInfo
+	identity            *baseIdentity
+	roleARN             arn.ARN
+
+	// inflight collapses concurrent identical requests into one issuance
+	inflight issuanceFlights
+
+	// revocationMu serializes updates to the role's revocation policy
+	revocationMu sync.Mutex
+
+	// clock is the measured skew between the local clock and AWS
+	clock clockSkew
+
+	// janitorStats counts cleanup activity across reconfigurations
+	janitorStats janitorStats
+
+	// metrics counts requests and AWS calls across reconfigurations
+	metrics metrics
+
+	// scopeRequests counts served requests per scope for the unused report
+	scopeRequests scopeRequests
+
+	// health tracks the outcomes reported by the health endpoint
+	health healthStats
+
+	// drift holds the last snapshot of the role for drift detection
+	drift driftState
+
+	// anomalies holds the per-requester baselines of anomaly detection
+	anomalies anomalyDetector
+
+	// approvals holds the requests waiting for an approver
+	approvals approvals
+
+	// simulationMu runs one on-demand policy simulation at a time
+	simulationMu sync.Mutex
+
+	// usageMu runs one usage report at a time, as CloudTrail limits lookups
+	usageMu sync.Mutex
+
+	// cleanupPending is set once a revocation statement awaits cleanup
+	cleanupPending atomic.Bool
+
+	// revocationCleanups are the scheduled prunings of the revocation policy
+	revocationCleanups revocationCleanups
+
+	// logicalExpiries are the sessions to deny at their logical TTL
+	logicalExpiries logicalExpiries
+
+	shutdownOnce sync.Once
 }
 
 // AWSConfig contains the plugin configuration
 type AWSConfig struct {
 	AccessKeyID     string `json:"access_key_id"`
 	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token,omitempty"`
 	RoleARN         string `json:"role_arn"`
 	Region          string `json:"region,omitempty"`
 	ExternalID      string `json:"external_id,omitempty"`
+
+	// Regions requests may select with the region parameter
+	AllowedRegions jsonValue[[]string] `json:"allowed_regions,omitempty"`
+
+	// Bundle of the settings regulated deployments need: fedramp or pci
+	ComplianceMode string `json:"compliance_mode,omitempty"`
+
+	// Endpoint overrides for LocalStack, moto or private gateways
+	EndpointURL    string                       `json:"endpoint_url,omitempty"`
+	EndpointURLs   jsonValue[map[string]string] `json:"endpoint_urls,omitempty"`
+	S3UsePathStyle jsonValue[bool]              `json:"s3_use_path_style,omitempty"`
+
+	// Resolve FIPS 140 and dual-stack (IPv4 and IPv6) endpoints
+	UseFIPSEndpoint      jsonValue[bool] `json:"use_fips_endpoint,omitempty"`
+	UseDualStackEndpoint jsonValue[bool] `json:"use_dualstack_endpoint,omitempty"`
+
+	// STS endpoint selection: regional (default) or legacy
+	STSRegionalEndpoints string `json:"sts_regional_endpoints,omitempty"`
+
+	// Only call AWS over VPC endpoints (PrivateLink), and the VPC endpoints
+	// the sessions of scopes without network settings only work through
+	RequirePrivateLink jsonValue[bool]     `json:"require_private_link,omitempty"`
+	SourceVpces        jsonValue[[]string] `json:"source_vpces,omitempty"`
+
+	// Proxies of AWS calls, used instead of the process environment
+	HTTPProxy  string `json:"http_proxy,omitempty"`
+	HTTPSProxy string `json:"https_proxy,omitempty"`
+	NoProxy    string `json:"no_proxy,omitempty"`
+
+	// TLS of AWS calls: extra trusted CAs (PEM or a file) and minimum version
+	CABundle      string `json:"ca_bundle,omitempty"`
+	TLSMinVersion string `json:"tls_min_version,omitempty"`
+
+	// Budget of a credential request across all its AWS calls
+	RequestTimeout duration `json:"request_timeout,omitempty"`
+
+	// Timeout of each AWS request attempt, and the SDK retry policy
+	APITimeout  duration       `json:"api_timeout,omitempty"`
+	MaxAttempts jsonValue[int] `json:"max_attempts,omitempty"`
+	RetryMode   string         `json:"retry_mode,omitempty"`
+
+	// Queueing of AssumeRole calls while STS is throttling
+	STSThrottleWait        duration       `json:"sts_throttle_wait,omitempty"`
+	STSThrottleConcurrency jsonValue[int] `json:"sts_throttle_concurrency,omitempty"`
+
+	// Token-bucket limits of AssumeRole calls, overall, per scope and per agent
+	STSRateLimit      jsonValue[RateLimit] `json:"sts_rate_limit,omitempty"`
+	STSScopeRateLimit jsonValue[RateLimit] `json:"sts_scope_rate_limit,omitempty"`
+	STSAgentRateLimit jsonValue[RateLimit] `json:"sts_agent_rate_limit,omitempty"`
+
+	// Issuance quotas of scopes, counted in the ledger, by name
+	Quotas jsonValue[map[string]Quota] `json:"quotas,omitempty"`
+
+	// Circuit breaking of STS and IAM calls during AWS outages
+	CircuitBreakerThreshold jsonValue[int] `json:"circuit_breaker_threshold,omitempty"`
+	CircuitBreakerCooldown  duration       `json:"circuit_breaker_cooldown,omitempty"`
+
+	// Local listener serving Prometheus metrics
+	MetricsListen string `json:"metrics_listen,omitempty"`
+
+	// OTLP/HTTP export of traces
+	OTLPEndpoint     string                       `json:"otlp_endpoint,omitempty"`
+	OTLPHeaders      jsonValue[map[string]string] `json:"otlp_headers,omitempty"`
+	TraceSampleRatio jsonValue[float64]           `json:"trace_sample_ratio,omitempty"`
+
+	// Level of the plugin's logs
+	LogLevel string `json:"log_level,omitempty"`
+
+	// CloudFront signing key pair for aws:cloudfront scopes
+	CloudFrontKeyPairID  string `json:"cloudfront_key_pair_id,omitempty"`
+	CloudFrontPrivateKey string `json:"cloudfront_private_key,omitempty"`
+
+	// Dedicated SES sending user for aws:ses:smtp
+	SESSMTPAccessKeyID     string `json:"ses_smtp_access_key_id,omitempty"`
+	SESSMTPSecretAccessKey string `json:"ses_smtp_secret_access_key,omitempty"`
+
+	// Account owning the S3 Access Grants instance (defaults to the role's account)
+	AccessGrantsAccountID string `json:"access_grants_account_id,omitempty"`
+
+	// IoT Core credentials provider for aws:iot scopes
+	IoTCredentialsEndpoint string `json:"iot_credentials_endpoint,omitempty"`
+	IoTCertificate         string `json:"iot_certificate,omitempty"`
+	IoTPrivateKey          string `json:"iot_private_key,omitempty"`
+	IoTCACertificate       string `json:"iot_ca_certificate,omitempty"`
+	IoTThingName           string `json:"iot_thing_name,omitempty"`
+
+	// Named request templates for aws:sigv4 scopes
+	SigV4Targets jsonValue[map[string]SigV4Target] `json:"sigv4_targets,omitempty"`
+
+	// Athena/Glue settings for aws:datalake scopes
+	DataLakeResultsLocation string `json:"datalake_results_location,omitempty"`
+	DataLakeWorkgroup       string `json:"datalake_workgroup,omitempty"`
+	DataLakeDataLocations   string `json:"datalake_data_locations,omitempty"`
+
+	// Settings for matching scopes, keyed by scope pattern
+	Scopes jsonValue[map[string]ScopeConfig] `json:"scopes,omitempty"`
+
+	// Inline role policy holding session revocation denies
+	RevocationPolicyName string `json:"revocation_policy_name,omitempty"`
+
+	// Delete the revocation policy when the plugin shuts down
+	RemoveRevocationsOnShutdown jsonValue[bool] `json:"remove_revocations_on_shutdown,omitempty"`
+
+	// Issued-credential ledger
+	Ledger      string `json:"ledger,omitempty"`
+	LedgerPath  string `json:"ledger_path,omitempty"`
+	LedgerTable string `json:"ledger_table,omitempty"`
+
+	// Periodic cleanup of revocation statements, grants and ledger entries
+	JanitorInterval duration `json:"janitor_interval,omitempty"`
+	LedgerRetention duration `json:"ledger_retention,omitempty"`
+
+	// Background AssumeRole checks of scopes
+	CanaryInterval duration            `json:"canary_interval,omitempty"`
+	CanaryScopes   jsonValue[[]string] `json:"canary_scopes,omitempty"`
+
+	// Assume the configured roles on every Validate
+	DeepValidate jsonValue[bool] `json:"deep_validate,omitempty"`
+
+	// Approval of requests for scopes with require_approval, decided by
+	// signed callbacks on metrics_listen
+	ApprovalSecret  string   `json:"approval_secret,omitempty"`
+	ApprovalTimeout duration `json:"approval_timeout,omitempty"`
+
+	// Anomaly detection on per-requester baselines: warn or block
+	AnomalyDetection   string         `json:"anomaly_detection,omitempty"`
+	AnomalyMinRequests jsonValue[int] `json:"anomaly_min_requests,omitempty"`
+
+	// Emergency access through aws:breakglass, with the MFA device whose
+	// code every break-glass request carries
+	BreakGlassMFASerial string `json:"breakglass_mfa_serial,omitempty"`
+
+	// Access Analyzer validation of generated session policies: warn or block
+	SessionPolicyValidation string `json:"session_policy_validation,omitempty"`
+
+	// Reports of scopes never requested and, from Access Analyzer unused
+	// access findings, permissions of the role never exercised
+	UnusedReports           jsonValue[bool] `json:"unused_reports,omitempty"`
+	UnusedAccessAnalyzerARN string          `json:"unused_access_analyzer_arn,omitempty"`
+
+	// CloudTrail reports of what issued credentials did, on demand
+	UsageReports jsonValue[bool] `json:"usage_reports,omitempty"`
+
+	// Access Analyzer policy generation proposing session policies for
+	// scopes, from the role's activity in a CloudTrail trail
+	PolicyGenerationTrailARN string   `json:"policy_generation_trail_arn,omitempty"`
+	PolicyGenerationRoleARN  string   `json:"policy_generation_role_arn,omitempty"`
+	PolicyGenerationPeriod   duration `json:"policy_generation_period,omitempty"`
+
+	// IAM policy simulation of scopes on every Validate and on demand
+	PolicySimulation jsonValue[bool]     `json:"policy_simulation,omitempty"`
+	SimulationScopes jsonValue[[]string] `json:"simulation_scopes,omitempty"`
+
+	// Snapshots of the role compared on every Validate
+	DriftDetection    jsonValue[bool] `json:"drift_detection,omitempty"`
+	DriftSnapshotFile string          `json:"drift_snapshot_file,omitempty"`
+
+	// Hash-chained local audit log of issuances and revocations
+	AuditLog         string         `json:"audit_log,omitempty"`
+	AuditLogFormat   string         `json:"audit_log_format,omitempty"`
+	AuditLogMaxSize  jsonValue[int] `json:"audit_log_max_size,omitempty"`
+	AuditLogMaxFiles jsonValue[int] `json:"audit_log_max_files,omitempty"`
+
+	// Shipping of audit records to CloudWatch Logs and S3, as a dedicated role
+	AuditCloudWatchLogGroup  string   `json:"audit_cloudwatch_log_group,omitempty"`
+	AuditCloudWatchLogStream string   `json:"audit_cloudwatch_log_stream,omitempty"`
+	AuditS3Bucket            string   `json:"audit_s3_bucket,omitempty"`
+	AuditS3Prefix            string   `json:"audit_s3_prefix,omitempty"`
+	AuditRoleARN             string   `json:"audit_role_arn,omitempty"`
+	AuditShipInterval        duration `json:"audit_ship_interval,omitempty"`
+
+	// Events of issuances, revocations and validation failures published to
+	// EventBridge and SNS, as a dedicated role
+	NotifyEventBus    string `json:"notify_event_bus,omitempty"`
+	NotifySNSTopicARN string `json:"notify_sns_topic_arn,omitempty"`
+	NotifyRoleARN     string `json:"notify_role_arn,omitempty"`
+
+	// HTTPS webhooks notified of issuances of matching scopes, by name
+	Webhooks jsonValue[map[string]Webhook] `json:"webhooks,omitempty"`
+
+	// Profiles of the shared credentials file kept filled with credentials
+	CredentialsFile         string                       `json:"credentials_file,omitempty"`
+	CredentialsFileProfiles jsonValue[map[string]string] `json:"credentials_file_profiles,omitempty"`
+	CredentialsFileTTL      duration                     `json:"credentials_file_ttl,omitempty"`
+
+	// In-memory credential cache
+	Cache       jsonValue[bool] `json:"cache,omitempty"`
+	CacheMargin duration        `json:"cache_margin,omitempty"`
+
+	// Background refresh of frequently requested cached credentials
+	Prefetch            jsonValue[bool] `json:"prefetch,omitempty"`
+	PrefetchMinRequests jsonValue[int]  `json:"prefetch_min_requests,omitempty"`
+
+	// Derive role session names from the requesting agent
+	StickySessionNames  jsonValue[bool] `json:"sticky_session_names,omitempty"`
+	SessionNameTemplate string          `json:"session_name_template,omitempty"`
+
+	// Session duration used when a request has no TTL
+	DefaultDuration duration `json:"default_duration,omitempty"`
+
+	// Reject out-of-range TTLs instead of clamping them
+	StrictTTL jsonValue[bool] `json:"strict_ttl,omitempty"`
+
+	// Enforce TTLs below 15 minutes by revoking the session
+	LogicalTTL jsonValue[bool] `json:"logical_ttl,omitempty"`
+
+	// How much earlier than their real expiry credentials are reported to expire
+	ExpiryMargin duration `json:"expiry_margin,omitempty"`
+
+	// Schema version of JSON credential values (1 or 2)
+	CredentialSchemaVersion jsonValue[int] `json:"credential_schema_version,omitempty"`
+
+	// Window in which identical requests get the same credential
+	IdempotencyWindow duration `json:"idempotency_window,omitempty"`
+
+	// Encrypted on-disk persistence of the credential cache
+	CacheFile        string `json:"cache_file,omitempty"`
+	CachePassphrase  string `json:"cache_passphrase,omitempty"`
+	CacheAgeIdentity string `json:"cache_age_identity,omitempty"`
+	CacheKMSKeyID    string `json:"cache_kms_key_id,omitempty"`
+
+	// httpClient is built from the HTTP settings by Configure
+	httpClient aws.HTTPClient
+
+	// Circuit breakers of the STS and IAM calls, reset by Configure
+	stsBreaker, iamBreaker *circuitBreaker
+
+	// metrics times the AWS calls, set by Configure
+	metrics *metrics
+
+	// tracing traces the AWS calls, if configured
+	tracing *tracing
 }
 
 // AWSCredentialValue is the JSON structure returned as the credential value
@@ -39,19 +370,38 @@ type AWSCredentialValue struct {
 	SecretAccessKey string `json:"secret_access_key"`
 	SessionToken    string `json:"session_token"`
 	Region          string `json:"region"`
+
+	// Regions the credentials are used in, from the scope's settings, with
+	// the scope's service endpoint in each
+	Regions   []string          `json:"regions,omitempty"`
+	Endpoints map[string]string `json:"endpoints,omitempty"`
+
+	// Schema v2 fields; v1 values have no schema_version
+	SchemaVersion   int    `json:"schema_version,omitempty"`
+	AccountID       string `json:"account_id,omitempty"`
+	AssumedRoleARN  string `json:"assumed_role_arn,omitempty"`
+	Expiration      string `json:"expiration,omitempty"`
+	ExpirationEpoch int64  `json:"expiration_epoch,omitempty"`
 }
 
-func (p *AWSPlugin) Info(ctx context.Context) (*sdk.PluginInfo, error) {
+func (p *AWSPlugin) Info(ctx context.Context) (_ *sdk.PluginInfo, err error) {
+	defer recoverPanic("Info", &err)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
 	return &sdk.PluginInfo{
 		Name:             PluginName,
 		Version:          PluginVersion,
-		Description:      "AWS STS temporary credentials via AssumeRole",
+		Description:      "AWS STS temporary credentials via AssumeRole [" + p.capabilities().String() + "]",
 		MinCreddyVersion: "0.4.0",
 	}, nil
 }
 
-func (p *AWSPlugin) Scopes(ctx context.Context) ([]sdk.ScopeSpec, error) {
-	return []sdk.ScopeSpec{
+func (p *AWSPlugin) Scopes(ctx context.Context) (_ []sdk.ScopeSpec, err error) {
+	defer recoverPanic("Scopes", &err)
+
+	scopes := []sdk.ScopeSpec{
 		{
 			Pattern:     "aws",
 			Description: "Full AWS access using the configured role",
@@ -77,10 +427,33 @@ func (p *AWSPlugin) Scopes(ctx context.Context) ([]sdk.ScopeSpec, error) {
 			Description: "AWS ECR access (logical scope - actual permissions depend on role)",
 			Examples:    []string{"aws:ecr"},
 		},
-	}, nil
+		{
+			Pattern:     "aws:multi:[<scope>,...]",
+			Description: "Bundle of credentials for several scopes, issued concurrently",
+			Examples:    []string{"aws:multi:[s3,ecr,lambda]"},
+		},
+		{
+			Pattern:     "aws:datalake:<database>",
+			Description: "Athena queries and Glue catalog reads for one database (enforced by session policy)",
+			Examples:    []string{"aws:datalake:sales"},
+		},
+		{
+			Pattern:     breakGlassScope,
+			Description: "Emergency access using the configured role, for 15 minutes, with an MFA code and a justification; alerts every notification sink",
+			Examples:    []string{breakGlassScope},
+		},
+	}
+
+	for _, ct := range credentialTypes {
+		scopes = append(scopes, ct.Spec)
+	}
+
+	return scopes, nil
 }
 
-func (p *AWSPlugin) ConfigSchema(ctx context.Context) ([]sdk.ConfigField, error) {
+func (p *AWSPlugin) ConfigSchema(ctx context.Context) (_ []sdk.ConfigField, err error) {
+	defer recoverPanic("ConfigSchema", &err)
+
 	return []sdk.ConfigField{
 		{
 			Name:        "access_key_id",
@@ -94,6 +467,12 @@ func (p *AWSPlugin) ConfigSchema(ctx context.Context) ([]sdk.ConfigField, error)
 			Description: "AWS Secret Access Key",
 			Required:    true,
 		},
+		{
+			Name:        "session_token",
+			Type:        "secret",
+			Description: "Session token, if the access key is temporary (e.g., a role session)",
+			Required:    false,
+		},
 		{
 			Name:        "role_arn",
 			Type:        "string",
@@ -107,164 +486,1827 @@ func (p *AWSPlugin) ConfigSchema(ctx context.Context) ([]sdk.ConfigField, error)
 			Required:    false,
 			Default:     "us-east-1",
 		},
+		{
+			Name:        "allowed_regions",
+			Type:        "string",
+			Description: "JSON array of regions requests may select with the region parameter",
+			Required:    false,
+		},
+		{
+			Name:        "endpoint_url",
+			Type:        "string",
+			Description: "Endpoint URL for all AWS API calls (e.g. http://localhost:4566 for LocalStack)",
+			Required:    false,
+		},
+		{
+			Name:        "endpoint_urls",
+			Type:        "string",
+			Description: "JSON object of endpoint URLs by service (sts, iam, s3, ...), overriding endpoint_url",
+			Required:    false,
+		},
+		{
+			Name:        "s3_use_path_style",
+			Type:        "bool",
+			Description: "Address S3 buckets in the URL path rather than the host name",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "compliance_mode",
+			Type:        "string",
+			Description: "fedramp or pci: require TLS 1.2+, regional STS, an audit sink, session tags and sessions of at most 1h; fedramp also uses FIPS endpoints",
+			Required:    false,
+		},
+		{
+			Name:        "use_fips_endpoint",
+			Type:        "bool",
+			Description: "Call AWS through FIPS 140 validated endpoints",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "use_dualstack_endpoint",
+			Type:        "bool",
+			Description: "Call AWS through dual-stack (IPv4 and IPv6) endpoints",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "sts_regional_endpoints",
+			Type:        "string",
+			Description: "STS endpoint: regional for the configured region's endpoint, or legacy for the global endpoint",
+			Required:    false,
+			Default:     stsRegionalEndpoints,
+		},
+		{
+			Name:        "require_private_link",
+			Type:        "bool",
+			Description: "Refuse to call AWS at public addresses, so AWS calls only go over VPC endpoints",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "source_vpces",
+			Type:        "string",
+			Description: "JSON array of VPC endpoint IDs the sessions of scopes without source_ips or source_vpces settings only work through",
+			Required:    false,
+		},
+		{
+			Name:        "http_proxy",
+			Type:        "string",
+			Description: "Proxy URL for plain HTTP AWS calls, instead of HTTP_PROXY",
+			Required:    false,
+		},
+		{
+			Name:        "https_proxy",
+			Type:        "string",
+			Description: "Proxy URL for HTTPS AWS calls, instead of HTTPS_PROXY",
+			Required:    false,
+		},
+		{
+			Name:        "no_proxy",
+			Type:        "string",
+			Description: "Comma-separated hosts, domains and CIDRs reached without a proxy, instead of NO_PROXY",
+			Required:    false,
+		},
+		{
+			Name:        "ca_bundle",
+			Type:        "string",
+			Description: "PEM certificates, or a PEM file path, trusted for AWS calls in addition to the system roots",
+			Required:    false,
+		},
+		{
+			Name:        "tls_min_version",
+			Type:        "string",
+			Description: "Minimum TLS version of AWS calls: 1.2 or 1.3",
+			Required:    false,
+			Default:     "1.2",
+		},
+		{
+			Name:        "request_timeout",
+			Type:        "string",
+			Description: "Total time a credential request may take, across all AWS calls and retries",
+			Required:    false,
+			Default:     formatDuration(defaultRequestTimeout),
+		},
+		{
+			Name:        "api_timeout",
+			Type:        "string",
+			Description: "Timeout of each AWS request attempt, including reading the response (e.g. 10s)",
+			Required:    false,
+		},
+		{
+			Name:        "max_attempts",
+			Type:        "int",
+			Description: "Attempts of each AWS call, including the first, before giving up",
+			Required:    false,
+			Default:     "3",
+		},
+		{
+			Name:        "retry_mode",
+			Type:        "string",
+			Description: "SDK retry mode: standard, or adaptive to also rate limit retries client-side",
+			Required:    false,
+			Default:     string(aws.RetryModeStandard),
+		},
+		{
+			Name:        "sts_throttle_wait",
+			Type:        "string",
+			Description: "How long a request retries and queues while STS is throttling before it fails",
+			Required:    false,
+			Default:     formatDuration(defaultSTSThrottleWait),
+		},
+		{
+			Name:        "sts_throttle_concurrency",
+			Type:        "int",
+			Description: "AssumeRole calls sent to STS at once while it is throttling",
+			Required:    false,
+			Default:     strconv.Itoa(defaultSTSThrottleConcurrency),
+		},
+		{
+			Name:        "sts_rate_limit",
+			Type:        "string",
+			Description: "JSON token bucket limiting all AssumeRole calls: rate in calls per second, and burst",
+			Required:    false,
+		},
+		{
+			Name:        "sts_scope_rate_limit",
+			Type:        "string",
+			Description: "JSON token bucket limiting the AssumeRole calls of each scope",
+			Required:    false,
+		},
+		{
+			Name:        "sts_agent_rate_limit",
+			Type:        "string",
+			Description: "JSON token bucket limiting the AssumeRole calls of each agent",
+			Required:    false,
+		},
+		{
+			Name:        "quotas",
+			Type:        "string",
+			Description: "JSON object mapping names to issuance quotas of scopes: at most max credentials per window, or unexpired at once, overall or per_requester",
+			Required:    false,
+		},
+		{
+			Name:        "circuit_breaker_threshold",
+			Type:        "int",
+			Description: "Consecutive STS or IAM outage errors that open the service's circuit breaker; -1 disables it",
+			Required:    false,
+			Default:     strconv.Itoa(defaultCircuitBreakerThreshold),
+		},
+		{
+			Name:        "circuit_breaker_cooldown",
+			Type:        "string",
+			Description: "How long an open circuit breaker fails calls before probing the service again",
+			Required:    false,
+			Default:     formatDuration(defaultCircuitBreakerCooldown),
+		},
+		{
+			Name:        "metrics_listen",
+			Type:        "string",
+			Description: "Address to serve Prometheus metrics on at /metrics (e.g. 127.0.0.1:9464)",
+			Required:    false,
+		},
+		{
+			Name:        "otlp_endpoint",
+			Type:        "string",
+			Description: "OTLP/HTTP collector URL to export traces to (e.g. http://localhost:4318)",
+			Required:    false,
+		},
+		{
+			Name:        "otlp_headers",
+			Type:        "secret",
+			Description: "JSON object of headers sent with exported traces, such as a collector API key",
+			Required:    false,
+		},
+		{
+			Name:        "trace_sample_ratio",
+			Type:        "string",
+			Description: "Fraction of traces started by the plugin that are sampled; the caller's sampling decision is followed when it sends trace context",
+			Required:    false,
+			Default:     "1",
+		},
+		{
+			Name:        "log_level",
+			Type:        "string",
+			Description: "Level of the plugin's logs: trace, debug, info, warn or error (defaults to the host's level)",
+			Required:    false,
+		},
 		{
 			Name:        "external_id",
 			Type:        "string",
 			Description: "External ID for cross-account role assumption",
 			Required:    false,
 		},
-	}, nil
-}
-
-func (p *AWSPlugin) Constraints(ctx context.Context) (*sdk.Constraints, error) {
-	return &sdk.Constraints{
-		MaxTTL:      12 * time.Hour,
-		MinTTL:      15 * time.Minute,
-		Description: "AWS STS AssumeRole supports session duration between 15 minutes and 12 hours (default role limit)",
-	}, nil
-}
-
-func (p *AWSPlugin) Configure(ctx context.Context, configJSON string) error {
-	var cfg AWSConfig
-	if err := json.Unmarshal([]byte(configJSON), &cfg); err != nil {
-		return fmt.Errorf("invalid config JSON: %w", err)
-	}
-
-	if cfg.AccessKeyID == "" {
-		return fmt.Errorf("access_key_id is required")
-	}
-	if cfg.SecretAccessKey == "" {
-		return fmt.Errorf("secret_access_key is required")
-	}
-	if cfg.RoleARN == "" {
-		return fmt.Errorf("role_arn is required")
-	}
-
-	// Default region
-	if cfg.Region == "" {
-		cfg.Region = "us-east-1"
-	}
-
-	p.config = &cfg
-	return nil
-}
-
-func (p *AWSPlugin) Validate(ctx context.Context) error {
-	if p.config == nil {
-		return fmt.Errorf("plugin not configured")
-	}
-
-	// Try to get caller identity to validate credentials
-	client, err := p.createSTSClient(ctx)
+		{
+			Name:        "cloudfront_key_pair_id",
+			Type:        "string",
+			Description: "CloudFront public key ID used to sign aws:cloudfront URLs and cookies",
+			Required:    false,
+		},
+		{
+			Name:        "cloudfront_private_key",
+			Type:        "file",
+			Description: "PEM-encoded RSA private key matching cloudfront_key_pair_id",
+			Required:    false,
+		},
+		{
+			Name:        "ses_smtp_access_key_id",
+			Type:        "string",
+			Description: "Access key ID of a dedicated SES sending IAM user for aws:ses:smtp",
+			Required:    false,
+		},
+		{
+			Name:        "ses_smtp_secret_access_key",
+			Type:        "secret",
+			Description: "Secret access key of the SES sending IAM user",
+			Required:    false,
+		},
+		{
+			Name:        "access_grants_account_id",
+			Type:        "string",
+			Description: "Account ID of the S3 Access Grants instance (defaults to the role's account)",
+			Required:    false,
+		},
+		{
+			Name:        "iot_credentials_endpoint",
+			Type:        "string",
+			Description: "IoT Core credentials provider endpoint (e.g., xxxx.credentials.iot.us-east-1.amazonaws.com)",
+			Required:    false,
+		},
+		{
+			Name:        "iot_certificate",
+			Type:        "file",
+			Description: "PEM-encoded X.509 device certificate registered with IoT Core",
+			Required:    false,
+		},
+		{
+			Name:        "iot_private_key",
+			Type:        "file",
+			Description: "PEM-encoded private key of the IoT device certificate",
+			Required:    false,
+		},
+		{
+			Name:        "iot_ca_certificate",
+			Type:        "file",
+			Description: "PEM-encoded CA bundle for the credentials provider endpoint (defaults to system roots)",
+			Required:    false,
+		},
+		{
+			Name:        "iot_thing_name",
+			Type:        "string",
+			Description: "Default IoT thing name sent with credential requests",
+			Required:    false,
+		},
+		{
+			Name:        "sigv4_targets",
+			Type:        "string",
+			Description: "JSON object mapping target names to request templates for aws:sigv4 scopes",
+			Required:    false,
+		},
+		{
+			Name:        "datalake_results_location",
+			Type:        "string",
+			Description: "Athena query results location for aws:datalake scopes (e.g., s3://athena-results/creddy/)",
+			Required:    false,
+		},
+		{
+			Name:        "datalake_workgroup",
+			Type:        "string",
+			Description: "Athena workgroup for aws:datalake scopes",
+			Required:    false,
+			Default:     "primary",
+		},
+		{
+			Name:        "datalake_data_locations",
+			Type:        "string",
+			Description: "Comma-separated s3:// locations of table data not governed by Lake Formation",
+			Required:    false,
+		},
+		{
+			Name:        "scopes",
+			Type:        "string",
+			Description: "JSON object mapping scope patterns (exact, or ending in *) to per-scope settings",
+			Required:    false,
+		},
+		{
+			Name:        "revocation_policy_name",
+			Type:        "string",
+			Description: "Name of the inline role policy used to deny revoked sessions",
+			Required:    false,
+			Default:     defaultRevocationPolicyName,
+		},
+		{
+			Name:        "remove_revocations_on_shutdown",
+			Type:        "bool",
+			Description: "Delete the revocation policy on shutdown, reinstating revoked sessions that have not expired",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "ledger",
+			Type:        "string",
+			Description: "Store for the issued-credential ledger: memory, bolt, dynamodb or none",
+			Required:    false,
+			Default:     ledgerMemory,
+		},
+		{
+			Name:        "ledger_path",
+			Type:        "string",
+			Description: "Path of the ledger database file for the bolt ledger",
+			Required:    false,
+		},
+		{
+			Name:        "ledger_table",
+			Type:        "string",
+			Description: "DynamoDB table for the dynamodb ledger (string partition key \"id\")",
+			Required:    false,
+		},
+		{
+			Name:        "credentials_file_profiles",
+			Type:        "string",
+			Description: "JSON object of shared credentials file profiles to keep filled, mapped to their scopes",
+			Required:    false,
+		},
+		{
+			Name:        "credentials_file",
+			Type:        "string",
+			Description: "Shared credentials file the profiles are written to",
+			Required:    false,
+			Default:     "~/.aws/credentials",
+		},
+		{
+			Name:        "credentials_file_ttl",
+			Type:        "string",
+			Description: "TTL of the credentials written to the shared credentials file",
+			Required:    false,
+			Default:     formatDuration(defaultCredentialsFileTTL),
+		},
+		{
+			Name:        "janitor_interval",
+			Type:        "string",
+			Description: "Run background cleanup of expired revocations, stale grants and old ledger entries at this interval (e.g., 15m)",
+			Required:    false,
+		},
+		{
+			Name:        "ledger_retention",
+			Type:        "string",
+			Description: "How long the janitor keeps ledger entries after they expire",
+			Required:    false,
+			Default:     formatDuration(defaultLedgerRetention),
+		},
+		{
+			Name:        "canary_interval",
+			Type:        "string",
+			Description: "Assume the role for each of canary_scopes with the shortest session at this interval, to detect broken trust policies early (e.g., 10m)",
+			Required:    false,
+		},
+		{
+			Name:        "canary_scopes",
+			Type:        "string",
+			Description: "JSON array of the scopes checked by the canary",
+			Required:    false,
+			Default:     `["aws"]`,
+		},
+		{
+			Name:        "deep_validate",
+			Type:        "bool",
+			Description: "Assume role_arn, audit_role_arn and notify_role_arn on every validation, so trust policies that do not allow it fail validation",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "approval_secret",
+			Type:        "string",
+			Description: "HMAC-SHA256 key signing the listings and decisions of /approvals on metrics_listen, for scopes with require_approval",
+			Required:    false,
+		},
+		{
+			Name:        "approval_timeout",
+			Type:        "string",
+			Description: "How long a request for a scope with require_approval waits for a decision, up to 1h",
+			Required:    false,
+			Default:     formatDuration(defaultApprovalTimeout),
+		},
+		{
+			Name:        "anomaly_detection",
+			Type:        "string",
+			Description: "Check requests against per-requester baselines of scope, TTL, hour of day and frequency: warn logs and notifies anomalies, block also fails the requests",
+			Required:    false,
+		},
+		{
+			Name:        "anomaly_min_requests",
+			Type:        "int",
+			Description: "Requests a requester makes before its baseline is used by anomaly_detection",
+			Required:    false,
+			Default:     strconv.Itoa(defaultAnomalyMinRequests),
+		},
+		{
+			Name:        "breakglass_mfa_serial",
+			Type:        "string",
+			Description: "MFA device serial number or ARN of the plugin's IAM user; enables the aws:breakglass scope, whose requests carry its code in mfa_code",
+			Required:    false,
+		},
+		{
+			Name:        "session_policy_validation",
+			Type:        "string",
+			Description: "Validate generated session policies with IAM Access Analyzer before attaching them: warn logs findings, block also fails requests on errors and security warnings",
+			Required:    false,
+		},
+		{
+			Name:        "unused_reports",
+			Type:        "bool",
+			Description: "Serve a report of the scopes settings never requested and, with unused_access_analyzer_arn, the role's unused permissions, on metrics_listen at /unused",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "unused_access_analyzer_arn",
+			Type:        "string",
+			Description: "Access Analyzer unused access analyzer whose findings on the role the unused report lists",
+			Required:    false,
+		},
+		{
+			Name:        "usage_reports",
+			Type:        "bool",
+			Description: "Serve reports of what issued credentials did, from CloudTrail LookupEvents, on metrics_listen at /usage",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "policy_generation_trail_arn",
+			Type:        "string",
+			Description: "CloudTrail trail from whose activity Access Analyzer generates proposed session policies for scopes, served on metrics_listen at /policy-generation",
+			Required:    false,
+		},
+		{
+			Name:        "policy_generation_role_arn",
+			Type:        "string",
+			Description: "Service role Access Analyzer assumes to read the trail for policy generation",
+			Required:    false,
+		},
+		{
+			Name:        "policy_generation_period",
+			Type:        "string",
+			Description: "How much CloudTrail activity policy generation reads, up to 90 days",
+			Required:    false,
+			Default:     formatDuration(defaultPolicyGenerationPeriod),
+		},
+		{
+			Name:        "policy_simulation",
+			Type:        "bool",
+			Description: "Simulate the representative actions of simulation_scopes against the role and session policy on every validation, and serve simulations on metrics_listen at /simulate",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "simulation_scopes",
+			Type:        "string",
+			Description: "JSON array of the scopes simulated on validation",
+			Required:    false,
+			Default:     `["aws:s3","aws:ecr","aws:lambda","aws:bedrock"]`,
+		},
+		{
+			Name:        "drift_detection",
+			Type:        "bool",
+			Description: "Snapshot the role's trust policy, boundary and policies on every validation and warn when they change",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "drift_snapshot_file",
+			Type:        "string",
+			Description: "File keeping the last role snapshot, so drift is detected across restarts",
+			Required:    false,
+		},
+		{
+			Name:        "audit_log",
+			Type:        "string",
+			Description: "File to append a hash-chained audit record of every issuance and revocation to",
+			Required:    false,
+		},
+		{
+			Name:        "audit_log_format",
+			Type:        "string",
+			Description: "Format of audit records: text (key=value) or json (JSON lines)",
+			Required:    false,
+			Default:     auditFormatText,
+		},
+		{
+			Name:        "audit_log_max_size",
+			Type:        "int",
+			Description: "Size in MB at which the audit log is rotated",
+			Required:    false,
+			Default:     strconv.Itoa(defaultAuditLogMaxSize),
+		},
+		{
+			Name:        "audit_log_max_files",
+			Type:        "int",
+			Description: "Number of rotated audit log files kept",
+			Required:    false,
+			Default:     strconv.Itoa(defaultAuditLogMaxFiles),
+		},
+		{
+			Name:        "audit_cloudwatch_log_group",
+			Type:        "string",
+			Description: "CloudWatch Logs group to ship audit records to",
+			Required:    false,
+		},
+		{
+			Name:        "audit_cloudwatch_log_stream",
+			Type:        "string",
+			Description: "Log stream of audit_cloudwatch_log_group, created if missing (defaults to creddy-aws-<hostname>)",
+			Required:    false,
+		},
+		{
+			Name:        "audit_s3_bucket",
+			Type:        "string",
+			Description: "S3 bucket to ship audit records to, an object per batch",
+			Required:    false,
+		},
+		{
+			Name:        "audit_s3_prefix",
+			Type:        "string",
+			Description: "Key prefix of the audit objects in audit_s3_bucket",
+			Required:    false,
+			Default:     defaultAuditS3Prefix,
+		},
+		{
+			Name:        "audit_role_arn",
+			Type:        "string",
+			Description: "Role assumed to ship audit records, instead of using the base credentials",
+			Required:    false,
+		},
+		{
+			Name:        "audit_ship_interval",
+			Type:        "string",
+			Description: "How often batches of audit records are shipped",
+			Required:    false,
+			Default:     formatDuration(defaultAuditShipInterval),
+		},
+		{
+			Name:        "notify_event_bus",
+			Type:        "string",
+			Description: "EventBridge bus (name or ARN) to put an event on for every issuance, revocation and validation failure",
+			Required:    false,
+		},
+		{
+			Name:        "notify_sns_topic_arn",
+			Type:        "string",
+			Description: "SNS topic to publish an event to for every issuance, revocation and validation failure",
+			Required:    false,
+		},
+		{
+			Name:        "notify_role_arn",
+			Type:        "string",
+			Description: "Role assumed to publish events, instead of using the base credentials",
+			Required:    false,
+		},
+		{
+			Name:        "webhooks",
+			Type:        "string",
+			Description: "JSON object mapping names to HTTPS webhooks notified of issuances of matching scopes",
+			Required:    false,
+		},
+		{
+			Name:        "cache",
+			Type:        "bool",
+			Description: "Reuse issued credentials for identical requests until shortly before they expire",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "cache_margin",
+			Type:        "string",
+			Description: "How long before expiry cached credentials stop being served (e.g., 5m)",
+			Required:    false,
+			Default:     defaultCacheMargin.String(),
+		},
+		{
+			Name:        "prefetch",
+			Type:        "bool",
+			Description: "Refresh cached credentials of frequently requested scopes before they expire",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "prefetch_min_requests",
+			Type:        "int",
+			Description: "Requests per 30 seconds for a scope to count as frequently requested",
+			Required:    false,
+			Default:     strconv.Itoa(defaultPrefetchMinRequests),
+		},
+		{
+			Name:        "sticky_session_names",
+			Type:        "bool",
+			Description: "Derive a stable role session name from the requesting agent instead of the scope and time",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "session_name_template",
+			Type:        "string",
+			Description: "Go template for role session names (e.g., creddy-{{.Requester}}-{{.Scope}})",
+			Required:    false,
+			Default:     defaultSessionNameTemplate,
+		},
+		{
+			Name:        "default_duration",
+			Type:        "string",
+			Description: "Session duration for requests without a TTL (e.g., 15m)",
+			Required:    false,
+			Default:     "1h",
+		},
+		{
+			Name:        "strict_ttl",
+			Type:        "bool",
+			Description: "Reject requested TTLs outside the supported session durations instead of clamping them",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "logical_ttl",
+			Type:        "bool",
+			Description: "Support TTLs under 15 minutes by revoking the 15 minute session once the TTL has passed",
+			Required:    false,
+			Default:     "false",
+		},
+		{
+			Name:        "expiry_margin",
+			Type:        "string",
+			Description: "Report credentials as expiring this long before they do, for consumers with skewed clocks (e.g., 30s)",
+			Required:    false,
+		},
+		{
+			Name:        "credential_schema_version",
+			Type:        "int",
+			Description: "Schema version of JSON credential values: 1, or 2 to add account, role and expiration fields",
+			Required:    false,
+			Default:     strconv.Itoa(credentialSchemaV1),
+		},
+		{
+			Name:        "idempotency_window",
+			Type:        "string",
+			Description: "Return the same credential for identical requests from an agent within this window (e.g., 30s)",
+			Required:    false,
+		},
+		{
+			Name:        "cache_file",
+			Type:        "string",
+			Description: "Persist the credential cache, encrypted, to this file across restarts",
+			Required:    false,
+		},
+		{
+			Name:        "cache_passphrase",
+			Type:        "secret",
+			Description: "Passphrase used to encrypt cache_file",
+			Required:    false,
+		},
+		{
+			Name:        "cache_age_identity",
+			Type:        "file",
+			Description: "age X25519 identity (AGE-SECRET-KEY-...) used to encrypt cache_file",
+			Required:    false,
+		},
+		{
+			Name:        "cache_kms_key_id",
+			Type:        "string",
+			Description: "KMS key used to encrypt the data key of cache_file",
+			Required:    false,
+		},
+	}, nil
+}
+
+func (p *AWSPlugin) Constraints(ctx context.Context) (_ *sdk.Constraints, err error) {
+	defer recoverPanic("Constraints", &err)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	maxTTL := maxSessionDuration
+	if p.config != nil {
+		maxTTL, _ = p.sessionLimit(ctx)
+	}
+
+	if p.config != nil && p.config.LogicalTTL.Value {
+		return &sdk.Constraints{
+			MaxTTL:      maxTTL,
+			MinTTL:      minLogicalTTL,
+			Description: fmt.Sprintf("AWS STS AssumeRole supports session duration up to %s (role limit); TTLs under 15 minutes are enforced by revoking the session", formatDuration(maxTTL)),
+		}, nil
+	}
+
+	return &sdk.Constraints{
+		MaxTTL:      maxTTL,
+		MinTTL:      minSessionDuration,
+		Description: fmt.Sprintf("AWS STS AssumeRole supports session duration between 15 minutes and %s (role limit)", formatDuration(maxTTL)),
+	}, nil
+}
+
+func (p *AWSPlugin) Configure(ctx context.Context, configJSON string) (err error) {
+	defer recoverPanic("Configure", &err)
+	defer func() {
+		// The config may not have parsed, so its secrets are found in the
+		// JSON itself
+		if err != nil {
+			err = redactError(err, configJSONSecrets(configJSON)...)
+		}
+	}()
+
+	p.configureMu.Lock()
+	defer p.configureMu.Unlock()
+
+	var cfg AWSConfig
+	if err := json.Unmarshal([]byte(configJSON), &cfg); err != nil {
+		return fmt.Errorf("invalid config JSON: %w", err)
+	}
+
+	if cfg.AccessKeyID == "" {
+		return fmt.Errorf("access_key_id is required")
+	}
+	if cfg.SecretAccessKey == "" {
+		return fmt.Errorf("secret_access_key is required")
+	}
+	if cfg.RoleARN == "" {
+		return fmt.Errorf("role_arn is required")
+	}
+
+	// Default region
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	roleARN, err := parseRoleARN(cfg.RoleARN)
+	if err != nil {
+		return err
+	}
+	if partition := regionPartition(cfg.Region); partition != roleARN.Partition {
+		sdk.Warn("MISCONFIGURATION: region is in a different partition than role_arn", "region", cfg.Region, "region_partition", partition, "role_partition", roleARN.Partition)
+	}
+
+	if cfg.RevocationPolicyName == "" {
+		cfg.RevocationPolicyName = defaultRevocationPolicyName
+	}
+
+	var cloudfrontKey *rsa.PrivateKey
+	if cfg.CloudFrontKeyPairID != "" || cfg.CloudFrontPrivateKey != "" {
+		if cfg.CloudFrontKeyPairID == "" || cfg.CloudFrontPrivateKey == "" {
+			return fmt.Errorf("cloudfront_key_pair_id and cloudfront_private_key must be set together")
+		}
+		key, err := parseRSAPrivateKey(cfg.CloudFrontPrivateKey)
+		if err != nil {
+			return fmt.Errorf("invalid cloudfront_private_key: %w", err)
+		}
+		cloudfrontKey = key
+	}
+
+	if (cfg.SESSMTPAccessKeyID == "") != (cfg.SESSMTPSecretAccessKey == "") {
+		return fmt.Errorf("ses_smtp_access_key_id and ses_smtp_secret_access_key must be set together")
+	}
+
+	if v := cfg.CredentialSchemaVersion.Value; v != 0 && (v < credentialSchemaV1 || v > credentialSchemaV2) {
+		return fmt.Errorf("invalid credential_schema_version %d: must be 1 or 2", v)
+	}
+
+	if err := validateRegions(cfg.AllowedRegions.Value); err != nil {
+		return fmt.Errorf("invalid allowed_regions: %w", err)
+	}
+
+	if err := applyComplianceMode(&cfg); err != nil {
+		return err
+	}
+	if err := validateEndpoints(&cfg); err != nil {
+		return err
+	}
+	if err := validatePrivateLink(&cfg); err != nil {
+		return err
+	}
+
+	if err := validateRetryPolicy(&cfg); err != nil {
+		return err
+	}
+
+	if err := validateTracing(&cfg); err != nil {
+		return err
+	}
+
+	if cfg.LogLevel != "" && !slices.Contains(logLevels, cfg.LogLevel) {
+		return fmt.Errorf("invalid log_level %q: must be one of %s", cfg.LogLevel, strings.Join(logLevels, ", "))
+	}
+
+	httpClient, err := newHTTPClient(&cfg)
 	if err != nil {
-		return fmt.Errorf("failed to create STS client: %w", err)
+		return err
+	}
+	cfg.httpClient = httpClient
+	cfg.metrics = &p.metrics
+
+	for pattern, scope := range cfg.Scopes.Value {
+		if scope.Format != "" && !slices.Contains(credentialFormats, scope.Format) {
+			return fmt.Errorf("invalid format for scopes %q: must be one of %s", pattern, strings.Join(credentialFormats, ", "))
+		}
+		if err := validateRegions(scope.Regions); err != nil {
+			return fmt.Errorf("invalid regions for scopes %q: %w", pattern, err)
+		}
+		if err := validateNetwork(scope); err != nil {
+			return fmt.Errorf("invalid network restriction for scopes %q: %w", pattern, err)
+		}
+		if err := validateWindows(scope); err != nil {
+			return fmt.Errorf("invalid allowed windows for scopes %q: %w", pattern, err)
+		}
+		for _, grantee := range scope.GranteePrincipals {
+			if !strings.HasPrefix(grantee, "arn:") {
+				return fmt.Errorf("invalid grantee_principals for scopes %q: %s is not an ARN", pattern, grantee)
+			}
+		}
+		if len(scope.SessionPolicy) > 0 {
+			var doc policyDocument
+			if err := json.Unmarshal(scope.SessionPolicy, &doc); err != nil {
+				return fmt.Errorf("invalid session_policy for scopes %q: %w", pattern, err)
+			}
+			if len(doc.Statement) == 0 {
+				return fmt.Errorf("invalid session_policy for scopes %q: no statements", pattern)
+			}
+		}
+	}
+
+	for name, target := range cfg.SigV4Targets.Value {
+		if err := target.validate(); err != nil {
+			return fmt.Errorf("invalid sigv4_targets %q: %w", name, err)
+		}
+	}
+
+	sessionNameTemplate, err := parseSessionNameTemplate(&cfg)
+	if err != nil {
+		return err
+	}
+
+	if d := time.Duration(cfg.DefaultDuration); d != 0 {
+		min := minSessionDuration
+		if cfg.LogicalTTL.Value {
+			min = minLogicalTTL
+		}
+		if d < min || d > maxSessionDuration {
+			return fmt.Errorf("default_duration must be between %s and %s", formatDuration(min), formatDuration(maxSessionDuration))
+		}
+	}
+
+	if cfg.LogicalTTL.Value && !uniqueSessionNames(&cfg) {
+		return fmt.Errorf("logical_ttl requires a unique session name per session (a session_name_template with {{.RequestID}})")
+	}
+
+	var iotClient *http.Client
+	if cfg.IoTCredentialsEndpoint != "" {
+		client, err := newIoTClient(&cfg)
+		if err != nil {
+			return err
+		}
+		iotClient = client
+	}
+
+	var cache *credentialCache
+	if cfg.Cache.Value {
+		if cfg.CacheMargin == 0 {
+			cfg.CacheMargin = duration(defaultCacheMargin)
+		}
+		cache = newCredentialCache(time.Duration(cfg.CacheMargin))
+
+		if cfg.CacheFile != "" {
+			file, entries, err := openCacheFile(ctx, &cfg)
+			if err != nil {
+				return err
+			}
+			cache.restore(entries)
+			cache.file = file
+		}
+	} else if cfg.CacheFile != "" {
+		return fmt.Errorf("cache_file requires cache to be enabled")
+	} else if cfg.Prefetch.Value {
+		return fmt.Errorf("prefetch requires cache to be enabled")
+	}
+	defer func() {
+		if err != nil && cache != nil {
+			cache.file.close()
+		}
+	}()
+	if cfg.LedgerRetention <= 0 {
+		cfg.LedgerRetention = duration(defaultLedgerRetention)
+	}
+	if cfg.PrefetchMinRequests.Value <= 0 {
+		cfg.PrefetchMinRequests.Value = defaultPrefetchMinRequests
+	}
+	if err := validateAuditShipping(&cfg); err != nil {
+		return err
+	}
+	audit, err := openAuditLog(&cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			audit.close()
+		}
+	}()
+	if err := validateNotify(&cfg); err != nil {
+		return err
+	}
+	if err := validateQuotas(&cfg); err != nil {
+		return err
+	}
+	if err := validateApprovals(&cfg); err != nil {
+		return err
+	}
+	if err := validateBreakGlass(&cfg); err != nil {
+		return err
+	}
+	if err := validateAnomalyDetection(&cfg); err != nil {
+		return err
+	}
+	if err := validatePolicyValidation(&cfg); err != nil {
+		return err
+	}
+	if err := validateUnusedReports(&cfg); err != nil {
+		return err
+	}
+	if err := validateUsageReports(&cfg); err != nil {
+		return err
+	}
+	if err := validatePolicyGeneration(&cfg); err != nil {
+		return err
+	}
+	if err := validateSimulation(&cfg); err != nil {
+		return err
+	}
+	if err := validateCanary(&cfg); err != nil {
+		return err
+	}
+	if cfg.DriftSnapshotFile != "" && !cfg.DriftDetection.Value {
+		return fmt.Errorf("drift_snapshot_file requires drift_detection to be enabled")
+	}
+	for name, hook := range cfg.Webhooks.Value {
+		if err := hook.validate(); err != nil {
+			return fmt.Errorf("invalid webhooks %q: %w", name, err)
+		}
+	}
+
+	for name, scope := range cfg.CredentialsFileProfiles.Value {
+		if name == "" || strings.ContainsAny(name, "[]\n") {
+			return fmt.Errorf("invalid credentials_file_profiles profile name %q", name)
+		}
+		if !isValidAWSScope(scope) {
+			return fmt.Errorf("invalid credentials_file_profiles scope for %q: %s", name, scope)
+		}
+	}
+	if len(cfg.CredentialsFileProfiles.Value) > 0 && cfg.CredentialsFile == "" {
+		path, err := defaultCredentialsFilePath()
+		if err != nil {
+			return err
+		}
+		cfg.CredentialsFile = path
+	}
+	if cfg.CredentialsFileTTL <= 0 {
+		cfg.CredentialsFileTTL = duration(defaultCredentialsFileTTL)
+	}
+	for name, limit := range map[string]RateLimit{
+		"sts_rate_limit":       cfg.STSRateLimit.Value,
+		"sts_scope_rate_limit": cfg.STSScopeRateLimit.Value,
+		"sts_agent_rate_limit": cfg.STSAgentRateLimit.Value,
+	} {
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	if cfg.CircuitBreakerThreshold.Value == 0 {
+		cfg.CircuitBreakerThreshold.Value = defaultCircuitBreakerThreshold
+	}
+	if cfg.CircuitBreakerCooldown <= 0 {
+		cfg.CircuitBreakerCooldown = duration(defaultCircuitBreakerCooldown)
+	}
+	cfg.stsBreaker = newCircuitBreaker("STS", cfg.CircuitBreakerThreshold.Value, time.Duration(cfg.CircuitBreakerCooldown))
+	cfg.iamBreaker = newCircuitBreaker("IAM", cfg.CircuitBreakerThreshold.Value, time.Duration(cfg.CircuitBreakerCooldown))
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = duration(defaultRequestTimeout)
+	}
+	if cfg.STSThrottleWait <= 0 {
+		cfg.STSThrottleWait = duration(defaultSTSThrottleWait)
+	}
+	if cfg.STSThrottleConcurrency.Value <= 0 {
+		cfg.STSThrottleConcurrency.Value = defaultSTSThrottleConcurrency
+	}
+
+	tracing, err := newTracing(&cfg)
+	if err != nil {
+		return err
+	}
+	cfg.tracing = tracing
+
+	clients, err := newAWSClients(ctx, &cfg)
+	if err != nil {
+		tracing.close()
+		return err
+	}
+
+	ledger := p.reusableLedger(&cfg)
+	if ledger == nil {
+		if ledger, err = openLedger(ctx, &cfg); err != nil {
+			tracing.close()
+			return err
+		}
+	}
+	defer func() {
+		if err != nil && ledger != nil && ledger != p.ledger {
+			ledger.Close()
+		}
+	}()
+	quotas, err := newQuotaCounters(ctx, cfg.Quotas.Value, ledger)
+	if err != nil {
+		tracing.close()
+		return err
+	}
+
+	// The listener is kept while its address stays the same
+	metricsServer := p.metricsServer
+	if metricsServer == nil || metricsServer.addr != cfg.MetricsListen {
+		metricsServer = nil
+		if cfg.MetricsListen != "" {
+			if metricsServer, err = p.startMetricsServer(cfg.MetricsListen); err != nil {
+				tracing.close()
+				return err
+			}
+		}
+	}
+
+	audit.startShippers(&cfg, clients)
+	notifier := startNotifier(&cfg, clients)
+	webhooks := startWebhooks(&cfg)
+
+	// Everything above is built from cfg alone; swapping it in waits for
+	// in-flight requests to finish with the old configuration
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Sessions of a role the plugin stops serving cannot be denied later
+	if p.config != nil && (p.config.RoleARN != cfg.RoleARN || p.config.RevocationPolicyName != cfg.RevocationPolicyName) {
+		p.expireLogicalTTLs(ctx)
+	}
+	if p.ledger != nil && p.ledger != ledger {
+		p.ledger.Close()
+	}
+	if l, ok := ledger.(*memoryLedger); ok {
+		l.setRetention(time.Duration(cfg.LedgerRetention))
+	}
+	if p.prefetch != nil {
+		p.prefetch.close()
+	}
+	if p.janitor != nil {
+		p.janitor.close()
+	}
+	p.revocationCleanups.stop()
+	if p.canary != nil {
+		p.canary.close()
+	}
+	if p.credentialsFile != nil {
+		p.credentialsFile.close()
+	}
+	if p.metricsServer != nil && p.metricsServer != metricsServer {
+		p.metricsServer.close()
+	}
+	if p.tracing != nil {
+		// Flushing waits on the collector, which requests need not
+		go p.tracing.close()
+	}
+	if p.audit != nil {
+		// Shipping the pending records waits on AWS; the replacement
+		// carries the chain on meanwhile
+		audit.continueChain(p.audit)
+		go p.audit.close()
+	}
+	if p.notifier != nil {
+		go p.notifier.close()
+	}
+	if p.webhooks != nil {
+		go p.webhooks.close()
 	}
 
-	_, err = client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
-	if err != nil {
-		return fmt.Errorf("failed to validate AWS credentials: %w", err)
+	p.config = &cfg
+	p.cloudfrontKey = cloudfrontKey
+	p.iotClient = iotClient
+	p.sessionNameTemplate = sessionNameTemplate
+	p.role = &roleInfo{}
+	p.identity = &baseIdentity{}
+	p.roleARN = roleARN
+	p.clients = clients
+	p.metricsServer = metricsServer
+	p.tracing = tracing
+	p.audit = audit
+	p.notifier = notifier
+	p.webhooks = webhooks
+	p.health.reset()
+	p.scopeRequests.start()
+	redactor.set(cfg.secretValues())
+	setLogLevel(cfg.LogLevel)
+	p.ledger = ledger
+	p.quotas = quotas
+	p.cache = cache
+	p.throttle = newSTSThrottle(time.Duration(cfg.STSThrottleWait), cfg.STSThrottleConcurrency.Value)
+	p.rateLimiter = newSTSRateLimiter(cfg.STSRateLimit.Value, cfg.STSScopeRateLimit.Value, cfg.STSAgentRateLimit.Value)
+	if cfg.AnomalyDetection != "" {
+		p.anomalies.seed(ledger)
+	}
+	p.policyChecks = nil
+	if cfg.SessionPolicyValidation != "" {
+		p.policyChecks = newPolicyChecks(cfg.SessionPolicyValidation)
+	}
+	p.window = nil
+	if cfg.IdempotencyWindow > 0 {
+		p.window = newIssuanceWindow(time.Duration(cfg.IdempotencyWindow))
+	}
+	p.prefetch = nil
+	if cfg.Prefetch.Value {
+		p.prefetch = p.startPrefetch(cfg.PrefetchMinRequests.Value)
+	}
+	p.janitor = nil
+	if cfg.JanitorInterval > 0 {
+		p.janitor = p.startJanitor(time.Duration(cfg.JanitorInterval), time.Duration(cfg.LedgerRetention))
+	}
+	p.canary = nil
+	if cfg.CanaryInterval > 0 {
+		p.canary = p.startCanary(time.Duration(cfg.CanaryInterval), cfg.CanaryScopes.Value)
+	}
+	p.credentialsFile = nil
+	if len(cfg.CredentialsFileProfiles.Value) > 0 {
+		p.credentialsFile = p.startCredentialsFileWriter(cfg.CredentialsFile, cfg.CredentialsFileProfiles.Value, time.Duration(cfg.CredentialsFileTTL))
+	}
+	return nil
+}
+
+func (p *AWSPlugin) Validate(ctx context.Context) (err error) {
+	defer recoverPanic("Validate", &err)
+	defer func() { err = redactError(err) }()
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ctx, span := p.startSpan(ctx, "Validate")
+	defer func() { endSpan(span, err) }()
+	defer func() { err = p.describeError("validation", err) }()
+
+	if p.config == nil {
+		return errNotConfigured
+	}
+	defer func() {
+		if err != nil {
+			p.notifyValidation(err)
+		}
+	}()
+
+	if err := p.checkBaseCredentials(ctx); err != nil {
+		return err
+	}
+
+	if p.chainedRole(ctx) {
+		sdk.Warn("base credentials are a role session; sessions are limited to 1 hour by role chaining")
+	}
+	if err := p.checkTrustPolicy(ctx); err != nil {
+		return err
+	}
+	if p.config.DeepValidate.Value {
+		if err := p.deepValidate(ctx); err != nil {
+			return err
+		}
+	}
+	if p.config.PolicySimulation.Value {
+		p.simulateScopes(ctx)
+	}
+	if p.config.DriftDetection.Value {
+		p.checkDrift(ctx)
 	}
 
 	return nil
 }
 
-func (p *AWSPlugin) GetCredential(ctx context.Context, req *sdk.CredentialRequest) (*sdk.Credential, error) {
+func (p *AWSPlugin) GetCredential(ctx context.Context, req *sdk.CredentialRequest) (cred *sdk.Credential, err error) {
+	defer recoverPanic("GetCredential", &err)
+	defer func() { err = redactError(err) }()
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ctx, span := p.startSpan(ctx, "GetCredential", attribute.String("creddy.scope", req.Scope), attribute.String("creddy.agent", req.Agent.Name))
+	start, result := time.Now(), "error"
+	defer func() {
+		p.metrics.recordRequest(req.Scope, result, time.Since(start), err)
+		if err == nil {
+			p.scopeRequests.record(req.Scope)
+		}
+		if req.Scope == breakGlassScope {
+			warnBreakGlass(req, cred, result)
+		}
+		if p.config != nil {
+			p.auditIssuance(auditAction(req.Scope), req, cred, result, err)
+		}
+		endSpan(span, err, attribute.String("creddy.result", result))
+	}()
+	defer func() { err = p.describeError("credential request", err) }()
+
 	if p.config == nil {
-		return nil, fmt.Errorf("plugin not configured")
+		return nil, errNotConfigured
+	}
+	parent := ctx
+	ctx, cancel := p.requestContext(parent)
+	defer func() { cancel() }()
+	if ctx.Err() != nil {
+		return nil, requestDone(ctx)
 	}
 
 	// Validate the scope
 	if !isValidAWSScope(req.Scope) {
-		return nil, fmt.Errorf("invalid aws scope: %s", req.Scope)
+		return nil, &pluginError{kind: errInvalidScope, msg: "invalid aws scope " + req.Scope, hint: "scopes are aws, aws:<service>, aws:multi:[...] or one of the credential types; see the plugin's scopes"}
 	}
 
-	// Create STS client
-	client, err := p.createSTSClient(ctx)
+	if req.TTL <= 0 && p.config.DefaultDuration > 0 {
+		defaulted := *req
+		defaulted.TTL = time.Duration(p.config.DefaultDuration)
+		req = &defaulted
+	}
+
+	if err := p.checkBreakGlass(req); err != nil {
+		return nil, err
+	}
+	breakGlass := req.Scope == breakGlassScope
+	if breakGlass {
+		req = breakGlassRequest(req)
+	}
+
+	if err := p.checkTTL(ctx, req.TTL); err != nil {
+		return nil, err
+	}
+	if err := p.checkJustification(req); err != nil {
+		return nil, err
+	}
+	// Break-glass requests are unusual by design, and alerted on anyway
+	if !breakGlass {
+		if err := p.checkAnomalies(req); err != nil {
+			return nil, err
+		}
+	}
+	outsideWindow, err := p.checkWindows(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create STS client: %w", err)
+		return nil, err
+	}
+	if outsideWindow || p.config.requiresApproval(req) {
+		reason := "require_approval"
+		if outsideWindow {
+			reason = "outside allowed windows"
+		}
+		// The request's budget starts once it is approved
+		cancel()
+		if err := p.awaitApproval(parent, req, reason); err != nil {
+			return nil, err
+		}
+		ctx, cancel = p.requestContext(parent)
+		if ctx.Err() != nil {
+			return nil, requestDone(ctx)
+		}
 	}
 
-	// Calculate session duration (default 1 hour, max from TTL if provided)
-	sessionDuration := int32(3600) // 1 hour default
-	if req.TTL > 0 {
-		ttlSeconds := int32(req.TTL.Seconds())
-		// AWS allows 900 to 43200 seconds (15 min to 12 hours)
-		if ttlSeconds >= 900 && ttlSeconds <= 43200 {
-			sessionDuration = ttlSeconds
-		} else if ttlSeconds < 900 {
-			sessionDuration = 900 // minimum
-		} else {
-			sessionDuration = 43200 // maximum
+	renews, err := p.renewalOf(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := p.cacheKey(req)
+	if err != nil {
+		return nil, err
+	}
+	reqKey := requestKey(key, req)
+	if p.window != nil && renews == nil {
+		if cred := p.window.get(reqKey); cred != nil {
+			result = "cached"
+			return cred, nil
 		}
 	}
 
-	// Build assume role input
-	assumeInput := &sts.AssumeRoleInput{
-		RoleArn:         aws.String(p.config.RoleARN),
-		RoleSessionName: aws.String(fmt.Sprintf("creddy-%s-%d", req.Scope, time.Now().Unix())),
-		DurationSeconds: aws.Int32(sessionDuration),
+	// Break-glass credentials are never shared between requests
+	cacheable := p.cache != nil && renews == nil && !breakGlass
+	if cacheable {
+		if p.prefetch != nil && p.config.prefetchable(req) {
+			p.prefetch.observe(key, req)
+		}
+		cached := p.cache.get(key, req.TTL)
+		p.metrics.recordCacheLookup(cached != nil)
+		if cached != nil {
+			result = "cached"
+			return cached, nil
+		}
 	}
 
-	if p.config.ExternalID != "" {
-		assumeInput.ExternalId = aws.String(p.config.ExternalID)
+	cred, err = p.issueShared(ctx, req, renews, key, cacheable, false)
+	if ctx.Err() != nil {
+		// Whatever was issued, the caller is no longer waiting for it
+		return nil, requestDone(ctx)
+	}
+	if err != nil {
+		// Fall back to a still-valid cached credential while AWS is unavailable
+		if cacheable && isServiceOutage(err) {
+			if stale := p.cache.getValid(key, req.TTL); stale != nil {
+				sdk.Warn("serving cached credential during AWS outage", "scope", req.Scope, "expires_at", stale.ExpiresAt, "error", err)
+				if stale.Metadata == nil {
+					stale.Metadata = make(map[string]string)
+				}
+				stale.Metadata["degraded"] = "true"
+				stale.Metadata["degraded_reason"] = redactError(err).Error()
+				result = "degraded"
+				return stale, nil
+			}
+		}
+		return nil, err
+	}
+	if p.window != nil && renews == nil {
+		p.window.put(reqKey, cred)
+	}
+	result = "issued"
+	return cred, nil
+}
+
+// issueShared issues a credential, recording it in the ledger and cache.
+// Concurrent identical requests from the same agent share one issuance.
+func (p *AWSPlugin) issueShared(ctx context.Context, req *sdk.CredentialRequest, renews *LedgerEntry, key string, cacheable, prefetch bool) (*sdk.Credential, error) {
+	flight := requestKey(key, req)
+	if prefetch {
+		// Prefetches are not charged to quotas, so requests do not join them
+		flight += "\x00prefetch"
+	}
+	return p.inflight.do(ctx, flight, func(ctx context.Context) (*sdk.Credential, error) {
+		ctx, iss := withIssuance(ctx)
+		iss.Agent = req.Agent
+		iss.Scope = req.Scope
+		iss.Renews = renews
+		iss.Prefetch = prefetch
+
+		// Parse the requester's key before anything is issued to it
+		recipient, err := parseEnvelopeRecipient(req.Parameters[encryptToParam])
+		if err != nil {
+			return nil, err
+		}
+
+		if !prefetch {
+			release, err := p.quotas.reserve(req, renews, &p.metrics)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+		}
+
+		cred, err := p.issueCredential(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if cred.Credential == "" {
+			cred.Credential = iss.credentialID()
+		}
+		p.enrichMetadata(cred, iss)
+		if recipient != nil {
+			if cred.Value, err = recipient.seal(cred.Value); err != nil {
+				return nil, err
+			}
+			cred.Metadata["encryption"] = recipient.scheme
+		}
+		p.recordIssuance(ctx, req, iss, cred)
+		if cacheable {
+			p.cache.put(key, cred)
+		}
+		return cred, nil
+	})
+}
+
+// issueCredential issues the credential for a validated scope
+func (p *AWSPlugin) issueCredential(ctx context.Context, req *sdk.CredentialRequest) (*sdk.Credential, error) {
+	// Bundles of other scopes; each part already carries the expiry margin
+	if resource, ok := strings.CutPrefix(req.Scope, multiScopePrefix); ok {
+		return p.issueMulti(ctx, req, resource)
+	}
+
+	format, err := p.credentialFormat(req)
+	if err != nil {
+		return nil, err
+	}
+	if iss := issuanceFrom(ctx); iss != nil {
+		iss.Format = format
+		iss.Justification = requestJustification(req)
+		if req.Scope == breakGlassScope {
+			iss.MFACode = req.Parameters[mfaCodeParam]
+		}
+		if iss.Network, err = p.networkRestriction(req); err != nil {
+			return nil, err
+		}
+	}
+	region, err := p.requestRegion(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Specialised credential types (auth tokens, presigned URLs, ...)
+	if ct, resource, ok := lookupCredentialType(req.Scope); ok {
+		cred, err := ct.Issue(p, ctx, req, resource, region)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := cred.Metadata["region"]; ok {
+			cred.Metadata["region"] = region
+		}
+		cred.ExpiresAt = p.withExpiryMargin(cred.ExpiresAt)
+		return cred, nil
 	}
 
 	// Assume the role
-	result, err := client.AssumeRole(ctx, assumeInput)
+	session, err := p.assumeRoleSession(ctx, req.Scope, sessionDurationSeconds(req.TTL))
 	if err != nil {
-		return nil, fmt.Errorf("failed to assume role: %w", err)
+		return nil, err
+	}
+	creds := session.Credentials
+
+	if p.config.scopeConfig(req.Scope).Verify {
+		if err := p.verifySession(ctx, req.Scope, creds); err != nil {
+			return nil, err
+		}
 	}
 
-	// Build the credential value as JSON
-	credValue := AWSCredentialValue{
-		AccessKeyID:     *result.Credentials.AccessKeyId,
-		SecretAccessKey: *result.Credentials.SecretAccessKey,
-		SessionToken:    *result.Credentials.SessionToken,
-		Region:          p.config.Region,
+	// TTLs below the STS floor get a minimum-length session that is denied
+	// once the requested TTL has passed
+	expiresAt := *creds.Expiration
+	if p.logicalTTL(req.TTL) {
+		expiresAt = time.Now().Add(req.TTL)
+		p.scheduleLogicalExpiry(sessionName(session), expiresAt, *creds.Expiration)
 	}
+	expiresAt = p.withExpiryMargin(expiresAt)
 
-	credJSON, err := json.Marshal(credValue)
+	var value string
+	if format == formatDocker {
+		value, expiresAt, err = p.dockerCredentials(ctx, req, creds, region, expiresAt)
+	} else {
+		value, err = p.formatSessionCredentials(format, req, session, region, expiresAt)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+		return nil, err
 	}
 
+	metadata := p.baseMetadata(req.Scope)
+	metadata["region"] = region
+	externalID := sessionRevocationID(sessionName(session), *creds.Expiration)
+	if iss := issuanceFrom(ctx); iss != nil && iss.CredentialID != "" {
+		externalID = iss.CredentialID
+	}
 	return &sdk.Credential{
-		Value:     string(credJSON),
-		ExpiresAt: *result.Credentials.Expiration,
-		Metadata: map[string]string{
-			"role_arn": p.config.RoleARN,
-			"region":   p.config.Region,
-			"scope":    req.Scope,
-		},
+		Value:      value,
+		ExpiresAt:  expiresAt,
+		Credential: externalID,
+		Metadata:   metadata,
 	}, nil
 }
 
-func (p *AWSPlugin) RevokeCredential(ctx context.Context, externalID string) error {
-	// STS temporary credentials cannot be revoked
-	// They expire automatically based on the session duration
+func (p *AWSPlugin) RevokeCredential(ctx context.Context, externalID string) (err error) {
+	defer recoverPanic("RevokeCredential", &err)
+	defer func() { err = redactError(err) }()
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	defer func() { err = p.describeError("revocation", err) }()
+
+	if p.config != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = p.requestContext(ctx)
+		defer cancel()
+		defer func() { p.auditRevocation(context.WithoutCancel(ctx), externalID, err) }()
+	}
+	return p.revokeCredential(ctx, externalID)
+}
+
+// revokeCredential revokes a credential, for callers holding the read lock
+func (p *AWSPlugin) revokeCredential(ctx context.Context, externalID string) error {
+	if selector, ok := strings.CutPrefix(externalID, bulkRevocationPrefix); ok {
+		return p.revokeAll(ctx, selector)
+	}
+
+	if p.cache != nil {
+		p.cache.evict(externalID)
+	}
+	if p.window != nil {
+		p.window.evict(externalID)
+	}
+
+	if p.config != nil && p.ledger != nil {
+		entry, err := p.ledger.Get(ctx, externalID)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			if err := p.revokeEntry(ctx, entry); err != nil {
+				return err
+			}
+			p.markRevoked(ctx, entry)
+			return nil
+		}
+	}
+
+	return p.revokeExternalID(ctx, externalID)
+}
+
+// revokeEntry revokes a credential recorded in the ledger. Credentials backed
+// by a role session (tokens, presigned URLs, ...) are revoked through their
+// session; those backed by none cannot be revoked.
+func (p *AWSPlugin) revokeEntry(ctx context.Context, entry *LedgerEntry) error {
+	if strings.HasPrefix(entry.ID, credentialIDPrefix) {
+		if entry.SessionName == "" {
+			return errCannotRevoke(entry)
+		}
+		return p.revokeSessions(ctx, []string{entry.SessionName}, entry.SessionExpiresAt)
+	}
+	return p.revokeExternalID(ctx, entry.ID)
+}
+
+// errCannotRevoke is the error revoking a credential backed by no role
+// session, such as a CloudFront signed URL
+func errCannotRevoke(entry *LedgerEntry) error {
+	hint := "it stays valid until it expires"
+	if entry.ExpiresAt.IsZero() {
+		hint = "it stays valid until the access key it was derived from is rotated"
+	}
+	return &pluginError{kind: errInvalidScope, msg: "credential type of scope " + entry.Scope + " cannot be revoked", hint: hint}
+}
+
+// revokeExternalID revokes a credential from its self-describing external ID
+func (p *AWSPlugin) revokeExternalID(ctx context.Context, externalID string) error {
+	// Bundles are revoked part by part
+	if ids, ok := strings.CutPrefix(externalID, multiExternalIDPrefix); ok {
+		return p.revokeMulti(ctx, ids)
+	}
+
+	// KMS grants are revoked by retiring them
+	if grantID, keyID, region, ok := parseKMSGrantExternalID(externalID); ok {
+		if p.config == nil {
+			return fmt.Errorf("plugin not configured")
+		}
+		return p.retireKMSGrant(ctx, keyID, grantID, region)
+	}
+
+	// STS sessions cannot be invalidated directly; deny them on the role
+	// until they would have expired anyway
+	if name, expiresAt, ok := parseSessionRevocationID(externalID); ok {
+		if p.config == nil {
+			return fmt.Errorf("plugin not configured")
+		}
+		return p.revokeSessions(ctx, []string{name}, expiresAt)
+	}
+
+	// Generated IDs map back to a credential through the ledger alone
+	if strings.HasPrefix(externalID, credentialIDPrefix) {
+		return &pluginError{kind: errInvalidScope, msg: "credential " + externalID + " is not in the ledger and cannot be revoked"}
+	}
 	return nil
 }
 
-func (p *AWSPlugin) MatchScope(ctx context.Context, scope string) (bool, error) {
+func (p *AWSPlugin) MatchScope(ctx context.Context, scope string) (_ bool, err error) {
+	defer recoverPanic("MatchScope", &err)
+
 	return isValidAWSScope(scope), nil
 }
 
 // --- AWS helpers ---
 
+// awsClients holds the AWS config and clients of the configured IAM user.
+// They are built once by Configure, since loading the config reads the
+// environment and shared files, and clients are safe for concurrent use.
+type awsClients struct {
+	base aws.Config
+	sts  *sts.Client
+	iam  *iam.Client
+}
+
+// newAWSClients builds the AWS config and clients for a plugin config
+func newAWSClients(ctx context.Context, c *AWSConfig) (*awsClients, error) {
+	base, err := newAWSConfig(ctx, c, baseCredentialsProvider(c))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return &awsClients{
+		base: base,
+		sts:  c.newSTSClient(base),
+		iam: iam.NewFromConfig(c.serviceAWSConfig(base, "iam"), func(o *iam.Options) {
+			o.APIOptions = append(o.APIOptions, withCircuitBreaker(c.iamBreaker)...)
+		}),
+	}, nil
+}
+
 func (p *AWSPlugin) createSTSClient(ctx context.Context) (*sts.Client, error) {
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion(p.config.Region),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			p.config.AccessKeyID,
-			p.config.SecretAccessKey,
-			"",
-		)),
+	if p.clients == nil {
+		return nil, fmt.Errorf("plugin not configured")
+	}
+	return p.clients.sts, nil
+}
+
+func (p *AWSPlugin) createIAMClient(ctx context.Context) (*iam.Client, error) {
+	if p.clients == nil {
+		return nil, fmt.Errorf("plugin not configured")
+	}
+	return p.clients.iam, nil
+}
+
+// baseCredentialsProvider returns the static credentials of the configured
+// IAM user
+func baseCredentialsProvider(cfg *AWSConfig) aws.CredentialsProvider {
+	return credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken)
+}
+
+// sessionAWSConfig returns an AWS config that uses assumed-role credentials,
+// for calling downstream services on behalf of a scope. It shares the
+// configured HTTP client and settings rather than loading a new config.
+func (p *AWSPlugin) sessionAWSConfig(ctx context.Context, creds *types.Credentials) (aws.Config, error) {
+	if p.clients == nil {
+		return aws.Config{}, fmt.Errorf("plugin not configured")
+	}
+	cfg := p.clients.base.Copy()
+	cfg.Credentials = credentials.NewStaticCredentialsProvider(
+		aws.ToString(creds.AccessKeyId),
+		aws.ToString(creds.SecretAccessKey),
+		aws.ToString(creds.SessionToken),
 	)
+	return cfg, nil
+}
+
+// assumeRole assumes the configured role on behalf of a scope and returns the
+// temporary credentials
+func (p *AWSPlugin) assumeRole(ctx context.Context, scope string, durationSeconds int32) (*types.Credentials, error) {
+	result, err := p.assumeRoleSession(ctx, scope, durationSeconds)
+	if err != nil {
+		return nil, err
+	}
+	return result.Credentials, nil
+}
+
+// assumeRoleSession assumes the configured role on behalf of a scope and
+// returns the full STS response
+func (p *AWSPlugin) assumeRoleSession(ctx context.Context, scope string, durationSeconds int32) (*sts.AssumeRoleOutput, error) {
+	// Create STS client
+	client, err := p.createSTSClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create STS client: %w", err)
+	}
+
+	name, err := p.roleSessionName(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clamp to the role's limit rather than let STS reject the request
+	if max, limit := p.sessionLimit(ctx); durationSeconds > int32(max.Seconds()) {
+		durationSeconds = int32(max.Seconds())
+		if iss := issuanceFrom(ctx); iss != nil {
+			iss.DurationNote = "session capped at " + formatDuration(max) + " by " + limit
+		}
+	}
+
+	// Build assume role input
+	assumeInput := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(p.config.RoleARN),
+		RoleSessionName: aws.String(name),
+		DurationSeconds: aws.Int32(durationSeconds),
+	}
+
+	if p.config.ExternalID != "" {
+		assumeInput.ExternalId = aws.String(p.config.ExternalID)
+	}
+
+	policy, err := p.sessionPolicy(scope)
 	if err != nil {
 		return nil, err
 	}
+	if iss := issuanceFrom(ctx); iss != nil && iss.Network != nil {
+		if policy, err = iss.Network.apply(policy); err != nil {
+			return nil, err
+		}
+	}
+	if policy != "" {
+		if err := p.checkSessionPolicy(ctx, scope, policy); err != nil {
+			return nil, err
+		}
+		assumeInput.Policy = aws.String(policy)
+	}
+
+	// The session's expiry is only known once STS answers, so its revocation
+	// ID is built from an upper bound of it
+	credentialID := sessionRevocationID(name, time.Now().Add(time.Duration(durationSeconds)*time.Second+credentialIDExpirySlack))
+	var agentID, requester string
+	if iss := issuanceFrom(ctx); iss != nil {
+		if iss.CredentialID == "" {
+			iss.CredentialID = credentialID
+		}
+		credentialID = iss.CredentialID
+		agentID = iss.Agent.ID
+		requester = iss.Agent.Name
+		if requester == "" {
+			requester = iss.Agent.ID
+		}
+		if iss.Justification != "" && (p.config.scopeConfig(scope).RequireJustification || scope == breakGlassScope) {
+			addJustification(assumeInput, requester, iss.Justification)
+		}
+		if scope == breakGlassScope && iss.MFACode != "" {
+			addBreakGlassMFA(assumeInput, p.config.BreakGlassMFASerial, iss.MFACode)
+		}
+	}
+	addWatermark(assumeInput, credentialID)
+	if p.config.ComplianceMode != "" {
+		if requester == "" {
+			requester = userAgentProduct
+		}
+		addComplianceTags(assumeInput, requester, scope)
+	}
+	if err := p.rateLimiter.allow(scope, agentID); err != nil {
+		return nil, err
+	}
+
+	var result *sts.AssumeRoleOutput
+	err = p.throttle.call(ctx, func() error {
+		var err error
+		result, err = client.AssumeRole(ctx, assumeInput)
+		if err != nil && p.clock.observeError(err) {
+			// The client corrects its signing time from the failed attempt
+			sdk.Debug("retrying AssumeRole after clock skew", "error", err)
+			result, err = client.AssumeRole(ctx, assumeInput)
+		}
+		if ctx.Err() == nil {
+			p.health.recordAssumeRole(scope, err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, p.assumeRoleError(ctx, err)
+	}
+	p.clock.observe(result.ResultMetadata)
+
+	// Expiry on the local clock, so local expiry checks are accurate
+	if creds := result.Credentials; creds != nil && creds.Expiration != nil {
+		creds.Expiration = aws.Time(p.clock.local(*creds.Expiration))
+	}
+	recordSession(ctx, p.config.RoleARN, result)
+
+	return result, nil
+}
+
+// checkTTL rejects TTLs outside the supported session durations in strict
+// mode, where they would otherwise be clamped
+func (p *AWSPlugin) checkTTL(ctx context.Context, ttl time.Duration) error {
+	if !p.config.StrictTTL.Value || ttl <= 0 {
+		return nil
+	}
+	if ttl < minSessionDuration && !p.logicalTTL(ttl) {
+		return fmt.Errorf("requested TTL %s is below the STS minimum of %s", formatDuration(ttl), formatDuration(minSessionDuration))
+	}
+	if ttl > maxSessionDuration {
+		return fmt.Errorf("requested TTL %s exceeds the STS maximum of %s", formatDuration(ttl), formatDuration(maxSessionDuration))
+	}
+	if max, limit := p.sessionLimit(ctx); ttl > max {
+		return fmt.Errorf("requested TTL %s exceeds %s", formatDuration(ttl), limit)
+	}
+	return nil
+}
+
+// sessionDurationSeconds converts a requested TTL into an STS session duration
+func sessionDurationSeconds(ttl time.Duration) int32 {
+	// Calculate session duration (default 1 hour, max from TTL if provided)
+	sessionDuration := int32(3600) // 1 hour default
+	if ttl > 0 {
+		ttlSeconds := int32(ttl.Seconds())
+		// AWS allows 900 to 43200 seconds (15 min to 12 hours)
+		if ttlSeconds >= 900 && ttlSeconds <= 43200 {
+			sessionDuration = ttlSeconds
+		} else if ttlSeconds < 900 {
+			sessionDuration = 900 // minimum
+		} else {
+			sessionDuration = 43200 // maximum
+		}
+	}
+	return sessionDuration
+}
+
+// baseMetadata returns the metadata attached to every issued credential
+func (p *AWSPlugin) baseMetadata(scope string) map[string]string {
+	return map[string]string{
+		"role_arn": p.config.RoleARN,
+		"region":   p.config.Region,
+		"scope":    scope,
+	}
+}
 
-	return sts.NewFromConfig(cfg), nil
+// signingCredentials converts STS credentials into SigV4 signing credentials
+func signingCredentials(creds *types.Credentials) aws.Credentials {
+	return aws.Credentials{
+		AccessKeyID:     aws.ToString(creds.AccessKeyId),
+		SecretAccessKey: aws.ToString(creds.SecretAccessKey),
+		SessionToken:    aws.ToString(creds.SessionToken),
+		CanExpire:       creds.Expiration != nil,
+		Expires:         aws.ToTime(creds.Expiration),
+	}
 }
 
 // isValidAWSScope checks if a scope is a valid AWS scope
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// These tests exercise the plugin's locking; run them with go test -race.
+
+// fakeAWS answers the STS and IAM calls the plugin makes, on one endpoint.
+// With hangAssumeRole set, AssumeRole waits until the caller gives up.
+type fakeAWS struct {
+	*httptest.Server
+	hangAssumeRole bool
+	assumeRoles    atomic.Int64
+	hanging        chan struct{}
+
+	mu       sync.Mutex
+	policies []url.Values
+}
+
+func newFakeAWS(t *testing.T, hangAssumeRole bool) *fakeAWS {
+	f := &fakeAWS{hangAssumeRole: hangAssumeRole, hanging: make(chan struct{}, 100)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeAWS) serve(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	switch action := r.Form.Get("Action"); action {
+	case "AssumeRole":
+		if f.hangAssumeRole {
+			f.hanging <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		n := f.assumeRoles.Add(1)
+		name := r.Form.Get("RoleSessionName")
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult>`+
+			`<Credentials><AccessKeyId>ASIATEST%d</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>%s</Expiration></Credentials>`+
+			`<AssumedRoleUser><Arn>arn:aws:sts::123456789012:assumed-role/test/%s</Arn><AssumedRoleId>AROATEST:%s</AssumedRoleId></AssumedRoleUser>`+
+			`</AssumeRoleResult></AssumeRoleResponse>`, n, time.Now().Add(time.Hour).UTC().Format(time.RFC3339), name, name)
+	case "GetCallerIdentity":
+		fmt.Fprint(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><GetCallerIdentityResult>`+
+			`<Arn>arn:aws:iam::123456789012:user/creddy</Arn><UserId>AIDATEST</UserId><Account>123456789012</Account>`+
+			`</GetCallerIdentityResult></GetCallerIdentityResponse>`)
+	case "GetRole":
+		fmt.Fprint(w, `<GetRoleResponse xmlns="https://iam.amazonaws.com/doc/2010-05-08/"><GetRoleResult><Role>`+
+			`<RoleName>test</RoleName><RoleId>AROATEST</RoleId><Arn>arn:aws:iam::123456789012:role/test</Arn><Path>/</Path>`+
+			`<CreateDate>2024-01-01T00:00:00Z</CreateDate><MaxSessionDuration>43200</MaxSessionDuration>`+
+			`</Role></GetRoleResult></GetRoleResponse>`)
+	case "GetRolePolicy":
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<ErrorResponse><Error><Type>Sender</Type><Code>NoSuchEntity</Code><Message>not found</Message></Error></ErrorResponse>`)
+	case "PutRolePolicy", "DeleteRolePolicy":
+		if action == "PutRolePolicy" {
+			f.mu.Lock()
+			f.policies = append(f.policies, r.Form)
+			f.mu.Unlock()
+		}
+		fmt.Fprintf(w, `<%sResponse xmlns="https://iam.amazonaws.com/doc/2010-05-08/"></%sResponse>`, action, action)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>InvalidAction</Code><Message>%s</Message></Error></ErrorResponse>`, action)
+	}
+}
+
+// putRolePolicies returns the parameters of the PutRolePolicy calls made
+func (f *fakeAWS) putRolePolicies() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.policies)
+}
+
+// config returns a plugin configuration against the fake, with extra
+// settings appended
+func (f *fakeAWS) config(extra string) string {
+	return fmt.Sprintf(`{"access_key_id":"AKIATEST","secret_access_key":"secret","role_arn":"arn:aws:iam::123456789012:role/test","endpoint_url":%q%s}`, f.URL, extra)
+}
+
+func TestConfigureConcurrentWithRequests(t *testing.T) {
+	f := newFakeAWS(t, false)
+	configs := []string{
+		f.config(`,"cache":true,"prefetch":true,"prefetch_min_requests":1,"idempotency_window":"1s"`),
+		f.config(`,"janitor_interval":"5ms","canary_interval":"5ms"`),
+		f.config(`,"ledger":"none","request_timeout":"5s"`),
+	}
+
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), configs[0]); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	deadline := time.Now().Add(time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &sdk.CredentialRequest{Scope: "aws", TTL: time.Hour, Agent: sdk.Agent{ID: fmt.Sprintf("agent-%d", i%2)}}
+			for ctx.Err() == nil {
+				cred, err := p.GetCredential(ctx, req)
+				if err != nil {
+					// Calls time out with the test's deadline, possibly just
+					// before ctx reports it
+					if time.Now().Before(deadline) {
+						errs <- fmt.Errorf("GetCredential: %w", err)
+					}
+					return
+				}
+				if i%4 == 0 {
+					// Revoking needs the ledger, which one configuration lacks
+					p.RevokeCredential(ctx, cred.Credential)
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; ctx.Err() == nil; i++ {
+			if err := p.Configure(context.Background(), configs[i%len(configs)]); err != nil {
+				errs <- fmt.Errorf("Configure: %w", err)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	wg.Wait()
+
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if f.assumeRoles.Load() == 0 {
+		t.Error("no credentials were issued")
+	}
+}
+
+func TestBackgroundChecksDoNotBlockConfigure(t *testing.T) {
+	f := newFakeAWS(t, true)
+	const requestTimeout = 500 * time.Millisecond
+
+	// Every probe of the canary hangs until the request budget runs out; a
+	// pass over all its scopes takes several budgets
+	p := &AWSPlugin{}
+	cfg := f.config(`,"request_timeout":"500ms","canary_interval":"1h","canary_scopes":["aws:s3","aws:ec2","aws:lambda","aws:sqs","aws:sns","aws:iam"]`)
+	if err := p.Configure(context.Background(), cfg); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	select {
+	case <-f.hanging:
+	case <-time.After(5 * time.Second):
+		t.Fatal("canary did not probe")
+	}
+
+	start := time.Now()
+	if err := p.Configure(context.Background(), f.config(`,"request_timeout":"500ms"`)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	if waited := time.Since(start); waited > 2*requestTimeout {
+		t.Errorf("Configure waited %s for the canary, more than one probe's budget of %s", waited, requestTimeout)
+	}
+}
+
+func TestConcurrentShutdown(t *testing.T) {
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), f.config(`,"cache":true,"janitor_interval":"5ms"`)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Fails once the plugin is shut down; only races matter here
+			p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: "aws:s3", TTL: time.Hour, Agent: sdk.Agent{ID: "agent"}})
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.Shutdown(context.Background())
+	}()
+	wg.Wait()
+
+	if _, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: "aws", TTL: time.Hour}); err == nil {
+		t.Error("GetCredential succeeded after Shutdown")
+	}
+}
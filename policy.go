@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// policyDocument is an IAM policy document
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+// policyStatement is a single IAM policy statement
+type policyStatement struct {
+	Sid       string                            `json:"Sid,omitempty"`
+	Effect    string                            `json:"Effect"`
+	Action    stringList                        `json:"Action"`
+	Resource  stringList                        `json:"Resource"`
+	Condition map[string]map[string]interface{} `json:"Condition,omitempty"`
+}
+
+// stringList is a policy element that may be written as a single string or a
+// list of strings
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = stringList{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// newPolicy returns a policy document with the current policy language version
+func newPolicy(statements ...policyStatement) *policyDocument {
+	return &policyDocument{Version: "2012-10-17", Statement: statements}
+}
+
+// String returns the policy as compact JSON
+func (d *policyDocument) String() (string, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal policy: %w", err)
+	}
+	return string(b), nil
+}
+
+// sessionPolicy returns the session policy that narrows the role's
+// permissions for a scope, or "" when the scope uses the role as-is
+func (p *AWSPlugin) sessionPolicy(scope string) (string, error) {
+	if database, ok := strings.CutPrefix(scope, "aws:datalake:"); ok {
+		policy, err := p.dataLakePolicy(database)
+		if err != nil {
+			return "", err
+		}
+		return policy.String()
+	}
+	if doc := p.config.scopeConfig(scope).SessionPolicy; len(doc) > 0 {
+		var b bytes.Buffer
+		if err := json.Compact(&b, doc); err != nil {
+			return "", fmt.Errorf("invalid session_policy: %w", err)
+		}
+		return b.String(), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// Modes of session_policy_validation
+const (
+	policyValidationWarn  = "warn"
+	policyValidationBlock = "block"
+)
+
+const (
+	// accessAnalyzerService is the signing name and endpoint prefix of IAM
+	// Access Analyzer, and its key in endpoint_urls
+	accessAnalyzerService = "access-analyzer"
+
+	// policyValidationTimeout bounds the ValidatePolicy calls of a policy
+	policyValidationTimeout = 10 * time.Second
+)
+
+// Access Analyzer finding types that block a session policy in block mode:
+// invalid policies and overly permissive ones
+var blockingFindingTypes = map[string]bool{
+	"ERROR":            true,
+	"SECURITY_WARNING": true,
+}
+
+// policyFinding is an Access Analyzer finding on a policy
+type policyFinding struct {
+	FindingType    string `json:"findingType"`
+	IssueCode      string `json:"issueCode"`
+	FindingDetails string `json:"findingDetails"`
+	LearnMoreLink  string `json:"learnMoreLink"`
+}
+
+func (f policyFinding) String() string {
+	return f.FindingType + " " + f.IssueCode + ": " + f.FindingDetails
+}
+
+// policyChecks validates generated session policies with Access Analyzer
+// before they are attached, remembering the findings of each policy
+// document, which do not change for the same document
+type policyChecks struct {
+	mode string
+
+	mu       sync.Mutex
+	findings map[string][]policyFinding
+}
+
+func newPolicyChecks(mode string) *policyChecks {
+	return &policyChecks{mode: mode, findings: make(map[string][]policyFinding)}
+}
+
+// validatePolicyValidation checks session_policy_validation
+func validatePolicyValidation(c *AWSConfig) error {
+	switch c.SessionPolicyValidation {
+	case "", policyValidationWarn, policyValidationBlock:
+		return nil
+	}
+	return fmt.Errorf("invalid session_policy_validation %q (expected warn or block)", c.SessionPolicyValidation)
+}
+
+// checkSessionPolicy validates a scope's session policy. Findings are
+// logged; in block mode, errors and security warnings fail the request. If
+// Access Analyzer cannot be reached, the failure is logged and the policy is
+// attached, so an Access Analyzer outage does not stop issuance.
+func (p *AWSPlugin) checkSessionPolicy(ctx context.Context, scope, policy string) error {
+	c := p.policyChecks
+	if c == nil {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(policy))
+	key := hex.EncodeToString(sum[:])
+
+	c.mu.Lock()
+	findings, ok := c.findings[key]
+	c.mu.Unlock()
+	if !ok {
+		ctx, cancel := context.WithTimeout(ctx, policyValidationTimeout)
+		defer cancel()
+		var err error
+		findings, err = p.validatePolicy(ctx, policy)
+		if err != nil {
+			sdk.Warn("failed to validate session policy with Access Analyzer, attaching it unchecked", "scope", scope, "error", err)
+			return nil
+		}
+		c.mu.Lock()
+		c.findings[key] = findings
+		c.mu.Unlock()
+		for _, f := range findings {
+			sdk.Warn("Access Analyzer finding on session policy", "scope", scope, "finding", f.String(), "link", f.LearnMoreLink)
+		}
+	}
+
+	if c.mode != policyValidationBlock {
+		return nil
+	}
+	var blocking []string
+	for _, f := range findings {
+		if blockingFindingTypes[f.FindingType] {
+			blocking = append(blocking, f.String())
+		}
+	}
+	if len(blocking) == 0 {
+		return nil
+	}
+	return &pluginError{
+		kind: errConfiguration,
+		msg:  "session policy of scope " + scope + " failed Access Analyzer validation: " + strings.Join(blocking, "; "),
+		hint: "fix the policy settings of the scope, or set session_policy_validation to warn",
+	}
+}
+
+// validatePolicy runs an identity policy through Access Analyzer's
+// ValidatePolicy with the base credentials and returns its findings
+func (p *AWSPlugin) validatePolicy(ctx context.Context, policy string) ([]policyFinding, error) {
+	input := map[string]string{"policyDocument": policy, "policyType": "IDENTITY_POLICY"}
+	var findings []policyFinding
+	query := url.Values{}
+	for {
+		var out struct {
+			Findings  []policyFinding `json:"findings"`
+			NextToken string          `json:"nextToken"`
+		}
+		if err := p.callAccessAnalyzer(ctx, http.MethodPost, "/policy/validation", query, input, &out); err != nil {
+			return nil, fmt.Errorf("failed to call ValidatePolicy: %w", err)
+		}
+		findings = append(findings, out.Findings...)
+		if out.NextToken == "" {
+			return findings, nil
+		}
+		query.Set("nextToken", out.NextToken)
+	}
+}
+
+// callAccessAnalyzer makes a REST call to IAM Access Analyzer with the base
+// credentials, encoding input (if any) and decoding the response into out
+func (p *AWSPlugin) callAccessAnalyzer(ctx context.Context, method, path string, query url.Values, input, out any) error {
+	u := p.config.serviceEndpoint(accessAnalyzerService, p.config.Region) + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	header := http.Header{}
+	if input != nil {
+		header.Set("Content-Type", "application/json")
+	}
+	return p.callAWS(ctx, accessAnalyzerService, p.config.Region, method, u, header, input, out)
+}
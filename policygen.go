@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+const (
+	// policyGenerationPath is where the metrics listener starts policy
+	// generation jobs and serves their proposals
+	policyGenerationPath = "/policy-generation"
+
+	// defaultPolicyGenerationPeriod is how much CloudTrail activity a job
+	// reads by default; Access Analyzer reads at most 90 days
+	defaultPolicyGenerationPeriod = 30 * 24 * time.Hour
+	maxPolicyGenerationPeriod     = 90 * 24 * time.Hour
+
+	// policyGenerationTimeout bounds the Access Analyzer calls of a request
+	policyGenerationTimeout = 30 * time.Second
+)
+
+// policyProposal is a policy generation job for a scope, with the session
+// policy it proposes once it has succeeded
+type policyProposal struct {
+	Scope  string          `json:"scope"`
+	JobID  string          `json:"job_id"`
+	Status string          `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	Policy *policyDocument `json:"policy,omitempty"`
+
+	// Scopes is the scopes setting applying the proposal
+	Scopes map[string]ScopeConfig `json:"scopes,omitempty"`
+}
+
+// validatePolicyGeneration checks the policy generation settings
+func validatePolicyGeneration(c *AWSConfig) error {
+	if c.PolicyGenerationTrailARN == "" {
+		if c.PolicyGenerationRoleARN != "" || c.PolicyGenerationPeriod != 0 {
+			return fmt.Errorf("policy_generation_role_arn and policy_generation_period require policy_generation_trail_arn")
+		}
+		return nil
+	}
+	if parsed, err := arn.Parse(c.PolicyGenerationTrailARN); err != nil {
+		return fmt.Errorf("invalid policy_generation_trail_arn: %w", err)
+	} else if parsed.Service != "cloudtrail" {
+		return fmt.Errorf("policy_generation_trail_arn is not a CloudTrail trail ARN: %s", c.PolicyGenerationTrailARN)
+	}
+	if c.PolicyGenerationRoleARN == "" {
+		return fmt.Errorf("policy_generation_trail_arn requires policy_generation_role_arn")
+	}
+	if _, err := parseRoleARN(c.PolicyGenerationRoleARN); err != nil {
+		return fmt.Errorf("invalid policy_generation_role_arn: %w", err)
+	}
+	if c.PolicyGenerationPeriod == 0 {
+		c.PolicyGenerationPeriod = duration(defaultPolicyGenerationPeriod)
+	}
+	if d := time.Duration(c.PolicyGenerationPeriod); d < 24*time.Hour || d > maxPolicyGenerationPeriod {
+		return fmt.Errorf("policy_generation_period must be between 24h and %s", formatDuration(maxPolicyGenerationPeriod))
+	}
+	return nil
+}
+
+// startPolicyGeneration starts an Access Analyzer job generating a policy
+// from the role's CloudTrail activity over policy_generation_period
+func (p *AWSPlugin) startPolicyGeneration(ctx context.Context, scope string) (*policyProposal, error) {
+	end := time.Now().UTC()
+	start := end.Add(-time.Duration(p.config.PolicyGenerationPeriod))
+	input := map[string]any{
+		"policyGenerationDetails": map[string]string{"principalArn": p.config.RoleARN},
+		"cloudTrailDetails": map[string]any{
+			"accessRole": p.config.PolicyGenerationRoleARN,
+			"startTime":  start.Format(time.RFC3339),
+			"endTime":    end.Format(time.RFC3339),
+			"trails":     []map[string]any{{"cloudTrailArn": p.config.PolicyGenerationTrailARN, "allRegions": true}},
+		},
+	}
+	var out struct {
+		JobID string `json:"jobId"`
+	}
+	if err := p.callAccessAnalyzer(ctx, http.MethodPut, "/policy/generation", nil, input, &out); err != nil {
+		return nil, fmt.Errorf("failed to start policy generation: %w", err)
+	}
+	return &policyProposal{Scope: scope, JobID: out.JobID, Status: "IN_PROGRESS"}, nil
+}
+
+// policyGeneration returns the state of a policy generation job and, once it
+// has succeeded, the generated policies merged into a session policy for the
+// scope
+func (p *AWSPlugin) policyGeneration(ctx context.Context, scope, jobID string) (*policyProposal, error) {
+	query := url.Values{
+		"includeResourcePlaceholders": {"false"},
+		"includeServiceLevelTemplate": {"false"},
+	}
+	var out struct {
+		JobDetails struct {
+			Status   string `json:"status"`
+			JobError *struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"jobError"`
+		} `json:"jobDetails"`
+		GeneratedPolicyResult struct {
+			GeneratedPolicies []struct {
+				Policy string `json:"policy"`
+			} `json:"generatedPolicies"`
+		} `json:"generatedPolicyResult"`
+	}
+	if err := p.callAccessAnalyzer(ctx, http.MethodGet, "/policy/generation/"+url.PathEscape(jobID), query, nil, &out); err != nil {
+		return nil, fmt.Errorf("failed to get generated policy: %w", err)
+	}
+
+	proposal := &policyProposal{Scope: scope, JobID: jobID, Status: out.JobDetails.Status}
+	if e := out.JobDetails.JobError; e != nil {
+		proposal.Error = e.Code + ": " + e.Message
+	}
+	if proposal.Status != "SUCCEEDED" {
+		return proposal, nil
+	}
+
+	var statements []policyStatement
+	for _, generated := range out.GeneratedPolicyResult.GeneratedPolicies {
+		var doc policyDocument
+		if err := json.Unmarshal([]byte(generated.Policy), &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse generated policy: %w", err)
+		}
+		statements = append(statements, doc.Statement...)
+	}
+	if len(statements) == 0 {
+		proposal.Error = "no activity of the role in CloudTrail over the period"
+		return proposal, nil
+	}
+	proposal.Policy = newPolicy(statements...)
+	policy, err := json.Marshal(proposal.Policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode proposed policy: %w", err)
+	}
+	sc := p.config.scopeConfig(scope)
+	sc.SessionPolicy = policy
+	proposal.Scopes = map[string]ScopeConfig{scope: sc}
+	return proposal, nil
+}
+
+// servePolicyGeneration starts a policy generation job for the scope query
+// parameter on POST, and reports a job given by job_id on GET
+func (p *AWSPlugin) servePolicyGeneration(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.config == nil || p.config.PolicyGenerationTrailARN == "" {
+		http.NotFound(w, r)
+		return
+	}
+	scope := r.URL.Query().Get("scope")
+	if !isValidAWSScope(scope) {
+		http.Error(w, "invalid scope", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), policyGenerationTimeout)
+	defer cancel()
+	var proposal *policyProposal
+	var err error
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodPost:
+		proposal, err = p.startPolicyGeneration(ctx, scope)
+		status = http.StatusAccepted
+	case http.MethodGet:
+		jobID := r.URL.Query().Get("job_id")
+		if jobID == "" {
+			http.Error(w, "job_id is required", http.StatusBadRequest)
+			return
+		}
+		proposal, err = p.policyGeneration(ctx, scope, jobID)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, redactError(p.describeError("policy generation", err)).Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(proposal)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	prefetchInterval           = 30 * time.Second
+	defaultPrefetchMinRequests = 10
+
+	// prefetchIdleIntervals is how many intervals without requests a scope
+	// is tracked for before being forgotten
+	prefetchIdleIntervals = 20
+)
+
+// prefetcher tracks how often cached requests are made and keeps the
+// credentials of hot ones fresh in the background
+type prefetcher struct {
+	mu          sync.Mutex
+	minRequests int
+	requests    map[string]*hotRequest
+	stop        chan struct{}
+}
+
+// hotRequest is a tracked cache key with the most recent request for it
+type hotRequest struct {
+	req  sdk.CredentialRequest
+	hits int
+	idle int
+}
+
+// startPrefetch starts the background refresher
+func (p *AWSPlugin) startPrefetch(minRequests int) *prefetcher {
+	f := &prefetcher{
+		minRequests: minRequests,
+		requests:    make(map[string]*hotRequest),
+		stop:        make(chan struct{}),
+	}
+	go p.runPrefetch(f)
+	return f
+}
+
+// observe counts a request for a cache key
+func (f *prefetcher) observe(key string, req *sdk.CredentialRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	hr, ok := f.requests[key]
+	if !ok {
+		hr = &hotRequest{}
+		f.requests[key] = hr
+	}
+	hr.req = *req
+	hr.req.Parameters = maps.Clone(req.Parameters)
+	hr.hits++
+	hr.idle = 0
+}
+
+// hot returns the requests made at least minRequests times in the interval
+// that just ended, and starts a new interval
+func (f *prefetcher) hot() map[string]sdk.CredentialRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	hot := make(map[string]sdk.CredentialRequest)
+	for key, hr := range f.requests {
+		if hr.hits >= f.minRequests {
+			hot[key] = hr.req
+		}
+		if hr.hits == 0 {
+			hr.idle++
+		}
+		if hr.idle >= prefetchIdleIntervals {
+			delete(f.requests, key)
+		}
+		hr.hits = 0
+	}
+	return hot
+}
+
+// prefetchable reports whether a request may be issued ahead of time: not
+// when a scope of it requires approval, a justification or an allowed
+// window, which only a request can meet
+func (c *AWSConfig) prefetchable(req *sdk.CredentialRequest) bool {
+	for _, scope := range requestedScopes(req.Scope) {
+		sc := c.scopeConfig(scope)
+		if sc.RequireApproval || sc.RequireJustification || len(sc.AllowedWindows) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// prefetchOutcome is the audit outcome of a prefetch
+func prefetchOutcome(err error) string {
+	if err != nil {
+		return auditError
+	}
+	return "issued"
+}
+
+func (f *prefetcher) close() {
+	close(f.stop)
+}
+
+func (p *AWSPlugin) runPrefetch(f *prefetcher) {
+	ticker := time.NewTicker(prefetchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			p.refreshHot(f)
+		}
+	}
+}
+
+// refreshHot reissues hot credentials that would reach the cache margin
+// before the next refresh. Each reissue holds the read lock on its own, so a
+// pending Configure only waits for one of them.
+func (p *AWSPlugin) refreshHot(f *prefetcher) {
+	defer recoverLogged("prefetch")
+	for key, req := range f.hot() {
+		if !p.refreshCredential(f, key, req) {
+			// Replaced by a reconfiguration
+			return
+		}
+	}
+}
+
+// refreshCredential reissues a hot credential if it would reach the cache
+// margin before the next refresh, unless the prefetcher was replaced
+func (p *AWSPlugin) refreshCredential(f *prefetcher, key string, req sdk.CredentialRequest) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.prefetch != f {
+		return false
+	}
+
+	cache := p.cache
+	if expiresAt, ok := cache.expiresAt(key); ok && time.Until(expiresAt) > cache.margin+2*prefetchInterval {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchInterval)
+	defer cancel()
+	cred, err := p.issueShared(ctx, &req, nil, key, true, true)
+	p.auditIssuance(auditPrefetch, &req, cred, prefetchOutcome(err), err)
+	if err != nil {
+		sdk.Warn("failed to prefetch credential", "scope", req.Scope, "error", err)
+		return true
+	}
+	sdk.Debug("prefetched credential", "scope", req.Scope)
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestPrefetchable(t *testing.T) {
+	cfg := &AWSConfig{}
+	cfg.Scopes.Value = map[string]ScopeConfig{
+		"aws:s3":     {RequireApproval: true},
+		"aws:ec2":    {RequireJustification: true},
+		"aws:lambda": {AllowedWindows: []string{"* 9-17 * * MON-FRI"}},
+	}
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{"aws", true},
+		{"aws:sqs", true},
+		{"aws:s3", false},
+		{"aws:ec2", false},
+		{"aws:lambda", false},
+		{"aws:multi:aws:sqs,aws:s3", false},
+	}
+	for _, tt := range tests {
+		if got := cfg.prefetchable(&sdk.CredentialRequest{Scope: tt.scope}); got != tt.want {
+			t.Errorf("prefetchable(%s) = %t, want %t", tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestPrefetchIsAuditedAndNotCharged(t *testing.T) {
+	f := newFakeAWS(t, false)
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+	p := &AWSPlugin{}
+	cfg := f.config(`,"cache":true,"prefetch":true,"quotas":{"one":{"scopes":["aws"],"max":1}},"audit_log":` + strconv.Quote(auditLog))
+	if err := p.Configure(context.Background(), cfg); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	req := sdk.CredentialRequest{Scope: "aws", TTL: time.Hour, Agent: sdk.Agent{ID: "agent"}}
+	key, err := p.cacheKey(&req)
+	if err != nil {
+		t.Fatalf("cacheKey: %v", err)
+	}
+	p.refreshCredential(p.prefetch, key, req)
+	if f.assumeRoles.Load() != 1 {
+		t.Fatalf("%d AssumeRole calls, want the prefetch's", f.assumeRoles.Load())
+	}
+
+	// The quota's one credential is still the requester's to take
+	release, err := p.quotas.reserve(&req, nil, &p.metrics)
+	if err != nil {
+		t.Fatalf("prefetch was charged to the quota: %v", err)
+	}
+	release()
+	entries, _ := p.ledger.List(context.Background())
+	if len(entries) != 1 || !entries[0].Prefetch {
+		t.Errorf("ledger entries = %+v, want one prefetch", entries)
+	}
+
+	p.Shutdown(context.Background())
+	data, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatalf("reading audit log: %v", err)
+	}
+	if !strings.Contains(string(data), "action=prefetch outcome=issued") {
+		t.Errorf("audit log = %q, want a prefetch record", data)
+	}
+}
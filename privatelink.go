@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// validatePrivateLink checks the settings that would send AWS calls around
+// VPC endpoints are off when require_private_link is set, and the default
+// source_vpces
+func validatePrivateLink(c *AWSConfig) error {
+	if _, err := parseSourceVpces(c.SourceVpces.Value); err != nil {
+		return fmt.Errorf("invalid source_vpces: %w", err)
+	}
+	if !c.RequirePrivateLink.Value {
+		return nil
+	}
+	if c.HTTPProxy != "" || c.HTTPSProxy != "" {
+		return fmt.Errorf("require_private_link does not allow http_proxy or https_proxy, as the plugin could not check where AWS calls go")
+	}
+	if c.STSRegionalEndpoints == stsLegacyEndpoints {
+		return fmt.Errorf("require_private_link requires regional STS endpoints, as VPC endpoints are regional")
+	}
+	return nil
+}
+
+// privateLinkControl refuses connections to public addresses, so AWS calls
+// only go to VPC endpoints, or to IMDS and local emulators. It runs once
+// DNS is resolved, for each address tried.
+func privateLinkControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("require_private_link: invalid address %s: %w", address, err)
+	}
+	if addr := addrPort.Addr().Unmap(); !addr.IsPrivate() && !addr.IsLoopback() && !addr.IsLinkLocalUnicast() {
+		return fmt.Errorf("require_private_link refuses to connect to public address %s; use a VPC endpoint for the service", addr)
+	}
+	return nil
+}
+
+// withPrivateLink makes a dialer refuse public addresses
+func withPrivateLink(d *net.Dialer) {
+	d.Control = privateLinkControl
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// Quota limits the credentials issued for matching scopes: at most Max in
+// any Window, or at most Max unexpired at once without a Window. With
+// PerRequester, each requester has its own count.
+type Quota struct {
+	// Scopes are the scope patterns the quota counts, exact or ending in '*'
+	Scopes       []string `json:"scopes"`
+	Max          int      `json:"max"`
+	Window       duration `json:"window,omitempty"`
+	PerRequester bool     `json:"per_requester,omitempty"`
+}
+
+func (q Quota) validate() error {
+	if len(q.Scopes) == 0 {
+		return fmt.Errorf("scopes is required")
+	}
+	for _, pattern := range q.Scopes {
+		if pattern == "" {
+			return fmt.Errorf("scopes must not be empty")
+		}
+	}
+	if q.Max <= 0 {
+		return fmt.Errorf("max must be positive")
+	}
+	if q.Window < 0 {
+		return fmt.Errorf("window must not be negative")
+	}
+	return nil
+}
+
+// matches reports whether the quota counts a scope, or any scope of an
+// aws:multi bundle
+func (q Quota) matches(scope string) bool {
+	for _, requested := range requestedScopes(scope) {
+		for _, pattern := range q.Scopes {
+			if scopePatternMatches(pattern, requested) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// live reports whether a counted issuance still counts at now: issued within
+// the window, or without one, unexpired
+func (q Quota) live(u quotaUsage, now time.Time) bool {
+	if q.Window > 0 {
+		return u.issuedAt.After(now.Add(-time.Duration(q.Window)))
+	}
+	return u.expiresAt.After(now)
+}
+
+// describe describes what the quota counts, for errors
+func (q Quota) describe(requester string) string {
+	s := strings.Join(q.Scopes, ", ") + " credentials"
+	if q.PerRequester {
+		s += " of requester " + requester
+	}
+	if q.Window > 0 {
+		return s + " issued in " + formatDuration(time.Duration(q.Window))
+	}
+	return s + " unexpired"
+}
+
+// validateQuotas checks the quotas and the ledger they count
+func validateQuotas(c *AWSConfig) error {
+	if len(c.Quotas.Value) == 0 {
+		return nil
+	}
+	if c.Ledger == ledgerNone {
+		return fmt.Errorf("quotas require the ledger")
+	}
+	for name, q := range c.Quotas.Value {
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("invalid quotas %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ledgerRequester identifies the requester of a ledger entry, as
+// requesterKey does for a request
+func ledgerRequester(entry *LedgerEntry) string {
+	if entry.AgentID != "" {
+		return entry.AgentID
+	}
+	return entry.AgentName
+}
+
+// quotaUsage is an issuance counted by a quota
+type quotaUsage struct {
+	id        string
+	issuedAt  time.Time
+	expiresAt time.Time
+}
+
+// quotaCounters counts the issuances of each quota, by quota and requester
+// for quotas with per_requester, seeded from the ledger when the plugin is
+// configured. Issuances checked against quotas and not yet recorded are
+// pending.
+type quotaCounters struct {
+	quotas map[string]Quota
+	names  []string
+
+	mu      sync.Mutex
+	counted map[string][]quotaUsage
+	pending map[string]int
+}
+
+// newQuotaCounters counts the ledger's issuances towards the quotas, or
+// returns nil without quotas
+func newQuotaCounters(ctx context.Context, quotas map[string]Quota, ledger ledgerStore) (*quotaCounters, error) {
+	if len(quotas) == 0 || ledger == nil {
+		return nil, nil
+	}
+	entries, err := ledger.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ledger for quotas: %w", err)
+	}
+
+	c := &quotaCounters{
+		quotas:  quotas,
+		names:   slices.Sorted(maps.Keys(quotas)),
+		counted: make(map[string][]quotaUsage),
+		pending: make(map[string]int),
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		c.add(entry, now)
+	}
+	return c, nil
+}
+
+// key is the counter of a quota for a requester
+func (c *quotaCounters) key(name, requester string) string {
+	if c.quotas[name].PerRequester {
+		return name + "\x00" + requester
+	}
+	return name
+}
+
+// add counts a ledger entry towards the quotas of its scope. Revoked
+// credentials only count towards quotas with a window, and prefetched ones
+// towards none.
+func (c *quotaCounters) add(entry *LedgerEntry, now time.Time) {
+	if entry.Prefetch {
+		return
+	}
+	u := quotaUsage{id: entry.ID, issuedAt: entry.IssuedAt, expiresAt: entry.ExpiresAt}
+	for _, name := range c.names {
+		q := c.quotas[name]
+		if !q.matches(entry.Scope) || !q.live(u, now) || (entry.RevokedAt != nil && q.Window == 0) {
+			continue
+		}
+		key := c.key(name, ledgerRequester(entry))
+		c.counted[key] = append(c.counted[key], u)
+	}
+}
+
+// record counts a newly recorded issuance
+func (c *quotaCounters) record(entry *LedgerEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(entry, time.Now())
+}
+
+// revoke stops counting a revoked credential towards quotas without a
+// window
+func (c *quotaCounters) revoke(entry *LedgerEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range c.names {
+		if q := c.quotas[name]; q.Window == 0 && q.matches(entry.Scope) {
+			key := c.key(name, ledgerRequester(entry))
+			c.counted[key] = slices.DeleteFunc(c.counted[key], func(u quotaUsage) bool { return u.id == entry.ID })
+		}
+	}
+}
+
+// reserve checks an issuance against the quotas of its scopes, including the
+// parts of aws:multi bundles, and reserves it in each until the returned
+// release is called once the credential is recorded. Unexpired credentials
+// being renewed are not counted, as their renewal replaces them.
+func (c *quotaCounters) reserve(req *sdk.CredentialRequest, renews *LedgerEntry, metrics *metrics) (func(), error) {
+	if c == nil {
+		return func() {}, nil
+	}
+	requester := requesterKey(req)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for _, name := range c.names {
+		q := c.quotas[name]
+		if !q.matches(req.Scope) {
+			continue
+		}
+		key := c.key(name, requester)
+		c.counted[key] = slices.DeleteFunc(c.counted[key], func(u quotaUsage) bool { return !q.live(u, now) })
+		counted := c.counted[key]
+		if renews != nil && q.Window == 0 {
+			counted = slices.DeleteFunc(slices.Clone(counted), func(u quotaUsage) bool { return u.id == renews.ID })
+		}
+		if n := len(counted) + c.pending[key]; n >= q.Max {
+			metrics.add(series("creddy_aws_quota_exceeded_total", "quota", name), 1)
+			return nil, &pluginError{
+				kind: errQuotaExceeded,
+				msg:  fmt.Sprintf("quota %s exceeded: %d of %d %s", name, n, q.Max, q.describe(requester)),
+				hint: quotaRetryHint(q, counted, n, now),
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		c.pending[key]++
+	}
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, key := range keys {
+			if c.pending[key]--; c.pending[key] <= 0 {
+				delete(c.pending, key)
+			}
+		}
+	}, nil
+}
+
+// quotaRetryHint says when the quota next has room: once enough counted
+// credentials leave the window or expire to bring n below the maximum
+func quotaRetryHint(q Quota, counted []quotaUsage, n int, now time.Time) string {
+	times := make([]time.Time, len(counted))
+	for i, u := range counted {
+		if q.Window > 0 {
+			times[i] = u.issuedAt.Add(time.Duration(q.Window))
+		} else {
+			times[i] = u.expiresAt
+		}
+	}
+	slices.SortFunc(times, func(a, b time.Time) int { return a.Compare(b) })
+	i := n - q.Max
+	if i >= len(times) {
+		// Only issuances in flight hold the quota
+		return "retry shortly, or raise the quota"
+	}
+	at := times[i].UTC().Truncate(time.Second).Add(time.Second)
+	return fmt.Sprintf("retry after %s (at %s), or raise the quota", formatDuration(at.Sub(now).Truncate(time.Second)), at.Format(time.RFC3339))
+}
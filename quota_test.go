@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestQuotaCounting(t *testing.T) {
+	now := time.Now()
+	revokedAt := now.Add(-time.Minute)
+	entry := func(scope, agent string, issuedAgo, expiresIn time.Duration) *LedgerEntry {
+		return &LedgerEntry{ID: newCredentialID(), Scope: scope, AgentID: agent, IssuedAt: now.Add(-issuedAgo), ExpiresAt: now.Add(expiresIn)}
+	}
+	revoked := entry("aws:s3", "a", time.Minute, time.Hour)
+	revoked.RevokedAt = &revokedAt
+	prefetched := entry("aws:s3", "a", time.Minute, time.Hour)
+	prefetched.Prefetch = true
+	// Each quota allows two; every scenario holds one of them
+	tests := []struct {
+		name    string
+		quota   Quota
+		entries []*LedgerEntry
+		scope   string
+		agent   string
+		want    bool
+	}{
+		{"unexpired counts", Quota{Scopes: []string{"aws:s3"}}, []*LedgerEntry{entry("aws:s3", "a", time.Minute, time.Hour)}, "aws:s3", "a", false},
+		{"expired does not count", Quota{Scopes: []string{"aws:s3"}}, []*LedgerEntry{entry("aws:s3", "a", 2*time.Hour, -time.Hour)}, "aws:s3", "a", true},
+		{"revoked does not count", Quota{Scopes: []string{"aws:s3"}}, []*LedgerEntry{revoked}, "aws:s3", "a", true},
+		{"revoked counts in a window", Quota{Scopes: []string{"aws:s3"}, Window: duration(time.Hour)}, []*LedgerEntry{revoked}, "aws:s3", "a", false},
+		{"expired counts in a window", Quota{Scopes: []string{"aws:s3"}, Window: duration(time.Hour)}, []*LedgerEntry{entry("aws:s3", "a", 30*time.Minute, -time.Minute)}, "aws:s3", "a", false},
+		{"left the window", Quota{Scopes: []string{"aws:s3"}, Window: duration(time.Hour)}, []*LedgerEntry{entry("aws:s3", "a", 2*time.Hour, time.Hour)}, "aws:s3", "a", true},
+		{"prefetch does not count", Quota{Scopes: []string{"aws:s3"}}, []*LedgerEntry{prefetched}, "aws:s3", "a", true},
+		{"prefix pattern", Quota{Scopes: []string{"aws:s3*"}}, []*LedgerEntry{entry("aws:s3:presign:reports/q1.csv", "a", time.Minute, time.Hour)}, "aws:s3express:scratch", "a", false},
+		{"other scope", Quota{Scopes: []string{"aws:s3"}}, []*LedgerEntry{entry("aws:ec2", "a", time.Minute, time.Hour)}, "aws:s3", "a", true},
+		{"bundle part counts", Quota{Scopes: []string{"aws:s3"}}, []*LedgerEntry{entry("aws:multi:aws:ec2,aws:s3", "a", time.Minute, time.Hour)}, "aws:s3", "a", false},
+		{"bundle is counted", Quota{Scopes: []string{"aws:s3"}}, []*LedgerEntry{entry("aws:s3", "a", time.Minute, time.Hour)}, "aws:multi:aws:ec2,aws:s3", "a", false},
+		{"shared across requesters", Quota{Scopes: []string{"aws:s3"}}, []*LedgerEntry{entry("aws:s3", "b", time.Minute, time.Hour)}, "aws:s3", "a", false},
+		{"per requester", Quota{Scopes: []string{"aws:s3"}, PerRequester: true}, []*LedgerEntry{entry("aws:s3", "b", time.Minute, time.Hour)}, "aws:s3", "a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := newMemoryLedger(0)
+			// Fill the quota's other slot with an issuance of the requester
+			entries := append(tt.entries, entry(tt.scope, tt.agent, time.Minute, time.Hour))
+			for _, e := range entries {
+				if err := ledger.Put(context.Background(), e); err != nil {
+					t.Fatalf("Put: %v", err)
+				}
+			}
+			tt.quota.Max = 2
+			c, err := newQuotaCounters(context.Background(), map[string]Quota{"q": tt.quota}, ledger)
+			if err != nil {
+				t.Fatalf("newQuotaCounters: %v", err)
+			}
+			release, err := c.reserve(&sdk.CredentialRequest{Scope: tt.scope, Agent: sdk.Agent{ID: tt.agent}}, nil, &metrics{})
+			if got := err == nil; got != tt.want {
+				t.Fatalf("reserve allowed = %t (%v), want %t", got, err, tt.want)
+			}
+			if err != nil {
+				if errorKindOf(err) != errQuotaExceeded || !strings.Contains(err.Error(), "2 of 2") {
+					t.Errorf("reserve = %v, want quota q exceeded with 2 of 2", err)
+				}
+				return
+			}
+			// The reservation holds the last slot until released
+			if _, err := c.reserve(&sdk.CredentialRequest{Scope: tt.scope, Agent: sdk.Agent{ID: tt.agent}}, nil, &metrics{}); err == nil {
+				t.Error("a second reservation fitted in a full quota")
+			}
+			release()
+		})
+	}
+}
+
+func TestQuotaRenewalNotCounted(t *testing.T) {
+	now := time.Now()
+	renewed := &LedgerEntry{ID: newCredentialID(), Scope: "aws:s3", AgentID: "a", IssuedAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour)}
+	ledger := newMemoryLedger(0)
+	ledger.Put(context.Background(), renewed)
+	c, err := newQuotaCounters(context.Background(), map[string]Quota{"q": {Scopes: []string{"aws:s3"}, Max: 1}}, ledger)
+	if err != nil {
+		t.Fatalf("newQuotaCounters: %v", err)
+	}
+	req := &sdk.CredentialRequest{Scope: "aws:s3", Agent: sdk.Agent{ID: "a"}}
+	if _, err := c.reserve(req, nil, &metrics{}); err == nil {
+		t.Fatal("a new issuance fitted in a full quota")
+	}
+	release, err := c.reserve(req, renewed, &metrics{})
+	if err != nil {
+		t.Fatalf("renewing the quota's credential: %v", err)
+	}
+	release()
+}
+
+func TestQuotaRetryHint(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	counted := []quotaUsage{
+		{issuedAt: now.Add(-50 * time.Minute), expiresAt: now.Add(30 * time.Minute)},
+		{issuedAt: now.Add(-20 * time.Minute), expiresAt: now.Add(10 * time.Minute)},
+	}
+	tests := []struct {
+		name  string
+		quota Quota
+		n     int
+		want  string
+	}{
+		{"first expiry", Quota{Max: 2}, 2, "retry after 10m1s (at 2024-01-01T12:10:01Z), or raise the quota"},
+		{"second expiry", Quota{Max: 1}, 2, "retry after 30m1s (at 2024-01-01T12:30:01Z), or raise the quota"},
+		{"leaving the window", Quota{Max: 2, Window: duration(time.Hour)}, 2, "retry after 10m1s (at 2024-01-01T12:10:01Z), or raise the quota"},
+		{"in flight", Quota{Max: 2}, 4, "retry shortly, or raise the quota"},
+	}
+	for _, tt := range tests {
+		if got := quotaRetryHint(tt.quota, counted, tt.n, now); got != tt.want {
+			t.Errorf("%s: quotaRetryHint = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQuotaEnforced(t *testing.T) {
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), f.config(`,"session_name_template":"creddy-{{.RequestID}}","quotas":{"s3":{"scopes":["aws:s3"],"max":2,"per_requester":true}}`)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	// Sessions are named per request, so each credential has its own ID
+	request := func(agent string) (*sdk.Credential, error) {
+		return p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: "aws:s3", TTL: time.Hour, Agent: sdk.Agent{ID: agent}})
+	}
+	var issued []*sdk.Credential
+	for range 2 {
+		cred, err := request("a")
+		if err != nil {
+			t.Fatalf("GetCredential within the quota: %v", err)
+		}
+		issued = append(issued, cred)
+	}
+	if _, err := request("a"); errorKindOf(err) != errQuotaExceeded {
+		t.Fatalf("third GetCredential = %v, want quota_exceeded", err)
+	}
+	if _, err := request("b"); err != nil {
+		t.Errorf("GetCredential of another requester: %v", err)
+	}
+
+	// Revoking frees the slot of a quota without a window
+	if err := p.RevokeCredential(context.Background(), issued[0].Credential); err != nil {
+		t.Fatalf("RevokeCredential: %v", err)
+	}
+	if _, err := request("a"); err != nil {
+		t.Errorf("GetCredential after a revocation: %v", err)
+	}
+}
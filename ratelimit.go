@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxRateLimitKeys bounds the per-scope and per-agent buckets kept; beyond
+// it, full buckets (which behave like new ones) are dropped
+const maxRateLimitKeys = 1024
+
+// RateLimit is a token bucket: Rate calls per second on average, in bursts
+// of up to Burst calls
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+func (l RateLimit) validate() error {
+	if l.Rate < 0 || math.IsInf(l.Rate, 0) || math.IsNaN(l.Rate) {
+		return fmt.Errorf("rate must be a non-negative number of calls per second")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	return nil
+}
+
+// enabled reports whether the limit is set
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+// burst returns the bucket size, defaulting to one second's worth of calls
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accrued since the last call and reports whether a
+// call may be made
+func (b *tokenBucket) refill(l RateLimit, now time.Time) bool {
+	b.tokens = math.Min(l.burst(), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	return b.tokens >= 1
+}
+
+// stsRateLimiter limits AssumeRole calls globally, per scope and per agent,
+// so one consumer cannot use up the account's STS request quota and starve
+// the others. Calls over a limit are rejected rather than queued.
+type stsRateLimiter struct {
+	global, scope, agent RateLimit
+
+	mu           sync.Mutex
+	globalBucket *tokenBucket
+	scopes       map[string]*tokenBucket
+	agents       map[string]*tokenBucket
+}
+
+func newSTSRateLimiter(global, scope, agent RateLimit) *stsRateLimiter {
+	if !global.enabled() && !scope.enabled() && !agent.enabled() {
+		return nil
+	}
+	return &stsRateLimiter{
+		global: global,
+		scope:  scope,
+		agent:  agent,
+		scopes: make(map[string]*tokenBucket),
+		agents: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from every bucket the call counts against, or none
+// if any of them is empty
+func (r *stsRateLimiter) allow(scope, agentID string) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+
+	var taken []*tokenBucket
+	if r.global.enabled() {
+		if r.globalBucket == nil {
+			r.globalBucket = &tokenBucket{tokens: r.global.burst(), last: now}
+		}
+		if !r.globalBucket.refill(r.global, now) {
+			return rateLimitError(fmt.Sprintf("STS rate limit exceeded (%g calls per second)", r.global.Rate), "sts_rate_limit")
+		}
+		taken = append(taken, r.globalBucket)
+	}
+	if r.scope.enabled() {
+		b := r.bucket(r.scopes, r.scope, scope, now)
+		if !b.refill(r.scope, now) {
+			return rateLimitError(fmt.Sprintf("STS rate limit exceeded for scope %s (%g calls per second)", scope, r.scope.Rate), "sts_scope_rate_limit")
+		}
+		taken = append(taken, b)
+	}
+	if r.agent.enabled() && agentID != "" {
+		b := r.bucket(r.agents, r.agent, agentID, now)
+		if !b.refill(r.agent, now) {
+			return rateLimitError(fmt.Sprintf("STS rate limit exceeded for agent %s (%g calls per second)", agentID, r.agent.Rate), "sts_agent_rate_limit")
+		}
+		taken = append(taken, b)
+	}
+
+	for _, b := range taken {
+		b.tokens--
+	}
+	return nil
+}
+
+// bucket returns the bucket of a key, creating it full
+func (r *stsRateLimiter) bucket(buckets map[string]*tokenBucket, l RateLimit, key string, now time.Time) *tokenBucket {
+	if b, ok := buckets[key]; ok {
+		return b
+	}
+	if len(buckets) >= maxRateLimitKeys {
+		for k, b := range buckets {
+			if b.refill(l, now) && b.tokens >= l.burst() {
+				delete(buckets, k)
+			}
+		}
+	}
+	b := &tokenBucket{tokens: l.burst(), last: now}
+	buckets[key] = b
+	return b
+}
+
+// rateLimitError is returned for a call over the limit of a setting
+func rateLimitError(msg, setting string) error {
+	return &pluginError{kind: errThrottled, msg: msg, hint: "retry later, or raise " + setting}
+}
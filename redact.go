@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+	"github.com/hashicorp/go-hclog"
+)
+
+// redacted replaces secrets in log output and errors
+const redacted = "[REDACTED]"
+
+const (
+	// minRedactedSecret is the shortest configured secret that is redacted
+	// by value; shorter ones would blank out ordinary words
+	minRedactedSecret = 8
+
+	// secretAccessKeyLength is the length of AWS secret access keys
+	secretAccessKeyLength = 40
+
+	// minSessionTokenLength is the length from which base64 runs are taken
+	// for session tokens; real ones are several hundred characters
+	minSessionTokenLength = 100
+)
+
+var (
+	// Access key IDs of IAM users, role sessions and other AWS principals;
+	// all but the prefix and the last four characters are masked
+	accessKeyIDPattern = regexp.MustCompile(`\b(AKIA|ASIA|ABIA|ACCA)[A-Z0-9]{12}([A-Z0-9]{4})\b`)
+
+	// Runs of base64 characters long enough to be a secret access key (40
+	// characters) or a session token (hundreds)
+	base64RunPattern = regexp.MustCompile(`[A-Za-z0-9/+=]{40,}`)
+
+	privateKeyPattern  = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)
+	ageIdentityPattern = regexp.MustCompile(`AGE-SECRET-KEY-1[0-9A-Z]+`)
+
+	// Secret fields of JSON documents (config, credential values) and of
+	// credentials files, by name
+	secretJSONFieldPattern = regexp.MustCompile(`("(?:` + strings.Join(secretFieldNames, "|") + `)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	secretINIFieldPattern  = regexp.MustCompile(`(?m)^(\s*(?:aws_secret_access_key|aws_session_token)\s*=\s*).*$`)
+
+	// The string values of the secret config fields, and the values of
+	// otlp_headers, in config JSON that might not parse
+	secretConfigPattern  = regexp.MustCompile(`"(?:` + strings.Join(secretFieldNames, "|") + `)"\s*:\s*"((?:[^"\\]|\\.)*)"`)
+	otlpHeadersPattern   = regexp.MustCompile(`"otlp_headers"\s*:\s*(\{[^}]*\}|"(?:[^"\\]|\\.)*")`)
+	jsonStringPattern    = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"`)
+	secretArgNamePattern = regexp.MustCompile(`(?i)secret|token|password|passphrase|private_key|age_identity`)
+)
+
+// secretFieldNames are the JSON fields holding secrets, in the config and in
+// the credential values the plugin returns
+var secretFieldNames = []string{
+	"secret_access_key", "session_token", "cloudfront_private_key", "ses_smtp_secret_access_key",
+	"iot_private_key", "cache_passphrase", "cache_age_identity",
+	"SecretAccessKey", "SessionToken", "Secret", "password", "Password", "token", "Token",
+	"secret", "routing_key", "approval_secret",
+}
+
+// secretRedactor redacts the secrets of the current configuration by value,
+// on top of the patterns of AWS secrets
+type secretRedactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+// redactor is shared by the logger and the entry points
+var redactor secretRedactor
+
+// set replaces the secrets redacted by value
+func (r *secretRedactor) set(secrets []string) {
+	var kept []string
+	for _, s := range secrets {
+		if len(s) >= minRedactedSecret {
+			kept = append(kept, s)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = kept
+}
+
+// redact replaces the secrets in s, those of the configuration and any
+// extra ones given
+func (r *secretRedactor) redact(s string, extra ...string) string {
+	s = secretJSONFieldPattern.ReplaceAllString(s, `$1"`+redacted+`"`)
+	s = secretINIFieldPattern.ReplaceAllString(s, "${1}"+redacted)
+	s = privateKeyPattern.ReplaceAllString(s, redacted)
+	s = ageIdentityPattern.ReplaceAllString(s, redacted)
+
+	r.mu.RLock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	r.mu.RUnlock()
+	for _, secret := range extra {
+		if len(secret) >= minRedactedSecret {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+
+	s = base64RunPattern.ReplaceAllStringFunc(s, func(run string) string {
+		if len(run) >= minSessionTokenLength || (len(run) == secretAccessKeyLength && mixedBase64(run)) {
+			return redacted
+		}
+		return run
+	})
+	return accessKeyIDPattern.ReplaceAllString(s, "$1************$2")
+}
+
+// mixedBase64 reports whether s has upper and lower case letters and
+// digits, as random base64 does, unlike hex digests and identifiers
+func mixedBase64(s string) bool {
+	return strings.ContainsAny(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") &&
+		strings.ContainsAny(s, "abcdefghijklmnopqrstuvwxyz") &&
+		strings.ContainsAny(s, "0123456789")
+}
+
+// secretValues returns the secrets of a configuration, to redact by value
+func (c *AWSConfig) secretValues() []string {
+	secrets := []string{
+		c.SecretAccessKey, c.SessionToken, c.CloudFrontPrivateKey, c.SESSMTPSecretAccessKey,
+		c.IoTPrivateKey, c.CachePassphrase, c.CacheAgeIdentity, c.ApprovalSecret,
+	}
+	for _, v := range c.OTLPHeaders.Value {
+		secrets = append(secrets, v)
+	}
+	for _, hook := range c.Webhooks.Value {
+		// Webhook URLs of Slack and others are credentials themselves
+		secrets = append(secrets, hook.URL, hook.Secret, hook.RoutingKey)
+	}
+	return secrets
+}
+
+// configJSONSecrets finds the secret values in config JSON without parsing
+// it, so the errors of config that does not parse are redacted too
+func configJSONSecrets(configJSON string) []string {
+	var secrets []string
+	for _, m := range secretConfigPattern.FindAllStringSubmatch(configJSON, -1) {
+		secrets = append(secrets, m[1])
+	}
+	for _, m := range otlpHeadersPattern.FindAllStringSubmatch(configJSON, -1) {
+		for _, v := range jsonStringPattern.FindAllStringSubmatch(m[1], -1) {
+			secrets = append(secrets, v[1])
+		}
+	}
+	return secrets
+}
+
+// redactedError is an error whose message has its secrets redacted. It
+// still unwraps to the original.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError redacts the secrets in an error returned by an entry point,
+// those of the configuration and any extra ones given
+func redactError(err error, extra ...string) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if clean := redactor.redact(msg, extra...); clean != msg {
+		return &redactedError{msg: clean, err: err}
+	}
+	return err
+}
+
+// redactingLogger redacts secrets from the messages and arguments of
+// everything logged through it
+type redactingLogger struct {
+	hclog.Logger
+}
+
+// initialLogLevel is the level the logger started with, restored when
+// log_level is unset
+var initialLogLevel hclog.Level
+
+func init() {
+	initialLogLevel = sdk.Logger.GetLevel()
+	sdk.SetLogger(redactingLogger{sdk.Logger})
+}
+
+// logLevels are the values of log_level
+var logLevels = []string{"trace", "debug", "info", "warn", "error"}
+
+// setLogLevel applies log_level, or the initial level if it is unset
+func setLogLevel(level string) {
+	if level == "" {
+		sdk.Logger.SetLevel(initialLogLevel)
+		return
+	}
+	sdk.Logger.SetLevel(hclog.LevelFromString(level))
+}
+
+// redactArgs redacts the values of key/value logging arguments. Values of
+// keys naming secrets are dropped entirely; others are redacted as text but
+// keep their type when there is nothing to redact.
+func redactArgs(args []interface{}) []interface{} {
+	out := make([]interface{}, len(args))
+	for i, arg := range args {
+		if i%2 == 1 {
+			if key, ok := args[i-1].(string); ok && secretArgNamePattern.MatchString(key) {
+				out[i] = redacted
+				continue
+			}
+		}
+		switch v := arg.(type) {
+		case nil, bool, int, int32, int64, uint, uint32, uint64, float32, float64, time.Duration, time.Time:
+			out[i] = v
+		case string:
+			out[i] = redactor.redact(v)
+		case error:
+			out[i] = redactor.redact(v.Error())
+		default:
+			s := fmt.Sprint(v)
+			if clean := redactor.redact(s); clean != s {
+				out[i] = clean
+			} else {
+				out[i] = v
+			}
+		}
+	}
+	return out
+}
+
+func (l redactingLogger) Log(level hclog.Level, msg string, args ...interface{}) {
+	l.Logger.Log(level, redactor.redact(msg), redactArgs(args)...)
+}
+
+func (l redactingLogger) Trace(msg string, args ...interface{}) {
+	l.Logger.Trace(redactor.redact(msg), redactArgs(args)...)
+}
+
+func (l redactingLogger) Debug(msg string, args ...interface{}) {
+	l.Logger.Debug(redactor.redact(msg), redactArgs(args)...)
+}
+
+func (l redactingLogger) Info(msg string, args ...interface{}) {
+	l.Logger.Info(redactor.redact(msg), redactArgs(args)...)
+}
+
+func (l redactingLogger) Warn(msg string, args ...interface{}) {
+	l.Logger.Warn(redactor.redact(msg), redactArgs(args)...)
+}
+
+func (l redactingLogger) Error(msg string, args ...interface{}) {
+	l.Logger.Error(redactor.redact(msg), redactArgs(args)...)
+}
+
+func (l redactingLogger) With(args ...interface{}) hclog.Logger {
+	return redactingLogger{l.Logger.With(redactArgs(args)...)}
+}
+
+func (l redactingLogger) Named(name string) hclog.Logger {
+	return redactingLogger{l.Logger.Named(name)}
+}
+
+func (l redactingLogger) ResetNamed(name string) hclog.Logger {
+	return redactingLogger{l.Logger.ResetNamed(name)}
+}
+
+func (l redactingLogger) StandardLogger(opts *hclog.StandardLoggerOptions) *log.Logger {
+	return log.New(l.StandardWriter(opts), "", 0)
+}
+
+func (l redactingLogger) StandardWriter(opts *hclog.StandardLoggerOptions) io.Writer {
+	return redactingWriter{l.Logger.StandardWriter(opts)}
+}
+
+// redactingWriter redacts what is written through it, a line at a time as
+// standard loggers write
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, redactor.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
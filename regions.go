@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// regionParam selects the region of a request's credentials
+const regionParam = "region"
+
+// partitionDNSSuffixes are the endpoint domains of partitions other than
+// the commercial one (amazonaws.com)
+var partitionDNSSuffixes = map[string]string{
+	"aws-cn":    "amazonaws.com.cn",
+	"aws-iso":   "c2s.ic.gov",
+	"aws-iso-b": "sc2s.sgov.gov",
+	"aws-iso-e": "cloud.adc-e.uk",
+	"aws-iso-f": "csp.hci.ic.gov",
+}
+
+// scopeEndpointPrefixes maps scope services to their endpoint prefixes
+// where they differ
+var scopeEndpointPrefixes = map[string]string{
+	"bedrock": "bedrock-runtime",
+	"ecr":     "api.ecr",
+}
+
+// regionDNSSuffix returns the endpoint domain of a region's partition
+func regionDNSSuffix(region string) string {
+	if suffix, ok := partitionDNSSuffixes[regionPartition(region)]; ok {
+		return suffix
+	}
+	return "amazonaws.com"
+}
+
+// scopeService returns the service a scope is for (aws:s3 -> s3), or "" for
+// scopes that are not for one service
+func scopeService(scope string) string {
+	rest, ok := strings.CutPrefix(scope, "aws:")
+	if !ok {
+		return ""
+	}
+	service, _, _ := strings.Cut(rest, ":")
+	if service == "" || strings.ContainsAny(service, "[*") {
+		return ""
+	}
+	if prefix, ok := scopeEndpointPrefixes[service]; ok {
+		return prefix
+	}
+	return service
+}
+
+// regionEndpoints returns the regional endpoint of a scope's service in each
+// region, as hints for clients choosing a region. Scopes not tied to a
+// service get none.
+func regionEndpoints(scope string, regions []string) map[string]string {
+	service := scopeService(scope)
+	if service == "" || len(regions) == 0 {
+		return nil
+	}
+	endpoints := make(map[string]string, len(regions))
+	for _, region := range regions {
+		endpoints[region] = fmt.Sprintf("https://%s.%s.%s", service, region, regionDNSSuffix(region))
+	}
+	return endpoints
+}
+
+// validateRegions checks a list of region names
+func validateRegions(regions []string) error {
+	seen := make(map[string]bool, len(regions))
+	for _, region := range regions {
+		if !awsRegionLabel.MatchString(region) {
+			return fmt.Errorf("invalid region %q", region)
+		}
+		if seen[region] {
+			return fmt.Errorf("duplicate region %q", region)
+		}
+		seen[region] = true
+	}
+	return nil
+}
+
+// requestRegion returns the region of a request's credentials: the region
+// parameter, else the configured region. A requested region must be the
+// configured one, in allowed_regions, or in the scope's regions.
+func (p *AWSPlugin) requestRegion(req *sdk.CredentialRequest) (string, error) {
+	region := req.Parameters[regionParam]
+	if region == "" || region == p.config.Region {
+		return p.config.Region, nil
+	}
+	if slices.Contains(p.config.AllowedRegions.Value, region) || slices.Contains(p.config.scopeConfig(req.Scope).Regions, region) {
+		return region, nil
+	}
+	return "", fmt.Errorf("region %q is not allowed for %s", region, req.Scope)
+}
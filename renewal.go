@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// renewParam is the request parameter referencing the credential to renew
+const renewParam = "renew"
+
+// renewalOf returns the ledger entry of the credential a request renews, or
+// nil if the request is not a renewal. Renewals keep the previous role
+// session name so CloudTrail shows one continuous session.
+func (p *AWSPlugin) renewalOf(ctx context.Context, req *sdk.CredentialRequest) (*LedgerEntry, error) {
+	id := req.Parameters[renewParam]
+	if id == "" {
+		return nil, nil
+	}
+	if p.ledger == nil {
+		return nil, fmt.Errorf("renewal requires the credential ledger")
+	}
+
+	entry, err := p.ledger.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("unknown credential to renew: %s", id)
+	}
+
+	if entry.Scope != req.Scope {
+		return nil, fmt.Errorf("credential %s was issued for scope %s, not %s", id, entry.Scope, req.Scope)
+	}
+	if entry.AgentID != req.Agent.ID {
+		return nil, fmt.Errorf("credential %s was issued to a different agent", id)
+	}
+	if entry.RoleARN != "" && entry.RoleARN != p.config.RoleARN {
+		return nil, fmt.Errorf("credential %s was issued for role %s, which is no longer configured", id, entry.RoleARN)
+	}
+	if entry.RevokedAt != nil {
+		return nil, fmt.Errorf("credential %s has been revoked", id)
+	}
+	if entry.ExpiresAt.IsZero() {
+		return nil, fmt.Errorf("credential %s does not expire and cannot be renewed", id)
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		return nil, fmt.Errorf("credential %s has expired", id)
+	}
+
+	return entry, nil
+}
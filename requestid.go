@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go/middleware"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// addRequestIDMiddleware records the request ID of every AWS call, failed or
+// not, in the issuance it is made for and in the debug log, so calls can be
+// matched with CloudTrail and AWS support cases
+func addRequestIDMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CreddyRequestID",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			out, md, err := next.HandleInitialize(ctx, in)
+			id, ok := awsmiddleware.GetRequestIDMetadata(md)
+			if !ok {
+				id = requestIDOf(err)
+			}
+			if id != "" {
+				call := awsmiddleware.GetServiceID(ctx) + ":" + awsmiddleware.GetOperationName(ctx)
+				sdk.Debug("aws call", "call", call, "request_id", id, "error", err)
+				if iss := issuanceFrom(ctx); iss != nil {
+					iss.addRequestID(call, id)
+				}
+			}
+			return out, md, err
+		}), middleware.After)
+}
+
+// requestIDOf returns the AWS request ID of a failed call, if it got a
+// response
+func requestIDOf(err error) string {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.ServiceRequestID()
+	}
+	return ""
+}
+
+// addRequestID records the request ID of a call made for the issuance
+func (iss *issuance) addRequestID(call, id string) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	if iss.RequestIDs == nil {
+		iss.RequestIDs = make(map[string]string)
+	}
+	iss.RequestIDs[call] = id
+}
+
+// requestIDList formats the request IDs of an issuance as call=id pairs,
+// sorted by call
+func (iss *issuance) requestIDList() string {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	pairs := make([]string, 0, len(iss.RequestIDs))
+	for call, id := range iss.RequestIDs {
+		pairs = append(pairs, call+"="+id)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
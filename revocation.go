@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	defaultRevocationPolicyName = "creddy-session-revocations"
+
+	// sessionRevocationPrefix marks revocation IDs of STS sessions; the full
+	// form is "sts-session:<expires-unix>:<session-name>"
+	sessionRevocationPrefix = "sts-session:"
+
+	// credentialIDExpirySlack pads the expiry of revocation IDs built before
+	// STS reports the session's, so they never end before the session does
+	credentialIDExpirySlack = time.Minute
+
+	// revocationSidPrefix marks statements managed by the plugin. The
+	// statement's expiry is encoded in the Sid so cleanup needs no state.
+	revocationSidPrefix = "CreddyRevoke"
+
+	// maxInlinePolicySize is IAM's limit on the inline policies of a role,
+	// in characters
+	maxInlinePolicySize = 10240
+)
+
+// revocationCleanups are the timers pruning the revocation policy once its
+// statements expire
+type revocationCleanups struct {
+	mu     sync.Mutex
+	timers map[*time.Timer]struct{}
+}
+
+// schedule runs fn after d, unless stopped first
+func (c *revocationCleanups) schedule(d time.Duration, fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timers == nil {
+		c.timers = make(map[*time.Timer]struct{})
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		c.mu.Lock()
+		delete(c.timers, t)
+		c.mu.Unlock()
+		fn()
+	})
+	c.timers[t] = struct{}{}
+}
+
+// stop cancels the pending cleanups. Expired statements are still pruned by
+// the next update of the policy, the janitor, or shutdown.
+func (c *revocationCleanups) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for t := range c.timers {
+		t.Stop()
+	}
+	clear(c.timers)
+}
+
+// sessionName returns the role session name of an AssumeRole result
+func sessionName(session *sts.AssumeRoleOutput) string {
+	assumedARN := aws.ToString(session.AssumedRoleUser.Arn)
+	return assumedARN[strings.LastIndex(assumedARN, "/")+1:]
+}
+
+// sessionRevocationID builds the revocation ID Creddy passes back to
+// RevokeCredential for an STS session
+func sessionRevocationID(name string, expiresAt time.Time) string {
+	return sessionRevocationPrefix + strconv.FormatInt(expiresAt.Unix(), 10) + ":" + name
+}
+
+// parseSessionRevocationID splits an STS session revocation ID
+func parseSessionRevocationID(externalID string) (name string, expiresAt time.Time, ok bool) {
+	rest, ok := strings.CutPrefix(externalID, sessionRevocationPrefix)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	expires, name, ok := strings.Cut(rest, ":")
+	if !ok || name == "" {
+		return "", time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return name, time.Unix(unix, 0), true
+}
+
+// revokeSessions denies every session of the role with one of the given
+// names that was issued before now. This is the documented pattern for
+// revoking role sessions: a Deny conditioned on aws:TokenIssueTime leaves
+// sessions issued later (including new sessions reusing the name) unaffected.
+// The statement is kept until expiresAt, after which the sessions have
+// expired anyway.
+func (p *AWSPlugin) revokeSessions(ctx context.Context, names []string, expiresAt time.Time) error {
+	if !expiresAt.After(time.Now()) {
+		// Nothing left to revoke
+		return nil
+	}
+
+	patterns := make([]string, len(names))
+	for i, name := range names {
+		// aws:userid of a role session is "<role-id>:<session-name>"
+		patterns[i] = "*:" + name
+	}
+	sort.Strings(patterns)
+
+	statement := policyStatement{
+		Sid:      revocationSid(expiresAt, patterns),
+		Effect:   "Deny",
+		Action:   []string{"*"},
+		Resource: []string{"*"},
+		Condition: map[string]map[string]interface{}{
+			"DateLessThan": {"aws:TokenIssueTime": time.Now().UTC().Format(time.RFC3339)},
+			"StringLike":   {"aws:userid": patterns},
+		},
+	}
+
+	if _, err := p.updateRevocationPolicy(ctx, func(statements []policyStatement) []policyStatement {
+		return append(statements, statement)
+	}); err != nil {
+		return err
+	}
+
+	sdk.Info("revoked role sessions", "sessions", strings.Join(names, ","), "until", expiresAt.UTC().Format(time.RFC3339))
+	p.scheduleRevocationCleanup(expiresAt)
+	return nil
+}
+
+// cleanupRevocations removes revocation statements whose sessions have
+// expired, deleting the policy once it is empty, and returns how many were
+// removed
+func (p *AWSPlugin) cleanupRevocations(ctx context.Context) (int, error) {
+	return p.updateRevocationPolicy(ctx, func(statements []policyStatement) []policyStatement {
+		return statements
+	})
+}
+
+// scheduleRevocationCleanup prunes the revocation policy shortly after a
+// statement expires
+func (p *AWSPlugin) scheduleRevocationCleanup(expiresAt time.Time) {
+	p.cleanupPending.Store(true)
+	p.revocationCleanups.schedule(time.Until(expiresAt)+time.Minute, func() {
+		defer recoverLogged("revocation cleanup")
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		if p.config == nil {
+			return
+		}
+
+		if _, err := p.cleanupRevocations(context.Background()); err != nil {
+			sdk.Warn("failed to clean up revocation policy", "error", err)
+		}
+	})
+}
+
+// updateRevocationPolicy applies fn to the live revocation statements of the
+// role (expired ones are dropped first) and writes the result back. It
+// returns the number of expired statements dropped.
+func (p *AWSPlugin) updateRevocationPolicy(ctx context.Context, fn func([]policyStatement) []policyStatement) (int, error) {
+	p.revocationMu.Lock()
+	defer p.revocationMu.Unlock()
+
+	roleName, err := roleNameFromARN(p.config.RoleARN)
+	if err != nil {
+		return 0, err
+	}
+
+	client, err := p.createIAMClient(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create IAM client: %w", err)
+	}
+
+	var current []policyStatement
+	existing, err := client.GetRolePolicy(ctx, &iam.GetRolePolicyInput{
+		RoleName:   aws.String(roleName),
+		PolicyName: aws.String(p.config.RevocationPolicyName),
+	})
+	var notFound *iamtypes.NoSuchEntityException
+	switch {
+	case errors.As(err, &notFound):
+	case err != nil:
+		return 0, fmt.Errorf("failed to read revocation policy: %w", err)
+	default:
+		current, err = parsePolicyDocument(aws.ToString(existing.PolicyDocument))
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse revocation policy: %w", err)
+		}
+	}
+
+	now := time.Now()
+	var live []policyStatement
+	for _, s := range current {
+		if expires, ok := revocationSidExpiry(s.Sid); ok && !expires.After(now) {
+			continue
+		}
+		live = append(live, s)
+	}
+
+	expired := len(current) - len(live)
+	updated := fn(live)
+	if len(updated) == len(current) && expired == 0 {
+		// Nothing expired and nothing added
+		return 0, nil
+	}
+
+	if len(updated) == 0 {
+		_, err := client.DeleteRolePolicy(ctx, &iam.DeleteRolePolicyInput{
+			RoleName:   aws.String(roleName),
+			PolicyName: aws.String(p.config.RevocationPolicyName),
+		})
+		if err != nil && !errors.As(err, &notFound) {
+			return 0, fmt.Errorf("failed to delete revocation policy: %w", err)
+		}
+		return expired, nil
+	}
+
+	document, err := newPolicy(dedupeStatements(updated)...).String()
+	if err != nil {
+		return 0, err
+	}
+	if len(document) > maxInlinePolicySize {
+		return 0, fmt.Errorf("failed to update revocation policy: %d live statements take %d characters, over IAM's limit of %d for a role's inline policies; revoke fewer sessions until some expire", len(updated), len(document), maxInlinePolicySize)
+	}
+
+	_, err = client.PutRolePolicy(ctx, &iam.PutRolePolicyInput{
+		RoleName:       aws.String(roleName),
+		PolicyName:     aws.String(p.config.RevocationPolicyName),
+		PolicyDocument: aws.String(document),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update revocation policy: %w", err)
+	}
+
+	return expired, nil
+}
+
+// revocationSid builds a statement ID encoding the statement's expiry and a
+// hash of what it denies, so revoking the same sessions twice replaces the
+// statement instead of duplicating it
+func revocationSid(expiresAt time.Time, patterns []string) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(patterns, ",")))
+	return fmt.Sprintf("%s%dH%08x", revocationSidPrefix, expiresAt.Unix(), h.Sum32())
+}
+
+// revocationSidExpiry extracts the expiry of a plugin-managed statement
+func revocationSidExpiry(sid string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(sid, revocationSidPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	expires, _, _ := strings.Cut(rest, "H")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
+
+// dedupeStatements keeps the last statement for each Sid
+func dedupeStatements(statements []policyStatement) []policyStatement {
+	index := map[string]int{}
+	var out []policyStatement
+	for _, s := range statements {
+		if i, ok := index[s.Sid]; ok && s.Sid != "" {
+			out[i] = s
+			continue
+		}
+		index[s.Sid] = len(out)
+		out = append(out, s)
+	}
+	return out
+}
+
+// parsePolicyDocument decodes the URL-encoded policy document returned by IAM.
+// It is percent-encoded, so '+' in session names is a plus, not a space.
+func parsePolicyDocument(encoded string) ([]policyStatement, error) {
+	decoded, err := url.PathUnescape(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var doc policyDocument
+	if err := json.Unmarshal([]byte(decoded), &doc); err != nil {
+		return nil, err
+	}
+	return doc.Statement, nil
+}
+
+// roleNameFromARN returns the role name (without path) of a role ARN
+func roleNameFromARN(roleARN string) (string, error) {
+	parsed, err := arn.Parse(roleARN)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse role_arn: %w", err)
+	}
+	resource, ok := strings.CutPrefix(parsed.Resource, "role/")
+	if !ok {
+		return "", fmt.Errorf("role_arn is not an IAM role: %s", roleARN)
+	}
+	return resource[strings.LastIndex(resource, "/")+1:], nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevokeCredentialWithoutSession(t *testing.T) {
+	f := newFakeAWS(t, false)
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), f.config(`,"audit_log":`+strconv.Quote(auditLog))); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	entry := &LedgerEntry{ID: newCredentialID(), Scope: "aws:cloudfront:https://d111111abcdef8.cloudfront.net/*", IssuedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := p.ledger.Put(context.Background(), entry); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	err := p.RevokeCredential(context.Background(), entry.ID)
+	if err == nil || !strings.Contains(err.Error(), "cannot be revoked") {
+		t.Fatalf("RevokeCredential = %v, want a cannot be revoked error", err)
+	}
+	if got, _ := p.ledger.Get(context.Background(), entry.ID); got.RevokedAt != nil {
+		t.Error("ledger entry was marked revoked")
+	}
+
+	p.Shutdown(context.Background())
+	data, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatalf("reading audit log: %v", err)
+	}
+	if record := string(data); !strings.Contains(record, "action=revoke outcome=error") || !strings.Contains(record, "cannot be revoked") {
+		t.Errorf("audit log = %q, want a revocation error", record)
+	}
+}
+
+func TestRevocationSid(t *testing.T) {
+	// Hashes are the FNV-1a 32-bit reference vectors of "", "a" and "foobar"
+	expiresAt := time.Unix(1700000000, 0)
+	tests := []struct {
+		patterns []string
+		want     string
+	}{
+		{nil, "CreddyRevoke1700000000H811c9dc5"},
+		{[]string{"a"}, "CreddyRevoke1700000000He40c292c"},
+		{[]string{"foobar"}, "CreddyRevoke1700000000Hbf9cf968"},
+	}
+	for _, tt := range tests {
+		sid := revocationSid(expiresAt, tt.patterns)
+		if sid != tt.want {
+			t.Errorf("revocationSid(%q) = %s, want %s", tt.patterns, sid, tt.want)
+		}
+		if got, ok := revocationSidExpiry(sid); !ok || !got.Equal(expiresAt) {
+			t.Errorf("revocationSidExpiry(%s) = %s, %t, want %s", sid, got, ok, expiresAt)
+		}
+	}
+}
+
+func TestRevocationSidExpiry(t *testing.T) {
+	tests := []struct {
+		sid    string
+		want   int64
+		wantOK bool
+	}{
+		{"CreddyRevoke1700000000H0badf00d", 1700000000, true},
+		{"CreddyRevoke1700000000", 1700000000, true},
+		{"CreddyRevokeH0badf00d", 0, false},
+		{"CreddyRevokeSoonH0badf00d", 0, false},
+		{"DenyAll", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := revocationSidExpiry(tt.sid)
+		if ok != tt.wantOK || (ok && got.Unix() != tt.want) {
+			t.Errorf("revocationSidExpiry(%q) = %s, %t, want %d, %t", tt.sid, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestDedupeStatements(t *testing.T) {
+	statement := func(sid, effect string) policyStatement {
+		return policyStatement{Sid: sid, Effect: effect}
+	}
+	tests := []struct {
+		name string
+		in   []policyStatement
+		want []policyStatement
+	}{
+		{"distinct", []policyStatement{statement("A", "Deny"), statement("B", "Deny")}, []policyStatement{statement("A", "Deny"), statement("B", "Deny")}},
+		{"last wins in place", []policyStatement{statement("A", "Deny"), statement("B", "Deny"), statement("A", "Allow")}, []policyStatement{statement("A", "Allow"), statement("B", "Deny")}},
+		{"without Sid kept", []policyStatement{statement("", "Deny"), statement("", "Allow")}, []policyStatement{statement("", "Deny"), statement("", "Allow")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dedupeStatements(tt.in)
+			if len(got) != len(tt.want) {
+				t.Fatalf("dedupeStatements = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Sid != tt.want[i].Sid || got[i].Effect != tt.want[i].Effect {
+					t.Errorf("dedupeStatements = %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSessionRevocationID(t *testing.T) {
+	tests := []struct {
+		id       string
+		wantName string
+		wantUnix int64
+		wantOK   bool
+	}{
+		{"sts-session:1700000000:creddy-agent+ci@1", "creddy-agent+ci@1", 1700000000, true},
+		{"sts-session:1700000000:", "", 0, false},
+		{"sts-session:soon:creddy-agent", "", 0, false},
+		{"sts-session:1700000000", "", 0, false},
+		{"cred-0123", "", 0, false},
+	}
+	for _, tt := range tests {
+		name, expiresAt, ok := parseSessionRevocationID(tt.id)
+		if ok != tt.wantOK || name != tt.wantName || (ok && expiresAt.Unix() != tt.wantUnix) {
+			t.Errorf("parseSessionRevocationID(%s) = %q, %s, %t, want %q, %d, %t", tt.id, name, expiresAt, ok, tt.wantName, tt.wantUnix, tt.wantOK)
+		}
+	}
+	if id := sessionRevocationID("creddy-agent+ci@1", time.Unix(1700000000, 0)); id != tests[0].id {
+		t.Errorf("sessionRevocationID = %s, want %s", id, tests[0].id)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	if err := p.Configure(context.Background(), f.config(`,"revocation_policy_name":"creddy-revocations"`)); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	// Sessions that have expired are left alone
+	if err := p.revokeSessions(context.Background(), []string{"gone"}, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("revokeSessions of expired sessions: %v", err)
+	}
+	if n := len(f.putRolePolicies()); n != 0 {
+		t.Fatalf("%d PutRolePolicy calls for expired sessions, want none", n)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	before := time.Now().UTC().Truncate(time.Second)
+	if err := p.revokeSessions(context.Background(), []string{"creddy-b", "creddy-a+ci"}, expiresAt); err != nil {
+		t.Fatalf("revokeSessions: %v", err)
+	}
+	policies := f.putRolePolicies()
+	if len(policies) != 1 {
+		t.Fatalf("%d PutRolePolicy calls, want 1", len(policies))
+	}
+	if got := policies[0].Get("RoleName") + "/" + policies[0].Get("PolicyName"); got != "test/creddy-revocations" {
+		t.Errorf("policy written to %s, want test/creddy-revocations", got)
+	}
+	var doc policyDocument
+	if err := json.Unmarshal([]byte(policies[0].Get("PolicyDocument")), &doc); err != nil {
+		t.Fatalf("invalid policy document: %v", err)
+	}
+	if len(doc.Statement) != 1 {
+		t.Fatalf("policy = %+v, want one statement", doc)
+	}
+	s := doc.Statement[0]
+	patterns := []string{"*:creddy-a+ci", "*:creddy-b"}
+	if want := revocationSid(expiresAt, patterns); s.Sid != want {
+		t.Errorf("Sid = %s, want %s", s.Sid, want)
+	}
+	if s.Effect != "Deny" || strings.Join(s.Action, ",") != "*" || strings.Join(s.Resource, ",") != "*" {
+		t.Errorf("statement = %+v, want a Deny of every action", s)
+	}
+	userids, _ := s.Condition["StringLike"]["aws:userid"].([]interface{})
+	if len(userids) != 2 || userids[0] != patterns[0] || userids[1] != patterns[1] {
+		t.Errorf("aws:userid = %v, want the sorted patterns %v", s.Condition["StringLike"]["aws:userid"], patterns)
+	}
+	issued, _ := s.Condition["DateLessThan"]["aws:TokenIssueTime"].(string)
+	if at, err := time.Parse(time.RFC3339, issued); err != nil || at.Before(before) || at.After(time.Now()) {
+		t.Errorf("aws:TokenIssueTime = %q, want the time of revocation", issued)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// bulkRevocationPrefix marks revocation selectors passed to
+	// RevokeCredential in place of an external ID, e.g.
+	// "revoke-all:agent=ci-runner&since=24h"
+	bulkRevocationPrefix = "revoke-all:"
+
+	// revokeAllBatchSize bounds the sessions denied by one revocation
+	// statement, keeping it well within the inline policy size limit
+	revokeAllBatchSize = 50
+)
+
+// revocationFilter selects the outstanding ledger entries to revoke
+type revocationFilter struct {
+	// Agent matches the agent ID or name
+	Agent string
+	// Scope matches exactly, or as a prefix when it ends in '*'
+	Scope string
+	// Since only selects credentials issued at or after this time
+	Since time.Time
+}
+
+// parseRevocationFilter parses the query part of a revoke-all selector
+func parseRevocationFilter(query string) (revocationFilter, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return revocationFilter{}, fmt.Errorf("invalid revoke-all selector: %w", err)
+	}
+
+	var f revocationFilter
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "agent":
+			f.Agent = value
+		case "scope":
+			f.Scope = value
+		case "since":
+			if d, err := time.ParseDuration(value); err == nil {
+				f.Since = time.Now().Add(-d)
+			} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+				f.Since = t
+			} else {
+				return revocationFilter{}, fmt.Errorf("invalid revoke-all since %q: must be a duration or RFC3339 time", value)
+			}
+		default:
+			return revocationFilter{}, fmt.Errorf("unknown revoke-all filter %q", key)
+		}
+	}
+	return f, nil
+}
+
+func (f revocationFilter) matches(entry *LedgerEntry) bool {
+	if f.Agent != "" && entry.AgentID != f.Agent && entry.AgentName != f.Agent {
+		return false
+	}
+	if f.Scope != "" {
+		prefix, wildcard := strings.CutSuffix(f.Scope, "*")
+		if entry.Scope != f.Scope && !(wildcard && strings.HasPrefix(entry.Scope, prefix)) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && entry.IssuedAt.Before(f.Since) {
+		return false
+	}
+	return true
+}
+
+// revokeAll revokes every outstanding credential in the ledger matching the
+// selector. Role sessions are denied in batches rather than one statement
+// per credential.
+func (p *AWSPlugin) revokeAll(ctx context.Context, selector string) error {
+	if p.config == nil {
+		return fmt.Errorf("plugin not configured")
+	}
+	if p.ledger == nil {
+		return fmt.Errorf("revoke-all requires the credential ledger")
+	}
+
+	filter, err := parseRevocationFilter(selector)
+	if err != nil {
+		return err
+	}
+
+	entries, err := p.ledger.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list ledger: %w", err)
+	}
+
+	now := time.Now()
+	byID := make(map[string]*LedgerEntry, len(entries))
+	for _, entry := range entries {
+		byID[entry.ID] = entry
+	}
+	outstanding := func(entry *LedgerEntry) bool {
+		return entry.RevokedAt == nil && entry.ExpiresAt.After(now)
+	}
+
+	// Bundles are selected together with their parts, which are revoked
+	// through their own entries
+	selected := map[string]*LedgerEntry{}
+	for _, entry := range entries {
+		if !outstanding(entry) || !filter.matches(entry) {
+			continue
+		}
+		selected[entry.ID] = entry
+		if ids, ok := strings.CutPrefix(entry.ID, multiExternalIDPrefix); ok {
+			for _, id := range strings.Split(ids, "|") {
+				if part := byID[id]; part != nil && outstanding(part) {
+					selected[id] = part
+				}
+			}
+		}
+	}
+
+	var sessions, others []*LedgerEntry
+	for _, entry := range selected {
+		if p.cache != nil {
+			p.cache.evict(entry.ID)
+		}
+		if p.window != nil {
+			p.window.evict(entry.ID)
+		}
+		switch {
+		case strings.HasPrefix(entry.ID, multiExternalIDPrefix):
+			// Revoked through its parts
+		case entry.SessionName != "" && (strings.HasPrefix(entry.ID, credentialIDPrefix) || strings.HasPrefix(entry.ID, sessionRevocationPrefix)):
+			sessions = append(sessions, entry)
+		default:
+			others = append(others, entry)
+		}
+	}
+
+	var errs []error
+	revoked := map[string]bool{}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].SessionExpiresAt.Before(sessions[j].SessionExpiresAt) })
+	for start := 0; start < len(sessions); start += revokeAllBatchSize {
+		batch := sessions[start:min(start+revokeAllBatchSize, len(sessions))]
+		names := make([]string, len(batch))
+		for i, entry := range batch {
+			names[i] = entry.SessionName
+		}
+		// Sorted by expiry, so the last entry outlives the rest of the batch
+		if err := p.revokeSessions(ctx, names, batch[len(batch)-1].SessionExpiresAt); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, entry := range batch {
+			revoked[entry.ID] = true
+		}
+	}
+
+	for _, entry := range others {
+		if err := p.revokeEntry(ctx, entry); err != nil {
+			errs = append(errs, fmt.Errorf("failed to revoke %s: %w", entry.ID, err))
+			continue
+		}
+		revoked[entry.ID] = true
+	}
+
+	for id, entry := range selected {
+		if strings.HasPrefix(id, multiExternalIDPrefix) {
+			revoked[id] = partsRevoked(id, revoked, selected)
+		}
+		if revoked[id] {
+			p.markRevoked(ctx, entry)
+		}
+	}
+
+	sdk.Info("revoked credentials", "selector", selector, "matched", len(selected), "revoked", countTrue(revoked))
+	return errors.Join(errs...)
+}
+
+// partsRevoked reports whether every outstanding part of a bundle was revoked
+func partsRevoked(bundleID string, revoked map[string]bool, selected map[string]*LedgerEntry) bool {
+	for _, id := range strings.Split(strings.TrimPrefix(bundleID, multiExternalIDPrefix), "|") {
+		if _, ok := selected[id]; ok && !revoked[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func countTrue(m map[string]bool) int {
+	n := 0
+	for _, v := range m {
+		if v {
+			n++
+		}
+	}
+	return n
+}
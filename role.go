@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// roleInfoTTL is how long role details from iam:GetRole are reused
+const roleInfoTTL = 15 * time.Minute
+
+// roleInfo caches details of the configured role
+type roleInfo struct {
+	mu                 sync.Mutex
+	fetchedAt          time.Time
+	maxSessionDuration time.Duration
+}
+
+// roleMaxSessionDuration returns the role's MaxSessionDuration. If the role
+// cannot be read (for example without iam:GetRole), the STS maximum is
+// assumed and STS enforces the real limit at issuance.
+func (p *AWSPlugin) roleMaxSessionDuration(ctx context.Context) time.Duration {
+	info := p.role
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	if !info.fetchedAt.IsZero() && time.Since(info.fetchedAt) < roleInfoTTL {
+		return info.maxSessionDuration
+	}
+
+	info.fetchedAt = time.Now()
+	info.maxSessionDuration = maxSessionDuration
+
+	name, err := roleNameFromARN(p.config.RoleARN)
+	if err != nil {
+		return info.maxSessionDuration
+	}
+	client, err := p.createIAMClient(ctx)
+	if err != nil {
+		return info.maxSessionDuration
+	}
+	out, err := client.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(name)})
+	if err != nil {
+		sdk.Warn("failed to read role MaxSessionDuration, assuming 12 hours", "role", p.config.RoleARN, "error", err)
+		return info.maxSessionDuration
+	}
+	if d := aws.ToInt32(out.Role.MaxSessionDuration); d > 0 {
+		info.maxSessionDuration = time.Duration(d) * time.Second
+	}
+	return info.maxSessionDuration
+}
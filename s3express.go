@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// S3ExpressSessionValue is the credential value returned for aws:s3express
+// scopes. The session credentials only work against Bucket.
+type S3ExpressSessionValue struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	SessionMode     string `json:"session_mode"`
+}
+
+// issueS3ExpressSession calls s3express:CreateSession for a directory bucket.
+// The "session_mode" request parameter selects ReadWrite (default) or ReadOnly.
+func (p *AWSPlugin) issueS3ExpressSession(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	if !strings.HasSuffix(resource, "--x-s3") {
+		return nil, fmt.Errorf("invalid s3express scope: %s (expected aws:s3express:<directory-bucket>)", req.Scope)
+	}
+
+	mode := s3types.SessionModeReadWrite
+	if m := req.Parameters["session_mode"]; m != "" {
+		switch {
+		case strings.EqualFold(m, string(s3types.SessionModeReadOnly)):
+			mode = s3types.SessionModeReadOnly
+		case strings.EqualFold(m, string(s3types.SessionModeReadWrite)):
+			mode = s3types.SessionModeReadWrite
+		default:
+			return nil, fmt.Errorf("invalid session_mode %q: must be ReadOnly or ReadWrite", m)
+		}
+	}
+
+	// S3 Express sessions are short-lived (5 minutes) regardless of the role
+	// session, so the minimum role session is enough
+	creds, err := p.assumeRole(ctx, req.Scope, 900)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := p.sessionAWSConfig(ctx, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	cfg.Region = region
+
+	result, err := p.config.newS3Client(cfg).CreateSession(ctx, &s3.CreateSessionInput{
+		Bucket:      aws.String(resource),
+		SessionMode: mode,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3express session: %w", err)
+	}
+
+	value, err := json.Marshal(S3ExpressSessionValue{
+		AccessKeyID:     aws.ToString(result.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(result.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(result.Credentials.SessionToken),
+		Region:          region,
+		Bucket:          resource,
+		SessionMode:     string(mode),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["bucket"] = resource
+	metadata["session_mode"] = string(mode)
+
+	return &sdk.Credential{
+		Value:     string(value),
+		ExpiresAt: aws.ToTime(result.Credentials.Expiration),
+		Metadata:  metadata,
+	}, nil
+}
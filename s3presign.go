@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// defaultPresignTTL is used when a presign request does not specify a TTL
+const defaultPresignTTL = time.Hour
+
+// parseS3Object splits a "<bucket>/<key>" resource
+func parseS3Object(resource string) (bucket, key string, ok bool) {
+	bucket, key, ok = strings.Cut(resource, "/")
+	return bucket, key, ok && bucket != "" && key != ""
+}
+
+// issueS3PresignedURL returns a presigned GET or PUT URL for a single object.
+// The credential value is the URL itself so consumers never see AWS keys.
+func (p *AWSPlugin) issueS3PresignedURL(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	// Bucket names cannot contain ':', so anything before the first ':' is
+	// the method modifier
+	method := "GET"
+	if modifier, rest, ok := strings.Cut(resource, ":"); ok && !strings.Contains(modifier, "/") {
+		method = strings.ToUpper(modifier)
+		resource = rest
+	}
+	if method != "GET" && method != "PUT" {
+		return nil, fmt.Errorf("invalid s3 presign method %q: must be get or put", method)
+	}
+
+	bucket, key, ok := parseS3Object(resource)
+	if !ok {
+		return nil, fmt.Errorf("invalid s3 presign scope: %s (expected aws:s3:presign:[get:|put:]<bucket>/<key>)", req.Scope)
+	}
+
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = defaultPresignTTL
+	}
+
+	creds, err := p.assumeRole(ctx, req.Scope, sessionDurationSeconds(ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	// A presigned URL stops working when the signing session expires
+	if remaining := time.Until(*creds.Expiration); remaining < ttl {
+		ttl = remaining
+	}
+
+	cfg, err := p.sessionAWSConfig(ctx, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	cfg.Region = region
+	presigner := s3.NewPresignClient(p.config.newS3Client(cfg), s3.WithPresignExpires(ttl))
+
+	var presigned *v4.PresignedHTTPRequest
+	switch method {
+	case "GET":
+		presigned, err = presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	case "PUT":
+		presigned, err = presigner.PresignPutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign s3 %s: %w", method, err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["method"] = presigned.Method
+	metadata["bucket"] = bucket
+	metadata["key"] = key
+
+	return &sdk.Credential{
+		Value:     presigned.URL,
+		ExpiresAt: time.Now().Add(ttl),
+		Metadata:  metadata,
+	}, nil
+}
+
+// S3PresignedPostValue is the credential value returned for aws:s3:post
+// scopes: the form action URL and the fields to submit with the file
+type S3PresignedPostValue struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+// issueS3PresignedPost returns a presigned POST form policy restricted to a
+// key prefix. Optional request parameters:
+//
+//	content_type        exact type, or a prefix ending in "/" (e.g. "image/")
+//	min_content_length  minimum upload size in bytes
+//	max_content_length  maximum upload size in bytes
+func (p *AWSPlugin) issueS3PresignedPost(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	bucket, prefix, _ := strings.Cut(resource, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid s3 post scope: %s (expected aws:s3:post:<bucket>/<prefix>)", req.Scope)
+	}
+
+	conditions := []interface{}{
+		[]interface{}{"starts-with", "$key", prefix},
+	}
+
+	if contentType := req.Parameters["content_type"]; contentType != "" {
+		if strings.HasSuffix(contentType, "/") {
+			conditions = append(conditions, []interface{}{"starts-with", "$Content-Type", contentType})
+		} else {
+			conditions = append(conditions, map[string]string{"Content-Type": contentType})
+		}
+	}
+
+	minLength, maxLength, err := contentLengthRange(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if maxLength > 0 {
+		conditions = append(conditions, []interface{}{"content-length-range", minLength, maxLength})
+	}
+
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = defaultPresignTTL
+	}
+
+	creds, err := p.assumeRole(ctx, req.Scope, sessionDurationSeconds(ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	if remaining := time.Until(*creds.Expiration); remaining < ttl {
+		ttl = remaining
+	}
+
+	cfg, err := p.sessionAWSConfig(ctx, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	cfg.Region = region
+	presigner := s3.NewPresignClient(p.config.newS3Client(cfg))
+
+	presigned, err := presigner.PresignPostObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(prefix + "${filename}"),
+	}, func(o *s3.PresignPostOptions) {
+		o.Expires = ttl
+		o.Conditions = conditions
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign s3 post: %w", err)
+	}
+
+	value, err := json.Marshal(S3PresignedPostValue{
+		URL:    presigned.URL,
+		Fields: presigned.Values,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["bucket"] = bucket
+	metadata["key_prefix"] = prefix
+
+	return &sdk.Credential{
+		Value:     string(value),
+		ExpiresAt: time.Now().Add(ttl),
+		Metadata:  metadata,
+	}, nil
+}
+
+// contentLengthRange parses the optional upload size bounds of a POST policy
+func contentLengthRange(params map[string]string) (int64, int64, error) {
+	var minLength, maxLength int64
+	if v := params["min_content_length"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid min_content_length: %q", v)
+		}
+		minLength = n
+	}
+	if v := params["max_content_length"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid max_content_length: %q", v)
+		}
+		maxLength = n
+	}
+	if minLength > 0 && maxLength == 0 {
+		return 0, 0, fmt.Errorf("min_content_length requires max_content_length")
+	}
+	if maxLength > 0 && minLength > maxLength {
+		return 0, 0, fmt.Errorf("min_content_length exceeds max_content_length")
+	}
+	return minLength, maxLength, nil
+}
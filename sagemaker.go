@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sagemaker"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// sagemakerURLLifetime is how long a presigned domain URL can be used
+	// before the Studio session begins (the API maximum)
+	sagemakerURLLifetime = 5 * time.Minute
+	// SageMaker Studio session duration limits
+	sagemakerMinSession = 30 * time.Minute
+	sagemakerMaxSession = 12 * time.Hour
+)
+
+// issueSageMakerDomainURL creates a presigned SageMaker domain URL for a user
+// profile. The Studio session lasts for the requested TTL. Optional request
+// parameters:
+//
+//	space        open a specific Studio space
+//	landing_uri  page to land on (e.g. "studio::" or "app:JupyterLab:")
+func (p *AWSPlugin) issueSageMakerDomainURL(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	domainID, profile, ok := strings.Cut(resource, "/")
+	if !ok || domainID == "" || profile == "" {
+		return nil, fmt.Errorf("invalid sagemaker scope: %s (expected aws:sagemaker:<domain-id>/<user-profile>)", req.Scope)
+	}
+
+	session := req.TTL
+	if session <= 0 {
+		session = time.Hour
+	}
+	session = max(sagemakerMinSession, min(session, sagemakerMaxSession))
+
+	// The role session only has to outlive the API call
+	creds, err := p.assumeRole(ctx, req.Scope, 900)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := p.sessionAWSConfig(ctx, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	cfg.Region = region
+
+	input := &sagemaker.CreatePresignedDomainUrlInput{
+		DomainId:                           aws.String(domainID),
+		UserProfileName:                    aws.String(profile),
+		ExpiresInSeconds:                   aws.Int32(int32(sagemakerURLLifetime.Seconds())),
+		SessionExpirationDurationInSeconds: aws.Int32(int32(session.Seconds())),
+	}
+	if space := req.Parameters["space"]; space != "" {
+		input.SpaceName = aws.String(space)
+	}
+	if landing := req.Parameters["landing_uri"]; landing != "" {
+		input.LandingUri = aws.String(landing)
+	}
+
+	result, err := sagemaker.NewFromConfig(p.config.serviceAWSConfig(cfg, "sagemaker")).CreatePresignedDomainUrl(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create presigned domain url: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["domain_id"] = domainID
+	metadata["user_profile"] = profile
+	metadata["session_expires_at"] = time.Now().Add(session).Format(time.RFC3339)
+
+	return &sdk.Credential{
+		Value:     aws.ToString(result.AuthorizedUrl),
+		ExpiresAt: time.Now().Add(sagemakerURLLifetime),
+		Metadata:  metadata,
+	}, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// sesSMTPPort is the STARTTLS submission port of the SES SMTP endpoint
+	sesSMTPPort = 587
+	// sesSMTPVersion prefixes SigV4-derived SMTP passwords
+	sesSMTPVersion = 0x04
+)
+
+// SESSMTPValue is the credential value returned for aws:ses:smtp
+type SESSMTPValue struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// issueSESSMTPCredential derives SES SMTP credentials. The SMTP interface has
+// no way to carry a session token, so the password is derived from the
+// dedicated SES sending user rather than an assumed-role session. It is valid
+// for as long as that user's access key, so the credential has no expiry and
+// cannot be revoked.
+func (p *AWSPlugin) issueSESSMTPCredential(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	if resource != "" {
+		return nil, fmt.Errorf("invalid ses scope: %s (expected aws:ses:smtp)", req.Scope)
+	}
+	if p.config.SESSMTPAccessKeyID == "" {
+		return nil, fmt.Errorf("ses_smtp_access_key_id and ses_smtp_secret_access_key must be configured for aws:ses:smtp")
+	}
+
+	value, err := json.Marshal(SESSMTPValue{
+		Host:     fmt.Sprintf("email-smtp.%s.amazonaws.com", region),
+		Port:     sesSMTPPort,
+		Username: p.config.SESSMTPAccessKeyID,
+		Password: sesSMTPPassword(p.config.SESSMTPSecretAccessKey, region),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	return &sdk.Credential{
+		Value: string(value),
+		Metadata: map[string]string{
+			"region": region,
+			"scope":  req.Scope,
+		},
+	}, nil
+}
+
+// sesSMTPPassword implements the documented SigV4 derivation of an SES SMTP
+// password from a secret access key
+func sesSMTPPassword(secretAccessKey, region string) string {
+	sign := func(key []byte, msg string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(msg))
+		return mac.Sum(nil)
+	}
+
+	// The date is fixed by the derivation, not the current date
+	signature := sign([]byte("AWS4"+secretAccessKey), "11111111")
+	signature = sign(signature, region)
+	signature = sign(signature, "ses")
+	signature = sign(signature, "aws4_request")
+	signature = sign(signature, "SendRawEmail")
+
+	return base64.StdEncoding.EncodeToString(append([]byte{sesSMTPVersion}, signature...))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// exampleSecretAccessKey is the secret access key of AWS's documentation
+const exampleSecretAccessKey = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+
+func TestSESSMTPPassword(t *testing.T) {
+	// Computed with the Python script of the SES developer guide's "Obtaining
+	// Amazon SES SMTP credentials"
+	tests := []struct {
+		region string
+		want   string
+	}{
+		{"us-east-1", "BLBM/9hSUELfq8Gw+rU1YcBjkOxGbhT2XG763xVLGWL9"},
+		{"eu-west-1", "BMW5RDrXmmVs0lV7GpI4oLkHXpZ4stDsk6q91z1g38Pk"},
+		{"ap-southeast-2", "BLNVIwl1Vk66qi8YP1q44PSaqUtaoyrS/0LT79VaGBfa"},
+	}
+	for _, tt := range tests {
+		if got := sesSMTPPassword(exampleSecretAccessKey, tt.region); got != tt.want {
+			t.Errorf("sesSMTPPassword(%s) = %s, want %s", tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestSESSMTPCredential(t *testing.T) {
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	cfg := f.config(`,"region":"eu-west-1","ses_smtp_access_key_id":"AKIASESTEST","ses_smtp_secret_access_key":"` + exampleSecretAccessKey + `"`)
+	if err := p.Configure(context.Background(), cfg); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	cred, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: "aws:ses:smtp", Agent: sdk.Agent{ID: "agent"}})
+	if err != nil {
+		t.Fatalf("GetCredential: %v", err)
+	}
+	var value SESSMTPValue
+	if err := json.Unmarshal([]byte(cred.Value), &value); err != nil {
+		t.Fatalf("invalid value %q: %v", cred.Value, err)
+	}
+	want := SESSMTPValue{Host: "email-smtp.eu-west-1.amazonaws.com", Port: 587, Username: "AKIASESTEST", Password: "BMW5RDrXmmVs0lV7GpI4oLkHXpZ4stDsk6q91z1g38Pk"}
+	if value != want {
+		t.Errorf("value = %+v, want %+v", value, want)
+	}
+	if !cred.ExpiresAt.IsZero() {
+		t.Errorf("ExpiresAt = %s, want none for a password of a long-lived key", cred.ExpiresAt)
+	}
+	if err := p.RevokeCredential(context.Background(), cred.Credential); err == nil || !strings.Contains(err.Error(), "cannot be revoked") {
+		t.Errorf("RevokeCredential = %v, want a cannot be revoked error", err)
+	}
+}
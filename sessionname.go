@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// defaultSessionNameTemplate names sessions after their scope
+	defaultSessionNameTemplate = "creddy-{{.Scope}}-{{.Timestamp}}"
+
+	// stickySessionNameTemplate names sessions after the requesting agent
+	stickySessionNameTemplate = "creddy-{{.Requester}}-{{.RequesterHash}}"
+
+	// logicalTTLSessionNameTemplate is the default template with logical_ttl,
+	// which needs a name no other session has
+	logicalTTLSessionNameTemplate = "creddy-{{.Scope}}-{{.Timestamp}}-{{.RequestID}}"
+
+	// maxSessionNameLength is the STS limit on RoleSessionName
+	maxSessionNameLength = 64
+
+	// minSessionNameLength is the STS minimum for RoleSessionName
+	minSessionNameLength = 2
+)
+
+// sessionNameData is the data available to session name templates
+type sessionNameData struct {
+	Scope         string
+	Requester     string
+	AgentID       string
+	RequesterHash string
+	Timestamp     int64
+
+	// RequestID is the issuance's request ID, unique to the session
+	RequestID string
+}
+
+// parseSessionNameTemplate parses the configured session name template,
+// falling back to the built-in ones
+func parseSessionNameTemplate(cfg *AWSConfig) (*template.Template, error) {
+	text := cfg.SessionNameTemplate
+	if text == "" {
+		text = defaultSessionNameTemplate
+		if cfg.StickySessionNames.Value {
+			text = stickySessionNameTemplate
+		} else if cfg.LogicalTTL.Value {
+			text = logicalTTLSessionNameTemplate
+		}
+	} else if cfg.StickySessionNames.Value {
+		return nil, fmt.Errorf("session_name_template and sticky_session_names cannot both be set")
+	}
+
+	tmpl, err := template.New("session_name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session_name_template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// roleSessionName renders the role session name for a new session. Renewals
+// keep the name of the session they renew.
+func (p *AWSPlugin) roleSessionName(ctx context.Context, scope string) (string, error) {
+	data := sessionNameData{
+		Scope:     scope,
+		Timestamp: time.Now().Unix(),
+	}
+	if iss := issuanceFrom(ctx); iss != nil {
+		if iss.Renews != nil && iss.Renews.SessionName != "" {
+			return iss.Renews.SessionName, nil
+		}
+		if iss.Probe != "" {
+			return fmt.Sprintf("%s-%s-%d", userAgentProduct, iss.Probe, data.Timestamp), nil
+		}
+		data.RequestID = iss.ID
+		data.Requester = iss.Agent.Name
+		data.AgentID = iss.Agent.ID
+		data.RequesterHash = requesterHash(iss.Agent.ID, iss.Agent.Name)
+	}
+
+	var b strings.Builder
+	if err := p.sessionNameTemplate.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render session name: %w", err)
+	}
+	return normalizeSessionName(b.String()), nil
+}
+
+// requesterHash is a short stable hash of the requesting agent, so agents
+// sharing a name still get distinct session names
+func requesterHash(id, name string) string {
+	if id == "" {
+		id = name
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// normalizeSessionName makes a rendered name acceptable to STS. Disallowed
+// characters become '-', and names over 64 characters are cut and suffixed
+// with a hash of the full name so distinct long names stay distinct.
+func normalizeSessionName(name string) string {
+	name = sanitizeSessionName(name)
+	if len(name) > maxSessionNameLength {
+		sum := sha256.Sum256([]byte(name))
+		suffix := "-" + hex.EncodeToString(sum[:])[:8]
+		name = name[:maxSessionNameLength-len(suffix)] + suffix
+	}
+	for len(name) < minSessionNameLength {
+		name += "-"
+	}
+	return name
+}
+
+// sanitizeSessionName replaces characters STS does not allow in session
+// names ([\w+=,.@-]) with '-'
+func sanitizeSessionName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("_+=,.@-", r):
+			return r
+		default:
+			return '-'
+		}
+	}, s)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// shutdownTimeout bounds the AWS calls made while shutting down
+const shutdownTimeout = 10 * time.Second
+
+// Shutdown stops background work, flushes persistent state, and drops the
+// secrets the plugin holds. It runs once, when the plugin process exits.
+func (p *AWSPlugin) Shutdown(ctx context.Context) {
+	p.shutdownOnce.Do(func() {
+		defer recoverLogged("Shutdown")
+		p.configureMu.Lock()
+		defer p.configureMu.Unlock()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.shutdown(ctx)
+	})
+}
+
+func (p *AWSPlugin) shutdown(ctx context.Context) {
+	if p.config == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+
+	if p.prefetch != nil {
+		p.prefetch.close()
+		p.prefetch = nil
+	}
+	if p.janitor != nil {
+		p.janitor.close()
+		p.janitor = nil
+	}
+	if p.canary != nil {
+		p.canary.close()
+		p.canary = nil
+	}
+	if p.credentialsFile != nil {
+		p.credentialsFile.close()
+		p.credentialsFile = nil
+	}
+	if p.metricsServer != nil {
+		p.metricsServer.close()
+		p.metricsServer = nil
+	}
+
+	// Pending logical expiries are lost with the process, so deny those
+	// sessions now
+	p.expireLogicalTTLs(ctx)
+
+	// Scheduled cleanups are lost with the process, so prune expired
+	// revocation statements now; the policy is removed entirely only when
+	// asked to, since that reinstates revoked sessions
+	p.revocationCleanups.stop()
+	if p.config.RemoveRevocationsOnShutdown.Value {
+		_, err := p.updateRevocationPolicy(ctx, func([]policyStatement) []policyStatement { return nil })
+		if err != nil {
+			sdk.Warn("failed to remove revocation policy", "error", err)
+		} else {
+			sdk.Info("removed revocation policy", "policy", p.config.RevocationPolicyName)
+		}
+	} else if p.cleanupPending.Load() {
+		if _, err := p.cleanupRevocations(ctx); err != nil {
+			sdk.Warn("failed to clean up revocation policy", "error", err)
+		}
+	}
+
+	if p.ledger != nil {
+		if err := p.ledger.Close(); err != nil {
+			sdk.Warn("failed to close ledger", "error", err)
+		}
+		p.ledger = nil
+	}
+	p.quotas = nil
+
+	if p.cache != nil {
+		p.cache.close()
+		p.cache = nil
+	}
+	p.window = nil
+
+	p.audit.close()
+	p.audit = nil
+	p.notifier.close()
+	p.notifier = nil
+	p.webhooks.close()
+	p.webhooks = nil
+
+	// Last, so the spans of the calls above are exported
+	if p.tracing != nil {
+		p.tracing.close()
+		p.tracing = nil
+	}
+
+	p.zeroSecrets()
+	sdk.Debug("plugin shut down")
+}
+
+// zeroSecrets overwrites the key material the plugin holds where Go allows
+// it, and drops the configuration holding the rest. The plugin reports
+// itself as unconfigured afterwards.
+func (p *AWSPlugin) zeroSecrets() {
+	if key := p.cloudfrontKey; key != nil {
+		key.D.SetInt64(0)
+		for _, prime := range key.Primes {
+			prime.SetInt64(0)
+		}
+		key.Precomputed = rsa.PrecomputedValues{}
+		p.cloudfrontKey = nil
+	}
+	p.iotClient = nil
+	p.config = nil
+	redactor.set(nil)
+}
+
+// close persists the cache one last time and wipes it from memory
+func (c *credentialCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sweep()
+	c.persist()
+	clear(c.entries)
+	if c.file != nil {
+		clear(c.file.key)
+		c.file = nil
+	}
+}
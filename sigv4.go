@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// presignURL returns a SigV4 query-string presigned URL valid for expires
+func presignURL(ctx context.Context, creds aws.Credentials, method, rawURL, service, region string, expires time.Duration) (string, http.Header, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+
+	query := u.Query()
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to build request: %w", err)
+	}
+
+	signedURL, headers, err := v4.NewSigner().PresignHTTP(ctx, creds, req, emptyPayloadHash, service, region, time.Now().UTC())
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to presign request: %w", err)
+	}
+
+	return signedURL, headers, nil
+}
+
+// signHeaders signs a bodiless request with SigV4 headers and returns the
+// headers a client must send (Authorization, X-Amz-Date, ...)
+func signHeaders(ctx context.Context, creds aws.Credentials, method, rawURL, service, region string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, emptyPayloadHash, service, region, time.Now().UTC()); err != nil {
+		return nil, fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	headers := map[string]string{"Host": req.URL.Host}
+	for name := range req.Header {
+		headers[name] = req.Header.Get(name)
+	}
+	return headers, nil
+}
+
+// tokenLifetime returns the requested TTL capped at a token's maximum lifetime
+func tokenLifetime(ttl, max time.Duration) time.Duration {
+	if ttl > 0 && ttl < max {
+		return ttl
+	}
+	return max
+}
+
+// SigV4Target is a configured request template for aws:sigv4 scopes
+type SigV4Target struct {
+	// Service is the SigV4 signing name (e.g. "es", "execute-api", "aoss")
+	Service string `json:"service"`
+	// Endpoint is the base URL (e.g. "https://search-logs.us-east-1.es.amazonaws.com")
+	Endpoint string `json:"endpoint"`
+	Method   string `json:"method,omitempty"`
+	Path     string `json:"path,omitempty"`
+	// Region defaults to the plugin region
+	Region string `json:"region,omitempty"`
+	// Signing is "query" (presigned URL, default) or "headers"
+	Signing string `json:"signing,omitempty"`
+}
+
+func (t SigV4Target) validate() error {
+	if t.Service == "" {
+		return fmt.Errorf("service is required")
+	}
+	u, err := url.Parse(t.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("endpoint must be an https URL")
+	}
+	if t.Signing != "" && t.Signing != "query" && t.Signing != "headers" {
+		return fmt.Errorf("signing must be query or headers")
+	}
+	return nil
+}
+
+// SigV4RequestValue is the credential value returned for aws:sigv4 scopes:
+// a request the consumer can send as-is
+type SigV4RequestValue struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// issueSigV4Request signs the configured request template for a target.
+// Requests are signed with an empty payload.
+func (p *AWSPlugin) issueSigV4Request(ctx context.Context, req *sdk.CredentialRequest, resource, region string) (*sdk.Credential, error) {
+	target, ok := p.config.SigV4Targets.Value[resource]
+	if !ok {
+		return nil, fmt.Errorf("unknown sigv4 target: %s", resource)
+	}
+
+	method := strings.ToUpper(target.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	if target.Region != "" {
+		region = target.Region
+	}
+	requestURL := strings.TrimSuffix(target.Endpoint, "/") + "/" + strings.TrimPrefix(target.Path, "/")
+
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = defaultPresignTTL
+	}
+
+	creds, err := p.assumeRole(ctx, req.Scope, sessionDurationSeconds(ttl))
+	if err != nil {
+		return nil, err
+	}
+	if remaining := time.Until(*creds.Expiration); remaining < ttl {
+		ttl = remaining
+	}
+
+	value := SigV4RequestValue{Method: method}
+	expiresAt := time.Now().Add(ttl)
+
+	if target.Signing == "headers" {
+		headers, err := signHeaders(ctx, signingCredentials(creds), method, requestURL, target.Service, region)
+		if err != nil {
+			return nil, err
+		}
+		value.URL = requestURL
+		value.Headers = headers
+		// Header signatures are only accepted for a few minutes
+		expiresAt = time.Now().Add(5 * time.Minute)
+	} else {
+		signedURL, signedHeaders, err := presignURL(ctx, signingCredentials(creds), method, requestURL, target.Service, region, ttl)
+		if err != nil {
+			return nil, err
+		}
+		value.URL = signedURL
+		value.Headers = map[string]string{}
+		for name := range signedHeaders {
+			value.Headers[name] = signedHeaders.Get(name)
+		}
+	}
+
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+
+	metadata := p.baseMetadata(req.Scope)
+	metadata["target"] = resource
+	metadata["service"] = target.Service
+
+	return &sdk.Credential{
+		Value:     string(valueJSON),
+		ExpiresAt: expiresAt,
+		Metadata:  metadata,
+	}, nil
+}
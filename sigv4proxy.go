@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// sigv4ProxyCommand is the subcommand that runs a local proxy signing
+	// AWS API requests with credentials that never leave the plugin
+	sigv4ProxyCommand = "sigv4-proxy"
+
+	defaultSigV4ProxyListen = "127.0.0.1:8171"
+
+	// maxSignedBody is the largest request body the proxy buffers to hash.
+	// S3 bodies are streamed unsigned instead.
+	maxSignedBody = 64 << 20
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// awsRegionLabel matches the region label of an AWS endpoint host
+var awsRegionLabel = regexp.MustCompile(`^[a-z]{2}(-gov|-iso[a-z]?)?-[a-z]+-\d+$`)
+
+// awsEndpointSuffixes are the domains the proxy signs requests for, so it
+// cannot be used as an open proxy
+var awsEndpointSuffixes = []string{".amazonaws.com", ".amazonaws.com.cn", ".api.aws"}
+
+// signingNames maps endpoint prefixes to their SigV4 signing names where
+// they differ
+var signingNames = map[string]string{
+	"email":                 "ses",
+	"bedrock-runtime":       "bedrock",
+	"bedrock-agent-runtime": "bedrock",
+	"runtime.sagemaker":     "sagemaker",
+	"runtime.lex":           "lex",
+}
+
+// hopHeaders are connection-level headers a proxy must not forward
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// sigv4Proxy signs requests it receives with the scope's credentials and
+// forwards them over HTTPS, for clients presenting the token. Requests in
+// absolute form (through HTTP_PROXY) go to the host they name; requests in
+// origin form go to the upstream.
+type sigv4Proxy struct {
+	token     string
+	upstream  *url.URL
+	service   string
+	region    string
+	refresher *credentialRefresher
+	transport http.RoundTripper
+}
+
+// runSigV4Proxy runs a local signing proxy for a scope, and prints the
+// environment pointing SDKs at it
+func runSigV4Proxy(ctx context.Context, p *AWSPlugin, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet(sigv4ProxyCommand, flag.ContinueOnError)
+	buildRequest := addHelperFlags(fs, sigv4ProxyCommand)
+	listen := fs.String("listen", defaultSigV4ProxyListen, "Loopback address to serve the proxy on")
+	upstream := fs.String("upstream", "", "AWS endpoint (https://...) to send requests without an absolute URL to")
+	service := fs.String("service", "", "SigV4 signing name, instead of deriving it from the endpoint host")
+	region := fs.String("region", "", "Signing region, instead of deriving it from the endpoint host")
+	tokenFile := fs.String("token-file", "", "File holding the proxy token; created with a random token if missing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	hr, err := buildRequest()
+	if err != nil {
+		return err
+	}
+
+	// Whoever reaches the proxy can have requests signed as the scope
+	if err := checkLoopbackListen(*listen); err != nil {
+		return err
+	}
+	token, err := containerToken(*tokenFile)
+	if err != nil {
+		return err
+	}
+
+	// Issuing credentials itself, the proxy forwards with the config's proxy,
+	// TLS and PrivateLink settings; through creddy, with the environment's
+	transport := http.DefaultTransport
+	if hr.Creddy == "" {
+		if err := configureHelper(ctx, p, hr); err != nil {
+			return err
+		}
+		transport = p.httpTransport()
+	}
+
+	s := &sigv4Proxy{
+		token:     token,
+		service:   *service,
+		region:    *region,
+		refresher: newCredentialRefresher(p, hr),
+		transport: transport,
+	}
+	if *upstream != "" {
+		u, err := url.Parse(*upstream)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("--upstream must be an https URL")
+		}
+		if !isAWSEndpoint(u.Hostname()) {
+			return fmt.Errorf("--upstream must be an AWS endpoint")
+		}
+		s.upstream = u
+	}
+
+	return serveCredentials(ctx, sigv4ProxyCommand, *listen, s.refresher, s, func(addr string) {
+		fmt.Fprintf(stdout, "HTTP_PROXY=http://%s\n", addr)
+		if *tokenFile == "" {
+			fmt.Fprintf(stdout, "AWS_ACCESS_KEY_ID=%s\n", token)
+		}
+	})
+}
+
+// authorized reports whether a request presents the proxy token: as the
+// access key ID of the client's own signature, since SDKs sign with whatever
+// keys they are given, or as a bearer token
+func (s *sigv4Proxy) authorized(r *http.Request) bool {
+	for _, header := range []string{"Authorization", "Proxy-Authorization"} {
+		value := r.Header.Get(header)
+		token, ok := strings.CutPrefix(value, "Bearer ")
+		if !ok {
+			token = sigV4AccessKeyID(value)
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// sigV4AccessKeyID returns the access key ID of a SigV4 Authorization header
+func sigV4AccessKeyID(authorization string) string {
+	rest, ok := strings.CutPrefix(authorization, "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return ""
+	}
+	for _, part := range strings.Split(rest, ",") {
+		if credential, ok := strings.CutPrefix(strings.TrimSpace(part), "Credential="); ok {
+			accessKeyID, _, _ := strings.Cut(credential, "/")
+			return accessKeyID
+		}
+	}
+	return ""
+}
+
+func (s *sigv4Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "invalid proxy token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		http.Error(w, "HTTPS tunnels cannot be signed; send plain http:// requests through the proxy", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target := s.upstream
+	if r.URL.IsAbs() {
+		target = &url.URL{Scheme: "https", Host: r.URL.Hostname()}
+	}
+	if target == nil {
+		http.Error(w, "no upstream: send absolute-form requests or start the proxy with --upstream", http.StatusBadRequest)
+		return
+	}
+	host := target.Hostname()
+	if !isAWSEndpoint(host) {
+		http.Error(w, fmt.Sprintf("%s is not an AWS endpoint", host), http.StatusForbidden)
+		return
+	}
+
+	service, region := endpointSigningScope(host)
+	if s.service != "" {
+		service = s.service
+	}
+	if s.region != "" {
+		region = s.region
+	}
+
+	creds, err := s.refresher.get(r.Context())
+	if err != nil {
+		sdk.Error("failed to get credentials", "server", sigv4ProxyCommand, "error", err)
+		http.Error(w, "credentials unavailable", http.StatusBadGateway)
+		return
+	}
+	if region == "" {
+		// Global endpoints are signed for us-east-1
+		region = "us-east-1"
+	}
+
+	out, err := s.signedRequest(r, target, service, region, creds)
+	if err != nil {
+		http.Error(w, redactError(err).Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("upstream request failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// signedRequest builds the outbound request, replacing any signature the
+// client added (SDKs sign with placeholder keys) with one from the scope's
+// credentials
+func (s *sigv4Proxy) signedRequest(r *http.Request, target *url.URL, service, region string, creds *servedCredentials) (*http.Request, error) {
+	u := *target
+	u.Path = r.URL.Path
+	u.RawPath = r.URL.RawPath
+	u.RawQuery = r.URL.RawQuery
+
+	payloadHash := unsignedPayload
+	body := r.Body
+	if service != "s3" {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		if len(data) > maxSignedBody {
+			return nil, fmt.Errorf("request body over %d bytes", maxSignedBody)
+		}
+		sum := sha256.Sum256(data)
+		payloadHash = hex.EncodeToString(sum[:])
+		body = io.NopCloser(bytes.NewReader(data))
+	}
+
+	out, err := http.NewRequestWithContext(r.Context(), r.Method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	out.ContentLength = r.ContentLength
+	out.Header = r.Header.Clone()
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	for _, h := range []string{"Authorization", "X-Amz-Date", "X-Amz-Security-Token", "X-Amz-Content-Sha256"} {
+		out.Header.Del(h)
+	}
+	if service == "s3" {
+		out.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	signing := aws.Credentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+	}
+	if err := v4.NewSigner().SignHTTP(r.Context(), signing, out, payloadHash, service, region, time.Now().UTC()); err != nil {
+		return nil, fmt.Errorf("failed to sign request: %w", err)
+	}
+	return out, nil
+}
+
+// isAWSEndpoint reports whether a host is in an AWS endpoint domain
+func isAWSEndpoint(host string) bool {
+	host = strings.ToLower(host)
+	for _, suffix := range awsEndpointSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointSigningScope derives the signing name and region of an AWS
+// endpoint host. The service label comes before the region
+// (<bucket>.s3.<region>.amazonaws.com) or, for some services, last
+// (<domain>.<region>.es.amazonaws.com). Global endpoints have no region
+// label; the region is then empty.
+func endpointSigningScope(host string) (service, region string) {
+	host = strings.ToLower(host)
+	for _, suffix := range awsEndpointSuffixes {
+		host = strings.TrimSuffix(host, suffix)
+	}
+	labels := strings.Split(host, ".")
+
+	service = labels[len(labels)-1]
+	for i, label := range labels {
+		if !awsRegionLabel.MatchString(label) {
+			continue
+		}
+		region = label
+		if i == len(labels)-1 && i > 0 {
+			service = labels[i-1]
+			if i > 1 {
+				if name, ok := signingNames[labels[i-2]+"."+service]; ok {
+					return name, region
+				}
+			}
+		}
+		break
+	}
+
+	service = strings.TrimSuffix(service, "-fips")
+	if name, ok := signingNames[service]; ok {
+		service = name
+	}
+	return service, region
+}
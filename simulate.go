@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// simulatePath is where the metrics listener serves policy simulations
+	simulatePath = "/simulate"
+
+	// simulateTimeout bounds an on-demand simulation
+	simulateTimeout = 30 * time.Second
+)
+
+// SimulatedAction is an action simulated for a scope, on a resource ARN or
+// on all resources
+type SimulatedAction struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource,omitempty"`
+}
+
+// simulationDefaults maps scope prefixes to representative actions, used
+// when the scope's settings have no simulate list
+var simulationDefaults = []struct {
+	Prefix  string
+	Actions []string
+}{
+	{"aws:s3", []string{"s3:ListAllMyBuckets", "s3:GetObject", "s3:PutObject"}},
+	{"aws:ecr", []string{"ecr:GetAuthorizationToken", "ecr:BatchGetImage", "ecr:DescribeRepositories"}},
+	{"aws:lambda", []string{"lambda:ListFunctions", "lambda:InvokeFunction"}},
+	{"aws:bedrock", []string{"bedrock:ListFoundationModels", "bedrock:InvokeModel"}},
+	{"aws:datalake", []string{"athena:StartQueryExecution", "glue:GetTable", "lakeformation:GetDataAccess"}},
+}
+
+// simulationReport is the outcome of simulating a scope's actions
+type simulationReport struct {
+	Scope         string           `json:"scope"`
+	RoleARN       string           `json:"role_arn"`
+	SessionPolicy bool             `json:"session_policy"`
+	SimulatedAt   time.Time        `json:"simulated_at"`
+	Actions       []actionDecision `json:"actions"`
+}
+
+// actionDecision is the simulated decision for one action and resource.
+// DeniedBy names what denies it: the role's policies or the session policy.
+type actionDecision struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+	Decision string `json:"decision"`
+	DeniedBy string `json:"denied_by,omitempty"`
+}
+
+// validateSimulation checks the simulated actions of the scope settings and
+// simulation_scopes, defaulting the scopes to those with default actions
+func validateSimulation(c *AWSConfig) error {
+	for pattern, scope := range c.Scopes.Value {
+		for _, action := range scope.Simulate {
+			if service, name, ok := strings.Cut(action.Action, ":"); !ok || service == "" || name == "" {
+				return fmt.Errorf("invalid simulate action for scopes %q: %q (expected service:Action)", pattern, action.Action)
+			}
+		}
+	}
+	if !c.PolicySimulation.Value {
+		if len(c.SimulationScopes.Value) > 0 {
+			return fmt.Errorf("simulation_scopes requires policy_simulation")
+		}
+		return nil
+	}
+	if len(c.SimulationScopes.Value) == 0 {
+		// aws:datalake scopes name a database, so have no default
+		c.SimulationScopes.Value = []string{"aws:s3", "aws:ecr", "aws:lambda", "aws:bedrock"}
+	}
+	for _, scope := range c.SimulationScopes.Value {
+		if !isValidAWSScope(scope) {
+			return fmt.Errorf("invalid simulation_scopes scope: %s", scope)
+		}
+	}
+	return nil
+}
+
+// simulationActions returns the representative actions of a scope: those of
+// its settings, or the defaults of its prefix
+func (c *AWSConfig) simulationActions(scope string) []SimulatedAction {
+	if actions := c.scopeConfig(scope).Simulate; len(actions) > 0 {
+		return actions
+	}
+	for _, d := range simulationDefaults {
+		if scope == d.Prefix || strings.HasPrefix(scope, d.Prefix+":") {
+			actions := make([]SimulatedAction, len(d.Actions))
+			for i, action := range d.Actions {
+				actions[i] = SimulatedAction{Action: action}
+			}
+			return actions
+		}
+	}
+	return nil
+}
+
+// simulateScope simulates a scope's representative actions with
+// iam:SimulatePrincipalPolicy against the role, and with
+// iam:SimulateCustomPolicy against the scope's session policy. An action
+// is allowed only if both allow it; resource policies, SCPs and conditions
+// are not evaluated.
+func (p *AWSPlugin) simulateScope(ctx context.Context, scope string) (*simulationReport, error) {
+	actions := p.config.simulationActions(scope)
+	if len(actions) == 0 {
+		return nil, fmt.Errorf("no actions to simulate for scope %s; set simulate in its scopes settings", scope)
+	}
+	policy, err := p.sessionPolicy(scope)
+	if err != nil {
+		return nil, err
+	}
+	client, err := p.createIAMClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IAM client: %w", err)
+	}
+
+	report := &simulationReport{Scope: scope, RoleARN: p.config.RoleARN, SessionPolicy: policy != "", SimulatedAt: time.Now().UTC()}
+	for _, action := range actions {
+		resource := action.Resource
+		if resource == "" {
+			resource = "*"
+		}
+		decision := actionDecision{Action: action.Action, Resource: resource}
+
+		roleDecision, err := simulatePrincipal(ctx, client, p.config.RoleARN, action.Action, resource)
+		if err != nil {
+			return nil, err
+		}
+		decision.Decision = roleDecision
+		if roleDecision != string(iamtypes.PolicyEvaluationDecisionTypeAllowed) {
+			decision.DeniedBy = "role"
+		} else if policy != "" {
+			sessionDecision, err := simulateCustom(ctx, client, policy, action.Action, resource)
+			if err != nil {
+				return nil, err
+			}
+			decision.Decision = sessionDecision
+			if sessionDecision != string(iamtypes.PolicyEvaluationDecisionTypeAllowed) {
+				decision.DeniedBy = "session_policy"
+			}
+		}
+		report.Actions = append(report.Actions, decision)
+	}
+	return report, nil
+}
+
+// simulatePrincipal returns the decision of the role's policies for an
+// action on a resource
+func simulatePrincipal(ctx context.Context, client *iam.Client, roleARN, action, resource string) (string, error) {
+	input := &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(roleARN),
+		ActionNames:     []string{action},
+		ResourceArns:    []string{resource},
+	}
+	out, err := client.SimulatePrincipalPolicy(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to simulate %s for role: %w", action, err)
+	}
+	return evaluationDecision(out.EvaluationResults), nil
+}
+
+// simulateCustom returns the decision of a session policy for an action on
+// a resource
+func simulateCustom(ctx context.Context, client *iam.Client, policy, action, resource string) (string, error) {
+	input := &iam.SimulateCustomPolicyInput{
+		PolicyInputList: []string{policy},
+		ActionNames:     []string{action},
+		ResourceArns:    []string{resource},
+	}
+	out, err := client.SimulateCustomPolicy(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to simulate %s for session policy: %w", action, err)
+	}
+	return evaluationDecision(out.EvaluationResults), nil
+}
+
+// evaluationDecision returns the decision of a single-action simulation
+func evaluationDecision(results []iamtypes.EvaluationResult) string {
+	if len(results) == 0 {
+		return string(iamtypes.PolicyEvaluationDecisionTypeImplicitDeny)
+	}
+	return string(results[0].EvalDecision)
+}
+
+// denied returns the actions the simulation denies, as "action on resource"
+func (r *simulationReport) denied() []string {
+	var denied []string
+	for _, d := range r.Actions {
+		if d.DeniedBy != "" {
+			denied = append(denied, fmt.Sprintf("%s on %s (%s by %s)", d.Action, d.Resource, d.Decision, d.DeniedBy))
+		}
+	}
+	return denied
+}
+
+// simulateScopes simulates simulation_scopes on Validate. Denied actions
+// and failed simulations are logged and do not fail validation.
+func (p *AWSPlugin) simulateScopes(ctx context.Context) {
+	for _, scope := range p.config.SimulationScopes.Value {
+		report, err := p.simulateScope(ctx, scope)
+		if err != nil {
+			sdk.Warn("failed to simulate scope policies", "scope", scope, "error", err)
+			continue
+		}
+		if denied := report.denied(); len(denied) > 0 {
+			sdk.Warn("policy simulation denies actions of scope", "scope", scope, "denied", denied)
+		} else {
+			sdk.Debug("policy simulation allows all actions of scope", "scope", scope, "actions", len(report.Actions))
+		}
+	}
+}
+
+// serveSimulation simulates the scope of the scope query parameter and
+// writes the report as JSON
+func (p *AWSPlugin) serveSimulation(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.config == nil || !p.config.PolicySimulation.Value {
+		http.NotFound(w, r)
+		return
+	}
+	scope := r.URL.Query().Get("scope")
+	if !isValidAWSScope(scope) {
+		http.Error(w, "invalid scope", http.StatusBadRequest)
+		return
+	}
+	if len(p.config.simulationActions(scope)) == 0 {
+		http.Error(w, "no actions to simulate for scope "+scope+"; set simulate in its scopes settings", http.StatusBadRequest)
+		return
+	}
+	if !p.simulationMu.TryLock() {
+		http.Error(w, "a simulation is already running", http.StatusTooManyRequests)
+		return
+	}
+	defer p.simulationMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), simulateTimeout)
+	defer cancel()
+	report, err := p.simulateScope(ctx, scope)
+	if err != nil {
+		http.Error(w, redactError(p.describeError("simulation", err)).Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	defaultSTSThrottleWait        = 10 * time.Second
+	defaultSTSThrottleConcurrency = 4
+
+	// stsThrottleCooldown is how long after the last throttling error
+	// calls keep queueing
+	stsThrottleCooldown = 30 * time.Second
+
+	// Backoff between throttled attempts: full jitter over an exponential
+	// window, capped
+	stsThrottleBaseDelay = 200 * time.Millisecond
+	stsThrottleMaxDelay  = 5 * time.Second
+)
+
+// stsThrottle spreads STS calls out while STS is throttling. Throttled calls
+// are retried with exponential backoff and jitter, beyond the SDK's own
+// retries, and until the pressure has passed only a few calls go to STS at
+// once; the rest queue with a bounded wait instead of failing straight
+// away.
+type stsThrottle struct {
+	wait  time.Duration
+	slots chan struct{}
+
+	mu            sync.Mutex
+	pressureUntil time.Time
+}
+
+func newSTSThrottle(wait time.Duration, concurrency int) *stsThrottle {
+	return &stsThrottle{wait: wait, slots: make(chan struct{}, concurrency)}
+}
+
+// call runs fn, retrying it while it is throttled, for up to the wait or
+// the request's deadline, whichever is sooner
+func (t *stsThrottle) call(ctx context.Context, fn func() error) error {
+	start := time.Now()
+	deadline := start.Add(t.wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	for attempt := 0; ; attempt++ {
+		release, err := t.acquire(ctx, start, deadline)
+		if err != nil {
+			return err
+		}
+		err = fn()
+		release()
+		if !isThrottling(err) {
+			return err
+		}
+		t.throttled()
+
+		delay := throttleDelay(attempt)
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("STS is throttling requests, gave up after %s: %w", formatDuration(time.Since(start).Round(time.Second)), err)
+		}
+		sdk.Debug("STS throttled request, backing off", "attempt", attempt+1, "delay", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// acquire takes a slot while STS is under pressure, waiting for one until
+// the deadline; otherwise calls go straight through
+func (t *stsThrottle) acquire(ctx context.Context, start, deadline time.Time) (func(), error) {
+	if !t.underPressure() {
+		return func() {}, nil
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return func() { <-t.slots }, nil
+	default:
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case t.slots <- struct{}{}:
+		return func() { <-t.slots }, nil
+	case <-timer.C:
+		return nil, &pluginError{
+			kind: errThrottled,
+			msg:  fmt.Sprintf("STS is throttling requests, timed out after %s in the queue", formatDuration(time.Since(start).Round(time.Second))),
+			hint: kindHint(errThrottled),
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *stsThrottle) throttled() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pressureUntil = time.Now().Add(stsThrottleCooldown)
+}
+
+func (t *stsThrottle) underPressure() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().Before(t.pressureUntil)
+}
+
+// throttleDelay returns a random delay in an exponentially growing window
+func throttleDelay(attempt int) time.Duration {
+	window := stsThrottleMaxDelay
+	if attempt < 5 {
+		window = min(stsThrottleBaseDelay<<attempt, stsThrottleMaxDelay)
+	}
+	return rand.N(window) + 1
+}
+
+// isThrottling reports whether an error is an AWS throttling response
+func isThrottling(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException":
+			return true
+		}
+	}
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusTooManyRequests
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// tracerName is the instrumentation scope of the plugin's spans
+	tracerName = "github.com/getcreddy/creddy-aws"
+
+	// otlpTracesPath is the OTLP/HTTP path of traces, used when
+	// otlp_endpoint has none
+	otlpTracesPath = "/v1/traces"
+
+	// tracingFlushTimeout bounds exporting the remaining spans of a
+	// replaced or shut down tracer
+	tracingFlushTimeout = 5 * time.Second
+)
+
+// traceContext reads the W3C trace context and baggage that callers send
+var traceContext = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+func init() {
+	// The OTel SDK reports export failures through its global handler,
+	// which would otherwise write to stderr
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		sdk.Warn("failed to export traces", "error", err)
+	}))
+}
+
+// tracing exports the spans of one configuration over OTLP
+type tracing struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// newTracing returns the tracer exporting to otlp_endpoint, or nil if
+// tracing is not configured
+func newTracing(c *AWSConfig) (*tracing, error) {
+	if c.OTLPEndpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(c.OTLPEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp_endpoint: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpTracesPath
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(u.String())}
+	if len(c.OTLPHeaders.Value) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(c.OTLPHeaders.Value))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.TraceSampleRatio.Value))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", userAgentProduct),
+			attribute.String("service.version", PluginVersion),
+		)),
+	)
+	return &tracing{provider: provider, tracer: provider.Tracer(tracerName, trace.WithInstrumentationVersion(PluginVersion))}, nil
+}
+
+// validateTracing checks otlp_endpoint and trace_sample_ratio, defaulting
+// the ratio
+func validateTracing(c *AWSConfig) error {
+	if c.OTLPEndpoint == "" {
+		if len(c.OTLPHeaders.Value) > 0 {
+			return fmt.Errorf("otlp_headers requires otlp_endpoint")
+		}
+		return nil
+	}
+	if err := validateEndpointURL(c.OTLPEndpoint); err != nil {
+		return fmt.Errorf("invalid otlp_endpoint: %w", err)
+	}
+	if c.TraceSampleRatio.Value == 0 {
+		c.TraceSampleRatio.Value = 1
+	}
+	if r := c.TraceSampleRatio.Value; r < 0 || r > 1 {
+		return fmt.Errorf("invalid trace_sample_ratio %g: must be greater than 0 and at most 1", r)
+	}
+	return nil
+}
+
+// close exports the spans still buffered and stops the exporter
+func (t *tracing) close() {
+	if t == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		sdk.Warn("failed to flush traces", "error", err)
+	}
+}
+
+// startSpan starts a span of an entry point. Its parent is the span already
+// in ctx, or else the trace context the host sent in the gRPC metadata of
+// the call. Without tracing configured the span only carries the parent on.
+func (p *AWSPlugin) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			ctx = traceContext.Extract(ctx, metadataCarrier(md))
+		}
+	}
+	var tracer trace.Tracer = noop.Tracer{}
+	if p.tracing != nil {
+		tracer = p.tracing.tracer
+	}
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span with the outcome of its call
+func endSpan(span trace.Span, err error, attrs ...attribute.KeyValue) {
+	span.SetAttributes(attrs...)
+	if err != nil {
+		err = redactError(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		if kind := errorKindOf(err); kind != "" {
+			span.SetAttributes(attribute.String("creddy.error_kind", string(kind)))
+		}
+	}
+	span.End()
+}
+
+// addMiddleware traces every AWS call of an SDK client as a child of the
+// span in its context, including the SDK's retries
+func (t *tracing) addMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CreddyTracing",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			ctx, span := t.startCall(ctx, awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx), awsmiddleware.GetRegion(ctx))
+			out, md, err := next.HandleInitialize(ctx, in)
+			id, ok := awsmiddleware.GetRequestIDMetadata(md)
+			if !ok {
+				id = requestIDOf(err)
+			}
+			if id != "" {
+				span.SetAttributes(attribute.String("aws.request_id", id))
+			}
+			if code := errorCode(err); code != "" {
+				span.SetAttributes(attribute.String("aws.error_code", code))
+			}
+			endSpan(span, err)
+			return out, md, err
+		}), middleware.After)
+}
+
+// startCall starts the span of an AWS call
+func (t *tracing) startCall(ctx context.Context, service, operation, region string) (context.Context, trace.Span) {
+	ctx, span := t.tracer.Start(ctx, service+"."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", service),
+		attribute.String("rpc.method", operation),
+		attribute.String("cloud.region", region),
+	))
+	if iss := issuanceFrom(ctx); iss != nil {
+		span.SetAttributes(attribute.String("creddy.request_id", iss.ID))
+	}
+	return ctx, span
+}
+
+// metadataCarrier reads trace headers from gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// trustPolicy is a role's trust policy, with the elements the plugin checks
+type trustPolicy struct {
+	Statement []trustStatement `json:"Statement"`
+}
+
+// trustStatement is a trust policy statement. Statement may be a single
+// object rather than a list.
+type trustStatement struct {
+	Effect       string                                `json:"Effect"`
+	Action       stringList                            `json:"Action"`
+	NotAction    stringList                            `json:"NotAction"`
+	Principal    json.RawMessage                       `json:"Principal"`
+	NotPrincipal json.RawMessage                       `json:"NotPrincipal"`
+	Condition    map[string]map[string]json.RawMessage `json:"Condition"`
+}
+
+func (t *trustPolicy) UnmarshalJSON(data []byte) error {
+	var doc struct {
+		Statement json.RawMessage `json:"Statement"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	var single trustStatement
+	if err := json.Unmarshal(doc.Statement, &single); err == nil {
+		t.Statement = []trustStatement{single}
+		return nil
+	}
+	return json.Unmarshal(doc.Statement, &t.Statement)
+}
+
+// checkTrustPolicy reads the role's trust policy and checks it lets the base
+// credentials assume the role with the configured external ID. Only the
+// principal, action and sts:ExternalId are evaluated; other conditions are
+// assumed to hold. Failing to read the policy, for example without
+// iam:GetRole, is logged and does not fail validation.
+func (p *AWSPlugin) checkTrustPolicy(ctx context.Context) error {
+	callerARN, account := p.callerIdentity(ctx)
+	if callerARN == "" {
+		return nil
+	}
+	name, err := roleNameFromARN(p.config.RoleARN)
+	if err != nil {
+		return nil
+	}
+	client, err := p.createIAMClient(ctx)
+	if err != nil {
+		return nil
+	}
+	out, err := client.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(name)})
+	if err != nil {
+		if errorKindOf(err) == errAccessDenied {
+			sdk.Debug("cannot read role trust policy, skipping trust policy check", "role", p.config.RoleARN, "error", err)
+		} else {
+			sdk.Warn("failed to read role trust policy, skipping trust policy check", "role", p.config.RoleARN, "error", err)
+		}
+		return nil
+	}
+	decoded, err := url.QueryUnescape(aws.ToString(out.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return nil
+	}
+	var policy trustPolicy
+	if err := json.Unmarshal([]byte(decoded), &policy); err != nil {
+		sdk.Warn("failed to parse role trust policy, skipping trust policy check", "role", p.config.RoleARN, "error", err)
+		return nil
+	}
+	return p.evaluateTrustPolicy(&policy, callerARN, account)
+}
+
+// evaluateTrustPolicy checks a trust policy for the base principal
+func (p *AWSPlugin) evaluateTrustPolicy(policy *trustPolicy, callerARN, account string) error {
+	principal := trustPrincipal(callerARN)
+	failed := func(msg, hint string) error {
+		return &pluginError{kind: errConfiguration, msg: "trust policy of " + p.config.RoleARN + " " + msg, hint: hint}
+	}
+
+	var allowed []trustStatement
+	uncertain := false
+	for _, s := range policy.Statement {
+		if len(s.NotAction) > 0 || len(s.NotPrincipal) > 0 {
+			// Not evaluated; such a statement may allow the caller
+			uncertain = uncertain || strings.EqualFold(s.Effect, "Allow")
+			continue
+		}
+		if !trustAllowsAssumeRole(s.Action) || !trustPrincipalMatches(s.Principal, callerARN, account) {
+			continue
+		}
+		switch {
+		case strings.EqualFold(s.Effect, "Deny") && len(s.Condition) == 0:
+			return failed("denies "+callerARN+" sts:AssumeRole",
+				"remove the Deny statement for the base principal from the role trust policy")
+		case strings.EqualFold(s.Effect, "Allow"):
+			allowed = append(allowed, s)
+		}
+	}
+	if len(allowed) == 0 {
+		if uncertain {
+			return nil
+		}
+		hint := fmt.Sprintf(`add a statement allowing sts:AssumeRole with "Principal": {"AWS": %q} to the role trust policy`, principal)
+		if principal != callerARN {
+			hint += ", with the path of the role if it has one"
+		}
+		return failed("does not allow "+callerARN+" to call sts:AssumeRole", hint)
+	}
+
+	externalID := p.config.ExternalID
+	open := false
+	for _, s := range allowed {
+		required, satisfied := trustExternalID(s.Condition, externalID)
+		if satisfied {
+			if !required {
+				open = true
+				continue
+			}
+			return nil
+		}
+	}
+	if open {
+		if externalID != "" {
+			sdk.Warn("role trust policy does not require the external ID; add a StringEquals condition on sts:ExternalId to protect the role from confused deputies", "role", p.config.RoleARN, "caller", callerARN)
+		}
+		return nil
+	}
+	if externalID == "" {
+		return failed("requires an external ID",
+			"set external_id to the external ID the role owner gave you")
+	}
+	return failed("requires an external ID other than external_id",
+		"check external_id matches the sts:ExternalId condition of the role trust policy")
+}
+
+// trustPrincipal returns the principal to name in a trust policy for the
+// base credentials: the role of a role session, or the caller itself
+func trustPrincipal(callerARN string) string {
+	parsed, err := arn.Parse(callerARN)
+	if err != nil || parsed.Service != "sts" {
+		return callerARN
+	}
+	if rest, ok := strings.CutPrefix(parsed.Resource, "assumed-role/"); ok {
+		roleName, _, _ := strings.Cut(rest, "/")
+		return arn.ARN{Partition: parsed.Partition, Service: "iam", AccountID: parsed.AccountID, Resource: "role/" + roleName}.String()
+	}
+	return callerARN
+}
+
+// trustAllowsAssumeRole reports whether a statement's actions include
+// sts:AssumeRole
+func trustAllowsAssumeRole(actions stringList) bool {
+	for _, action := range actions {
+		if wildcardMatch(strings.ToLower(action), "sts:assumerole") {
+			return true
+		}
+	}
+	return false
+}
+
+// trustPrincipalMatches reports whether a statement's Principal names the
+// base credentials, their role, their account or anyone
+func trustPrincipalMatches(raw json.RawMessage, callerARN, account string) bool {
+	var wildcard string
+	if err := json.Unmarshal(raw, &wildcard); err == nil {
+		return wildcard == "*"
+	}
+	var principals map[string]stringList
+	if err := json.Unmarshal(raw, &principals); err != nil {
+		return false
+	}
+	caller, err := arn.Parse(callerARN)
+	if err != nil {
+		return false
+	}
+	roleARN := trustPrincipal(callerARN)
+	for _, p := range principals["AWS"] {
+		switch {
+		case p == "*", p == callerARN, p == account:
+			return true
+		case p == arn.ARN{Partition: caller.Partition, Service: "iam", AccountID: account, Resource: "root"}.String():
+			return true
+		case roleARN != callerARN && trustRoleMatches(p, roleARN):
+			return true
+		}
+	}
+	return false
+}
+
+// trustRoleMatches compares a principal to a role ARN without its path,
+// which role session ARNs do not carry
+func trustRoleMatches(principal, roleARN string) bool {
+	parsed, err := arn.Parse(principal)
+	if err != nil || !strings.HasPrefix(parsed.Resource, "role/") {
+		return false
+	}
+	parsed.Resource = "role/" + path.Base(parsed.Resource)
+	return parsed.String() == roleARN
+}
+
+// trustExternalID reports whether a statement's conditions require an
+// external ID, and whether externalID satisfies them. Conditions the
+// plugin does not evaluate are taken as satisfied.
+func trustExternalID(conditions map[string]map[string]json.RawMessage, externalID string) (required, satisfied bool) {
+	satisfied = true
+	for operator, keys := range conditions {
+		for key, raw := range keys {
+			if !strings.EqualFold(key, "sts:ExternalId") {
+				continue
+			}
+			values := conditionValues(raw)
+			op, ifExists := strings.CutSuffix(operator, "IfExists")
+			if _, after, ok := strings.Cut(op, ":"); ok {
+				// ForAnyValue: and ForAllValues: on a single-valued key
+				op = after
+			}
+			switch op {
+			case "StringEquals", "StringEqualsIgnoreCase", "StringLike":
+				if !ifExists {
+					required = true
+				}
+				switch {
+				case externalID == "":
+					satisfied = satisfied && ifExists
+				case !conditionMatches(op, values, externalID):
+					satisfied = false
+				}
+			case "Null":
+				if len(values) == 1 && values[0] == "false" {
+					required = true
+					satisfied = satisfied && externalID != ""
+				}
+			}
+		}
+	}
+	return required, satisfied
+}
+
+// conditionMatches reports whether a value satisfies a string condition
+func conditionMatches(op string, values []string, value string) bool {
+	for _, v := range values {
+		switch op {
+		case "StringEquals":
+			if v == value {
+				return true
+			}
+		case "StringEqualsIgnoreCase":
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		case "StringLike":
+			if wildcardMatch(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// conditionValues returns a condition's values, which may be a string, a
+// boolean or a list
+func conditionValues(raw json.RawMessage) []string {
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return []string{fmt.Sprint(b)}
+	}
+	var values stringList
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil
+	}
+	return values
+}
+
+// wildcardMatch matches a value against a policy pattern, where '*' matches
+// any characters and '?' any one character
+func wildcardMatch(pattern, value string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(expr)
+	ok, _ := regexp.MatchString("^"+expr+"$", value)
+	return ok
+}
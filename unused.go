@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+const (
+	// unusedPath is where the metrics listener serves the unused report
+	unusedPath = "/unused"
+
+	// unusedTimeout bounds an unused report
+	unusedTimeout = time.Minute
+)
+
+// scopeRequests tracks the credential requests served per scope across
+// reconfigurations, bounding how many scopes are tracked
+type scopeRequests struct {
+	mu      sync.Mutex
+	started time.Time
+	scopes  map[string]*scopeRequestStats
+}
+
+type scopeRequestStats struct {
+	Requests      int        `json:"requests"`
+	LastRequested *time.Time `json:"last_requested,omitempty"`
+}
+
+// start starts counting, once per process
+func (s *scopeRequests) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started.IsZero() {
+		s.started = time.Now().UTC()
+	}
+}
+
+// record counts a served request of a scope
+func (s *scopeRequests) record(scope string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scopes == nil {
+		s.scopes = make(map[string]*scopeRequestStats)
+	}
+	stats, ok := s.scopes[scope]
+	if !ok {
+		if len(s.scopes) >= maxMetricScopes {
+			return
+		}
+		stats = &scopeRequestStats{}
+		s.scopes[scope] = stats
+	}
+	now := time.Now().UTC()
+	stats.Requests++
+	stats.LastRequested = &now
+}
+
+// snapshot copies the tracked scopes, with when counting started
+func (s *scopeRequests) snapshot() (time.Time, map[string]scopeRequestStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]scopeRequestStats, len(s.scopes))
+	for scope, stats := range s.scopes {
+		out[scope] = *stats
+	}
+	return s.started, out
+}
+
+// unusedReport lists the configured scopes nobody requests and the role's
+// permissions nobody exercises
+type unusedReport struct {
+	GeneratedAt time.Time `json:"generated_at"`
+
+	// RequestsSince is when the plugin started counting requests
+	RequestsSince time.Time `json:"requests_since"`
+
+	// Scopes are the patterns of the scopes setting. Unused ones match no
+	// request since RequestsSince and no credential in the ledger.
+	Scopes []scopePatternUsage `json:"scopes"`
+
+	// RequestedScopes are the scopes requested since RequestsSince
+	RequestedScopes map[string]scopeRequestStats `json:"requested_scopes"`
+
+	// UnusedPermissions are the Access Analyzer unused access findings on
+	// the role, with unused_access_analyzer_arn
+	UnusedPermissions []unusedServicePermissions `json:"unused_permissions,omitempty"`
+	UnusedRole        *unusedRole                `json:"unused_role,omitempty"`
+	FindingsError     string                     `json:"findings_error,omitempty"`
+}
+
+type scopePatternUsage struct {
+	Pattern       string     `json:"pattern"`
+	Requests      int        `json:"requests"`
+	LastRequested *time.Time `json:"last_requested,omitempty"`
+	Unused        bool       `json:"unused"`
+}
+
+// unusedServicePermissions are the unused actions of one service. An empty
+// Actions means the whole service is unused.
+type unusedServicePermissions struct {
+	Service      string         `json:"service"`
+	LastAccessed *time.Time     `json:"last_accessed,omitempty"`
+	Actions      []unusedAction `json:"actions,omitempty"`
+	FindingID    string         `json:"finding_id"`
+	UpdatedAt    *time.Time     `json:"updated_at,omitempty"`
+}
+
+type unusedAction struct {
+	Action       string     `json:"action"`
+	LastAccessed *time.Time `json:"last_accessed,omitempty"`
+}
+
+type unusedRole struct {
+	LastAccessed *time.Time `json:"last_accessed,omitempty"`
+	FindingID    string     `json:"finding_id"`
+}
+
+// validateUnusedReports checks the unused report settings
+func validateUnusedReports(c *AWSConfig) error {
+	if c.UnusedAccessAnalyzerARN == "" {
+		return nil
+	}
+	if !c.UnusedReports.Value {
+		return fmt.Errorf("unused_access_analyzer_arn requires unused_reports")
+	}
+	if parsed, err := arn.Parse(c.UnusedAccessAnalyzerARN); err != nil {
+		return fmt.Errorf("invalid unused_access_analyzer_arn: %w", err)
+	} else if parsed.Service != accessAnalyzerService {
+		return fmt.Errorf("unused_access_analyzer_arn is not an Access Analyzer analyzer ARN: %s", c.UnusedAccessAnalyzerARN)
+	}
+	return nil
+}
+
+// unusedReport builds the unused report. Failing to read the findings is
+// reported in FindingsError rather than failing the report.
+func (p *AWSPlugin) unusedReport(ctx context.Context) (*unusedReport, error) {
+	since, requested := p.scopeRequests.snapshot()
+	report := &unusedReport{
+		GeneratedAt:     time.Now().UTC(),
+		RequestsSince:   since,
+		Scopes:          []scopePatternUsage{},
+		RequestedScopes: requested,
+	}
+
+	// The ledger remembers issuances from before the plugin started
+	lastIssued := make(map[string]time.Time)
+	if p.ledger != nil {
+		entries, err := p.ledger.List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ledger: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IssuedAt.After(lastIssued[entry.Scope]) {
+				lastIssued[entry.Scope] = entry.IssuedAt
+			}
+		}
+	}
+
+	for _, pattern := range sortedKeys(p.config.Scopes.Value) {
+		usage := scopePatternUsage{Pattern: pattern}
+		for scope, stats := range requested {
+			if scopePatternMatches(pattern, scope) {
+				usage.Requests += stats.Requests
+				usage.LastRequested = laterTime(usage.LastRequested, stats.LastRequested)
+			}
+		}
+		for scope, at := range lastIssued {
+			if scopePatternMatches(pattern, scope) {
+				usage.LastRequested = laterTime(usage.LastRequested, &at)
+			}
+		}
+		usage.Unused = usage.LastRequested == nil
+		report.Scopes = append(report.Scopes, usage)
+	}
+
+	if p.config.UnusedAccessAnalyzerARN != "" {
+		if err := p.unusedAccessFindings(ctx, report); err != nil {
+			report.FindingsError = redactError(p.describeError("unused access findings", err)).Error()
+		}
+	}
+	return report, nil
+}
+
+// scopePatternMatches matches a scope against a scopes pattern, exactly or
+// as a prefix when the pattern ends in '*'
+func scopePatternMatches(pattern, scope string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(scope, prefix)
+	}
+	return pattern == scope
+}
+
+func laterTime(a, b *time.Time) *time.Time {
+	if b == nil || (a != nil && !b.After(*a)) {
+		return a
+	}
+	t := b.UTC()
+	return &t
+}
+
+// unusedAccessFindings adds the active unused access findings of the role
+// to the report, from Access Analyzer's ListFindingsV2 and GetFindingV2
+func (p *AWSPlugin) unusedAccessFindings(ctx context.Context, report *unusedReport) error {
+	input := map[string]any{
+		"analyzerArn": p.config.UnusedAccessAnalyzerARN,
+		"filter": map[string]any{
+			"resource": map[string][]string{"eq": {p.config.RoleARN}},
+			"status":   map[string][]string{"eq": {"ACTIVE"}},
+		},
+	}
+	for {
+		var out struct {
+			Findings []struct {
+				ID          string     `json:"id"`
+				FindingType string     `json:"findingType"`
+				UpdatedAt   *time.Time `json:"updatedAt"`
+			} `json:"findings"`
+			NextToken string `json:"nextToken"`
+		}
+		if err := p.callAccessAnalyzer(ctx, http.MethodPost, "/findingv2", nil, input, &out); err != nil {
+			return fmt.Errorf("failed to list findings: %w", err)
+		}
+		for _, f := range out.Findings {
+			switch f.FindingType {
+			case "UnusedPermission", "UnusedIAMRole":
+				if err := p.unusedAccessFinding(ctx, f.ID, f.UpdatedAt, report); err != nil {
+					return err
+				}
+			}
+		}
+		if out.NextToken == "" {
+			break
+		}
+		input["nextToken"] = out.NextToken
+	}
+	sort.Slice(report.UnusedPermissions, func(i, j int) bool {
+		return report.UnusedPermissions[i].Service < report.UnusedPermissions[j].Service
+	})
+	return nil
+}
+
+// unusedAccessFinding adds the details of one finding to the report
+func (p *AWSPlugin) unusedAccessFinding(ctx context.Context, id string, updatedAt *time.Time, report *unusedReport) error {
+	query := url.Values{"analyzerArn": {p.config.UnusedAccessAnalyzerARN}}
+	for {
+		var out struct {
+			FindingDetails []struct {
+				UnusedPermissionDetails *struct {
+					ServiceNamespace string         `json:"serviceNamespace"`
+					LastAccessed     *time.Time     `json:"lastAccessed"`
+					Actions          []unusedAction `json:"actions"`
+				} `json:"unusedPermissionDetails"`
+				UnusedIAMRoleDetails *struct {
+					LastAccessed *time.Time `json:"lastAccessed"`
+				} `json:"unusedIamRoleDetails"`
+			} `json:"findingDetails"`
+			NextToken string `json:"nextToken"`
+		}
+		if err := p.callAccessAnalyzer(ctx, http.MethodGet, "/findingv2/"+url.PathEscape(id), query, nil, &out); err != nil {
+			return fmt.Errorf("failed to get finding %s: %w", id, err)
+		}
+		for _, d := range out.FindingDetails {
+			if u := d.UnusedPermissionDetails; u != nil {
+				report.UnusedPermissions = append(report.UnusedPermissions, unusedServicePermissions{
+					Service:      u.ServiceNamespace,
+					LastAccessed: u.LastAccessed,
+					Actions:      u.Actions,
+					FindingID:    id,
+					UpdatedAt:    updatedAt,
+				})
+			}
+			if u := d.UnusedIAMRoleDetails; u != nil {
+				report.UnusedRole = &unusedRole{LastAccessed: u.LastAccessed, FindingID: id}
+			}
+		}
+		if out.NextToken == "" {
+			return nil
+		}
+		query.Set("nextToken", out.NextToken)
+	}
+}
+
+// serveUnused writes the unused report as JSON
+func (p *AWSPlugin) serveUnused(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.config == nil || !p.config.UnusedReports.Value {
+		http.NotFound(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), unusedTimeout)
+	defer cancel()
+	report, err := p.unusedReport(ctx)
+	if err != nil {
+		http.Error(w, redactError(p.describeError("unused report", err)).Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(report)
+}
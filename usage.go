@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+const (
+	// usagePath is where the metrics listener serves usage reports
+	usagePath = "/usage"
+
+	// cloudTrailLookupTarget is the JSON protocol target of LookupEvents
+	cloudTrailLookupTarget = "com.amazonaws.cloudtrail.v20131101.CloudTrail_20131101.LookupEvents"
+
+	// cloudTrailLookupInterval spaces LookupEvents calls, which CloudTrail
+	// limits to 2 per second per account and region
+	cloudTrailLookupInterval = 500 * time.Millisecond
+
+	// cloudTrailRetention is how far back LookupEvents can look
+	cloudTrailRetention = 90 * 24 * time.Hour
+
+	// maxUsageCredentials bounds the credentials of a report, and
+	// maxUsageEvents the events read for each
+	maxUsageCredentials = 10
+	maxUsageEvents      = 1000
+
+	// usageTimeout bounds a usage report
+	usageTimeout = 2 * time.Minute
+)
+
+// errUnknownCredential is returned for report IDs that are not in the ledger
+var errUnknownCredential = errors.New("no such credential in the ledger")
+
+// usageReport summarizes what issued credentials did, from CloudTrail
+type usageReport struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Credentials []credentialUsage `json:"credentials"`
+}
+
+// credentialUsage summarizes the CloudTrail events of one issued
+// credential. Actions are keyed "<service>:<event name>".
+type credentialUsage struct {
+	ID          string    `json:"id"`
+	Scope       string    `json:"scope"`
+	AgentID     string    `json:"agent_id,omitempty"`
+	AgentName   string    `json:"agent_name,omitempty"`
+	AccessKeyID string    `json:"access_key_id,omitempty"`
+	SessionName string    `json:"session_name,omitempty"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+
+	Events     int            `json:"events"`
+	Errors     int            `json:"errors"`
+	ErrorRate  float64        `json:"error_rate"`
+	FirstEvent *time.Time     `json:"first_event,omitempty"`
+	LastEvent  *time.Time     `json:"last_event,omitempty"`
+	Regions    map[string]int `json:"regions,omitempty"`
+	Services   map[string]int `json:"services,omitempty"`
+	Actions    map[string]int `json:"actions,omitempty"`
+	ErrorCodes map[string]int `json:"error_codes,omitempty"`
+	SourceIPs  map[string]int `json:"source_ips,omitempty"`
+
+	// Truncated is set when the credential had more than maxUsageEvents
+	// events; the counts cover the first ones
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// cloudTrailEvent is the part of a CloudTrail record the report uses
+type cloudTrailEvent struct {
+	EventTime       time.Time `json:"eventTime"`
+	EventSource     string    `json:"eventSource"`
+	EventName       string    `json:"eventName"`
+	AWSRegion       string    `json:"awsRegion"`
+	SourceIPAddress string    `json:"sourceIPAddress"`
+	ErrorCode       string    `json:"errorCode"`
+}
+
+// validateUsageReports checks the ledger that usage reports read is enabled
+func validateUsageReports(c *AWSConfig) error {
+	if c.UsageReports.Value && c.Ledger == ledgerNone {
+		return fmt.Errorf("usage_reports requires the ledger")
+	}
+	return nil
+}
+
+// usageReport reports the usage of the ledger entries with the given IDs,
+// or of an agent's most recent credentials
+func (p *AWSPlugin) usageReport(ctx context.Context, ids []string, agentID string) (*usageReport, error) {
+	var entries []*LedgerEntry
+	if agentID != "" {
+		all, err := p.ledger.List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ledger: %w", err)
+		}
+		for _, entry := range all {
+			if entry.AgentID == agentID {
+				entries = append(entries, entry)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].IssuedAt.After(entries[j].IssuedAt) })
+		if len(entries) > maxUsageCredentials {
+			entries = entries[:maxUsageCredentials]
+		}
+	}
+	for _, id := range ids {
+		entry, err := p.ledger.Get(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ledger entry %s: %w", id, err)
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("%w: %s", errUnknownCredential, id)
+		}
+		entries = append(entries, entry)
+	}
+
+	report := &usageReport{GeneratedAt: time.Now().UTC(), Credentials: []credentialUsage{}}
+	for _, entry := range entries {
+		report.Credentials = append(report.Credentials, p.credentialUsage(ctx, entry))
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return report, nil
+}
+
+// credentialUsage looks up a credential's events by access key ID, or by
+// session name for entries without one, in the plugin's region and those of
+// the scope's settings. Each event is counted once, in the region that
+// recorded it.
+func (p *AWSPlugin) credentialUsage(ctx context.Context, entry *LedgerEntry) credentialUsage {
+	u := credentialUsage{
+		ID:          entry.ID,
+		Scope:       entry.Scope,
+		AgentID:     entry.AgentID,
+		AgentName:   entry.AgentName,
+		AccessKeyID: entry.AccessKeyID,
+		SessionName: entry.SessionName,
+		IssuedAt:    entry.IssuedAt,
+		ExpiresAt:   entry.ExpiresAt,
+	}
+	attribute := map[string]string{"AttributeKey": "AccessKeyId", "AttributeValue": entry.AccessKeyID}
+	if entry.AccessKeyID == "" {
+		if entry.SessionName == "" {
+			u.Error = "the credential has neither an access key ID nor a session name to look up"
+			return u
+		}
+		attribute = map[string]string{"AttributeKey": "Username", "AttributeValue": entry.SessionName}
+	}
+
+	end := entry.ExpiresAt
+	if entry.SessionExpiresAt.After(end) {
+		end = entry.SessionExpiresAt
+	}
+	if now := time.Now(); end.After(now) || end.IsZero() {
+		end = now
+	}
+	start := entry.IssuedAt
+	if limit := time.Now().Add(-cloudTrailRetention); start.Before(limit) {
+		start = limit
+	}
+
+	regions := []string{p.config.Region}
+	for _, region := range p.config.scopeConfig(entry.Scope).Regions {
+		if !slices.Contains(regions, region) {
+			regions = append(regions, region)
+		}
+	}
+	for _, region := range regions {
+		if u.Truncated {
+			break
+		}
+		if err := p.lookupEvents(ctx, region, attribute, start, end, &u); err != nil {
+			sdk.Warn("failed to look up CloudTrail events of credential", "id", entry.ID, "region", region, "error", err)
+			u.Error = redactError(fmt.Errorf("%s: %w", region, err)).Error()
+		}
+	}
+	if u.Events > 0 {
+		u.ErrorRate = float64(u.Errors) / float64(u.Events)
+	}
+	return u
+}
+
+// lookupEvents adds the events CloudTrail recorded in a region for a lookup
+// attribute to u
+func (p *AWSPlugin) lookupEvents(ctx context.Context, region string, attribute map[string]string, start, end time.Time, u *credentialUsage) error {
+	endpoint := p.config.serviceEndpoint("cloudtrail", region) + "/"
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-amz-json-1.1")
+	header.Set("X-Amz-Target", cloudTrailLookupTarget)
+	input := map[string]any{
+		"LookupAttributes": []map[string]string{attribute},
+		"StartTime":        start.Unix(),
+		"EndTime":          end.Unix(),
+		"MaxResults":       50,
+	}
+	for {
+		var out struct {
+			Events []struct {
+				CloudTrailEvent string `json:"CloudTrailEvent"`
+			} `json:"Events"`
+			NextToken string `json:"NextToken"`
+		}
+		err := p.callAWS(ctx, "cloudtrail", region, http.MethodPost, endpoint, header, input, &out)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cloudTrailLookupInterval):
+		}
+		if err != nil {
+			return fmt.Errorf("failed to look up events: %w", err)
+		}
+		for _, e := range out.Events {
+			var event cloudTrailEvent
+			if err := json.Unmarshal([]byte(e.CloudTrailEvent), &event); err != nil {
+				continue
+			}
+			if u.Events >= maxUsageEvents {
+				u.Truncated = true
+				return nil
+			}
+			u.add(event)
+		}
+		if out.NextToken == "" {
+			return nil
+		}
+		input["NextToken"] = out.NextToken
+	}
+}
+
+// add counts an event
+func (u *credentialUsage) add(event cloudTrailEvent) {
+	if u.Regions == nil {
+		u.Regions, u.Services, u.Actions = make(map[string]int), make(map[string]int), make(map[string]int)
+		u.ErrorCodes, u.SourceIPs = make(map[string]int), make(map[string]int)
+	}
+	u.Events++
+	service, _, _ := strings.Cut(event.EventSource, ".")
+	u.Regions[event.AWSRegion]++
+	u.Services[service]++
+	u.Actions[service+":"+event.EventName]++
+	if event.SourceIPAddress != "" {
+		u.SourceIPs[event.SourceIPAddress]++
+	}
+	if event.ErrorCode != "" {
+		u.Errors++
+		u.ErrorCodes[event.ErrorCode]++
+	}
+	at := event.EventTime
+	if u.FirstEvent == nil || at.Before(*u.FirstEvent) {
+		u.FirstEvent = &at
+	}
+	if u.LastEvent == nil || at.After(*u.LastEvent) {
+		u.LastEvent = &at
+	}
+}
+
+// serveUsage writes the usage report of the credentials given by id
+// (repeatable) or agent_id as JSON, one report at a time
+func (p *AWSPlugin) serveUsage(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.config == nil || !p.config.UsageReports.Value {
+		http.NotFound(w, r)
+		return
+	}
+	ids := r.URL.Query()["id"]
+	agentID := r.URL.Query().Get("agent_id")
+	if len(ids) == 0 && agentID == "" {
+		http.Error(w, "id or agent_id is required", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxUsageCredentials {
+		http.Error(w, fmt.Sprintf("at most %d ids per report", maxUsageCredentials), http.StatusBadRequest)
+		return
+	}
+	if !p.usageMu.TryLock() {
+		http.Error(w, "a usage report is already running", http.StatusTooManyRequests)
+		return
+	}
+	defer p.usageMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), usageTimeout)
+	defer cancel()
+	report, err := p.usageReport(ctx, ids, agentID)
+	if errors.Is(err, errUnknownCredential) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, redactError(p.describeError("usage report", err)).Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(report)
+}
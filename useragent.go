@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// userAgentProduct names the plugin in the user agent of its AWS calls
+const userAgentProduct = "creddy-aws"
+
+// userAgentOptions are the API options adding creddy to the user agent of
+// AWS calls, which CloudTrail records as userAgent: creddy-aws/<version>
+// always, and scope/<scope> req/<id> for calls made issuing a credential
+func userAgentOptions() []func(*middleware.Stack) error {
+	return []func(*middleware.Stack) error{
+		awsmiddleware.AddUserAgentKeyValue(userAgentProduct, PluginVersion),
+		addIssuanceUserAgent,
+	}
+}
+
+// addIssuanceUserAgent appends the scope and request ID of the issuance a
+// call is made for to its user agent, after the SDK has built it
+func addIssuanceUserAgent(stack *middleware.Stack) error {
+	return stack.Build.Add(middleware.BuildMiddlewareFunc("CreddyUserAgent",
+		func(ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler) (middleware.BuildOutput, middleware.Metadata, error) {
+			iss := issuanceFrom(ctx)
+			if req, ok := in.Request.(*smithyhttp.Request); ok && iss != nil && iss.Scope != "" {
+				ua := req.Header.Get("User-Agent")
+				ua += " scope/" + userAgentToken(iss.Scope) + " req/" + iss.ID
+				req.Header.Set("User-Agent", strings.TrimSpace(ua))
+			}
+			return next.HandleBuild(ctx, in)
+		}), middleware.After)
+}
+
+// userAgentToken replaces the characters user agent tokens cannot contain,
+// as the SDK does for its own
+func userAgentToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+// newIssuanceID returns a random ID for an issuance, to find its AWS calls
+// by their user agent
+func newIssuanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
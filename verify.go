@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// verifyProbes maps scope prefixes to a cheap read-only call exercising the
+// scope's service. Scopes without a probe are checked with
+// sts:GetCallerIdentity.
+var verifyProbes = []struct {
+	Prefix string
+	Probe  func(ctx context.Context, c *AWSConfig, cfg aws.Config) error
+}{
+	{
+		Prefix: "aws:s3",
+		Probe: func(ctx context.Context, c *AWSConfig, cfg aws.Config) error {
+			_, err := c.newS3Client(cfg).ListBuckets(ctx, &s3.ListBucketsInput{MaxBuckets: aws.Int32(1)})
+			return err
+		},
+	},
+	{
+		Prefix: "aws:ecr",
+		Probe: func(ctx context.Context, c *AWSConfig, cfg aws.Config) error {
+			_, err := ecr.NewFromConfig(c.serviceAWSConfig(cfg, "ecr")).DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{MaxResults: aws.Int32(1)})
+			return err
+		},
+	},
+	{
+		Prefix: "aws:lambda",
+		Probe: func(ctx context.Context, c *AWSConfig, cfg aws.Config) error {
+			_, err := lambda.NewFromConfig(c.serviceAWSConfig(cfg, "lambda")).ListFunctions(ctx, &lambda.ListFunctionsInput{MaxItems: aws.Int32(1)})
+			return err
+		},
+	},
+}
+
+// verifySession checks newly issued session credentials work for their
+// scope, so SCPs or permission boundaries that deny the scope's service
+// surface at issuance rather than on first use
+func (p *AWSPlugin) verifySession(ctx context.Context, scope string, creds *types.Credentials) error {
+	cfg, err := p.sessionAWSConfig(ctx, creds)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	probe := func(ctx context.Context, c *AWSConfig, cfg aws.Config) error {
+		_, err := c.newSTSClient(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		return err
+	}
+	for _, vp := range verifyProbes {
+		if scope == vp.Prefix || strings.HasPrefix(scope, vp.Prefix+":") {
+			probe = vp.Probe
+			break
+		}
+	}
+
+	if err := probe(ctx, p.config, cfg); err != nil {
+		return fmt.Errorf("issued credentials for %s failed verification: %w", scope, err)
+	}
+	return nil
+}
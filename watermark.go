@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// credentialIDTagKey is the session tag watermarking a session with the
+// external ID of its credential
+const credentialIDTagKey = "creddy:credential_id"
+
+// addWatermark tags a session with the external ID of its credential, as a
+// transitive tag that sessions chained from it keep. CloudTrail records it
+// in the AssumeRole event, from which the session's calls are traced.
+func addWatermark(input *sts.AssumeRoleInput, credentialID string) {
+	value := disallowedTagChars.ReplaceAllString(credentialID, "_")
+	input.Tags = append(input.Tags, ststypes.Tag{Key: aws.String(credentialIDTagKey), Value: aws.String(value)})
+	input.TransitiveTagKeys = append(input.TransitiveTagKeys, credentialIDTagKey)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook bodies: the audit record as JSON, a Slack message, or a PagerDuty
+// Events API v2 alert
+const (
+	webhookFormatJSON      = "json"
+	webhookFormatSlack     = "slack"
+	webhookFormatPagerDuty = "pagerduty"
+)
+
+const (
+	// webhookTimeout bounds one webhook request
+	webhookTimeout = 10 * time.Second
+
+	// Headers of the HMAC signature of webhook requests
+	webhookTimestampHeader = "X-Creddy-Timestamp"
+	webhookSignatureHeader = "X-Creddy-Signature"
+	webhookDeliveryHeader  = "X-Creddy-Delivery"
+)
+
+// Webhook is an HTTPS endpoint notified of issuances of matching scopes,
+// of role drift, of anomalous requests and of approvals
+type Webhook struct {
+	URL string `json:"url"`
+	// Scopes are the scope patterns to notify of, exact or ending in '*'
+	Scopes []string `json:"scopes,omitempty"`
+	// Drift notifies of changes to the role found by drift detection
+	Drift bool `json:"drift,omitempty"`
+	// Anomalies notifies of requests flagged by anomaly detection
+	Anomalies bool `json:"anomalies,omitempty"`
+	// Approvals notifies of requests awaiting approval and their outcomes
+	Approvals bool `json:"approvals,omitempty"`
+	// Format is json (default), slack or pagerduty
+	Format string `json:"format,omitempty"`
+	// Secret is the HMAC-SHA256 key signing requests
+	Secret string `json:"secret,omitempty"`
+	// RoutingKey is the PagerDuty integration key of the pagerduty format
+	RoutingKey string `json:"routing_key,omitempty"`
+}
+
+func (w Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("url must be an https URL")
+	}
+	if len(w.Scopes) == 0 && !w.Drift && !w.Anomalies && !w.Approvals {
+		return fmt.Errorf("scopes, drift, anomalies or approvals is required")
+	}
+	for _, pattern := range w.Scopes {
+		if pattern == "" {
+			return fmt.Errorf("scopes must not be empty")
+		}
+	}
+	switch w.Format {
+	case "", webhookFormatJSON, webhookFormatSlack:
+	case webhookFormatPagerDuty:
+		if w.RoutingKey == "" {
+			return fmt.Errorf("routing_key is required by the pagerduty format")
+		}
+	default:
+		return fmt.Errorf("invalid format %q (expected json, slack or pagerduty)", w.Format)
+	}
+	return nil
+}
+
+// matches reports whether the webhook is notified of a scope
+func (w Webhook) matches(scope string) bool {
+	for _, pattern := range w.Scopes {
+		if scopePatternMatches(pattern, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhooks delivers issuances to the configured webhooks
+type webhooks struct {
+	hooks []webhookShipper
+}
+
+type webhookShipper struct {
+	config  Webhook
+	shipper *auditShipper
+}
+
+// startWebhooks starts delivering to the configured webhooks, or returns nil
+// if there are none
+func startWebhooks(c *AWSConfig) *webhooks {
+	if len(c.Webhooks.Value) == 0 {
+		return nil
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	w := &webhooks{}
+	for name, hook := range c.Webhooks.Value {
+		w.hooks = append(w.hooks, webhookShipper{
+			config:  hook,
+			shipper: startAuditShipper(&webhookDestination{client: client, hookName: name, hook: hook}, notifyInterval),
+		})
+	}
+	return w
+}
+
+// notify queues an issuance for the webhooks of its scope, and drift, an
+// anomaly or an approval for the webhooks of those. Failed requests are not
+// notified, except break-glass requests, which every webhook is notified of.
+func (w *webhooks) notify(event auditEvent) {
+	if w == nil {
+		return
+	}
+	for _, h := range w.hooks {
+		switch {
+		case event.Action == auditIssue && event.Outcome != auditError && h.config.matches(event.Scope),
+			event.Action == auditDrift && h.config.Drift,
+			event.Action == auditAnomaly && h.config.Anomalies,
+			event.Action == auditApproval && h.config.Approvals,
+			event.Action == auditBreakGlass:
+			h.shipper.send(auditRecord{at: event.Time, event: event})
+		}
+	}
+}
+
+// close delivers the requests still pending and stops the webhooks
+func (w *webhooks) close() {
+	if w == nil {
+		return
+	}
+	for _, h := range w.hooks {
+		h.shipper.close()
+	}
+}
+
+// webhookDestination posts each record to a webhook
+type webhookDestination struct {
+	client   *http.Client
+	hookName string
+	hook     Webhook
+}
+
+// name names the webhook without its URL, which can be a credential
+func (d *webhookDestination) name() string {
+	return "webhook:" + d.hookName
+}
+
+func (d *webhookDestination) put(ctx context.Context, records []auditRecord) error {
+	for _, r := range records {
+		body, err := d.body(r.event)
+		if err != nil {
+			return err
+		}
+		if err := d.post(ctx, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends one webhook request, signed if the webhook has a secret
+func (d *webhookDestination) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgentProduct+"/"+PluginVersion)
+	sum := sha256.Sum256(body)
+	req.Header.Set(webhookDeliveryHeader, hex.EncodeToString(sum[:16]))
+	if d.hook.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(d.hook.Secret, timestamp, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		// The error names the URL
+		return fmt.Errorf("failed to post webhook: %w", redactError(err, d.hook.URL))
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>"
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// body renders an issuance in the webhook's format
+func (d *webhookDestination) body(event auditEvent) ([]byte, error) {
+	var v any = event
+	switch d.hook.Format {
+	case webhookFormatSlack:
+		v = map[string]string{"text": webhookSummary(event)}
+	case webhookFormatPagerDuty:
+		alert := map[string]any{
+			"routing_key":  d.hook.RoutingKey,
+			"event_action": "trigger",
+			"payload": map[string]any{
+				"summary":        webhookSummary(event),
+				"source":         userAgentProduct,
+				"severity":       webhookSeverity(event),
+				"timestamp":      event.Time.Format(time.RFC3339),
+				"component":      event.Scope,
+				"custom_details": event,
+			},
+		}
+		if event.RequestID != "" {
+			alert["dedup_key"] = event.RequestID
+		}
+		v = alert
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode webhook body: %w", err)
+	}
+	return body, nil
+}
+
+// webhookSummary describes an issuance, drift, anomaly or approval in a line
+func webhookSummary(event auditEvent) string {
+	if event.Action == auditDrift {
+		return fmt.Sprintf("creddy-aws detected changes to role %s: %s", event.RoleARN, strings.Join(event.Changes, "; "))
+	}
+	agent := event.AgentName
+	if agent == "" {
+		agent = event.AgentID
+	}
+	if event.Action == auditAnomaly {
+		return fmt.Sprintf("creddy-aws %s an anomalous request of %s by %s: %s", event.Outcome, event.Scope, agent, strings.Join(event.Anomalies, "; "))
+	}
+	if event.Action == auditBreakGlass {
+		s := fmt.Sprintf("creddy-aws break-glass request of %s by %s: %s", event.Scope, agent, event.Outcome)
+		if event.Justification != "" {
+			s += " (" + event.Justification + ")"
+		}
+		if event.ExpiresAt != "" {
+			s += ", expiring " + event.ExpiresAt
+		}
+		return s
+	}
+	if event.Action == auditApproval {
+		s := fmt.Sprintf("creddy-aws approval %s of %s for %s: %s", event.Approval, event.Scope, agent, event.Outcome)
+		if event.Approver != "" {
+			s += " by " + event.Approver
+		}
+		if event.Justification != "" {
+			s += " (" + event.Justification + ")"
+		}
+		return s
+	}
+	s := fmt.Sprintf("creddy-aws issued %s to %s", event.Scope, agent)
+	if event.RoleARN != "" {
+		s += " as " + event.RoleARN
+	}
+	if event.ExpiresAt != "" {
+		s += ", expiring " + event.ExpiresAt
+	}
+	return s
+}
+
+// webhookSeverity is the PagerDuty severity of an event
+func webhookSeverity(event auditEvent) string {
+	if event.Action == auditBreakGlass {
+		return "critical"
+	}
+	return "warning"
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	// Window timezones resolve without the system's timezone database
+	_ "time/tzdata"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// What happens to requests outside the allowed windows of their scope
+const (
+	windowDeny    = "deny"
+	windowApprove = "approve"
+)
+
+// windowSearchLimit bounds the search for the next allowed window, for
+// errors
+const windowSearchLimit = 8 * 24 * time.Hour
+
+// cronSchedule is a five-field cron expression, as the sets of minutes,
+// hours, days of the month, months and days of the week it matches
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// With both day fields restricted, either may match, as in cron
+	domAny, dowAny bool
+}
+
+// cronField describes one field of a cron expression
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = [5]cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}},
+}
+
+// parseCron parses a cron expression: minute, hour, day of month, month and
+// day of week, each *, a value, a range or a list of them, with optional
+// /step. Months and days of the week may be named; 0 and 7 are Sunday.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := cronFields[i].parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		sets[i] = set
+	}
+	s := &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parse parses one field into the set of values it matches
+func (f cronField) parse(field string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		span, stepText, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid %s step %q", f.name, stepText)
+			}
+		}
+		lo, hi := f.min, f.max
+		if span != "*" {
+			first, last, ranged := strings.Cut(span, "-")
+			var err error
+			if lo, err = f.value(first); err != nil {
+				return 0, err
+			}
+			switch {
+			case ranged:
+				if hi, err = f.value(last); err != nil {
+					return 0, err
+				}
+			case !stepped:
+				hi = lo
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid %s range %q", f.name, span)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// value parses one value of the field, a number or a name
+func (f cronField) value(s string) (int, error) {
+	if i := slices.Index(f.names, strings.ToUpper(s)); i >= 0 {
+		return i + f.min, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q (expected %d-%d)", f.name, s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// matches reports whether the schedule matches the minute of t
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// windows parses the allowed windows of a scope and their timezone
+func (sc ScopeConfig) windows() ([]*cronSchedule, *time.Location, error) {
+	loc := time.UTC
+	if sc.WindowTimezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(sc.WindowTimezone); err != nil {
+			return nil, nil, fmt.Errorf("invalid window_timezone %q: %w", sc.WindowTimezone, err)
+		}
+	}
+	schedules := make([]*cronSchedule, len(sc.AllowedWindows))
+	for i, expr := range sc.AllowedWindows {
+		s, err := parseCron(expr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid allowed_windows: %w", err)
+		}
+		schedules[i] = s
+	}
+	return schedules, loc, nil
+}
+
+// validateWindows checks the allowed windows settings of a scope
+func validateWindows(sc ScopeConfig) error {
+	switch sc.OutsideWindow {
+	case "", windowDeny, windowApprove:
+	default:
+		return fmt.Errorf("invalid outside_window %q (expected deny or approve)", sc.OutsideWindow)
+	}
+	if len(sc.AllowedWindows) == 0 {
+		if sc.WindowTimezone != "" || sc.OutsideWindow != "" {
+			return fmt.Errorf("window_timezone and outside_window require allowed_windows")
+		}
+		return nil
+	}
+	_, _, err := sc.windows()
+	return err
+}
+
+// inWindow reports whether now is in one of the allowed windows of a scope
+// and, if not, when the next one opens; zero if none does within
+// windowSearchLimit
+func (sc ScopeConfig) inWindow(now time.Time) (bool, time.Time) {
+	schedules, loc, err := sc.windows()
+	if err != nil {
+		// Checked by Configure
+		return false, time.Time{}
+	}
+	matches := func(t time.Time) bool {
+		return slices.ContainsFunc(schedules, func(s *cronSchedule) bool { return s.matches(t) })
+	}
+	t := now.In(loc).Truncate(time.Minute)
+	if matches(t) {
+		return true, time.Time{}
+	}
+	for next := t.Add(time.Minute); next.Sub(t) <= windowSearchLimit; next = next.Add(time.Minute) {
+		if matches(next) {
+			return false, next
+		}
+	}
+	return false, time.Time{}
+}
+
+// checkWindows checks a request against the allowed windows of its scopes,
+// including the parts of aws:multi bundles. Outside them, it fails the
+// request, or reports that it needs approval for scopes with outside_window
+// approve. Break-glass requests are the way around windows, so they are
+// not checked.
+func (p *AWSPlugin) checkWindows(req *sdk.CredentialRequest) (bool, error) {
+	now := time.Now()
+	approve := false
+	for _, scope := range requestedScopes(req.Scope) {
+		sc := p.config.scopeConfig(scope)
+		if len(sc.AllowedWindows) == 0 || scope == breakGlassScope {
+			continue
+		}
+		inside, next := sc.inWindow(now)
+		if inside {
+			continue
+		}
+		if sc.OutsideWindow == windowApprove {
+			approve = true
+			continue
+		}
+		hint := "no allowed window opens in the next 8 days"
+		if !next.IsZero() {
+			hint = "retry once the next allowed window opens, at " + next.Format(time.RFC3339)
+		}
+		return false, &pluginError{kind: errAccessDenied, msg: "scope " + scope + " is outside its allowed windows", hint: hint}
+	}
+	return approve, nil
+}
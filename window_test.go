@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestCronMatches(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04 Mon", s)
+		if err != nil {
+			t.Fatalf("invalid time %q: %v", s, err)
+		}
+		return v
+	}
+	tests := []struct {
+		expr string
+		t    string
+		want bool
+	}{
+		{"* * * * *", "2024-01-06 03:17 Sat", true},
+		{"*/15 9-17 * * MON-FRI", "2024-01-08 09:45 Mon", true},
+		{"*/15 9-17 * * MON-FRI", "2024-01-08 09:46 Mon", false},
+		{"*/15 9-17 * * MON-FRI", "2024-01-08 18:00 Mon", false},
+		{"*/15 9-17 * * MON-FRI", "2024-01-06 10:00 Sat", false},
+		{"5-59/20 * * * *", "2024-01-06 03:25 Sat", true},
+		{"5-59/20 * * * *", "2024-01-06 03:20 Sat", false},
+		{"0 0 1 * *", "2024-02-01 00:00 Thu", true},
+		{"0 0 1 * *", "2024-02-02 00:00 Fri", false},
+		{"* * * jan,Jul *", "2024-07-04 12:00 Thu", true},
+		{"* * * jan,Jul *", "2024-08-04 12:00 Sun", false},
+		// 0 and 7 are both Sunday
+		{"* * * * 7", "2024-01-07 12:00 Sun", true},
+		{"* * * * 0", "2024-01-07 12:00 Sun", true},
+		// With both day fields restricted, either matches
+		{"0 0 13 * FRI", "2024-09-13 00:00 Fri", true},
+		{"0 0 13 * FRI", "2024-01-13 00:00 Sat", true},
+		{"0 0 13 * FRI", "2024-01-05 00:00 Fri", true},
+		{"0 0 13 * FRI", "2024-01-06 00:00 Sat", false},
+		// A day field starting with * leaves the other to decide, as in
+		// Vixie cron
+		{"0 0 */2 * FRI", "2024-01-05 00:00 Fri", true},
+		{"0 0 */2 * FRI", "2024-01-03 00:00 Wed", false},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		if got := s.matches(at(tt.t)); got != tt.want {
+			t.Errorf("%q matches %s = %t, want %t", tt.expr, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"* * * *", "expected 5 fields"},
+		{"60 * * * *", "invalid minute \"60\" (expected 0-59)"},
+		{"* 24 * * *", "invalid hour \"24\""},
+		{"* * 0 * *", "invalid day of month \"0\""},
+		{"* * * 13 *", "invalid month \"13\""},
+		{"* * * * 8", "invalid day of week \"8\""},
+		{"* * * * MON-SUNDAY", "invalid day of week \"SUNDAY\""},
+		{"*/0 * * * *", "invalid minute step \"0\""},
+		{"* 17-9 * * *", "invalid hour range \"17-9\""},
+	}
+	for _, tt := range tests {
+		if _, err := parseCron(tt.expr); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseCron(%q) = %v, want an error containing %s", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	// Saturday noon in UTC, 07:00 in New York
+	now := time.Date(2024, 1, 6, 12, 0, 30, 0, time.UTC)
+	tests := []struct {
+		name       string
+		sc         ScopeConfig
+		wantInside bool
+		wantNext   string
+	}{
+		{"inside", ScopeConfig{AllowedWindows: []string{"* 12 * * SAT"}}, true, ""},
+		{"second window", ScopeConfig{AllowedWindows: []string{"* 9-17 * * MON-FRI", "0-30 12 * * *"}}, true, ""},
+		{"next weekday", ScopeConfig{AllowedWindows: []string{"* 9-17 * * MON-FRI"}}, false, "2024-01-08T09:00:00Z"},
+		{"in the timezone", ScopeConfig{AllowedWindows: []string{"* 9-17 * * MON-FRI"}, WindowTimezone: "America/New_York"}, false, "2024-01-08T14:00:00Z"},
+		{"later today in the timezone", ScopeConfig{AllowedWindows: []string{"30 8 * * *"}, WindowTimezone: "America/New_York"}, false, "2024-01-06T13:30:00Z"},
+		{"none within the search", ScopeConfig{AllowedWindows: []string{"0 0 30 2 *"}}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inside, next := tt.sc.inWindow(now)
+			var gotNext string
+			if !next.IsZero() {
+				gotNext = next.UTC().Format(time.RFC3339)
+			}
+			if inside != tt.wantInside || gotNext != tt.wantNext {
+				t.Errorf("inWindow = %t, %q, want %t, %q", inside, gotNext, tt.wantInside, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestWindowsEnforced(t *testing.T) {
+	f := newFakeAWS(t, false)
+	p := &AWSPlugin{}
+	cfg := f.config(`,"scopes":{"aws:s3":{"allowed_windows":["* * * * *"]},"aws:ec2":{"allowed_windows":["0 0 30 2 *"]}}`)
+	if err := p.Configure(context.Background(), cfg); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	tests := []struct {
+		scope   string
+		wantErr string
+	}{
+		{"aws:s3", ""},
+		{"aws:ec2", "scope aws:ec2 is outside its allowed windows"},
+		{"aws:multi:aws:s3,aws:ec2", "scope aws:ec2 is outside its allowed windows"},
+	}
+	for _, tt := range tests {
+		_, err := p.GetCredential(context.Background(), &sdk.CredentialRequest{Scope: tt.scope, TTL: time.Hour, Agent: sdk.Agent{ID: "agent"}})
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("GetCredential(%s): %v", tt.scope, err)
+		case tt.wantErr != "" && (errorKindOf(err) != errAccessDenied || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("GetCredential(%s) = %v, want access_denied: %s", tt.scope, err, tt.wantErr)
+		}
+	}
+}